@@ -0,0 +1,123 @@
+// Command buffer-tool moves the pending buffer between hosts without sending
+// it through Kafka.
+//
+//	buffer-tool export [-buffer-path path] [-shards n] [-o file]
+//	buffer-tool import [-buffer-path path] [-shards n] [-i file]
+//
+// export writes every pending and dead-lettered event as newline-delimited
+// JSON, to stdout by default. import loads such a file into a buffer, creating
+// it if needed and skipping events already present. Like replay, it needs the
+// service stopped, since bbolt allows only one process to hold the file.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"buffered-cdc/internal/buffer"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "export":
+		runExport(os.Args[2:])
+	case "import":
+		runImport(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: buffer-tool export|import [flags]")
+	os.Exit(2)
+}
+
+// openFlags registers the flags shared by both subcommands.
+func openFlags(fs *flag.FlagSet) (path *string, shards *int) {
+	defaultPath := os.Getenv("BUFFER_PATH")
+	if defaultPath == "" {
+		defaultPath = "./buffer.db"
+	}
+
+	defaultShards, err := strconv.Atoi(os.Getenv("BUFFER_SHARDS"))
+	if err != nil {
+		defaultShards = 1
+	}
+
+	path = fs.String("buffer-path", defaultPath, "Path to the buffer database")
+	shards = fs.Int("shards", defaultShards, "Number of buffer shards (must match the service's BUFFER_SHARDS)")
+	return path, shards
+}
+
+func openBuffer(path string, shards int, readOnly bool) *buffer.Buffer {
+	opts := buffer.DefaultOptions()
+	opts.ReadOnly = readOnly
+	opts.Shards = shards
+
+	buf, err := buffer.New(path, opts)
+	if err != nil {
+		log.Fatalf("Failed to open buffer (is the service still running?): %v", err)
+	}
+	return buf
+}
+
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	path, shards := openFlags(fs)
+	output := fs.String("o", "", "File to write to (default: stdout)")
+	fs.Parse(args)
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %v", *output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	buf := openBuffer(*path, *shards, true)
+	defer buf.Close()
+
+	count, err := buf.Export(w)
+	if err != nil {
+		log.Fatalf("Export failed after %d events: %v", count, err)
+	}
+	log.Printf("Exported %d events", count)
+}
+
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	path, shards := openFlags(fs)
+	input := fs.String("i", "", "File to read from (default: stdin)")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *input, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	buf := openBuffer(*path, *shards, false)
+	defer buf.Close()
+
+	imported, skipped, err := buf.Import(r)
+	if err != nil {
+		log.Fatalf("Import failed after %d events: %v", imported, err)
+	}
+	log.Printf("Imported %d events, skipped %d already present", imported, skipped)
+}
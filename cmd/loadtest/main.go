@@ -6,11 +6,17 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	cdcconfig "buffered-cdc/internal/config"
+
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/time/rate"
 )
 
 type LoadTestConfig struct {
@@ -22,24 +28,109 @@ type LoadTestConfig struct {
 	BatchSize      int
 	DelayedPercent int
 	MaxDelayHours  int
+	ReadyTimeField string
+	RunID          string
+
+	Verify        bool
+	KafkaBrokers  []string
+	KafkaTopic    string
+	VerifyTimeout time.Duration
+
+	Output     string
+	OutputFile string
+
+	MaxErrorRate float64
+	Rate         float64
+}
+
+// Counters aggregates insert outcomes across all workers.
+type Counters struct {
+	Inserted atomic.Int64
+	Failed   atomic.Int64
+}
+
+// ErrorRate returns the fraction of attempted messages that failed to insert.
+func (c *Counters) ErrorRate() float64 {
+	inserted, failed := c.Inserted.Load(), c.Failed.Load()
+	if inserted+failed == 0 {
+		return 0
+	}
+	return float64(failed) / float64(inserted+failed)
+}
+
+// inserter is the part of *mongo.Collection the workers use, so tests can
+// stand in for MongoDB.
+type inserter interface {
+	InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+}
+
+// exitCode returns the status the load test exits with for its insert
+// outcomes: 1 once messages failed at a rate above maxErrorRate, so any
+// failure with the default of 0, and 0 otherwise.
+func (c *Counters) exitCode(maxErrorRate float64) int {
+	if c.Failed.Load() > 0 && c.ErrorRate() > maxErrorRate {
+		return 1
+	}
+	return 0
 }
 
 type TestMessage struct {
 	ID           string     `bson:"_id,omitempty"`
 	Message      string     `bson:"message"`
 	Timestamp    time.Time  `bson:"timestamp"`
-	DelayedUntil *time.Time `bson:"delayedUntil,omitempty"`
 	LoadTestBatch int       `bson:"loadTestBatch"`
 	MessageType  string     `bson:"messageType"`
 	Payload      map[string]interface{} `bson:"payload"`
+	// Fields holds the ready time of a delayed message, under the field
+	// named by -ready-time-field, which the service must read too.
+	Fields map[string]interface{} `bson:",inline"`
+
+	readyTimeField string
+}
+
+// ReadyTime returns the ready time written to the message's ready time
+// field, and whether there is one: the same field the service delays on.
+func (m *TestMessage) ReadyTime() (time.Time, bool) {
+	var current interface{} = m.Fields
+	for _, key := range strings.Split(m.readyTimeField, ".") {
+		doc, ok := current.(map[string]interface{})
+		if !ok {
+			return time.Time{}, false
+		}
+		current = doc[key]
+	}
+	readyTime, ok := current.(time.Time)
+	return readyTime, ok
+}
+
+// setReadyTime writes readyTime to the ready time field, creating the
+// documents a dotted path such as meta.deliverAt runs through.
+func (m *TestMessage) setReadyTime(readyTime time.Time) {
+	if m.Fields == nil {
+		m.Fields = make(map[string]interface{})
+	}
+	doc := m.Fields
+	keys := strings.Split(m.readyTimeField, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[keys[len(keys)-1]] = readyTime
 }
 
 func main() {
 	config := parseFlags()
 	
 	log.Printf("Starting load test with %d workers, %d total messages", config.Workers, config.TotalMessages)
-	log.Printf("MongoDB: %s/%s.%s", config.MongoURI, config.Database, config.Collection)
+	log.Printf("MongoDB: %s/%s.%s", cdcconfig.RedactURI(config.MongoURI), config.Database, config.Collection)
 	log.Printf("Delayed messages: %d%%, max delay: %d hours", config.DelayedPercent, config.MaxDelayHours)
+	if config.Rate > 0 {
+		log.Printf("Target rate: %.2f messages/second", config.Rate)
+	}
 	
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(config.MongoURI))
 	if err != nil {
@@ -48,16 +139,56 @@ func main() {
 	defer client.Disconnect(context.Background())
 	
 	collection := client.Database(config.Database).Collection(config.Collection)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var verifier *Verifier
+	if config.Verify {
+		verifier, err = NewVerifier(ctx, config.KafkaBrokers, config.KafkaTopic, config.RunID)
+		if err != nil {
+			log.Fatalf("Failed to start verifier: %v", err)
+		}
+		verifier.Start(ctx)
+	}
 	
 	startTime := time.Now()
 	
-	runLoadTest(collection, config)
+	counters := &Counters{}
+	workerStats := runLoadTest(ctx, collection, config, verifier, newRateLimiter(config.Rate), counters)
 	
 	duration := time.Since(startTime)
-	throughput := float64(config.TotalMessages) / duration.Seconds()
+	inserted, failed := counters.Inserted.Load(), counters.Failed.Load()
+	throughput := float64(inserted) / duration.Seconds()
 	
 	log.Printf("Load test completed in %v", duration)
+	log.Printf("Inserted: %d, failed: %d (error rate %.2f%%)", inserted, failed, counters.ErrorRate()*100)
 	log.Printf("Throughput: %.2f messages/second", throughput)
+
+	if config.Output != "text" {
+		results := buildResults(config, startTime, duration, workerStats)
+		if err := writeResults(results, config.Output, config.OutputFile); err != nil {
+			log.Fatalf("Failed to write results: %v", err)
+		}
+	}
+
+	if verifier != nil {
+		log.Printf("Waiting up to %v for events to arrive on Kafka topic %s", config.VerifyTimeout, config.KafkaTopic)
+		verifier.Wait(ctx, config.VerifyTimeout)
+		result := verifier.Result()
+		cancel()
+		verifier.Close()
+
+		logVerifyResult(result)
+		if len(result.Missing) > 0 {
+			os.Exit(1)
+		}
+	}
+
+	if code := counters.exitCode(config.MaxErrorRate); code != 0 {
+		log.Printf("Load test failed: error rate %.2f%% exceeds maximum %.2f%%", counters.ErrorRate()*100, config.MaxErrorRate*100)
+		os.Exit(code)
+	}
 }
 
 func parseFlags() *LoadTestConfig {
@@ -71,8 +202,26 @@ func parseFlags() *LoadTestConfig {
 	flag.IntVar(&config.BatchSize, "batch-size", 10, "Batch size for insertions")
 	flag.IntVar(&config.DelayedPercent, "delayed-percent", 30, "Percentage of messages with delayed delivery")
 	flag.IntVar(&config.MaxDelayHours, "max-delay-hours", 24, "Maximum delay in hours for delayed messages")
+	flag.StringVar(&config.ReadyTimeField, "ready-time-field", cdcconfig.DefaultReadyTimeField, "Field the ready time of delayed messages is written to; must match the service's MONGODB_READY_TIME_FIELD")
+	flag.BoolVar(&config.Verify, "verify", false, "Consume the Kafka topic and verify inserted messages arrive end-to-end")
+	kafkaBrokers := flag.String("kafka-brokers", "kafka:29092", "Comma-separated Kafka brokers used by -verify")
+	flag.StringVar(&config.KafkaTopic, "kafka-topic", "cdc-events", "Kafka topic used by -verify")
+	flag.DurationVar(&config.VerifyTimeout, "verify-timeout", 2*time.Minute, "How long -verify waits for outstanding messages")
+	flag.StringVar(&config.Output, "output", "text", "Results format: text, json or csv")
+	flag.StringVar(&config.OutputFile, "output-file", "", "Write structured results to this file instead of stdout")
+	flag.Float64Var(&config.Rate, "rate", 0, "Maximum insert rate in messages/second across all workers (0 = unlimited)")
+	flag.Float64Var(&config.MaxErrorRate, "max-error-rate", 0, "Maximum tolerated fraction of failed messages (0-1) before exiting non-zero")
 	
 	flag.Parse()
+
+	switch config.Output {
+	case "text", "json", "csv":
+	default:
+		log.Fatalf("Invalid -output %q: must be text, json or csv", config.Output)
+	}
+
+	config.KafkaBrokers = strings.Split(*kafkaBrokers, ",")
+	config.RunID = fmt.Sprintf("lt-%d", time.Now().UnixNano())
 	
 	if config.TotalMessages < config.Workers {
 		config.Workers = config.TotalMessages
@@ -81,8 +230,19 @@ func parseFlags() *LoadTestConfig {
 	return config
 }
 
-func runLoadTest(collection *mongo.Collection, config *LoadTestConfig) {
+// newRateLimiter returns a limiter shared by all workers that admits perSecond
+// messages a second, or nil when perSecond is 0. A burst of one spaces the
+// messages evenly rather than letting a second's worth through at once.
+func newRateLimiter(perSecond float64) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), 1)
+}
+
+func runLoadTest(ctx context.Context, collection inserter, config *LoadTestConfig, verifier *Verifier, limiter *rate.Limiter, counters *Counters) []*WorkerStats {
 	var wg sync.WaitGroup
+	stats := make([]*WorkerStats, config.Workers)
 	messagesChan := make(chan int, config.TotalMessages)
 	
 	// Fill the channel with message indices
@@ -93,25 +253,51 @@ func runLoadTest(collection *mongo.Collection, config *LoadTestConfig) {
 	
 	// Start workers
 	for i := 0; i < config.Workers; i++ {
+		stats[i] = &WorkerStats{WorkerID: i}
 		wg.Add(1)
-		go worker(i, collection, config, messagesChan, &wg)
+		go worker(ctx, i, collection, config, messagesChan, verifier, limiter, counters, stats[i], &wg)
 	}
 	
 	wg.Wait()
+	return stats
 }
 
-func worker(workerID int, collection *mongo.Collection, config *LoadTestConfig, messagesChan <-chan int, wg *sync.WaitGroup) {
+func worker(ctx context.Context, workerID int, collection inserter, config *LoadTestConfig, messagesChan <-chan int, verifier *Verifier, limiter *rate.Limiter, counters *Counters, stats *WorkerStats, wg *sync.WaitGroup) {
 	defer wg.Done()
+
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
 	
 	batch := make([]interface{}, 0, config.BatchSize)
 	batchNum := 0
+
+	flush := func() {
+		stats.Batches++
+		if !insertBatch(collection, batch, workerID, batchNum) {
+			stats.FailedBatches++
+			stats.Failed += len(batch)
+			counters.Failed.Add(int64(len(batch)))
+			return
+		}
+		stats.recordInserted(batch)
+		counters.Inserted.Add(int64(len(batch)))
+		expectBatch(verifier, batch)
+	}
 	
 	for msgIndex := range messagesChan {
+		// The limiter is shared by all workers, so this paces the aggregate rate
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				log.Printf("Worker %d: rate limiter wait failed: %v", workerID, err)
+				break
+			}
+		}
+
 		message := generateTestMessage(msgIndex, config)
 		batch = append(batch, message)
 		
 		if len(batch) >= config.BatchSize {
-			insertBatch(collection, batch, workerID, batchNum)
+			flush()
 			batch = batch[:0]
 			batchNum++
 		}
@@ -119,16 +305,18 @@ func worker(workerID int, collection *mongo.Collection, config *LoadTestConfig,
 	
 	// Insert remaining messages
 	if len(batch) > 0 {
-		insertBatch(collection, batch, workerID, batchNum)
+		flush()
 	}
 }
 
 func generateTestMessage(index int, config *LoadTestConfig) *TestMessage {
 	now := time.Now()
 	message := &TestMessage{
+		ID:            fmt.Sprintf("%s-%d", config.RunID, index),
 		Message:       fmt.Sprintf("Load test message #%d", index),
 		Timestamp:     now,
 		LoadTestBatch: index / config.BatchSize,
+		readyTimeField: config.ReadyTimeField,
 		Payload: map[string]interface{}{
 			"index":     index,
 			"worker":    index % config.Workers,
@@ -145,7 +333,7 @@ func generateTestMessage(index int, config *LoadTestConfig) *TestMessage {
 		delayMinutes := minDelayMinutes + rand.Intn(maxDelayMinutes-minDelayMinutes)
 		
 		delayTime := now.Add(time.Duration(delayMinutes) * time.Minute)
-		message.DelayedUntil = &delayTime
+		message.setReadyTime(delayTime)
 		message.MessageType = "delayed"
 	} else {
 		message.MessageType = "immediate"
@@ -154,16 +342,31 @@ func generateTestMessage(index int, config *LoadTestConfig) *TestMessage {
 	return message
 }
 
-func insertBatch(collection *mongo.Collection, batch []interface{}, workerID, batchNum int) {
+func insertBatch(collection inserter, batch []interface{}, workerID, batchNum int) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	
 	result, err := collection.InsertMany(ctx, batch)
 	if err != nil {
 		log.Printf("Worker %d: Failed to insert batch %d: %v", workerID, batchNum, err)
-		return
+		return false
 	}
 	
 	log.Printf("Worker %d: Inserted batch %d with %d messages (IDs: %d)", 
 		workerID, batchNum, len(result.InsertedIDs), len(result.InsertedIDs))
+	return true
+}
+
+// expectBatch registers the immediate messages of an inserted batch with the
+// verifier. Delayed messages are not expected on the topic within the run.
+func expectBatch(verifier *Verifier, batch []interface{}) {
+	if verifier == nil {
+		return
+	}
+	for _, item := range batch {
+		message := item.(*TestMessage)
+		if _, delayed := message.ReadyTime(); !delayed {
+			verifier.Expect(message.ID, message.Timestamp)
+		}
+	}
 }
\ No newline at end of file
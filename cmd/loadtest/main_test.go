@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mockCollection fails every failEvery-th InsertMany call, or none when
+// failEvery is 0.
+type mockCollection struct {
+	failEvery int
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (m *mockCollection) InsertMany(ctx context.Context, documents []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	m.mu.Lock()
+	m.calls++
+	fail := m.failEvery > 0 && m.calls%m.failEvery == 0
+	m.mu.Unlock()
+	if fail {
+		return nil, errors.New("insert failed")
+	}
+	return &mongo.InsertManyResult{InsertedIDs: make([]interface{}, len(documents))}, nil
+}
+
+func testConfig(messages, workers, batchSize int) *LoadTestConfig {
+	return &LoadTestConfig{
+		Workers:       workers,
+		TotalMessages: messages,
+		BatchSize:     batchSize,
+		MaxDelayHours: 1,
+		RunID:         "test",
+	}
+}
+
+func TestRunLoadTestCountsFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		failEvery int
+		// Batches of 10 messages, so failures come in tens
+		wantFailed int64
+	}{
+		{"all succeed", 0, 0},
+		{"every other batch fails", 2, 50},
+		{"every batch fails", 1, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters := &Counters{}
+			config := testConfig(100, 4, 10)
+			stats := runLoadTest(context.Background(), &mockCollection{failEvery: tt.failEvery}, config, nil, nil, counters)
+
+			if got := counters.Failed.Load(); got != tt.wantFailed {
+				t.Errorf("Failed = %d, want %d", got, tt.wantFailed)
+			}
+			if got := counters.Inserted.Load(); got != 100-tt.wantFailed {
+				t.Errorf("Inserted = %d, want %d", got, 100-tt.wantFailed)
+			}
+
+			var failed, failedBatches int
+			for _, ws := range stats {
+				failed += ws.Failed
+				failedBatches += ws.FailedBatches
+			}
+			if int64(failed) != tt.wantFailed || int64(failedBatches*10) != tt.wantFailed {
+				t.Errorf("worker stats report %d failed messages in %d batches, want %d", failed, failedBatches, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name             string
+		inserted, failed int64
+		maxErrorRate     float64
+		want             int
+	}{
+		{"no failures", 100, 0, 0, 0},
+		{"any failure with the default", 99, 1, 0, 1},
+		{"below the maximum", 95, 5, 0.1, 0},
+		{"at the maximum", 90, 10, 0.1, 0},
+		{"above the maximum", 80, 20, 0.1, 1},
+		{"nothing attempted", 0, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters := &Counters{}
+			counters.Inserted.Store(tt.inserted)
+			counters.Failed.Store(tt.failed)
+			if got := counters.exitCode(tt.maxErrorRate); got != tt.want {
+				t.Errorf("exitCode(%v) = %d, want %d (error rate %.2f)", tt.maxErrorRate, got, tt.want, counters.ErrorRate())
+			}
+		})
+	}
+}
+
+func TestFailingRunExitsNonZero(t *testing.T) {
+	counters := &Counters{}
+	runLoadTest(context.Background(), &mockCollection{failEvery: 3}, testConfig(90, 3, 10), nil, nil, counters)
+
+	if code := counters.exitCode(0.5); code != 0 {
+		t.Errorf("exit code %d with error rate %.2f under -max-error-rate=0.5, want 0", code, counters.ErrorRate())
+	}
+	if code := counters.exitCode(0.2); code == 0 {
+		t.Errorf("exit code 0 with error rate %.2f over -max-error-rate=0.2", counters.ErrorRate())
+	}
+}
+
+func TestRateLimiterPacesAllWorkers(t *testing.T) {
+	if newRateLimiter(0) != nil {
+		t.Error("newRateLimiter(0) limits the rate, want unlimited")
+	}
+
+	const perSecond, messages = 200.0, 101
+	counters := &Counters{}
+	start := time.Now()
+	runLoadTest(context.Background(), &mockCollection{}, testConfig(messages, 4, 1), nil, newRateLimiter(perSecond), counters)
+	elapsed := time.Since(start)
+
+	// The first message is let through at once and the rest are spaced by
+	// 1/perSecond, whatever the number of workers
+	want := time.Duration(float64(messages-1) / perSecond * float64(time.Second))
+	if elapsed < want*9/10 || elapsed > want*3/2 {
+		t.Errorf("%d messages at %.0f/s took %v, want about %v", messages, perSecond, elapsed, want)
+	}
+	if got := counters.Inserted.Load(); got != messages {
+		t.Errorf("Inserted = %d, want %d", got, messages)
+	}
+}
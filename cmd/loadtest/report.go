@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// WorkerStats is owned by a single worker goroutine while the test runs and
+// only read once all workers have finished.
+type WorkerStats struct {
+	WorkerID      int           `json:"workerId"`
+	Inserted      int           `json:"inserted"`
+	Failed        int           `json:"failed"`
+	Delayed       int           `json:"delayed"`
+	Immediate     int           `json:"immediate"`
+	Batches       int           `json:"batches"`
+	FailedBatches int           `json:"failedBatches"`
+	Duration      time.Duration `json:"-"`
+	Seconds       float64       `json:"durationSeconds"`
+}
+
+func (ws *WorkerStats) recordInserted(batch []interface{}) {
+	for _, item := range batch {
+		message := item.(*TestMessage)
+		if _, delayed := message.ReadyTime(); delayed {
+			ws.Delayed++
+		} else {
+			ws.Immediate++
+		}
+		ws.Inserted++
+	}
+}
+
+// Results is the machine-readable record emitted by -output json|csv.
+type Results struct {
+	RunID           string         `json:"runId"`
+	StartedAt       time.Time      `json:"startedAt"`
+	TotalMessages   int            `json:"totalMessages"`
+	Inserted        int            `json:"inserted"`
+	Errors          int            `json:"errors"`
+	DurationSeconds float64        `json:"durationSeconds"`
+	Throughput      float64        `json:"throughput"`
+	Delayed         int            `json:"delayed"`
+	Immediate       int            `json:"immediate"`
+	Workers         []*WorkerStats `json:"workers"`
+}
+
+func buildResults(config *LoadTestConfig, startedAt time.Time, duration time.Duration, workers []*WorkerStats) *Results {
+	results := &Results{
+		RunID:           config.RunID,
+		StartedAt:       startedAt,
+		TotalMessages:   config.TotalMessages,
+		DurationSeconds: duration.Seconds(),
+		Workers:         workers,
+	}
+
+	for _, ws := range workers {
+		ws.Seconds = ws.Duration.Seconds()
+		results.Inserted += ws.Inserted
+		results.Errors += ws.Failed
+		results.Delayed += ws.Delayed
+		results.Immediate += ws.Immediate
+	}
+	results.Throughput = float64(results.Inserted) / duration.Seconds()
+
+	return results
+}
+
+func writeResults(results *Results, format, path string) error {
+	var w io.Writer = os.Stdout
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	case "csv":
+		return writeResultsCSV(w, results)
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+// writeResultsCSV emits one "total" row followed by one row per worker so the
+// file can be appended to a time series without a nested schema.
+func writeResultsCSV(w io.Writer, results *Results) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{
+		"run_id", "scope", "worker_id", "messages", "inserted", "errors",
+		"delayed", "immediate", "batches", "failed_batches", "duration_seconds", "throughput",
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	batches, failedBatches := 0, 0
+	for _, ws := range results.Workers {
+		batches += ws.Batches
+		failedBatches += ws.FailedBatches
+	}
+
+	rows := [][]string{{
+		results.RunID, "total", "",
+		strconv.Itoa(results.TotalMessages),
+		strconv.Itoa(results.Inserted),
+		strconv.Itoa(results.Errors),
+		strconv.Itoa(results.Delayed),
+		strconv.Itoa(results.Immediate),
+		strconv.Itoa(batches),
+		strconv.Itoa(failedBatches),
+		formatFloat(results.DurationSeconds),
+		formatFloat(results.Throughput),
+	}}
+
+	for _, ws := range results.Workers {
+		throughput := 0.0
+		if ws.Seconds > 0 {
+			throughput = float64(ws.Inserted) / ws.Seconds
+		}
+		rows = append(rows, []string{
+			results.RunID, "worker",
+			strconv.Itoa(ws.WorkerID),
+			strconv.Itoa(ws.Inserted + ws.Failed),
+			strconv.Itoa(ws.Inserted),
+			strconv.Itoa(ws.Failed),
+			strconv.Itoa(ws.Delayed),
+			strconv.Itoa(ws.Immediate),
+			strconv.Itoa(ws.Batches),
+			strconv.Itoa(ws.FailedBatches),
+			formatFloat(ws.Seconds),
+			formatFloat(throughput),
+		})
+	}
+
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testResults builds the results of a fixed two-worker run.
+func testResults() *Results {
+	workers := []*WorkerStats{
+		{WorkerID: 0, Inserted: 40, Delayed: 10, Immediate: 30, Batches: 4, Duration: 2 * time.Second},
+		{WorkerID: 1, Inserted: 30, Failed: 10, Delayed: 5, Immediate: 25, Batches: 4, FailedBatches: 1, Duration: 1500 * time.Millisecond},
+	}
+	config := &LoadTestConfig{RunID: "lt-1714564800000000000", TotalMessages: 80}
+	startedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return buildResults(config, startedAt, 2500*time.Millisecond, workers)
+}
+
+func TestWriteResultsGolden(t *testing.T) {
+	for _, format := range []string{"json", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "results."+format)
+			if err := writeResults(testResults(), format, path); err != nil {
+				t.Fatalf("writeResults: %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+
+			golden := filepath.Join("testdata", "results."+format+".golden")
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatalf("WriteFile: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s output differs from %s:\n%s\nwant:\n%s", format, golden, got, want)
+			}
+		})
+	}
+}
+
+func TestWriteResultsRejectsUnknownFormat(t *testing.T) {
+	if err := writeResults(testResults(), "xml", filepath.Join(t.TempDir(), "results.xml")); err == nil {
+		t.Error("writeResults accepted format xml")
+	}
+}
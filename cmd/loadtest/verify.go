@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Verifier consumes the CDC topic while the load test runs and correlates the
+// emitted events with the inserted TestMessage IDs.
+type Verifier struct {
+	prefix  string
+	readers []*kafka.Reader
+
+	mu       sync.Mutex
+	expected map[string]time.Time
+	seen     map[string]time.Time
+
+	wg sync.WaitGroup
+}
+
+type VerifyResult struct {
+	Expected int
+	Observed int
+	Missing  []string
+	P50      time.Duration
+	P95      time.Duration
+	P99      time.Duration
+}
+
+// cdcEvent mirrors the parts of the buffered event JSON needed for correlation.
+type cdcEvent struct {
+	Data struct {
+		DocumentKey map[string]interface{} `json:"documentKey"`
+	} `json:"data"`
+}
+
+// NewVerifier positions one reader per partition at the current end of the
+// topic so that only events produced by this run are observed.
+func NewVerifier(ctx context.Context, brokers []string, topic, prefix string) (*Verifier, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("no Kafka brokers configured")
+	}
+
+	conn, err := kafka.DialContext(ctx, "tcp", brokers[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka: %w", err)
+	}
+	defer conn.Close()
+
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partitions for topic %s: %w", topic, err)
+	}
+
+	v := &Verifier{
+		prefix:   prefix,
+		expected: make(map[string]time.Time),
+		seen:     make(map[string]time.Time),
+	}
+
+	for _, p := range partitions {
+		leader, err := kafka.DialLeader(ctx, "tcp", brokers[0], topic, p.ID)
+		if err != nil {
+			v.Close()
+			return nil, fmt.Errorf("failed to dial leader for partition %d: %w", p.ID, err)
+		}
+		offset, err := leader.ReadLastOffset()
+		leader.Close()
+		if err != nil {
+			v.Close()
+			return nil, fmt.Errorf("failed to read last offset for partition %d: %w", p.ID, err)
+		}
+
+		reader := kafka.NewReader(kafka.ReaderConfig{
+			Brokers:   brokers,
+			Topic:     topic,
+			Partition: p.ID,
+			MinBytes:  1,
+			MaxBytes:  10e6,
+			MaxWait:   500 * time.Millisecond,
+		})
+		if err := reader.SetOffset(offset); err != nil {
+			reader.Close()
+			v.Close()
+			return nil, fmt.Errorf("failed to set offset for partition %d: %w", p.ID, err)
+		}
+		v.readers = append(v.readers, reader)
+	}
+
+	log.Printf("Verifier watching %d partitions of topic %s", len(v.readers), topic)
+	return v, nil
+}
+
+func (v *Verifier) Start(ctx context.Context) {
+	for _, reader := range v.readers {
+		v.wg.Add(1)
+		go v.consume(ctx, reader)
+	}
+}
+
+func (v *Verifier) consume(ctx context.Context, reader *kafka.Reader) {
+	defer v.wg.Done()
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Verifier: failed to read from partition %d: %v", reader.Config().Partition, err)
+			}
+			return
+		}
+		receivedAt := time.Now()
+
+		var event cdcEvent
+		if err := json.Unmarshal(msg.Value, &event); err != nil {
+			continue
+		}
+
+		id := fmt.Sprintf("%v", event.Data.DocumentKey["_id"])
+		if !strings.HasPrefix(id, v.prefix) {
+			continue
+		}
+
+		v.mu.Lock()
+		if _, exists := v.seen[id]; !exists {
+			v.seen[id] = receivedAt
+		}
+		v.mu.Unlock()
+	}
+}
+
+// Expect registers an inserted message that should appear on the topic.
+func (v *Verifier) Expect(id string, sentAt time.Time) {
+	v.mu.Lock()
+	v.expected[id] = sentAt
+	v.mu.Unlock()
+}
+
+// Wait blocks until every expected message has been observed or the timeout elapses.
+func (v *Verifier) Wait(ctx context.Context, timeout time.Duration) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if v.outstanding() == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (v *Verifier) outstanding() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	count := 0
+	for id := range v.expected {
+		if _, ok := v.seen[id]; !ok {
+			count++
+		}
+	}
+	return count
+}
+
+func (v *Verifier) Result() *VerifyResult {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	result := &VerifyResult{Expected: len(v.expected)}
+	latencies := make([]time.Duration, 0, len(v.expected))
+
+	for id, sentAt := range v.expected {
+		receivedAt, ok := v.seen[id]
+		if !ok {
+			result.Missing = append(result.Missing, id)
+			continue
+		}
+		latencies = append(latencies, receivedAt.Sub(sentAt))
+	}
+	sort.Strings(result.Missing)
+
+	result.Observed = len(latencies)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.P50 = percentile(latencies, 0.50)
+	result.P95 = percentile(latencies, 0.95)
+	result.P99 = percentile(latencies, 0.99)
+
+	return result
+}
+
+func (v *Verifier) Close() {
+	for _, reader := range v.readers {
+		reader.Close()
+	}
+	v.wg.Wait()
+}
+
+// percentile expects sorted input and uses the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func logVerifyResult(result *VerifyResult) {
+	log.Printf("Verification: observed %d/%d immediate messages on Kafka", result.Observed, result.Expected)
+	log.Printf("End-to-end latency: p50=%v p95=%v p99=%v", result.P50, result.P95, result.P99)
+
+	if len(result.Missing) > 0 {
+		log.Printf("Missing %d messages:", len(result.Missing))
+		for _, id := range result.Missing {
+			log.Printf("  %s", id)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestVerifier() *Verifier {
+	return &Verifier{
+		prefix:   "test",
+		expected: make(map[string]time.Time),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+// storedReadyTime reports whether the document message is stored as holds a
+// date at path, the way the service looks up MONGODB_READY_TIME_FIELD.
+func storedReadyTime(t *testing.T, message *TestMessage, path string) bool {
+	t.Helper()
+	raw, err := bson.Marshal(message)
+	if err != nil {
+		t.Fatalf("bson.Marshal: %v", err)
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		t.Fatalf("bson.Unmarshal: %v", err)
+	}
+	var current interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(bson.M)
+		if !ok {
+			return false
+		}
+		current = m[key]
+	}
+	_, ok := current.(primitive.DateTime)
+	return ok
+}
+
+func TestExpectBatchSkipsDelayedMessages(t *testing.T) {
+	for _, field := range []string{"delayedUntil", "meta.deliverAt"} {
+		t.Run(field, func(t *testing.T) {
+			config := testConfig(200, 1, 200)
+			config.DelayedPercent = 50
+			config.ReadyTimeField = field
+
+			var batch []interface{}
+			var immediate []string
+			for i := 0; i < config.TotalMessages; i++ {
+				message := generateTestMessage(i, config)
+				batch = append(batch, message)
+				if !storedReadyTime(t, message, field) {
+					immediate = append(immediate, message.ID)
+				}
+			}
+			if len(immediate) == 0 || len(immediate) == len(batch) {
+				t.Fatalf("%d of %d messages immediate, want a mix", len(immediate), len(batch))
+			}
+
+			v := newTestVerifier()
+			expectBatch(v, batch)
+
+			var expected []string
+			for id := range v.expected {
+				expected = append(expected, id)
+			}
+			sort.Strings(expected)
+			sort.Strings(immediate)
+			if !reflect.DeepEqual(expected, immediate) {
+				t.Errorf("verifier expects %d messages, want the %d stored without %s", len(expected), len(immediate), field)
+			}
+		})
+	}
+}
+
+func TestVerifierResult(t *testing.T) {
+	v := newTestVerifier()
+	sentAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"test-1", "test-2", "test-3", "test-4"} {
+		v.Expect(id, sentAt)
+		if id != "test-3" {
+			v.seen[id] = sentAt.Add(time.Duration(i+1) * time.Second)
+		}
+	}
+	// Seen but never expected, such as a delayed message
+	v.seen["test-5"] = sentAt
+
+	result := v.Result()
+	if result.Expected != 4 || result.Observed != 3 {
+		t.Errorf("Result observed %d/%d, want 3/4", result.Observed, result.Expected)
+	}
+	if !reflect.DeepEqual(result.Missing, []string{"test-3"}) {
+		t.Errorf("Missing = %v, want [test-3]", result.Missing)
+	}
+	if result.P50 != 2*time.Second || result.P99 != 4*time.Second {
+		t.Errorf("latency p50=%v p99=%v, want 2s and 4s", result.P50, result.P99)
+	}
+	if v.outstanding() != 1 {
+		t.Errorf("outstanding = %d, want 1", v.outstanding())
+	}
+}
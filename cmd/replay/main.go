@@ -0,0 +1,160 @@
+// Command replay inspects the buffer file and re-enqueues dead-lettered events.
+//
+// bbolt allows a single process to hold the file open for writing, so the
+// buffered-cdc service must be stopped before running replay against its
+// buffer; otherwise opening the file times out.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+)
+
+type ReplayConfig struct {
+	BufferPath string
+	Shards     int
+	Action     string
+	DeadLetter bool
+	Operations map[string]bool
+	Since      time.Time
+	Until      time.Time
+}
+
+func main() {
+	config := parseFlags()
+
+	// Listing only needs a shared lock; requeueing has to write
+	opts := buffer.DefaultOptions()
+	opts.ReadOnly = config.Action == "list"
+	opts.Shards = config.Shards
+
+	buf, err := buffer.New(config.BufferPath, opts)
+	if err != nil {
+		log.Fatalf("Failed to open buffer (is the service still running?): %v", err)
+	}
+	defer buf.Close()
+
+	switch config.Action {
+	case "list":
+		err = listEvents(os.Stdout, buf, config)
+	case "requeue":
+		err = requeueEvents(buf, config)
+	}
+	if err != nil {
+		log.Fatalf("Replay %s failed: %v", config.Action, err)
+	}
+}
+
+func parseFlags() *ReplayConfig {
+	config := &ReplayConfig{}
+
+	defaultPath := os.Getenv("BUFFER_PATH")
+	if defaultPath == "" {
+		defaultPath = "./buffer.db"
+	}
+
+	defaultShards, err := strconv.Atoi(os.Getenv("BUFFER_SHARDS"))
+	if err != nil {
+		defaultShards = 1
+	}
+
+	flag.StringVar(&config.BufferPath, "buffer-path", defaultPath, "Path to the buffer database")
+	flag.IntVar(&config.Shards, "shards", defaultShards, "Number of buffer shards (must match the service's BUFFER_SHARDS)")
+	flag.StringVar(&config.Action, "action", "list", "Action to perform: list or requeue")
+	flag.BoolVar(&config.DeadLetter, "dead-letter", false, "List the dead-letter bucket instead of the main bucket")
+	operations := flag.String("operations", "", "Comma-separated operation types to include (default: all)")
+	since := flag.String("since", "", "Only include events buffered at or after this RFC3339 time")
+	until := flag.String("until", "", "Only include events buffered before this RFC3339 time")
+
+	flag.Parse()
+
+	switch config.Action {
+	case "list", "requeue":
+	default:
+		log.Fatalf("Invalid -action %q: must be list or requeue", config.Action)
+	}
+
+	if *operations != "" {
+		config.Operations = make(map[string]bool)
+		for _, op := range strings.Split(*operations, ",") {
+			config.Operations[strings.TrimSpace(op)] = true
+		}
+	}
+
+	if *since != "" {
+		if config.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			log.Fatalf("Invalid -since: %v", err)
+		}
+	}
+	if *until != "" {
+		if config.Until, err = time.Parse(time.RFC3339, *until); err != nil {
+			log.Fatalf("Invalid -until: %v", err)
+		}
+	}
+
+	return config
+}
+
+func (c *ReplayConfig) matches(event *buffer.Event) bool {
+	if c.Operations != nil && !c.Operations[event.Operation] {
+		return false
+	}
+	if !c.Since.IsZero() && event.Timestamp.Before(c.Since) {
+		return false
+	}
+	if !c.Until.IsZero() && !event.Timestamp.Before(c.Until) {
+		return false
+	}
+	return true
+}
+
+// listEvents writes the matching events to w as newline-delimited JSON.
+func listEvents(w io.Writer, buf *buffer.Buffer, config *ReplayConfig) error {
+	encoder := json.NewEncoder(w)
+	count := 0
+
+	err := buf.ForEach(config.DeadLetter, func(event *buffer.Event) error {
+		if !config.matches(event) {
+			return nil
+		}
+		count++
+		return encoder.Encode(event)
+	})
+
+	log.Printf("Listed %d events", count)
+	return err
+}
+
+func requeueEvents(buf *buffer.Buffer, config *ReplayConfig) error {
+	// Collect first: writes are not allowed inside the ForEach read transaction
+	var events []*buffer.Event
+	err := buf.ForEach(true, func(event *buffer.Event) error {
+		if config.matches(event) {
+			events = append(events, event)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	requeued := 0
+	for _, event := range events {
+		if err := buf.RequeueDeadLetter(event); err != nil {
+			log.Printf("Failed to requeue event %s: %v", event.ID, err)
+			continue
+		}
+		requeued++
+	}
+
+	log.Printf("Requeued %d of %d dead-letter events", requeued, len(events))
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+)
+
+var base = time.Date(2025, 1, 14, 12, 0, 0, 0, time.UTC)
+
+// newReplayBuffer writes a buffer file holding queued and dead-lettered
+// events and returns its path.
+func newReplayBuffer(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	buf, err := buffer.New(path, nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	defer buf.Close()
+
+	events := []struct {
+		id, operation string
+		hours         int
+		deadLetter    bool
+	}{
+		{"queued-insert", "insert", 0, false},
+		{"dl-insert-old", "insert", -48, true},
+		{"dl-delete-old", "delete", -30, true},
+		{"dl-delete-new", "delete", -2, true},
+		{"dl-update-new", "update", -1, true},
+	}
+	for _, e := range events {
+		event := &buffer.Event{ID: e.id, Operation: e.operation, Timestamp: base.Add(time.Duration(e.hours) * time.Hour)}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if e.deadLetter {
+			if err := buf.MoveToDeadLetter(event, "test"); err != nil {
+				t.Fatalf("MoveToDeadLetter: %v", err)
+			}
+		}
+	}
+	return path
+}
+
+func openBuffer(t *testing.T, path string, readOnly bool) *buffer.Buffer {
+	t.Helper()
+	opts := buffer.DefaultOptions()
+	opts.ReadOnly = readOnly
+	buf, err := buffer.New(path, opts)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	t.Cleanup(func() { buf.Close() })
+	return buf
+}
+
+func listIDs(t *testing.T, buf *buffer.Buffer, config *ReplayConfig) []string {
+	t.Helper()
+	var out bytes.Buffer
+	if err := listEvents(&out, buf, config); err != nil {
+		t.Fatalf("listEvents: %v", err)
+	}
+	var ids []string
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var event buffer.Event
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatalf("listed line does not decode: %v", err)
+		}
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func sameIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool)
+	for _, id := range got {
+		seen[id] = true
+	}
+	for _, id := range want {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestListFilters(t *testing.T) {
+	buf := openBuffer(t, newReplayBuffer(t), true)
+
+	tests := []struct {
+		name   string
+		config ReplayConfig
+		want   []string
+	}{
+		{"main bucket", ReplayConfig{}, []string{"queued-insert"}},
+		{"dead letters", ReplayConfig{DeadLetter: true}, []string{"dl-insert-old", "dl-delete-old", "dl-delete-new", "dl-update-new"}},
+		{"by operation", ReplayConfig{DeadLetter: true, Operations: map[string]bool{"delete": true}}, []string{"dl-delete-old", "dl-delete-new"}},
+		{"since", ReplayConfig{DeadLetter: true, Since: base.Add(-24 * time.Hour)}, []string{"dl-delete-new", "dl-update-new"}},
+		{"until is exclusive", ReplayConfig{DeadLetter: true, Until: base.Add(-2 * time.Hour)}, []string{"dl-insert-old", "dl-delete-old"}},
+		{"operation and range", ReplayConfig{
+			DeadLetter: true,
+			Operations: map[string]bool{"delete": true, "insert": true},
+			Since:      base.Add(-36 * time.Hour),
+			Until:      base,
+		}, []string{"dl-delete-old", "dl-delete-new"}},
+	}
+	for _, tt := range tests {
+		if got := listIDs(t, buf, &tt.config); !sameIDs(got, tt.want) {
+			t.Errorf("%s: listed %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequeueMatchingDeadLetters(t *testing.T) {
+	path := newReplayBuffer(t)
+	buf := openBuffer(t, path, false)
+
+	config := &ReplayConfig{Operations: map[string]bool{"delete": true}}
+	if err := requeueEvents(buf, config); err != nil {
+		t.Fatalf("requeueEvents: %v", err)
+	}
+
+	if got := listIDs(t, buf, &ReplayConfig{}); !sameIDs(got, []string{"queued-insert", "dl-delete-old", "dl-delete-new"}) {
+		t.Fatalf("main bucket after requeue = %v", got)
+	}
+	if got := listIDs(t, buf, &ReplayConfig{DeadLetter: true}); !sameIDs(got, []string{"dl-insert-old", "dl-update-new"}) {
+		t.Fatalf("dead letters after requeue = %v", got)
+	}
+	events, err := buf.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	for _, event := range events {
+		if event.Retries != 0 {
+			t.Errorf("requeued event %s has %d retries, want 0", event.ID, event.Retries)
+		}
+	}
+}
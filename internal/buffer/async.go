@@ -0,0 +1,133 @@
+package buffer
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// asyncWriter coalesces StoreAsync calls in memory and writes them in one
+// transaction per shard every interval, or sooner once size events are
+// pending. Once max events are pending, add flushes inline so a stalled
+// flusher applies backpressure instead of growing without bound. Events not
+// yet flushed are lost if the process crashes.
+type asyncWriter struct {
+	buffer   *Buffer
+	size     int
+	max      int
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []*Event
+
+	flushCh chan struct{}
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+func newAsyncWriter(b *Buffer, size, max int, interval time.Duration) *asyncWriter {
+	if size <= 0 {
+		size = 500
+	}
+	if max < size {
+		max = size
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	w := &asyncWriter{
+		buffer:   b,
+		size:     size,
+		max:      max,
+		interval: interval,
+		flushCh:  make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *asyncWriter) add(event *Event) {
+	w.mu.Lock()
+	w.pending = append(w.pending, event)
+	n := len(w.pending)
+	w.mu.Unlock()
+
+	if n >= w.max {
+		w.flush()
+		return
+	}
+	if n >= w.size {
+		select {
+		case w.flushCh <- struct{}{}:
+		default:
+			// A flush is already requested
+		}
+	}
+}
+
+func (w *asyncWriter) run() {
+	defer close(w.doneCh)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			w.flush()
+			return
+		case <-ticker.C:
+			w.flush()
+		case <-w.flushCh:
+			w.flush()
+		}
+	}
+}
+
+// flush writes everything pending. On failure the events are put back in
+// front of anything added meanwhile so the next flush retries them in order.
+func (w *asyncWriter) flush() {
+	w.mu.Lock()
+	events := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+
+	err := w.buffer.storeBatch(events)
+	if errors.Is(err, ErrDuplicateKey) {
+		// Retrying the batch would fail on the same event, so the events
+		// are stored one by one and the duplicates dropped
+		var failed []*Event
+		err = nil
+		for _, event := range events {
+			storeErr := w.buffer.Store(event)
+			switch {
+			case errors.Is(storeErr, ErrDuplicateKey):
+				log.Printf("Dropping buffered write of event %s: %v", event.ID, storeErr)
+			case storeErr != nil:
+				failed = append(failed, event)
+				err = storeErr
+			}
+		}
+		events = failed
+	}
+	if err != nil {
+		log.Printf("Failed to flush %d buffered writes, will retry: %v", len(events), err)
+		w.mu.Lock()
+		w.pending = append(events, w.pending...)
+		w.mu.Unlock()
+	}
+}
+
+// close stops the flusher after a final flush.
+func (w *asyncWriter) close() {
+	close(w.stopCh)
+	<-w.doneCh
+}
@@ -0,0 +1,86 @@
+package buffer
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCloseFlushesPendingAsyncWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	// An interval and batch size the test never reaches, so only Close can
+	// write the events
+	b, err := New(path, &Options{Timeout: time.Second, AsyncWrites: true, FlushInterval: time.Hour, FlushSize: 1000, MaxPending: 1000})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		if err := b.StoreAsync(&Event{ID: fmt.Sprint(i), Operation: "insert", Timestamp: time.Now()}); err != nil {
+			t.Fatalf("StoreAsync: %v", err)
+		}
+	}
+	if count, _ := b.Count(); count != 0 {
+		t.Fatalf("Count = %d before any flush, want 0", count)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reopened, err := New(path, nil)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if count, err := reopened.Count(); err != nil || count != n {
+		t.Fatalf("Count after Close = %d, %v; want %d", count, err, n)
+	}
+}
+
+func TestAsyncWritesFlushAtSize(t *testing.T) {
+	b := newTestBuffer(t, &Options{Timeout: time.Second, AsyncWrites: true, FlushInterval: time.Hour, FlushSize: 10, MaxPending: 100})
+	for i := 0; i < 10; i++ {
+		if err := b.StoreAsync(&Event{ID: fmt.Sprint(i), Operation: "insert", Timestamp: time.Now()}); err != nil {
+			t.Fatalf("StoreAsync: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, err := b.Count()
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		if count == 10 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Count = %d after reaching the flush size, want 10", count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// BenchmarkStoreAsync compares StoreAsync, which commits many events per
+// transaction, with Store, which commits each on its own.
+func BenchmarkStoreAsync(b *testing.B) {
+	for _, async := range []bool{false, true} {
+		name := "Store"
+		if async {
+			name = "StoreAsync"
+		}
+		b.Run(name, func(b *testing.B) {
+			buf := newTestBuffer(b, &Options{Timeout: time.Second, AsyncWrites: async, FlushInterval: 10 * time.Millisecond, FlushSize: 500, MaxPending: 10000})
+			now := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := buf.StoreAsync(&Event{ID: fmt.Sprint(i), Operation: "insert", Timestamp: now}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			// Include the final flush, so both write every event to disk
+			buf.Flush()
+		})
+	}
+}
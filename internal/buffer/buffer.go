@@ -1,218 +1,701 @@
 package buffer
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"buffered-cdc/internal/clock"
+
 	"go.etcd.io/bbolt"
 )
 
 const (
-	eventsBucket = "events"
+	eventsBucket   = "events"
+	priorityBucket = "events_priority"
+	// scheduledBucket holds events whose ready time had not passed when they
+	// were stored. The sync worker never reads it; PromoteScheduled moves
+	// events out of it once they are ready.
+	scheduledBucket  = "events_scheduled"
+	deadLetterBucket = "dead_letter"
+	checkpointBucket = "checkpoints"
+	// corruptBucket holds raw records from the queue buckets that could not
+	// be decoded, kept for investigation.
+	corruptBucket = "corrupt"
+)
+
+const (
+	PriorityNormal = ""
+	PriorityHigh   = "high"
+)
+
+// DefaultTxnChunkSize is the Options.TxnChunkSize used when none is set.
+const DefaultTxnChunkSize = 1000
+
+// Values for Options.ReadOrder.
+const (
+	// ReadFIFO drains the oldest ready events first.
+	ReadFIFO = "fifo"
+	// ReadLIFO drains the newest ready events first, so fresh changes flow
+	// while a backlog catches up. Changes to one document are then delivered
+	// newest first.
+	ReadLIFO = "lifo"
+)
+
+// Values for Options.OnDuplicate, which decides what Store does when an
+// event's key already holds a different event.
+const (
+	// DuplicateOverwrite replaces the stored event.
+	DuplicateOverwrite = "overwrite"
+	// DuplicateError fails the store with ErrDuplicateKey.
+	DuplicateError = "error"
+	// DuplicateRename stores the event under its key with a -1, -2, ...
+	// suffix, which sorts right after the original.
+	DuplicateRename = "rename"
 )
 
+// ErrEventNotFound is returned when an operation targets an event that is no
+// longer in the buffer, typically because it was delivered, expired or
+// dead-lettered after it was read.
+var ErrEventNotFound = errors.New("event not found")
+
+// ErrDuplicateKey is returned by Store under DuplicateError when an event's
+// key already holds a different event.
+var ErrDuplicateKey = errors.New("buffer key already holds a different event")
+
+// queueBuckets lists every bucket holding pending events.
+var queueBuckets = []string{priorityBucket, eventsBucket, scheduledBucket}
+
+// readyBuckets lists the queue buckets the sync worker reads, in the order
+// they are drained: high-priority events are always read before normal ones.
+var readyBuckets = []string{priorityBucket, eventsBucket}
+
 type Event struct {
+	// Key is the event's record key, a ULID assigned by Store. Events
+	// buffered before keys were stored have none and are found by the key
+	// derived from Timestamp and ID.
+	Key              string                 `json:"key,omitempty"`
 	ID          string                 `json:"id"`
 	Operation   string                 `json:"operation"`
 	Timestamp   time.Time              `json:"timestamp"`
 	Data        map[string]interface{} `json:"data"`
 	Retries     int                    `json:"retries"`
 	DelayedUntil *time.Time             `json:"delayedUntil"`
+	DeadLetterReason string             `json:"deadLetterReason,omitempty"`
+	ExpiresAt   *time.Time             `json:"expiresAt,omitempty"`
+	Priority    string                 `json:"priority,omitempty"`
+	// Delivered lists the sinks that have acknowledged the event when it is
+	// still buffered because another sink has not.
+	Delivered []string `json:"delivered,omitempty"`
+	// LastAttempt is when the most recent failed sync was recorded.
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	// SchemaVersion is the record format the event was stored with. Records
+	// written before versions were kept have none and read as version 0.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+
+	// size is the length of the stored record, set when the event is read.
+	size int
 }
 
-type Buffer struct {
-	db *bbolt.DB
+// Checkpoint records where a delivered event was written in Kafka.
+type Checkpoint struct {
+	EventID   string    `json:"eventId"`
+	Topic     string    `json:"topic"`
+	Partition int       `json:"partition"`
+	Offset    int64     `json:"offset"`
+	SyncedAt  time.Time `json:"syncedAt"`
 }
 
-func New(path string) (*Buffer, error) {
-	db, err := bbolt.Open(path, 0600, &bbolt.Options{
-		Timeout:         1 * time.Second,
-		NoGrowSync:      false,
-		NoFreelistSync:  false,
-		FreelistType:    bbolt.FreelistMapType,
-		ReadOnly:        false,
-		MmapFlags:       0,
-		InitialMmapSize: 1 << 26, // 64MB initial mmap size
-		PageSize:        4096,
-		NoSync:          false,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to open buffer database: %w", err)
+// Expired reports whether the event's TTL has passed and it should no longer
+// be delivered.
+func (e *Event) Expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !e.ExpiresAt.After(now)
+}
+
+// bufferKey returns the key the event is stored under. Events read from the
+// buffer always carry it; the derived key is only a fallback for events built
+// elsewhere from an old record.
+func (e *Event) bufferKey() []byte {
+	if e.Key != "" {
+		return []byte(e.Key)
 	}
+	return eventKey(e.ID, e.Timestamp)
+}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(eventsBucket))
-		return err
-	})
-	if err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to create bucket: %w", err)
+// retryAt returns when an event that has failed syncs becomes eligible again:
+// base after its last attempt, doubled for every retry after the first and
+// capped at max. Events that have never failed are eligible immediately.
+func (e *Event) retryAt(base, max time.Duration) time.Time {
+	if e.Retries == 0 || e.LastAttempt == nil || base <= 0 {
+		return time.Time{}
 	}
 
-	return &Buffer{db: db}, nil
+	delay := base
+	for i := 1; i < e.Retries && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return e.LastAttempt.Add(delay)
 }
 
-func (b *Buffer) Store(event *Event) error {
-	return b.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(eventsBucket))
-		
-		data, err := json.Marshal(event)
+// Size returns the length in bytes of the event's stored record, or 0 for an
+// event that was not read from the buffer.
+func (e *Event) Size() int {
+	return e.size
+}
+
+// Collection returns the collection recorded in the event's data.ns, or ""
+// for events captured without one.
+func (e *Event) Collection() string {
+	ns, ok := e.Data["ns"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	coll, _ := ns["coll"].(string)
+	return coll
+}
+
+// DeliveredTo reports whether sink has already acknowledged the event.
+func (e *Event) DeliveredTo(sink string) bool {
+	for _, name := range e.Delivered {
+		if name == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketFor returns the ready bucket for event.
+func bucketFor(event *Event) string {
+	if event.Priority == PriorityHigh {
+		return priorityBucket
+	}
+	return eventsBucket
+}
+
+// PromoteScheduled moves the scheduled events whose ready time has passed to
+// the queue the sync worker reads, and returns how many it moved.
+func (b *Buffer) PromoteScheduled() (int, error) {
+	now := b.clock.Now()
+	promoted := 0
+	for _, s := range b.shards {
+		n, err := s.promoteScheduled(now)
+		promoted += n
 		if err != nil {
-			return fmt.Errorf("failed to marshal event: %w", err)
+			return promoted, fmt.Errorf("failed to promote scheduled events: %w", err)
 		}
+	}
+	return promoted, nil
+}
 
-		key := fmt.Sprintf("%d_%s", event.Timestamp.UnixNano(), event.ID)
-		return bucket.Put([]byte(key), data)
-	})
+type Buffer struct {
+	shards   []*shard
+	clock    clock.Clock
+	slowLane int
+	lifo     bool
+	async    *asyncWriter
+	noSync   bool
 }
 
-func (b *Buffer) GetBatch(batchSize int) ([]*Event, error) {
-	var events []*Event
+// Options controls how the underlying bbolt files are opened.
+type Options struct {
+	// Timeout bounds how long Open waits for the file lock. bbolt holds an
+	// exclusive lock for writers, so a ReadOnly open of a file the service has
+	// open fails after Timeout instead of blocking forever.
+	Timeout time.Duration
+	// NoSync skips fsync after each commit. Faster, but a crash can lose the
+	// most recent writes. It is the same as SyncPolicy SyncNever.
+	NoSync          bool
+	// SyncPolicy is SyncAlways (the default when empty), SyncInterval or
+	// SyncNever. SyncInterval groups concurrent stores into one transaction
+	// of at most TxnChunkSize events, waiting up to SyncInterval for them.
+	SyncPolicy   string
+	SyncInterval time.Duration
+	InitialMmapSize int
+	// ReadOnly opens the file with a shared lock and skips bucket creation.
+	ReadOnly bool
+	// Shards splits the buffer across this many files, routed by a hash of
+	// the event ID. Every file has its own write lock, so more shards allow
+	// more concurrent writers. One shard keeps everything in the file at path.
+	Shards int
+	// Clock decides when delayed events become ready and TTLs expire. Nil
+	// uses the system clock.
+	Clock clock.Clock
+	// SlowLaneRetries moves events that have failed this many times behind
+	// fresh events in GetReadyEvents, so a failing head of the buffer cannot
+	// starve the rest. Zero keeps strict buffered order.
+	SlowLaneRetries int
+	// RetryBackoff defers an event after a failed sync: it is not returned
+	// by GetReadyEvents until RetryBackoff after its last attempt, doubled
+	// per further retry up to MaxRetryBackoff. Zero retries on the next read.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// ScheduleDelayed stores events whose DelayedUntil is still in the
+	// future in a separate bucket that GetReadyEvents does not read, so
+	// reads do not walk past them. PromoteScheduled moves them to the ready
+	// queue. Without it they are queued with the rest and skipped by every
+	// read until ready.
+	ScheduleDelayed bool
+	// ReadOrder is ReadFIFO (the default when empty) or ReadLIFO. It orders
+	// events within each priority for GetReadyEvents; high-priority events
+	// are still read first and slow-lane events last.
+	ReadOrder string
+	// TxnChunkSize caps how many records a bulk write (batch stores and
+	// deletes, expiry, Import and Migrate) changes per transaction. Long
+	// write transactions hold the single bbolt writer lock and grow memory
+	// with every dirty page, so larger operations are split and committed in
+	// chunks. Zero uses DefaultTxnChunkSize.
+	TxnChunkSize int
+	// Codec is CodecJSON (the default when empty) or CodecBSON, the
+	// encoding new records are written with. Records in either are read.
+	Codec string
+	// OnDuplicate is DuplicateOverwrite (the default when empty),
+	// DuplicateError or DuplicateRename. Storing the same event ID again is
+	// never a duplicate and replaces the stored copy.
+	OnDuplicate string
+	// AsyncWrites makes StoreAsync collect events in memory and write them in
+	// one transaction per shard every FlushInterval, or once FlushSize events
+	// are pending. At most MaxPending events are held before StoreAsync
+	// writes inline. Close flushes what is left; a crash loses it.
+	AsyncWrites   bool
+	FlushInterval time.Duration
+	FlushSize     int
+	MaxPending    int
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		Timeout:         1 * time.Second,
+		NoSync:          false,
+		InitialMmapSize: 1 << 26, // 64MB initial mmap size
+		ReadOnly:        false,
+		Shards:          1,
+	}
+}
 
-	err := b.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(eventsBucket))
-		cursor := bucket.Cursor()
+// New opens the buffer at path. A nil opts uses DefaultOptions.
+func New(path string, opts *Options) (*Buffer, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
 
-		count := 0
-		for key, value := cursor.First(); key != nil && count < batchSize; key, value = cursor.Next() {
-			var event Event
-			if err := json.Unmarshal(value, &event); err != nil {
-				continue
-			}
-			events = append(events, &event)
-			count++
+	if err := validateSyncPolicy(opts.SyncPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateCodec(opts.Codec); err != nil {
+		return nil, err
+	}
+	switch opts.ReadOrder {
+	case "", ReadFIFO, ReadLIFO:
+	default:
+		return nil, fmt.Errorf("invalid read order %q: must be fifo or lifo", opts.ReadOrder)
+	}
+
+	n := opts.Shards
+	if n < 1 {
+		n = 1
+	}
+
+	clk := opts.Clock
+	if clk == nil {
+		clk = clock.New()
+	}
+
+	b := &Buffer{shards: make([]*shard, 0, n), clock: clk, slowLane: opts.SlowLaneRetries, lifo: opts.ReadOrder == ReadLIFO, noSync: opts.noSync() && !opts.ReadOnly}
+	for i := 0; i < n; i++ {
+		s, err := openShard(ShardPath(path, i, n), opts)
+		if err != nil {
+			b.Close()
+			return nil, err
 		}
+		b.shards = append(b.shards, s)
+	}
 
-		return nil
-	})
+	if opts.AsyncWrites && !opts.ReadOnly {
+		b.async = newAsyncWriter(b, opts.FlushSize, opts.MaxPending, opts.FlushInterval)
+	}
+
+	return b, nil
+}
+
+// ShardPath returns the file used for shard i of n. A single shard uses path
+// unchanged; otherwise the index is inserted before the extension, so
+// buffer.db becomes buffer-0.db, buffer-1.db and so on.
+func ShardPath(path string, i, n int) string {
+	if n <= 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), i, ext)
+}
 
-	return events, err
+// shardFor routes an event ID to its shard. The mapping depends on the shard
+// count, so changing BUFFER_SHARDS requires an empty buffer.
+func (b *Buffer) shardFor(eventID string) *shard {
+	if len(b.shards) == 1 {
+		return b.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(eventID))
+	return b.shards[h.Sum32()%uint32(len(b.shards))]
 }
 
-func (b *Buffer) GetReadyEvents(batchSize int) ([]*Event, error) {
+// mergeEvents combines per-shard results into a single drain order: slow-lane
+// events (retries >= slowLane, when set) last, then high priority first, then
+// by buffered time, newest first when lifo is set. Each shard's slice is
+// already in that order, so a single shard is returned as-is.
+func mergeEvents(perShard [][]*Event, limit, slowLane int, lifo bool) []*Event {
+	if len(perShard) == 1 {
+		return perShard[0]
+	}
+
 	var events []*Event
-	now := time.Now()
-
-	err := b.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(eventsBucket))
-		cursor := bucket.Cursor()
-
-		// Pre-allocate slice with capacity for better performance
-		events = make([]*Event, 0, batchSize)
-		
-		count := 0
-		for key, value := cursor.First(); key != nil && count < batchSize; key, value = cursor.Next() {
-			var event Event
-			if err := json.Unmarshal(value, &event); err != nil {
-				continue
-			}
-			
-			// Include events that are ready (null delayedUntil or delayedUntil <= now)
-			if event.DelayedUntil == nil || 
-			   event.DelayedUntil.Before(now) || 
-			   event.DelayedUntil.Equal(now) {
-				events = append(events, &event)
-				count++
+	for _, shardEvents := range perShard {
+		events = append(events, shardEvents...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if slowLane > 0 {
+			si, sj := events[i].Retries >= slowLane, events[j].Retries >= slowLane
+			if si != sj {
+				return sj
 			}
 		}
-
-		return nil
+		pi, pj := events[i].Priority == PriorityHigh, events[j].Priority == PriorityHigh
+		if pi != pj {
+			return pi
+		}
+		if !events[i].Timestamp.Equal(events[j].Timestamp) {
+			return events[i].Timestamp.Before(events[j].Timestamp) != lifo
+		}
+		return (events[i].ID < events[j].ID) != lifo
 	})
 
-	return events, err
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events
 }
 
-// GetReadyEventsBulk retrieves multiple batches of ready events for concurrent processing
-func (b *Buffer) GetReadyEventsBulk(batchSize, numBatches int) ([][]*Event, error) {
-	var batches [][]*Event
-	now := time.Now()
+// Store writes event to the buffer. An event with a DeadLetterReason is
+// stored straight in the dead-letter bucket.
+func (b *Buffer) Store(event *Event) error {
+	return b.shardFor(event.ID).store(event)
+}
 
-	err := b.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(eventsBucket))
-		cursor := bucket.Cursor()
+// StoreAsync queues event for the background flusher when AsyncWrites is
+// enabled, trading a short durability window for far fewer fsyncs. Otherwise
+// it is the same as Store.
+func (b *Buffer) StoreAsync(event *Event) error {
+	if b.async == nil {
+		return b.Store(event)
+	}
+	b.async.add(event)
+	return nil
+}
 
-		batches = make([][]*Event, 0, numBatches)
-		currentBatch := make([]*Event, 0, batchSize)
-		count := 0
-		batchCount := 0
-		
-		for key, value := cursor.First(); key != nil && batchCount < numBatches; key, value = cursor.Next() {
-			var event Event
-			if err := json.Unmarshal(value, &event); err != nil {
-				continue
-			}
-			
-			// Include events that are ready (null delayedUntil or delayedUntil <= now)
-			if event.DelayedUntil == nil || 
-			   event.DelayedUntil.Before(now) || 
-			   event.DelayedUntil.Equal(now) {
-				currentBatch = append(currentBatch, &event)
-				count++
-				
-				if count >= batchSize {
-					batches = append(batches, currentBatch)
-					currentBatch = make([]*Event, 0, batchSize)
-					count = 0
-					batchCount++
-				}
-			}
-		}
-		
-		// Add remaining events as final batch
-		if len(currentBatch) > 0 && batchCount < numBatches {
-			batches = append(batches, currentBatch)
+// storeBatch writes events with one transaction per shard.
+func (b *Buffer) storeBatch(events []*Event) error {
+	perShard := make(map[*shard][]*Event)
+	for _, event := range events {
+		s := b.shardFor(event.ID)
+		perShard[s] = append(perShard[s], event)
+	}
+	for s, shardEvents := range perShard {
+		if err := s.storeBatch(shardEvents); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		return nil
-	})
+func (b *Buffer) GetBatch(batchSize int) ([]*Event, error) {
+	perShard := make([][]*Event, 0, len(b.shards))
+	for _, s := range b.shards {
+		events, err := s.getBatch(batchSize)
+		if err != nil {
+			return nil, err
+		}
+		perShard = append(perShard, events)
+	}
+	return mergeEvents(perShard, batchSize, 0, false), nil
+}
 
-	return batches, err
+// readyEvents collects up to limit ready events, and at most maxBytes of
+// them when maxBytes is positive, from every shard and merges them, so the
+// result is the first events across the whole buffer within both limits.
+func (b *Buffer) readyEvents(limit, maxBytes int, admit func(*Event) bool) ([]*Event, error) {
+	now := b.clock.Now()
+	perShard := make([][]*Event, 0, len(b.shards))
+	for _, s := range b.shards {
+		events, err := s.readyEvents(now, limit, maxBytes, b.slowLane, admit)
+		if err != nil {
+			return nil, err
+		}
+		perShard = append(perShard, events)
+	}
+	events := mergeEvents(perShard, limit, b.slowLane, b.lifo)
+	return events[:withinBytes(events, maxBytes)], nil
 }
 
-func (b *Buffer) Delete(eventID string, timestamp time.Time) error {
-	return b.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(eventsBucket))
-		key := fmt.Sprintf("%d_%s", timestamp.UnixNano(), eventID)
-		return bucket.Delete([]byte(key))
-	})
+// fitsBytes reports whether an event of size bytes may join a batch already
+// holding total bytes without going over maxBytes. The first event always
+// fits, so an oversized one cannot stall the buffer; maxBytes <= 0 is
+// unlimited.
+func fitsBytes(total, size, maxBytes int) bool {
+	return maxBytes <= 0 || total == 0 || total+size <= maxBytes
 }
 
-func (b *Buffer) UpdateRetries(eventID string, timestamp time.Time, retries int) error {
-	return b.db.Update(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(eventsBucket))
-		key := fmt.Sprintf("%d_%s", timestamp.UnixNano(), eventID)
-		
-		value := bucket.Get([]byte(key))
-		if value == nil {
-			return fmt.Errorf("event not found")
+// withinBytes returns how many of events, from the start, fit in maxBytes.
+func withinBytes(events []*Event, maxBytes int) int {
+	total := 0
+	for i, event := range events {
+		if !fitsBytes(total, event.Size(), maxBytes) {
+			return i
 		}
+		total += event.Size()
+	}
+	return len(events)
+}
 
-		var event Event
-		if err := json.Unmarshal(value, &event); err != nil {
-			return err
+// GetReadyEvents returns the next ready events, stopping at batchSize events
+// or, when maxBytes is positive, before the stored size of the events would
+// exceed maxBytes, whichever comes first.
+func (b *Buffer) GetReadyEvents(batchSize, maxBytes int) ([]*Event, error) {
+	if batchSize <= 0 {
+		return nil, nil
+	}
+	return b.readyEvents(batchSize, maxBytes, nil)
+}
+
+// GetReadyEventsBulk retrieves multiple batches of ready events for concurrent
+// processing, each limited like GetReadyEvents.
+func (b *Buffer) GetReadyEventsBulk(batchSize, maxBytes, numBatches int) ([][]*Event, error) {
+	return b.GetAdmittedEvents(batchSize, maxBytes, numBatches, nil)
+}
+
+// GetAdmittedEvents is GetReadyEventsBulk with admit deciding, in drain
+// order, whether each ready event is taken. Rejected events stay buffered and
+// the scan moves on, so a caller can skip past events it is not ready for
+// instead of being handed the same ones every pass. With several shards admit
+// also sees events the merge then drops; they are returned on a later read.
+func (b *Buffer) GetAdmittedEvents(batchSize, maxBytes, numBatches int, admit func(*Event) bool) ([][]*Event, error) {
+	if batchSize <= 0 || numBatches <= 0 {
+		return nil, nil
+	}
+
+	events, err := b.readyEvents(batchSize*numBatches, maxBytes*numBatches, admit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Events left over once numBatches are full stay buffered for the next
+	// read
+	batches := make([][]*Event, 0, numBatches)
+	for len(events) > 0 && len(batches) < numBatches {
+		n := withinBytes(events[:min(batchSize, len(events))], maxBytes)
+		batches = append(batches, events[:n])
+		events = events[n:]
+	}
+	return batches, nil
+}
+
+// PurgeExpired scans the queue buckets and deletes events whose TTL has
+// passed, returning how many were removed.
+func (b *Buffer) PurgeExpired() (int, error) {
+	now := b.clock.Now()
+	total := 0
+	for _, s := range b.shards {
+		n, err := s.purgeExpired(now)
+		total += n
+		if err != nil {
+			return total, err
 		}
+	}
+	return total, nil
+}
 
-		event.Retries = retries
-		data, err := json.Marshal(event)
+// Delete removes a pending event by its stored key, returning ErrEventNotFound
+// if it is no longer queued.
+func (b *Buffer) Delete(event *Event) error {
+	return b.shardFor(event.ID).delete(event)
+}
+
+// DeleteBatch removes delivered events, grouped by shard and committed in
+// transactions of at most TxnChunkSize events. Events already gone are
+// skipped. It returns how many events were removed.
+func (b *Buffer) DeleteBatch(events []*Event) (int, error) {
+	perShard := make(map[*shard][]*Event)
+	for _, event := range events {
+		s := b.shardFor(event.ID)
+		perShard[s] = append(perShard[s], event)
+	}
+
+	deleted := 0
+	for s, shardEvents := range perShard {
+		n, err := s.deleteBatch(shardEvents)
+		deleted += n
 		if err != nil {
+			return deleted, fmt.Errorf("failed to delete events: %w", err)
+		}
+	}
+	return deleted, nil
+}
+
+func (b *Buffer) UpdateRetries(event *Event, retries int) error {
+	return b.shardFor(event.ID).updateRetries(event, retries, b.clock.Now())
+}
+
+// MarkDelivered records that the named sinks have acknowledged the event, so
+// later syncs only send it to the sinks that have not.
+func (b *Buffer) MarkDelivered(event *Event, sinks []string) error {
+	return b.shardFor(event.ID).markDelivered(event, sinks)
+}
+
+// MoveToDeadLetter removes an event from the main bucket and keeps it, along
+// with the reason, in the dead-letter bucket for later inspection or replay.
+func (b *Buffer) MoveToDeadLetter(event *Event, reason string) error {
+	return b.shardFor(event.ID).moveToDeadLetter(event, reason)
+}
+
+// RequeueDeadLetter moves a dead-lettered event back into the main bucket with
+// its retry count reset so the sync worker picks it up again.
+func (b *Buffer) RequeueDeadLetter(event *Event) error {
+	return b.shardFor(event.ID).requeueDeadLetter(event)
+}
+
+// ForEach calls fn for every pending event (high priority first), or for every
+// dead-lettered event when deadLetter is true, in key order within each shard.
+// Returning an error stops the walk. fn runs inside a read transaction and
+// must not write to the buffer.
+func (b *Buffer) ForEach(deadLetter bool, fn func(*Event) error) error {
+	names := queueBuckets
+	if deadLetter {
+		names = []string{deadLetterBucket}
+	}
+
+	for _, s := range b.shards {
+		if err := s.forEach(names, fn); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		return bucket.Put([]byte(key), data)
-	})
+func (b *Buffer) DeadLetterCount() (int, error) {
+	return b.count([]string{deadLetterBucket})
 }
 
 func (b *Buffer) Count() (int, error) {
-	var count int
-	err := b.db.View(func(tx *bbolt.Tx) error {
-		bucket := tx.Bucket([]byte(eventsBucket))
-		count = bucket.Stats().KeyN
+	return b.count(queueBuckets)
+}
+
+// Stats summarizes the buffer's contents.
+type Stats struct {
+	Queued       int
+	DeadLettered int
+	// Oldest is the capture time of the oldest queued event, zero when the
+	// queue is empty.
+	Oldest time.Time
+}
+
+// Stats counts the queued and dead-lettered events and finds the oldest
+// queued one. Keys sort by capture time, so only the first event of each
+// queue bucket is read.
+func (b *Buffer) Stats() (Stats, error) {
+	var stats Stats
+	var err error
+	if stats.Queued, err = b.Count(); err != nil {
+		return stats, err
+	}
+	if stats.DeadLettered, err = b.DeadLetterCount(); err != nil {
+		return stats, err
+	}
+	for _, s := range b.shards {
+		oldest, err := s.oldest()
+		if err != nil {
+			return stats, err
+		}
+		if !oldest.IsZero() && (stats.Oldest.IsZero() || oldest.Before(stats.Oldest)) {
+			stats.Oldest = oldest
+		}
+	}
+	return stats, nil
+}
+
+func (b *Buffer) count(names []string) (int, error) {
+	total := 0
+	for _, s := range b.shards {
+		n, err := s.count(names)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// RecordCheckpoints appends the Kafka positions of delivered events to the
+// checkpoint ring, dropping the oldest entries beyond max. Checkpoints are
+// audit data rather than routing state, so they all live in the first shard.
+func (b *Buffer) RecordCheckpoints(checkpoints []Checkpoint, max int) error {
+	if len(checkpoints) == 0 || max <= 0 {
 		return nil
-	})
-	return count, err
+	}
+	return b.shards[0].recordCheckpoints(checkpoints, max)
+}
+
+// Checkpoints returns up to limit of the most recent checkpoints, newest first.
+func (b *Buffer) Checkpoints(limit int) ([]Checkpoint, error) {
+	return b.shards[0].checkpoints(limit)
+}
+
+// CheckWritable commits a write transaction on every shard, creating and
+// removing a scratch bucket, to confirm the files accept writes and, unless
+// fsync is disabled, can be synced.
+func (b *Buffer) CheckWritable() error {
+	for _, s := range b.shards {
+		err := s.db.Update(func(tx *bbolt.Tx) error {
+			if _, err := tx.CreateBucket([]byte("preflight")); err != nil {
+				return err
+			}
+			return tx.DeleteBucket([]byte("preflight"))
+		})
+		if err != nil {
+			return fmt.Errorf("buffer %s is not writable: %w", s.db.Path(), err)
+		}
+	}
+	return nil
+}
+
+// Flush writes the events passed to StoreAsync that are still pending.
+func (b *Buffer) Flush() {
+	if b.async != nil {
+		b.async.flush()
+	}
 }
 
 func (b *Buffer) Close() error {
-	return b.db.Close()
-}
\ No newline at end of file
+	if b.async != nil {
+		b.async.close()
+	}
+	// bbolt does not fsync on close, so commits made without it would
+	// otherwise be left to the OS
+	if b.noSync {
+		b.sync()
+	}
+
+	var firstErr error
+	for _, s := range b.shards {
+		if err := s.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
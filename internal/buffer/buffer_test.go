@@ -0,0 +1,552 @@
+package buffer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/clock"
+
+	bbolterrors "go.etcd.io/bbolt/errors"
+)
+
+// newTestBuffer opens a buffer in a temporary directory that is closed when
+// the test ends. A nil opts uses DefaultOptions.
+func newTestBuffer(t testing.TB, opts *Options) *Buffer {
+	t.Helper()
+	b, err := New(filepath.Join(t.TempDir(), "buffer.db"), opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// roundTrip returns event as it reads after being encoded to JSON and back,
+// as it is when it comes back from an export, a webhook or another process.
+func roundTrip(t *testing.T, event *Event) *Event {
+	t.Helper()
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var decoded Event
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return &decoded
+}
+
+func TestDeleteAfterTimestampRoundTrip(t *testing.T) {
+	b := newTestBuffer(t, nil)
+
+	// A zone other than UTC and a monotonic clock reading are both lost in
+	// a JSON round trip, so a key derived from Timestamp would change.
+	zone := time.FixedZone("UTC+5:30", 5*3600+1800)
+	events := []*Event{
+		{ID: "single", Operation: "insert", Timestamp: time.Now().In(zone)},
+		{ID: "batch-1", Operation: "update", Timestamp: time.Now()},
+		{ID: "batch-2", Operation: "delete", Timestamp: time.Now().In(zone)},
+	}
+	for _, event := range events {
+		if err := b.Store(event); err != nil {
+			t.Fatalf("Store %s: %v", event.ID, err)
+		}
+	}
+
+	single := roundTrip(t, events[0])
+	if single.Timestamp == events[0].Timestamp {
+		t.Fatal("round trip kept the timestamp identical; the test would not cover the regression")
+	}
+	if err := b.Delete(single); err != nil {
+		t.Fatalf("Delete after round trip: %v", err)
+	}
+	if err := b.Delete(single); !errors.Is(err, ErrEventNotFound) {
+		t.Fatalf("second Delete = %v, want ErrEventNotFound", err)
+	}
+
+	deleted, err := b.DeleteBatch([]*Event{roundTrip(t, events[1]), roundTrip(t, events[2])})
+	if err != nil {
+		t.Fatalf("DeleteBatch after round trip: %v", err)
+	}
+	if deleted != 2 {
+		t.Fatalf("DeleteBatch removed %d events, want 2", deleted)
+	}
+
+	count, err := b.Count()
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("Count = %d after deleting every event, want 0", count)
+	}
+}
+
+func TestStoreAssignsSortableUniqueKeys(t *testing.T) {
+	b := newTestBuffer(t, nil)
+
+	ts := time.Now()
+	seen := make(map[string]bool)
+	var previous string
+	for i := 0; i < 100; i++ {
+		// The same timestamp for every event, as when a burst of changes is
+		// captured within one clock tick
+		event := &Event{ID: "same-id", Operation: "insert", Timestamp: ts}
+		if err := b.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if seen[event.Key] {
+			t.Fatalf("key %s assigned twice", event.Key)
+		}
+		seen[event.Key] = true
+		if event.Key <= previous {
+			t.Fatalf("key %s does not sort after %s", event.Key, previous)
+		}
+		previous = event.Key
+	}
+}
+
+func TestReadOnlyOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	writer, err := New(path, &Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := writer.Store(&Event{ID: id, Operation: "insert", Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	// The writer's exclusive lock makes a read-only open give up after its
+	// timeout rather than block
+	started := time.Now()
+	reader, err := New(path, &Options{Timeout: 50 * time.Millisecond, ReadOnly: true})
+	if err == nil {
+		reader.Close()
+		t.Fatal("read-only open succeeded while a writer holds the file")
+	}
+	if !errors.Is(err, bbolterrors.ErrTimeout) {
+		t.Fatalf("read-only open = %v, want a lock timeout", err)
+	}
+	if waited := time.Since(started); waited > 2*time.Second {
+		t.Fatalf("read-only open waited %v with a 50ms timeout", waited)
+	}
+	// The writer is unaffected by the attempt
+	if err := writer.Store(&Event{ID: "c", Operation: "insert", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Store after a read-only attempt: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Once the writer is gone, readers share the file
+	var readers []*Buffer
+	for i := 0; i < 2; i++ {
+		reader, err := New(path, &Options{Timeout: time.Second, ReadOnly: true})
+		if err != nil {
+			t.Fatalf("read-only open %d: %v", i, err)
+		}
+		defer reader.Close()
+		readers = append(readers, reader)
+	}
+	for i, reader := range readers {
+		if count, err := reader.Count(); err != nil || count != 3 {
+			t.Fatalf("reader %d Count = %d, %v; want 3", i, count, err)
+		}
+	}
+	if err := readers[0].Store(&Event{ID: "d", Operation: "insert", Timestamp: time.Now()}); err == nil {
+		t.Fatal("Store succeeded on a read-only buffer")
+	}
+}
+
+func TestDefaultOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	b, err := New(path, nil)
+	if err != nil {
+		t.Fatalf("New with nil options: %v", err)
+	}
+	defer b.Close()
+
+	opts := DefaultOptions()
+	if len(b.shards) != opts.Shards || b.noSync != opts.NoSync {
+		t.Fatalf("nil options opened %d shards with noSync %v, want DefaultOptions", len(b.shards), b.noSync)
+	}
+	if b.shards[0].db.NoSync || b.shards[0].db.IsReadOnly() {
+		t.Fatal("default buffer skips fsync or is read-only")
+	}
+}
+
+func TestExpiryAgainstReadyTime(t *testing.T) {
+	tests := []struct {
+		name           string
+		ready, expires time.Duration
+		// wantReadAt is the step the event is read at, or -1 for never
+		wantReadAt time.Duration
+	}{
+		{"expires before it is ready", 2 * time.Hour, time.Hour, -1},
+		{"expires after it is ready", time.Hour, 2 * time.Hour, 90 * time.Minute},
+	}
+	// Read before either time, between the two, and after both
+	steps := []time.Duration{30 * time.Minute, 90 * time.Minute, 3 * time.Hour}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			clk := clock.NewFake(start)
+			b := newTestBuffer(t, &Options{Timeout: time.Second, Clock: clk})
+
+			ready, expires := start.Add(tt.ready), start.Add(tt.expires)
+			event := &Event{ID: "e", Operation: "insert", Timestamp: start, DelayedUntil: &ready, ExpiresAt: &expires}
+			if err := b.Store(event); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+
+			for _, step := range steps {
+				clk.Set(start.Add(step))
+				events, err := b.GetReadyEvents(10, 0)
+				if err != nil {
+					t.Fatalf("GetReadyEvents: %v", err)
+				}
+				if read := len(events) == 1; read != (step == tt.wantReadAt) {
+					t.Errorf("at +%v read %d events, want the event read only at +%v", step, len(events), tt.wantReadAt)
+				}
+
+				// An expired event is deleted as the read passes over it
+				count, err := b.Count()
+				if err != nil {
+					t.Fatalf("Count: %v", err)
+				}
+				if want := step < tt.expires; (count == 1) != want {
+					t.Errorf("at +%v the buffer holds %d events, want it held only before +%v", step, count, tt.expires)
+				}
+			}
+		})
+	}
+}
+
+func TestHighPriorityReadFirst(t *testing.T) {
+	for _, shards := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			b := newTestBuffer(t, &Options{Timeout: time.Second, Shards: shards})
+			start := time.Now()
+			for i := 0; i < 5; i++ {
+				event := &Event{ID: fmt.Sprintf("low%d", i), Operation: "insert", Timestamp: start.Add(time.Duration(i) * time.Second)}
+				if err := b.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			high := &Event{ID: "high", Operation: "insert", Timestamp: start.Add(time.Minute), Priority: PriorityHigh}
+			if err := b.Store(high); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+
+			events, err := b.GetReadyEvents(1, 0)
+			if err != nil {
+				t.Fatalf("GetReadyEvents: %v", err)
+			}
+			if len(events) != 1 || events[0].ID != "high" {
+				t.Fatalf("a batch of one read %v, want the high-priority event", eventIDs(events))
+			}
+
+			events, err = b.GetReadyEvents(10, 0)
+			if err != nil {
+				t.Fatalf("GetReadyEvents: %v", err)
+			}
+			want := []string{"high", "low0", "low1", "low2", "low3", "low4"}
+			if got := eventIDs(events); !reflect.DeepEqual(got, want) {
+				t.Fatalf("read %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func eventIDs(events []*Event) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func TestSentinelErrors(t *testing.T) {
+	b := newTestBuffer(t, &Options{Timeout: time.Second, OnDuplicate: DuplicateError})
+	stored := &Event{Key: "k1", ID: "stored", Operation: "insert", Timestamp: time.Now()}
+	if err := b.Store(stored); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	gone := &Event{Key: "k2", ID: "gone", Operation: "insert", Timestamp: time.Now()}
+
+	tests := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"Delete", b.Delete(gone), ErrEventNotFound},
+		{"UpdateRetries", b.UpdateRetries(gone, 1), ErrEventNotFound},
+		{"MarkDelivered", b.MarkDelivered(gone, []string{"kafka"}), ErrEventNotFound},
+		{"RequeueDeadLetter", b.RequeueDeadLetter(gone), ErrEventNotFound},
+		{"Store over a different event", b.Store(&Event{Key: "k1", ID: "other", Operation: "insert", Timestamp: time.Now()}), ErrDuplicateKey},
+	}
+	for _, tt := range tests {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.name, tt.err, tt.want)
+		}
+	}
+	if err := b.Delete(stored); err != nil {
+		t.Errorf("Delete of a buffered event = %v", err)
+	}
+}
+
+func TestDelayedEventReadyOnTheFakeClock(t *testing.T) {
+	for _, scheduled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ScheduleDelayed=%v", scheduled), func(t *testing.T) {
+			start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			clk := clock.NewFake(start)
+			b := newTestBuffer(t, &Options{Timeout: time.Second, Clock: clk, ScheduleDelayed: scheduled})
+
+			ready := start.Add(time.Hour)
+			for _, event := range []*Event{
+				{ID: "now", Operation: "insert", Timestamp: start},
+				{ID: "later", Operation: "insert", Timestamp: start, DelayedUntil: &ready},
+			} {
+				if err := b.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+
+			read := func(at time.Time) []string {
+				t.Helper()
+				clk.Set(at)
+				if _, err := b.PromoteScheduled(); err != nil {
+					t.Fatalf("PromoteScheduled: %v", err)
+				}
+				events, err := b.GetReadyEvents(10, 0)
+				if err != nil {
+					t.Fatalf("GetReadyEvents: %v", err)
+				}
+				return eventIDs(events)
+			}
+
+			if got := read(start); !reflect.DeepEqual(got, []string{"now"}) {
+				t.Errorf("at the start read %v, want [now]", got)
+			}
+			if got := read(ready.Add(-time.Nanosecond)); !reflect.DeepEqual(got, []string{"now"}) {
+				t.Errorf("just before the ready time read %v, want [now]", got)
+			}
+			if got := read(ready); !reflect.DeepEqual(got, []string{"now", "later"}) {
+				t.Errorf("at the ready time read %v, want [now later]", got)
+			}
+		})
+	}
+}
+
+func TestRetryBackoffGrowsWithRetries(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	b := newTestBuffer(t, &Options{Timeout: time.Second, Clock: clk, RetryBackoff: time.Second, MaxRetryBackoff: 10 * time.Second})
+
+	poison := &Event{ID: "poison", Operation: "insert", Timestamp: start}
+	if err := b.Store(poison); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	read := func() []string {
+		t.Helper()
+		events, err := b.GetReadyEvents(10, 0)
+		if err != nil {
+			t.Fatalf("GetReadyEvents: %v", err)
+		}
+		return eventIDs(events)
+	}
+
+	tests := []struct {
+		retries int
+		delay   time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		// Capped at MaxRetryBackoff
+		{5, 10 * time.Second},
+		{9, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if err := b.UpdateRetries(poison, tt.retries); err != nil {
+			t.Fatalf("UpdateRetries: %v", err)
+		}
+		// Fresh events keep flowing while the failed one waits
+		fresh := &Event{ID: fmt.Sprintf("fresh-%d", tt.retries), Operation: "insert", Timestamp: clk.Now()}
+		if err := b.Store(fresh); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+
+		clk.Advance(tt.delay - time.Millisecond)
+		if got := read(); !reflect.DeepEqual(got, []string{fresh.ID}) {
+			t.Fatalf("%d retries, %v after the attempt: read %v, want only %s", tt.retries, tt.delay-time.Millisecond, got, fresh.ID)
+		}
+		clk.Advance(time.Millisecond)
+		if got := read(); !reflect.DeepEqual(got, []string{"poison", fresh.ID}) {
+			t.Fatalf("%d retries, %v after the attempt: read %v, want poison back", tt.retries, tt.delay, got)
+		}
+		if err := b.Delete(fresh); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+	}
+}
+
+func TestReadOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		want  string
+	}{
+		{"", "[urgent e00 e01 e02]"},
+		{ReadFIFO, "[urgent e00 e01 e02]"},
+		// Newest first within each priority; high priority is still first
+		{ReadLIFO, "[urgent e09 e08 e07]"},
+	}
+	for _, tt := range tests {
+		for _, shards := range []int{1, 3} {
+			t.Run(fmt.Sprintf("%q/%d shards", tt.order, shards), func(t *testing.T) {
+				b := newTestBuffer(t, &Options{Timeout: time.Second, Shards: shards, ReadOrder: tt.order})
+				base := time.Now().Add(-time.Minute)
+				for i := 0; i < 10; i++ {
+					event := &Event{ID: fmt.Sprintf("e%02d", i), Operation: "insert", Timestamp: base.Add(time.Duration(i) * time.Millisecond)}
+					if err := b.Store(event); err != nil {
+						t.Fatalf("Store: %v", err)
+					}
+				}
+				urgent := &Event{ID: "urgent", Operation: "insert", Timestamp: base.Add(5 * time.Millisecond), Priority: PriorityHigh}
+				if err := b.Store(urgent); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+
+				events, err := b.GetReadyEvents(4, 0)
+				if err != nil {
+					t.Fatalf("GetReadyEvents: %v", err)
+				}
+				if got := fmt.Sprint(eventIDs(events)); got != tt.want {
+					t.Errorf("read %s, want %s", got, tt.want)
+				}
+			})
+		}
+	}
+
+	if _, err := New(filepath.Join(t.TempDir(), "buffer.db"), &Options{ReadOrder: "random"}); err == nil {
+		t.Error("New accepted read order random")
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	writer, err := New(path, &Options{Timeout: time.Second, Shards: 2})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := writer.CheckWritable(); err != nil {
+		t.Fatalf("CheckWritable on a writable buffer: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	reader, err := New(path, &Options{Timeout: time.Second, Shards: 2, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("read-only open: %v", err)
+	}
+	defer reader.Close()
+	if err := reader.CheckWritable(); err == nil || !strings.Contains(err.Error(), "is not writable") {
+		t.Fatalf("CheckWritable on a read-only buffer = %v, want it not writable", err)
+	}
+}
+
+// storeDocuments stores one event per entry of sizes, each carrying a
+// document padded to that many bytes, and returns their stored sizes.
+func storeDocuments(t *testing.T, b *Buffer, sizes ...int) []int {
+	t.Helper()
+	base := time.Now()
+	for i, size := range sizes {
+		event := &Event{
+			ID:        fmt.Sprintf("doc%02d", i),
+			Operation: "insert",
+			Timestamp: base.Add(time.Duration(i) * time.Microsecond),
+			Data:      map[string]interface{}{"fullDocument": map[string]interface{}{"body": strings.Repeat("x", size)}},
+		}
+		if err := b.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	events, err := b.GetReadyEvents(len(sizes), 0)
+	if err != nil || len(events) != len(sizes) {
+		t.Fatalf("GetReadyEvents = %d events, %v", len(events), err)
+	}
+	stored := make([]int, len(events))
+	for i, event := range events {
+		stored[i] = event.Size()
+	}
+	return stored
+}
+
+func TestReadyEventsBatchLimits(t *testing.T) {
+	const small, large = 10, 10000
+	tests := []struct {
+		name  string
+		docs  []int
+		count int
+		// maxBytes is given in stored events: the sum of the sizes of the
+		// first maxEvents events, plus slack bytes
+		maxEvents int
+		slack     int
+		want      int
+	}{
+		{"small documents hit the count", []int{small, small, small, small, small, small}, 4, 6, 0, 4},
+		{"large documents hit the bytes", []int{large, large, large, large, large, large}, 6, 2, 0, 2},
+		{"bytes stop before a large document", []int{small, small, large, small}, 10, 2, large / 2, 2},
+		{"no byte limit", []int{large, large, large}, 10, 0, 0, 3},
+		{"oversized first event", []int{large, small}, 10, 0, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBuffer(t, nil)
+			sizes := storeDocuments(t, b, tt.docs...)
+			maxBytes := tt.slack
+			for _, size := range sizes[:tt.maxEvents] {
+				maxBytes += size
+			}
+
+			events, err := b.GetReadyEvents(tt.count, maxBytes)
+			if err != nil {
+				t.Fatalf("GetReadyEvents: %v", err)
+			}
+			if len(events) != tt.want {
+				t.Fatalf("read %d events with batchSize %d and maxBytes %d, want %d", len(events), tt.count, maxBytes, tt.want)
+			}
+			total := 0
+			for _, event := range events {
+				total += event.Size()
+			}
+			if maxBytes > 0 && len(events) > 1 && total > maxBytes {
+				t.Errorf("read %d bytes, over maxBytes %d", total, maxBytes)
+			}
+		})
+	}
+
+	// Bulk reads apply both limits to each batch
+	b := newTestBuffer(t, nil)
+	sizes := storeDocuments(t, b, large, large, large, small, small, small, small, small)
+	batches, err := b.GetReadyEventsBulk(3, sizes[0]*2, 3)
+	if err != nil {
+		t.Fatalf("GetReadyEventsBulk: %v", err)
+	}
+	var got []int
+	for _, batch := range batches {
+		got = append(got, len(batch))
+	}
+	if !reflect.DeepEqual(got, []int{2, 3, 3}) {
+		t.Errorf("bulk read batches of %v, want [2 3 3]: two large, then one large with two small, then three small", got)
+	}
+}
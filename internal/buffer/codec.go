@@ -0,0 +1,74 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+)
+
+// Values for Options.Codec, the encoding new records are written with.
+// Records are decoded by their content, so a buffer can hold both and the
+// codec can be changed without migrating it.
+const (
+	// CodecJSON stores events as JSON. Typed BSON values in Data, such as
+	// ObjectIDs, dates and Decimal128, come back as their JSON form, and
+	// numbers as float64.
+	CodecJSON = "json"
+	// CodecBSON stores events as BSON, so typed values in Data come back
+	// with their types. Times in the event's own fields keep millisecond
+	// precision.
+	CodecBSON = "bson"
+)
+
+// bsonRegistry decodes embedded documents and arrays in Data to the same Go
+// types JSON does, so code reading Data does not depend on the codec for
+// anything but scalar types.
+var bsonRegistry = func() *bsoncodec.Registry {
+	reg := bson.NewRegistry()
+	reg.RegisterTypeMapEntry(bson.TypeEmbeddedDocument, reflect.TypeOf(map[string]interface{}{}))
+	reg.RegisterTypeMapEntry(bson.TypeArray, reflect.TypeOf([]interface{}{}))
+	return reg
+}()
+
+func validateCodec(codec string) error {
+	switch codec {
+	case "", CodecJSON, CodecBSON:
+		return nil
+	}
+	return fmt.Errorf("invalid codec %q: must be json or bson", codec)
+}
+
+// encodeEvent encodes event as a record in codec; "" is CodecJSON.
+func encodeEvent(event *Event, codec string) ([]byte, error) {
+	if codec == CodecBSON {
+		return bson.Marshal(event)
+	}
+	return json.Marshal(event)
+}
+
+// unmarshalEvent decodes a record written with either codec.
+func unmarshalEvent(value []byte, event *Event) error {
+	if !isBSON(value) {
+		return json.Unmarshal(value, event)
+	}
+	dec, err := bson.NewDecoder(bsonrw.NewBSONDocumentReader(value))
+	if err != nil {
+		return err
+	}
+	dec.SetRegistry(bsonRegistry)
+	return dec.Decode(event)
+}
+
+// isBSON reports whether value is framed as a BSON document: a little-endian
+// length equal to its own length, and a trailing NUL. A JSON record starts
+// with `{"`, which would be a length of over a gigabyte.
+func isBSON(value []byte) bool {
+	return len(value) >= 5 &&
+		int(binary.LittleEndian.Uint32(value)) == len(value) &&
+		value[len(value)-1] == 0
+}
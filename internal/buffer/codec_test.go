@@ -0,0 +1,156 @@
+package buffer
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// typedEvent returns an event whose data holds the BSON types JSON cannot
+// keep.
+func typedEvent(t *testing.T, id string) *Event {
+	t.Helper()
+	oid, err := primitive.ObjectIDFromHex("65f1c2a4b7e8d9f0a1b2c3d4")
+	if err != nil {
+		t.Fatalf("ObjectIDFromHex: %v", err)
+	}
+	price, err := primitive.ParseDecimal128("19.99")
+	if err != nil {
+		t.Fatalf("ParseDecimal128: %v", err)
+	}
+	return &Event{
+		ID:        id,
+		Operation: "insert",
+		Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC),
+		Data: map[string]interface{}{
+			"fullDocument": map[string]interface{}{
+				"_id":      oid,
+				"placedAt": primitive.NewDateTimeFromTime(time.Date(2024, 5, 1, 11, 59, 0, 0, time.UTC)),
+				"price":    price,
+				"quantity": int32(3),
+				"views":    int64(1) << 40,
+				"tags":     []interface{}{"new", int32(1)},
+			},
+		},
+	}
+}
+
+// readBack stores event in a fresh buffer written with codec, retries it
+// once, and returns what GetReadyEvents reads.
+func readBack(t *testing.T, codec string, event *Event) *Event {
+	t.Helper()
+	b := newTestBuffer(t, &Options{Timeout: time.Second, Codec: codec})
+	if err := b.Store(event); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	// A rewrite keeps the codec's fidelity
+	batch, err := b.GetBatch(1)
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("GetBatch = %v, %v", batch, err)
+	}
+	if err := b.UpdateRetries(batch[0], 1); err != nil {
+		t.Fatalf("UpdateRetries: %v", err)
+	}
+	events, err := b.GetReadyEvents(1, 0)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("GetReadyEvents = %v, %v", events, err)
+	}
+	return events[0]
+}
+
+func TestCodecFidelity(t *testing.T) {
+	want := typedEvent(t, "typed").Data["fullDocument"].(map[string]interface{})
+	tests := []struct {
+		codec string
+		// same lists the fields that come back exactly as stored; the rest
+		// come back as converted
+		same      []string
+		converted map[string]interface{}
+	}{
+		{
+			codec: CodecJSON,
+			converted: map[string]interface{}{
+				"_id":      "65f1c2a4b7e8d9f0a1b2c3d4",
+				"placedAt": "2024-05-01T11:59:00Z",
+				"price":    "19.99",
+				"quantity": float64(3),
+				"views":    float64(1 << 40),
+				"tags":     []interface{}{"new", float64(1)},
+			},
+		},
+		{
+			codec: CodecBSON,
+			same:  []string{"_id", "placedAt", "price", "quantity", "views", "tags"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.codec, func(t *testing.T) {
+			event := readBack(t, tt.codec, typedEvent(t, "typed"))
+			doc, ok := event.Data["fullDocument"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("fullDocument read as %T, want a map with either codec", event.Data["fullDocument"])
+			}
+			for _, field := range tt.same {
+				if !reflect.DeepEqual(doc[field], want[field]) {
+					t.Errorf("%s read as %#v, want %#v", field, doc[field], want[field])
+				}
+			}
+			for field, converted := range tt.converted {
+				if !reflect.DeepEqual(doc[field], converted) {
+					t.Errorf("%s read as %#v, want %#v", field, doc[field], converted)
+				}
+			}
+			if event.ID != "typed" || event.Retries != 1 {
+				t.Errorf("read %s with %d retries, want typed with 1", event.ID, event.Retries)
+			}
+		})
+	}
+
+	// BSON keeps the event's own times to the millisecond
+	event := readBack(t, CodecBSON, typedEvent(t, "typed"))
+	if want := time.Date(2024, 5, 1, 12, 0, 0, 123000000, time.UTC); !event.Timestamp.Equal(want) {
+		t.Errorf("BSON timestamp read as %s, want %s", event.Timestamp, want)
+	}
+}
+
+func TestCodecSwitchReadsBoth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	for i, codec := range []string{CodecJSON, CodecBSON} {
+		b, err := New(path, &Options{Timeout: time.Second, Codec: codec})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		event := typedEvent(t, codec)
+		event.Timestamp = event.Timestamp.Add(time.Duration(i) * time.Hour)
+		if err := b.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if err := b.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	}
+
+	// Reopened with the default codec, both records are read
+	b, err := New(path, &Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer b.Close()
+	events, err := b.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if got := eventIDs(events); !reflect.DeepEqual(got, []string{CodecJSON, CodecBSON}) {
+		t.Fatalf("read %v, want the JSON and the BSON record", got)
+	}
+	if _, ok := events[1].Data["fullDocument"].(map[string]interface{})["_id"].(primitive.ObjectID); !ok {
+		t.Error("BSON record read back without its ObjectID")
+	}
+
+	if err := validateCodec("msgpack"); err == nil {
+		t.Error("validateCodec accepted msgpack")
+	}
+}
@@ -0,0 +1,80 @@
+package buffer
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Values for Options.SyncPolicy, which decides when commits reach disk.
+const (
+	// SyncAlways commits every Store in its own fsynced transaction, so a
+	// stored event survives a power loss as soon as Store returns.
+	SyncAlways = "always"
+	// SyncInterval groups Store calls made at the same time into one
+	// fsynced transaction, waiting at most SyncInterval for others to join.
+	// Durability is that of SyncAlways, since Store only returns once its
+	// transaction is on disk; Store calls wait longer, but concurrent ones
+	// share a single fsync.
+	SyncInterval = "interval"
+	// SyncNever leaves flushing to the OS, like NoSync.
+	SyncNever = "never"
+)
+
+// DefaultSyncInterval is how long a grouped commit waits for more Store
+// calls when Options.SyncInterval is not set.
+const DefaultSyncInterval = 10 * time.Millisecond
+
+// noSync reports whether commits skip fsync under opts.
+func (opts *Options) noSync() bool {
+	return opts.NoSync || opts.SyncPolicy == SyncNever
+}
+
+// groupCommit reports whether stores are grouped into shared transactions
+// under opts.
+func (opts *Options) groupCommit() bool {
+	return opts.SyncPolicy == SyncInterval && !opts.NoSync && !opts.ReadOnly
+}
+
+func validateSyncPolicy(policy string) error {
+	switch policy {
+	case "", SyncAlways, SyncInterval, SyncNever:
+		return nil
+	}
+	return fmt.Errorf("invalid sync policy %q: must be always, interval or never", policy)
+}
+
+// configureGroupCommit sets how db.Batch groups stores: a batch commits once
+// it holds maxSize calls or interval after its first one.
+func configureGroupCommit(db *bbolt.DB, interval time.Duration, maxSize int) {
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	db.MaxBatchDelay = interval
+	db.MaxBatchSize = maxSize
+}
+
+// batchChunked is updateChunked with every chunk committed through db.Batch,
+// so chunks written by concurrent callers share a transaction and its fsync.
+// fn may run more than once for a chunk when another call in the same batch
+// fails, so it must be idempotent.
+func (s *shard) batchChunked(n int, fn func(tx *bbolt.Tx, lo, hi int) error) error {
+	for lo := 0; lo < n; lo += s.chunkSize {
+		hi := min(lo+s.chunkSize, n)
+		if err := s.db.Batch(func(tx *bbolt.Tx) error { return fn(tx, lo, hi) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sync fsyncs every shard that commits without fsync.
+func (b *Buffer) sync() {
+	for i, s := range b.shards {
+		if err := s.db.Sync(); err != nil {
+			log.Printf("Failed to sync buffer shard %d: %v", i, err)
+		}
+	}
+}
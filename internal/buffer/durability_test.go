@@ -0,0 +1,155 @@
+package buffer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// copyFile copies the buffer file at src while it is still open, leaving
+// what a crash at that moment would leave on disk.
+func copyFile(t *testing.T, src, dst string) {
+	t.Helper()
+	in, err := os.Open(src)
+	if err != nil {
+		t.Fatalf("open %s: %v", src, err)
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		t.Fatalf("create %s: %v", dst, err)
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		t.Fatalf("copy %s: %v", src, err)
+	}
+}
+
+func TestIntervalSurvivesCrash(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buffer.db")
+	b, err := New(path, &Options{Timeout: time.Second, SyncPolicy: SyncInterval, SyncInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer b.Close()
+
+	const writers, perWriter = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				event := &Event{ID: fmt.Sprintf("w%d-%d", w, i), Operation: "insert", Timestamp: time.Now()}
+				if err := b.Store(event); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Store: %v", err)
+	}
+
+	// Every Store has returned, so every event must be in the file without
+	// Close having run
+	crashed := filepath.Join(dir, "crashed.db")
+	copyFile(t, path, crashed)
+	recovered, err := New(crashed, nil)
+	if err != nil {
+		t.Fatalf("reopen after crash: %v", err)
+	}
+	defer recovered.Close()
+
+	count, err := recovered.Count()
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if count != writers*perWriter {
+		t.Fatalf("recovered %d events, want %d", count, writers*perWriter)
+	}
+}
+
+// lastTxID returns the ID of the last write transaction committed to the
+// first shard, which goes up by one per commit.
+func lastTxID(t *testing.T, b *Buffer) int {
+	t.Helper()
+	var id int
+	if err := b.shards[0].db.View(func(tx *bbolt.Tx) error {
+		id = tx.ID()
+		return nil
+	}); err != nil {
+		t.Fatalf("View: %v", err)
+	}
+	return id
+}
+
+func TestIntervalGroupsConcurrentStores(t *testing.T) {
+	b := newTestBuffer(t, &Options{Timeout: time.Second, SyncPolicy: SyncInterval, SyncInterval: 50 * time.Millisecond})
+	before := lastTxID(t, b)
+
+	const writers = 10
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.Store(&Event{ID: fmt.Sprintf("w%d", w), Operation: "insert", Timestamp: time.Now()}); err != nil {
+				t.Errorf("Store: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if commits := lastTxID(t, b) - before; commits >= writers {
+		t.Fatalf("%d concurrent stores took %d commits, want them grouped", writers, commits)
+	}
+}
+
+func TestSyncPolicyValidated(t *testing.T) {
+	if _, err := New(filepath.Join(t.TempDir(), "buffer.db"), &Options{SyncPolicy: "sometimes"}); err == nil {
+		t.Fatal("New accepted an unknown sync policy")
+	}
+}
+
+// BenchmarkStoreSyncPolicy compares the sync policies with one writer and
+// with concurrent writers, where interval shares fsyncs between them.
+func BenchmarkStoreSyncPolicy(b *testing.B) {
+	for _, policy := range []string{SyncAlways, SyncInterval, SyncNever} {
+		b.Run(policy+"/serial", func(b *testing.B) {
+			buf := newTestBuffer(b, &Options{Timeout: time.Second, SyncPolicy: policy, SyncInterval: time.Millisecond})
+			now := time.Now()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := buf.Store(&Event{ID: fmt.Sprint(i), Operation: "insert", Timestamp: now}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(policy+"/parallel", func(b *testing.B) {
+			buf := newTestBuffer(b, &Options{Timeout: time.Second, SyncPolicy: policy, SyncInterval: time.Millisecond})
+			now := time.Now()
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := buf.Store(&Event{ID: newULID(now), Operation: "insert", Timestamp: now}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
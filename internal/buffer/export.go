@@ -0,0 +1,123 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"go.etcd.io/bbolt"
+)
+
+// Export writes every pending and dead-lettered event to w as
+// newline-delimited JSON. Each shard is read in a single read transaction, so
+// the output is a consistent snapshot of each file. Dead-lettered events keep
+// their DeadLetterReason, which is how Import tells them apart.
+func (b *Buffer) Export(w io.Writer) (int, error) {
+	names := append(append([]string(nil), queueBuckets...), deadLetterBucket)
+	encoder := json.NewEncoder(w)
+
+	count := 0
+	for _, s := range b.shards {
+		err := s.forEach(names, func(event *Event) error {
+			count++
+			return encoder.Encode(event)
+		})
+		if err != nil {
+			return count, fmt.Errorf("failed to export events: %w", err)
+		}
+	}
+	return count, nil
+}
+
+// Import loads events written by Export, routing each to the bucket and shard
+// it belongs to in this buffer, so the shard count may differ from the
+// exporting one. Events whose key is already present are skipped. Events are
+// written in transactions of up to TxnChunkSize per shard. It returns how many
+// events were imported and skipped.
+func (b *Buffer) Import(r io.Reader) (imported, skipped int, err error) {
+	scanner := bufio.NewScanner(r)
+	// Events carry whole documents, which can exceed the default 64KB
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	pending := make(map[*shard][]*Event)
+	flush := func(s *shard) error {
+		n, dup, err := s.importEvents(pending[s])
+		imported += n
+		skipped += dup
+		pending[s] = pending[s][:0]
+		return err
+	}
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return imported, skipped, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		s := b.shardFor(event.ID)
+		pending[s] = append(pending[s], &event)
+		if len(pending[s]) >= s.chunkSize {
+			if err := flush(s); err != nil {
+				return imported, skipped, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, skipped, fmt.Errorf("failed to read import: %w", err)
+	}
+
+	for s := range pending {
+		if err := flush(s); err != nil {
+			return imported, skipped, err
+		}
+	}
+	return imported, skipped, nil
+}
+
+// importEvents stores events in one transaction, skipping any whose key is
+// already queued or dead-lettered.
+func (s *shard) importEvents(events []*Event) (imported, skipped int, err error) {
+	if len(events) == 0 {
+		return 0, 0, nil
+	}
+
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		imported, skipped = 0, 0
+		deadLetter := tx.Bucket([]byte(deadLetterBucket))
+		for _, event := range events {
+			key := event.bufferKey()
+			if findQueued(tx, key) != nil || deadLetter.Get(key) != nil {
+				skipped++
+				continue
+			}
+
+			data, err := encodeEvent(event, s.codec)
+			if err != nil {
+				return fmt.Errorf("failed to marshal event: %w", err)
+			}
+
+			name := s.bucketFor(event, s.clock.Now())
+			if err := tx.Bucket([]byte(name)).Put(key, data); err != nil {
+				return err
+			}
+			if name != deadLetterBucket {
+				if err := addToIndexes(tx, key, event); err != nil {
+					return err
+				}
+			}
+			imported++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to import events: %w", err)
+	}
+	return imported, skipped, nil
+}
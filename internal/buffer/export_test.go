@@ -0,0 +1,98 @@
+package buffer
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/clock"
+)
+
+// contents returns the events in b, pending or dead-lettered, by ID.
+func contents(t *testing.T, b *Buffer, deadLetter bool) map[string]*Event {
+	t.Helper()
+	events := make(map[string]*Event)
+	if err := b.ForEach(deadLetter, func(event *Event) error {
+		events[event.ID] = event
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	return events
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	src := newTestBuffer(t, &Options{Timeout: time.Second, Clock: clk, ScheduleDelayed: true})
+
+	later := start.Add(time.Hour)
+	ns := map[string]interface{}{"db": "shop", "coll": "orders"}
+	events := []*Event{
+		{ID: "insert", Operation: "insert", Timestamp: start, Data: map[string]interface{}{
+			"ns":           ns,
+			"fullDocument": map[string]interface{}{"_id": "o1", "total": 12.5, "tags": []interface{}{"a", "b"}},
+		}},
+		{ID: "urgent", Operation: "update", Timestamp: start.Add(time.Second), Priority: PriorityHigh, Data: map[string]interface{}{"ns": ns}},
+		{ID: "delayed", Operation: "insert", Timestamp: start.Add(2 * time.Second), DelayedUntil: &later, Data: map[string]interface{}{"ns": ns}},
+		{ID: "retried", Operation: "delete", Timestamp: start.Add(3 * time.Second), Data: map[string]interface{}{"ns": ns}},
+		{ID: "poison", Operation: "insert", Timestamp: start.Add(4 * time.Second), Data: map[string]interface{}{"ns": ns}},
+	}
+	for _, event := range events {
+		if err := src.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	if err := src.UpdateRetries(events[3], 2); err != nil {
+		t.Fatalf("UpdateRetries: %v", err)
+	}
+	if err := src.MarkDelivered(events[3], []string{"webhook-1"}); err != nil {
+		t.Fatalf("MarkDelivered: %v", err)
+	}
+	if err := src.MoveToDeadLetter(events[4], "rejected by the broker"); err != nil {
+		t.Fatalf("MoveToDeadLetter: %v", err)
+	}
+
+	var exported bytes.Buffer
+	n, err := src.Export(&exported)
+	if err != nil || n != len(events) {
+		t.Fatalf("Export = %d, %v; want %d events", n, err, len(events))
+	}
+	dump := exported.Bytes()
+
+	// A fresh database, sharded differently from the source
+	dst := newTestBuffer(t, &Options{Timeout: time.Second, Clock: clk, ScheduleDelayed: true, Shards: 3})
+	imported, skipped, err := dst.Import(bytes.NewReader(dump))
+	if err != nil || imported != len(events) || skipped != 0 {
+		t.Fatalf("Import = %d imported, %d skipped, %v; want %d and 0", imported, skipped, err, len(events))
+	}
+
+	for _, deadLetter := range []bool{false, true} {
+		want, got := contents(t, src, deadLetter), contents(t, dst, deadLetter)
+		if !reflect.DeepEqual(got, want) {
+			var ids []string
+			for id := range got {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			t.Errorf("deadLetter=%v: imported %v, want the exported events unchanged", deadLetter, ids)
+		}
+	}
+
+	// Each event is back in the queue it was exported from
+	ready, err := dst.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if got := eventIDs(ready); !reflect.DeepEqual(got, []string{"urgent", "insert", "retried"}) {
+		t.Errorf("ready after import: %v, want urgent first and delayed held back", got)
+	}
+
+	// Importing the same dump again adds nothing
+	imported, skipped, err = dst.Import(bytes.NewReader(dump))
+	if err != nil || imported != 0 || skipped != len(events) {
+		t.Fatalf("second Import = %d imported, %d skipped, %v; want every event skipped", imported, skipped, err)
+	}
+}
@@ -0,0 +1,324 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Secondary indexes over the queued events. Each entry's key is the indexed
+// value, a 0 byte, a time as big-endian nanoseconds and the event's record
+// key, with an empty value; entries for one value are thus sorted by time and
+// a range is found with a single Seek. Indexes are updated in the same
+// transaction as the queue buckets, and readers skip any entry whose event is
+// gone so a stale one is harmless.
+const (
+	operationIndexBucket  = "index_operation"
+	collectionIndexBucket = "index_collection"
+	// readyTimeIndexBucket indexes delayed events by their ready time, under
+	// an empty value, so PromoteScheduled finds the ready ones with a cursor
+	// instead of decoding every scheduled event.
+	readyTimeIndexBucket = "index_ready_time"
+	// documentIndexBucket indexes events by namespace and documentKey, so
+	// LatestForDocument finds the buffered changes to one document without
+	// scanning the queue.
+	documentIndexBucket = "index_document"
+)
+
+type index struct {
+	bucket string
+	// entry returns the value an event is indexed under and the time its
+	// entry is sorted by; ok is false for events the index leaves out.
+	entry func(*Event) (value string, ts time.Time, ok bool)
+}
+
+var indexes = []index{
+	{operationIndexBucket, func(e *Event) (string, time.Time, bool) { return e.Operation, e.Timestamp, true }},
+	{collectionIndexBucket, func(e *Event) (string, time.Time, bool) { return e.Collection(), e.Timestamp, true }},
+	{readyTimeIndexBucket, func(e *Event) (string, time.Time, bool) {
+		if e.DelayedUntil == nil {
+			return "", time.Time{}, false
+		}
+		return "", *e.DelayedUntil, true
+	}},
+	{documentIndexBucket, func(e *Event) (string, time.Time, bool) {
+		key, ok := e.Data["documentKey"]
+		if !ok || key == nil {
+			return "", time.Time{}, false
+		}
+		ns, _ := e.Data["ns"].(map[string]interface{})
+		db, _ := ns["db"].(string)
+		coll, _ := ns["coll"].(string)
+		value, ok := documentValue(db, coll, key)
+		return value, e.Timestamp, ok
+	}},
+}
+
+// documentValue is the document index value for documentKey in db.coll. The
+// key is compared as JSON, which is how it reads back from the buffer.
+func documentValue(db, coll string, documentKey interface{}) (string, bool) {
+	data, err := json.Marshal(documentKey)
+	if err != nil {
+		return "", false
+	}
+	return db + "." + coll + " " + string(data), true
+}
+
+// Query selects queued events by operation or collection and capture time.
+type Query struct {
+	// Operation and Collection filter on the event's operation type and
+	// source collection. At least one must be set.
+	Operation  string
+	Collection string
+	// From and To bound the event Timestamp; From is inclusive, To
+	// exclusive, and a zero value leaves that side open.
+	From time.Time
+	To   time.Time
+	// Limit caps the number of events returned; 0 returns all matches.
+	Limit int
+}
+
+// Query returns the queued events matching q, oldest first, using the
+// secondary indexes instead of scanning the queue.
+func (b *Buffer) Query(q Query) ([]*Event, error) {
+	if q.Operation == "" && q.Collection == "" {
+		return nil, fmt.Errorf("query needs an operation or a collection")
+	}
+
+	var events []*Event
+	for _, s := range b.shards {
+		found, err := s.query(q)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, found...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp.Before(events[j].Timestamp)
+	})
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, nil
+}
+
+func (s *shard) query(q Query) ([]*Event, error) {
+	// Walk the operation index when it is filtered on, checking the
+	// collection on each event; otherwise walk the collection index.
+	idx, value := indexes[0], q.Operation
+	if q.Operation == "" {
+		idx, value = indexes[1], q.Collection
+	}
+
+	var events []*Event
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(idx.bucket))
+		if bucket == nil {
+			return nil
+		}
+
+		prefix := append([]byte(value), 0)
+		start := indexKey(value, q.From, nil)
+		cursor := bucket.Cursor()
+		for key, _ := cursor.Seek(start); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			rest := key[len(prefix):]
+			if len(rest) < 8 {
+				continue
+			}
+			ts := time.Unix(0, int64(binary.BigEndian.Uint64(rest[:8])))
+			if !q.To.IsZero() && !ts.Before(q.To) {
+				break
+			}
+
+			eventKey := rest[8:]
+			queued := findQueued(tx, eventKey)
+			if queued == nil {
+				continue
+			}
+			event, err := decodeEvent(eventKey, queued.Get(eventKey))
+			if err != nil {
+				continue
+			}
+			if q.Collection != "" && event.Collection() != q.Collection {
+				continue
+			}
+
+			events = append(events, event)
+			if q.Limit > 0 && len(events) >= q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return events, err
+}
+
+// LatestForDocument returns the most recently captured queued event for the
+// document with documentKey in db.coll for which match returns true, or nil
+// if there is none. It reads only that document's entries in the document
+// index. Events buffered before the namespace was recorded are indexed under
+// an empty one and are also considered, as they can only come from the
+// single watched collection.
+func (b *Buffer) LatestForDocument(db, coll string, documentKey interface{}, match func(*Event) bool) (*Event, error) {
+	var values []string
+	for _, ns := range [][2]string{{db, coll}, {"", ""}} {
+		if value, ok := documentValue(ns[0], ns[1], documentKey); ok {
+			values = append(values, value)
+		}
+	}
+
+	var latest *Event
+	for _, s := range b.shards {
+		for _, value := range values {
+			event, err := s.latestIndexed(documentIndexBucket, value, match)
+			if err != nil {
+				return nil, err
+			}
+			if event != nil && (latest == nil || event.Timestamp.After(latest.Timestamp)) {
+				latest = event
+			}
+		}
+	}
+	return latest, nil
+}
+
+// latestIndexed returns the newest queued event indexed under value in
+// bucket for which match returns true.
+func (s *shard) latestIndexed(bucketName, value string, match func(*Event) bool) (*Event, error) {
+	var latest *Event
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(bucketName))
+		if bucket == nil {
+			return nil
+		}
+
+		// Entries are sorted by time, so walk back from the end of the
+		// value's range
+		prefix := append([]byte(value), 0)
+		cursor := bucket.Cursor()
+		key, _ := cursor.Seek(append([]byte(value), 1))
+		if key == nil {
+			key, _ = cursor.Last()
+		} else {
+			key, _ = cursor.Prev()
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Prev() {
+			rest := key[len(prefix):]
+			if len(rest) < 8 {
+				continue
+			}
+			eventKey := rest[8:]
+			queued := findQueued(tx, eventKey)
+			if queued == nil {
+				continue
+			}
+			event, err := decodeEvent(eventKey, queued.Get(eventKey))
+			if err != nil || !match(event) {
+				continue
+			}
+			latest = event
+			return nil
+		}
+		return nil
+	})
+	return latest, err
+}
+
+// indexKey builds an index entry key. A nil eventKey gives the smallest key
+// for value at ts, the start of a range scan.
+func indexKey(value string, ts time.Time, eventKey []byte) []byte {
+	key := make([]byte, 0, len(value)+9+len(eventKey))
+	key = append(key, value...)
+	key = append(key, 0)
+	var nanos uint64
+	if !ts.IsZero() && ts.UnixNano() > 0 {
+		nanos = uint64(ts.UnixNano())
+	}
+	key = binary.BigEndian.AppendUint64(key, nanos)
+	return append(key, eventKey...)
+}
+
+// addToIndexes records a queued event in every index.
+func addToIndexes(tx *bbolt.Tx, key []byte, event *Event) error {
+	for _, idx := range indexes {
+		value, ts, ok := idx.entry(event)
+		if !ok {
+			continue
+		}
+		if err := tx.Bucket([]byte(idx.bucket)).Put(indexKey(value, ts, key), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeFromIndexes drops the index entries of the event stored as value
+// under key. Records that no longer decode were never indexed as they are.
+func removeFromIndexes(tx *bbolt.Tx, key, value []byte) error {
+	event, err := decodeEvent(key, value)
+	if err != nil {
+		return nil
+	}
+	for _, idx := range indexes {
+		value, ts, ok := idx.entry(event)
+		if !ok {
+			continue
+		}
+		if err := tx.Bucket([]byte(idx.bucket)).Delete(indexKey(value, ts, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeIndexEntries drops every index entry pointing at key without the
+// event's record, for records that no longer decode. It walks the whole
+// index, so it is only for rare cases such as quarantine.
+func removeIndexEntries(tx *bbolt.Tx, key []byte) error {
+	for _, idx := range indexes {
+		bucket := tx.Bucket([]byte(idx.bucket))
+		var stale [][]byte
+		err := bucket.ForEach(func(entry, _ []byte) error {
+			if sep := bytes.IndexByte(entry, 0); sep >= 0 && len(entry) >= sep+9 && bytes.Equal(entry[sep+9:], key) {
+				stale = append(stale, append([]byte(nil), entry...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, entry := range stale {
+			if err := bucket.Delete(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rebuildIndexes indexes every queued event. It runs when a shard is opened
+// without index buckets, such as a buffer written by an older version.
+func rebuildIndexes(tx *bbolt.Tx) (int, error) {
+	indexed := 0
+	for _, name := range queueBuckets {
+		err := tx.Bucket([]byte(name)).ForEach(func(key, value []byte) error {
+			event, err := decodeEvent(key, value)
+			if err != nil {
+				// Quarantined on the next read
+				return nil
+			}
+			indexed++
+			return addToIndexes(tx, key, event)
+		})
+		if err != nil {
+			return indexed, err
+		}
+	}
+	return indexed, nil
+}
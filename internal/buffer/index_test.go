@@ -0,0 +1,418 @@
+package buffer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/clock"
+
+	"go.etcd.io/bbolt"
+)
+
+// indexedEvent builds an event from coll with the given operation, captured
+// at ts.
+func indexedEvent(id, operation, coll string, ts time.Time) *Event {
+	return &Event{
+		ID:        id,
+		Operation: operation,
+		Timestamp: ts,
+		Data:      map[string]interface{}{"ns": map[string]interface{}{"db": "app", "coll": coll}},
+	}
+}
+
+// checkIndexes fails the test unless the operation and collection indexes of
+// every shard hold exactly one entry per queued event, and the ready-time
+// index holds none for events that are gone.
+func checkIndexes(t *testing.T, b *Buffer) {
+	t.Helper()
+	for i, s := range b.shards {
+		err := s.db.View(func(tx *bbolt.Tx) error {
+			want := make(map[string]map[string]bool)
+			for _, idx := range indexes {
+				want[idx.bucket] = make(map[string]bool)
+			}
+			for _, name := range queueBuckets {
+				err := tx.Bucket([]byte(name)).ForEach(func(key, value []byte) error {
+					event, err := decodeEvent(key, value)
+					if err != nil {
+						return fmt.Errorf("queued record %s does not decode: %w", key, err)
+					}
+					for _, idx := range indexes {
+						if value, ts, ok := idx.entry(event); ok {
+							want[idx.bucket][string(indexKey(value, ts, key))] = true
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, idx := range indexes {
+				got := make(map[string]bool)
+				err := tx.Bucket([]byte(idx.bucket)).ForEach(func(key, _ []byte) error {
+					got[string(key)] = true
+					if !want[idx.bucket][string(key)] {
+						t.Errorf("shard %d: %s has an entry %q for no queued event", i, idx.bucket, key)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				// Promotion drops ready-time entries of events it moves, so
+				// only the other indexes must cover every queued event
+				if idx.bucket == readyTimeIndexBucket {
+					continue
+				}
+				for key := range want[idx.bucket] {
+					if !got[key] {
+						t.Errorf("shard %d: %s is missing the entry %q", i, idx.bucket, key)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("shard %d: %v", i, err)
+		}
+	}
+}
+
+func queryIDs(t *testing.T, b *Buffer, q Query) []string {
+	t.Helper()
+	events, err := b.Query(q)
+	if err != nil {
+		t.Fatalf("Query(%+v): %v", q, err)
+	}
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func sameIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestQueryRanges(t *testing.T) {
+	for _, shards := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d shards", shards), func(t *testing.T) {
+			b := newTestBuffer(t, &Options{Timeout: time.Second, Shards: shards})
+			base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+
+			for _, event := range []*Event{
+				indexedEvent("e0", "insert", "orders", at(0)),
+				indexedEvent("e1", "delete", "orders", at(1)),
+				indexedEvent("e2", "insert", "users", at(2)),
+				indexedEvent("e3", "delete", "users", at(3)),
+				indexedEvent("e4", "delete", "orders", at(4)),
+				indexedEvent("e5", "update", "orders", at(5)),
+			} {
+				if err := b.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+
+			tests := []struct {
+				name string
+				q    Query
+				want []string
+			}{
+				{"operation", Query{Operation: "delete"}, []string{"e1", "e3", "e4"}},
+				{"collection", Query{Collection: "orders"}, []string{"e0", "e1", "e4", "e5"}},
+				{"both", Query{Operation: "delete", Collection: "orders"}, []string{"e1", "e4"}},
+				{"from is inclusive", Query{Operation: "delete", From: at(3)}, []string{"e3", "e4"}},
+				{"to is exclusive", Query{Operation: "delete", To: at(3)}, []string{"e1"}},
+				{"from and to", Query{Collection: "orders", From: at(1), To: at(5)}, []string{"e1", "e4"}},
+				{"empty range", Query{Collection: "orders", From: at(2), To: at(2)}, []string{}},
+				{"limit keeps the oldest", Query{Collection: "orders", Limit: 2}, []string{"e0", "e1"}},
+				{"unknown value", Query{Operation: "replace"}, []string{}},
+			}
+			for _, tt := range tests {
+				if got := queryIDs(t, b, tt.q); !sameIDs(got, tt.want) {
+					t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				}
+			}
+
+			if _, err := b.Query(Query{From: at(0)}); err == nil {
+				t.Error("Query without an operation or collection succeeded")
+			}
+		})
+	}
+}
+
+func TestIndexesConsistent(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	b := newTestBuffer(t, &Options{Timeout: time.Second, Clock: clk, ScheduleDelayed: true})
+
+	var events []*Event
+	for i := 0; i < 6; i++ {
+		event := indexedEvent(fmt.Sprintf("e%d", i), "insert", "orders", clk.Now().Add(time.Duration(i)*time.Second))
+		if err := b.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		events = append(events, event)
+	}
+	later := clk.Now().Add(time.Hour)
+	delayed := indexedEvent("delayed", "update", "users", clk.Now())
+	delayed.DelayedUntil = &later
+	if err := b.Store(delayed); err != nil {
+		t.Fatalf("Store delayed: %v", err)
+	}
+	checkIndexes(t, b)
+
+	t.Run("delete", func(t *testing.T) {
+		if err := b.Delete(events[0]); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := b.DeleteBatch(events[1:2]); err != nil {
+			t.Fatalf("DeleteBatch: %v", err)
+		}
+		checkIndexes(t, b)
+		if got := queryIDs(t, b, Query{Operation: "insert"}); !sameIDs(got, []string{"e2", "e3", "e4", "e5"}) {
+			t.Fatalf("after deletes Query = %v", got)
+		}
+	})
+
+	t.Run("dead letter and requeue", func(t *testing.T) {
+		if err := b.MoveToDeadLetter(events[2], "test"); err != nil {
+			t.Fatalf("MoveToDeadLetter: %v", err)
+		}
+		checkIndexes(t, b)
+		if got := queryIDs(t, b, Query{Operation: "insert"}); !sameIDs(got, []string{"e3", "e4", "e5"}) {
+			t.Fatalf("after dead-lettering Query = %v", got)
+		}
+
+		if err := b.RequeueDeadLetter(events[2]); err != nil {
+			t.Fatalf("RequeueDeadLetter: %v", err)
+		}
+		checkIndexes(t, b)
+		if got := queryIDs(t, b, Query{Operation: "insert"}); !sameIDs(got, []string{"e2", "e3", "e4", "e5"}) {
+			t.Fatalf("after requeue Query = %v", got)
+		}
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		err := b.shards[0].db.Update(func(tx *bbolt.Tx) error {
+			return tx.Bucket([]byte(eventsBucket)).Put(events[3].bufferKey(), []byte("not an event"))
+		})
+		if err != nil {
+			t.Fatalf("corrupting a record: %v", err)
+		}
+		// Reading runs into the record and quarantines it
+		if _, err := b.GetReadyEvents(100, 0); err != nil {
+			t.Fatalf("GetReadyEvents: %v", err)
+		}
+		checkIndexes(t, b)
+		if got := queryIDs(t, b, Query{Collection: "orders"}); !sameIDs(got, []string{"e2", "e4", "e5"}) {
+			t.Fatalf("after quarantine Query = %v", got)
+		}
+	})
+
+	t.Run("promote", func(t *testing.T) {
+		clk.Advance(2 * time.Hour)
+		if n, err := b.PromoteScheduled(); err != nil || n != 1 {
+			t.Fatalf("PromoteScheduled = %d, %v; want 1", n, err)
+		}
+		checkIndexes(t, b)
+		if got := queryIDs(t, b, Query{Collection: "users"}); !sameIDs(got, []string{"delayed"}) {
+			t.Fatalf("after promotion Query = %v", got)
+		}
+	})
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	b := newTestBuffer(t, nil)
+	for i := 0; i < 5; i++ {
+		if err := b.Store(indexedEvent(fmt.Sprintf("e%d", i), "insert", "orders", time.Now())); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	// Drop the index buckets, as in a buffer written before they existed,
+	// and rebuild them
+	err := b.shards[0].db.Update(func(tx *bbolt.Tx) error {
+		for _, idx := range indexes {
+			if err := tx.DeleteBucket([]byte(idx.bucket)); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte(idx.bucket)); err != nil {
+				return err
+			}
+		}
+		n, err := rebuildIndexes(tx)
+		if n != 5 {
+			return fmt.Errorf("rebuildIndexes indexed %d events, want 5", n)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexes(t, b)
+	if got := queryIDs(t, b, Query{Collection: "orders"}); len(got) != 5 {
+		t.Fatalf("after rebuild Query = %v", got)
+	}
+}
+
+func TestLatestForDocument(t *testing.T) {
+	b := newTestBuffer(t, &Options{Timeout: time.Second, Shards: 3})
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	change := func(id, coll string, key interface{}, status string, minutes int) *Event {
+		event := indexedEvent(id, "update", coll, base.Add(time.Duration(minutes)*time.Minute))
+		event.Data["documentKey"] = map[string]interface{}{"_id": key}
+		event.Data["fullDocument"] = map[string]interface{}{"status": status}
+		if coll == "" {
+			// Buffered before the namespace was recorded
+			delete(event.Data, "ns")
+		}
+		if err := b.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		return event
+	}
+	latest := func(coll string, key interface{}) string {
+		t.Helper()
+		event, err := b.LatestForDocument("app", coll, map[string]interface{}{"_id": key}, func(*Event) bool { return true })
+		if err != nil {
+			t.Fatalf("LatestForDocument: %v", err)
+		}
+		if event == nil {
+			return ""
+		}
+		return event.ID
+	}
+
+	change("a1", "orders", "a", "new", 0)
+	newest := change("a2", "orders", "a", "paid", 2)
+	change("a-other-coll", "users", "a", "active", 3)
+	change("b1", "orders", "b", "new", 1)
+	change("legacy", "", 7, "old", 4)
+	checkIndexes(t, b)
+
+	if got := latest("orders", "a"); got != "a2" {
+		t.Errorf("latest for a = %q, want a2", got)
+	}
+	if got := latest("users", "a"); got != "a-other-coll" {
+		t.Errorf("latest for a in users = %q, want a-other-coll", got)
+	}
+	if got := latest("orders", "missing"); got != "" {
+		t.Errorf("latest for an unbuffered document = %q, want none", got)
+	}
+	// A decoded number matches the key it was stored with
+	if got := latest("orders", 7.0); got != "legacy" {
+		t.Errorf("latest for a legacy event = %q, want legacy", got)
+	}
+
+	if err := b.Delete(newest); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	checkIndexes(t, b)
+	if got := latest("orders", "a"); got != "a1" {
+		t.Errorf("latest for a after deleting a2 = %q, want a1", got)
+	}
+}
+
+// scheduledEvents returns n events captured at now that become ready one
+// second apart from readyAt.
+func scheduledEvents(prefix string, n int, now, readyAt time.Time) []*Event {
+	events := make([]*Event, n)
+	for i := range events {
+		ready := readyAt.Add(time.Duration(i) * time.Second)
+		events[i] = indexedEvent(fmt.Sprintf("%s%04d", prefix, i), "insert", "orders", now)
+		events[i].DelayedUntil = &ready
+	}
+	return events
+}
+
+func TestPromoteScheduledByReadyTime(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	b := newTestBuffer(t, &Options{Timeout: time.Second, Clock: clk, ScheduleDelayed: true, NoSync: true})
+
+	// More far-future events than a 1000-event scan would reach, stored
+	// before the ones that become ready first
+	far := scheduledEvents("far", 1200, clk.Now(), start.Add(24*time.Hour))
+	if err := b.storeBatch(far); err != nil {
+		t.Fatalf("storeBatch: %v", err)
+	}
+	soon := scheduledEvents("soon", 3, clk.Now(), start.Add(time.Minute))
+	if err := b.storeBatch(soon); err != nil {
+		t.Fatalf("storeBatch: %v", err)
+	}
+	checkIndexes(t, b)
+
+	promote := func(want int) {
+		t.Helper()
+		if n, err := b.PromoteScheduled(); err != nil || n != want {
+			t.Fatalf("PromoteScheduled at %s = %d, %v; want %d", clk.Now().Sub(start), n, err, want)
+		}
+	}
+
+	promote(0)
+	clk.Advance(time.Minute)
+	promote(1)
+	events, err := b.GetReadyEvents(100, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if len(events) != 1 || events[0].ID != "soon0000" {
+		t.Fatalf("ready events = %v, want only soon0000", events)
+	}
+
+	// A scheduled event deleted before its time leaves no entry to promote
+	if err := b.Delete(soon[1]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	checkIndexes(t, b)
+	clk.Advance(time.Minute)
+	promote(1)
+
+	clk.Set(start.Add(24*time.Hour + 599*time.Second))
+	promote(600)
+	clk.Advance(time.Hour)
+	promote(600)
+	promote(0)
+	checkIndexes(t, b)
+
+	// Everything but the deleted event is queued
+	want := len(far) + len(soon) - 1
+	if count, err := b.Count(); err != nil || count != want {
+		t.Fatalf("Count = %d, %v; want %d", count, err, want)
+	}
+}
+
+// BenchmarkPromoteScheduled measures a promotion pass when nothing is ready
+// yet, by how many far-future events are scheduled. With the ready-time
+// index it does not grow with the number scheduled.
+func BenchmarkPromoteScheduled(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprintf("scheduled=%d", n), func(b *testing.B) {
+			clk := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+			buf := newTestBuffer(b, &Options{Timeout: time.Second, Clock: clk, ScheduleDelayed: true, NoSync: true})
+			if err := buf.storeBatch(scheduledEvents("far", n, clk.Now(), clk.Now().Add(24*time.Hour))); err != nil {
+				b.Fatalf("storeBatch: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if promoted, err := buf.PromoteScheduled(); err != nil || promoted != 0 {
+					b.Fatalf("PromoteScheduled = %d, %v", promoted, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// CurrentSchemaVersion is the record format Store writes.
+//
+// Version 1 records carry their ULID key and a non-nil Data map. Version 0
+// records were written before versions were kept; they may be stored under a
+// legacy <UnixNano>_<id> key and may have a null Data.
+const CurrentSchemaVersion = 1
+
+// upgradeEvent brings an event decoded from an older record up to
+// CurrentSchemaVersion in memory. It reports whether anything changed. The
+// key is left alone: re-keying a record is only done by Migrate, which can
+// move it in the same transaction.
+func upgradeEvent(event *Event) bool {
+	if event.SchemaVersion >= CurrentSchemaVersion {
+		return false
+	}
+	if event.Data == nil {
+		event.Data = map[string]interface{}{}
+	}
+	event.SchemaVersion = CurrentSchemaVersion
+	return true
+}
+
+// isLegacyKey reports whether key is a <UnixNano>_<id> key rather than a ULID.
+func isLegacyKey(key []byte) bool {
+	return bytes.IndexByte(key, '_') >= 0
+}
+
+// Migrate rewrites every queued and dead-lettered record older than
+// CurrentSchemaVersion in the current format. Events under legacy keys are
+// moved to a ULID key for their capture time, so they sort with events
+// stored since. Records are rewritten in transactions of up to TxnChunkSize.
+// It returns how many records were rewritten.
+func (b *Buffer) Migrate() (int, error) {
+	migrated := 0
+	for _, s := range b.shards {
+		n, err := s.migrate()
+		migrated += n
+		if err != nil {
+			return migrated, fmt.Errorf("failed to migrate buffer: %w", err)
+		}
+	}
+	return migrated, nil
+}
+
+func (s *shard) migrate() (int, error) {
+	migrated := 0
+	names := append(append([]string(nil), queueBuckets...), deadLetterBucket)
+	for _, name := range names {
+		n, err := s.migrateBucket(name)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// migrateBucket rewrites the outdated records of one bucket. Keys are
+// collected in a read transaction first and each record is read again when
+// it is rewritten, so events delivered in between are skipped. Records that
+// do not decode are left for the read path to quarantine.
+func (s *shard) migrateBucket(name string) (int, error) {
+	var outdated [][]byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		// ForEach walks keys in order, so legacy keys are re-keyed oldest
+		// first and keep their relative order within a millisecond.
+		return tx.Bucket([]byte(name)).ForEach(func(key, value []byte) error {
+			if _, ok := outdatedEvent(key, value); ok {
+				outdated = append(outdated, append([]byte(nil), key...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	indexed := name != deadLetterBucket
+	migrated := 0
+	err = s.updateChunked(len(outdated), func(tx *bbolt.Tx, lo, hi int) error {
+		bucket := tx.Bucket([]byte(name))
+		for _, key := range outdated[lo:hi] {
+			value := bucket.Get(key)
+			event, ok := outdatedEvent(key, value)
+			if !ok {
+				continue
+			}
+			// bbolt values are only valid until the bucket is modified
+			value = append([]byte(nil), value...)
+
+			upgradeEvent(event)
+			event.Key = string(key)
+			if isLegacyKey(key) {
+				event.Key = newULID(event.Timestamp)
+			}
+			newKey := []byte(event.Key)
+
+			data, err := encodeEvent(event, s.codec)
+			if err != nil {
+				return fmt.Errorf("failed to marshal event: %w", err)
+			}
+
+			if indexed {
+				if err := removeFromIndexes(tx, key, value); err != nil {
+					return err
+				}
+			}
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			if err := bucket.Put(newKey, data); err != nil {
+				return err
+			}
+			if indexed {
+				if err := addToIndexes(tx, newKey, event); err != nil {
+					return err
+				}
+			}
+			migrated++
+		}
+		return nil
+	})
+	return migrated, err
+}
+
+// outdatedEvent decodes the record stored as value under key without
+// upgrading it, and reports whether Migrate should rewrite it.
+func outdatedEvent(key, value []byte) (*Event, bool) {
+	if value == nil {
+		return nil, false
+	}
+	var event Event
+	if err := unmarshalEvent(value, &event); err != nil {
+		return nil, false
+	}
+	if event.SchemaVersion >= CurrentSchemaVersion && !isLegacyKey(key) {
+		return nil, false
+	}
+	return &event, true
+}
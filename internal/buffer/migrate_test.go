@@ -0,0 +1,113 @@
+package buffer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// putV0 writes a record the way it was stored before schema versions were
+// kept: under a legacy <UnixNano>_<id> key, with no version and null data.
+func putV0(t *testing.T, b *Buffer, bucket, id string, ts time.Time) {
+	t.Helper()
+	record := fmt.Sprintf(`{"id":%q,"operation":"insert","timestamp":%q,"data":null,"retries":0,"delayedUntil":null}`,
+		id, ts.Format(time.RFC3339Nano))
+	if err := b.shards[0].db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put(eventKey(id, ts), []byte(record))
+	}); err != nil {
+		t.Fatalf("put v0 record: %v", err)
+	}
+}
+
+// rawKeys returns the keys stored in bucket.
+func rawKeys(t *testing.T, b *Buffer, bucket string) []string {
+	t.Helper()
+	var keys []string
+	if err := b.shards[0].db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	}); err != nil {
+		t.Fatalf("read keys: %v", err)
+	}
+	return keys
+}
+
+func TestReadUpgradesV0Record(t *testing.T) {
+	b := newTestBuffer(t, &Options{Timeout: time.Second})
+	putV0(t, b, eventsBucket, "old", time.Now().Add(-time.Minute))
+
+	events, err := b.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("read %d events, want the v0 record", len(events))
+	}
+	event := events[0]
+	if event.SchemaVersion != CurrentSchemaVersion || event.Data == nil {
+		t.Errorf("read version %d with data %v, want version %d with empty data", event.SchemaVersion, event.Data, CurrentSchemaVersion)
+	}
+	// Without a stored key the legacy one is derived, so it can be deleted
+	if err := b.Delete(event); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if count, _ := b.Count(); count != 0 {
+		t.Fatalf("Count after Delete = %d, want 0", count)
+	}
+}
+
+func TestMigrateV0Records(t *testing.T) {
+	b := newTestBuffer(t, &Options{Timeout: time.Second})
+	base := time.Now().Add(-time.Hour)
+	putV0(t, b, eventsBucket, "old-2", base.Add(2*time.Millisecond))
+	putV0(t, b, eventsBucket, "old-1", base.Add(time.Millisecond))
+	putV0(t, b, deadLetterBucket, "old-dead", base)
+	// Stored since, so already current
+	if err := b.Store(&Event{ID: "new", Operation: "insert", Timestamp: base.Add(3 * time.Millisecond), Data: map[string]interface{}{}}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	migrated, err := b.Migrate()
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if migrated != 3 {
+		t.Fatalf("Migrate rewrote %d records, want the 3 v0 records", migrated)
+	}
+	for _, bucket := range []string{eventsBucket, deadLetterBucket} {
+		for _, key := range rawKeys(t, b, bucket) {
+			if isLegacyKey([]byte(key)) {
+				t.Errorf("%s still holds legacy key %s", bucket, key)
+			}
+		}
+	}
+
+	// Re-keyed by capture time, they sort with events stored since
+	events, err := b.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if got, want := fmt.Sprint(eventIDs(events)), "[old-1 old-2 new]"; got != want {
+		t.Errorf("read %s after migrating, want %s", got, want)
+	}
+	for _, event := range events {
+		if event.SchemaVersion != CurrentSchemaVersion || event.Data == nil {
+			t.Errorf("%s read as version %d with data %v", event.ID, event.SchemaVersion, event.Data)
+		}
+	}
+	dead := contents(t, b, true)
+	if event, ok := dead["old-dead"]; !ok || event.SchemaVersion != CurrentSchemaVersion {
+		t.Errorf("dead-lettered v0 record read as %+v, want it migrated", event)
+	}
+
+	if migrated, err := b.Migrate(); err != nil || migrated != 0 {
+		t.Errorf("second Migrate = %d, %v; want nothing left to rewrite", migrated, err)
+	}
+	if deleted, err := b.DeleteBatch(events); err != nil || deleted != len(events) {
+		t.Fatalf("DeleteBatch of migrated events = %d, %v; want %d", deleted, err, len(events))
+	}
+}
@@ -0,0 +1,865 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/metrics"
+
+	"go.etcd.io/bbolt"
+)
+
+// shard is a single bbolt file. Each shard has its own write lock, so events
+// routed to different shards can be stored concurrently.
+type shard struct {
+	db              *bbolt.DB
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	// lifo makes scanReady walk each queue bucket newest first.
+	lifo bool
+	// chunkSize caps how many records a bulk write changes per transaction.
+	chunkSize int
+	// scheduleDelayed routes events that are not ready yet to
+	// scheduledBucket; clock decides which those are.
+	scheduleDelayed bool
+	clock           clock.Clock
+	// codec is the encoding records are written with.
+	codec string
+	// onDuplicate is Options.OnDuplicate.
+	onDuplicate string
+	// groupCommit commits stores through db.Batch, for SyncInterval.
+	groupCommit bool
+}
+
+func openShard(path string, opts *Options) (*shard, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout:         opts.Timeout,
+		NoGrowSync:      false,
+		NoFreelistSync:  false,
+		FreelistType:    bbolt.FreelistMapType,
+		ReadOnly:        opts.ReadOnly,
+		MmapFlags:       0,
+		InitialMmapSize: opts.InitialMmapSize,
+		PageSize:        4096,
+		NoSync:          opts.noSync(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open buffer database %s: %w", path, err)
+	}
+
+	if opts.ReadOnly {
+		err = db.View(func(tx *bbolt.Tx) error {
+			if tx.Bucket([]byte(eventsBucket)) == nil {
+				return fmt.Errorf("bucket %s does not exist", eventsBucket)
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("buffer %s is not initialized: %w", path, err)
+		}
+		return newShard(db, opts), nil
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range []string{eventsBucket, priorityBucket, scheduledBucket, deadLetterBucket, checkpointBucket, corruptBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		rebuild := false
+		for _, idx := range indexes {
+			if tx.Bucket([]byte(idx.bucket)) == nil {
+				rebuild = true
+			}
+			if _, err := tx.CreateBucketIfNotExists([]byte(idx.bucket)); err != nil {
+				return err
+			}
+		}
+		if rebuild {
+			indexed, err := rebuildIndexes(tx)
+			if err != nil {
+				return fmt.Errorf("failed to build indexes: %w", err)
+			}
+			if indexed > 0 {
+				log.Printf("Indexed %d buffered events in %s", indexed, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create bucket: %w", err)
+	}
+
+	return newShard(db, opts), nil
+}
+
+func newShard(db *bbolt.DB, opts *Options) *shard {
+	chunkSize := opts.TxnChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultTxnChunkSize
+	}
+	clk := opts.Clock
+	if clk == nil {
+		clk = clock.New()
+	}
+	if opts.groupCommit() {
+		configureGroupCommit(db, opts.SyncInterval, chunkSize)
+	}
+	return &shard{
+		db:              db,
+		retryBackoff:    opts.RetryBackoff,
+		maxRetryBackoff: opts.MaxRetryBackoff,
+		lifo:            opts.ReadOrder == ReadLIFO,
+		chunkSize:       chunkSize,
+		scheduleDelayed: opts.ScheduleDelayed,
+		codec:           opts.Codec,
+		onDuplicate:     opts.OnDuplicate,
+		groupCommit:     opts.groupCommit(),
+		clock:           clk,
+	}
+}
+
+// bucketFor returns the bucket a new event is stored in at now: the
+// dead-letter bucket for one that already has a DeadLetterReason, otherwise
+// its queue bucket.
+func (s *shard) bucketFor(event *Event, now time.Time) string {
+	if event.DeadLetterReason != "" {
+		return deadLetterBucket
+	}
+	if s.scheduleDelayed && event.DelayedUntil != nil && event.DelayedUntil.After(now) {
+		return scheduledBucket
+	}
+	return bucketFor(event)
+}
+
+// updateChunked calls fn for consecutive ranges [lo, hi) of n items, each in
+// its own write transaction of at most chunkSize items. A large bulk write
+// then never holds the write lock or grows the dirty page set for long. Each
+// chunk commits on its own, so an error leaves earlier chunks applied.
+func (s *shard) updateChunked(n int, fn func(tx *bbolt.Tx, lo, hi int) error) error {
+	for lo := 0; lo < n; lo += s.chunkSize {
+		hi := lo + s.chunkSize
+		if hi > n {
+			hi = n
+		}
+		if err := s.db.Update(func(tx *bbolt.Tx) error { return fn(tx, lo, hi) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shard) store(event *Event) error {
+	return s.storeBatch([]*Event{event})
+}
+
+// storeBatch writes events in transactions of up to chunkSize events,
+// assigning a key to any event that has none. With groupCommit the
+// transactions are shared with concurrent stores.
+func (s *shard) storeBatch(events []*Event) error {
+	write := s.updateChunked
+	if s.groupCommit {
+		write = s.batchChunked
+	}
+	return write(len(events), func(tx *bbolt.Tx, lo, hi int) error {
+		now := s.clock.Now()
+		for _, event := range events[lo:hi] {
+			if event.Key == "" {
+				event.Key = newULID(event.Timestamp)
+			}
+			event.SchemaVersion = CurrentSchemaVersion
+			name := s.bucketFor(event, now)
+			bucket := tx.Bucket([]byte(name))
+
+			if err := s.resolveDuplicate(tx, event); err != nil {
+				return err
+			}
+			data, err := encodeEvent(event, s.codec)
+			if err != nil {
+				return fmt.Errorf("failed to marshal event: %w", err)
+			}
+
+			if err := bucket.Put(event.bufferKey(), data); err != nil {
+				return err
+			}
+			if name == deadLetterBucket {
+				continue
+			}
+			if err := addToIndexes(tx, event.bufferKey(), event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// resolveDuplicate applies onDuplicate when event's key already holds a
+// record, removing the stored record or giving event a new key. A record with
+// the same event ID, as left by a retried batch, is simply replaced.
+func (s *shard) resolveDuplicate(tx *bbolt.Tx, event *Event) error {
+	key := event.bufferKey()
+	deadBucket := tx.Bucket([]byte(deadLetterBucket))
+	bucket := findQueued(tx, key)
+	if bucket == nil && deadBucket.Get(key) != nil {
+		bucket = deadBucket
+	}
+	if bucket == nil {
+		return nil
+	}
+
+	old := bucket.Get(key)
+	stored, err := decodeEvent(key, old)
+	if err == nil && stored.ID == event.ID {
+		return s.removeStored(tx, bucket, key, old, bucket != deadBucket)
+	}
+	storedID := "(unreadable)"
+	if err == nil {
+		storedID = stored.ID
+	}
+
+	policy := s.onDuplicate
+	if policy == "" {
+		policy = DuplicateOverwrite
+	}
+	metrics.BufferDuplicateKeys.WithLabelValues(policy).Inc()
+	switch policy {
+	case DuplicateError:
+		return fmt.Errorf("%w: key %s holds event %s, not %s", ErrDuplicateKey, key, storedID, event.ID)
+	case DuplicateRename:
+		for n := 1; ; n++ {
+			renamed := fmt.Sprintf("%s-%d", key, n)
+			if findQueued(tx, []byte(renamed)) == nil && deadBucket.Get([]byte(renamed)) == nil {
+				log.Printf("WARNING: buffer key %s holds event %s, storing event %s as %s", key, storedID, event.ID, renamed)
+				event.Key = renamed
+				return nil
+			}
+		}
+	}
+	log.Printf("WARNING: event %s overwrites event %s under buffer key %s", event.ID, storedID, key)
+	return s.removeStored(tx, bucket, key, old, bucket != deadBucket)
+}
+
+// removeStored deletes the record under key from bucket, with its index
+// entries when the bucket is a queue bucket.
+func (s *shard) removeStored(tx *bbolt.Tx, bucket *bbolt.Bucket, key, value []byte, queued bool) error {
+	if queued {
+		if err := removeFromIndexes(tx, key, value); err != nil {
+			return err
+		}
+	}
+	return bucket.Delete(key)
+}
+
+// decodeEvent decodes a stored event and sets its Key to the key it is
+// actually stored under. Deletes and updates then address that exact record,
+// even for events stored before keys were kept on the event, whose Timestamp
+// may no longer reproduce the derived key after a round trip. Records of
+// an older schema version are upgraded in memory.
+func decodeEvent(key, value []byte) (*Event, error) {
+	var event Event
+	if err := unmarshalEvent(value, &event); err != nil {
+		return nil, err
+	}
+	event.Key = string(key)
+	event.size = len(value)
+	upgradeEvent(&event)
+	return &event, nil
+}
+
+// eventKey is the key events were stored under before they carried their
+// own. It is still used to find such events.
+func eventKey(eventID string, timestamp time.Time) []byte {
+	return []byte(fmt.Sprintf("%d_%s", timestamp.UnixNano(), eventID))
+}
+
+func (s *shard) getBatch(batchSize int) ([]*Event, error) {
+	var events []*Event
+	var corrupt []queuedKey
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		count := 0
+		for _, name := range queueBuckets {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			cursor := bucket.Cursor()
+
+			for key, value := cursor.First(); key != nil && count < batchSize; key, value = cursor.Next() {
+				event, err := decodeEvent(key, value)
+				if err != nil {
+					corrupt = append(corrupt, queuedKey{bucket: name, key: append([]byte(nil), key...)})
+					continue
+				}
+				events = append(events, event)
+				count++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.quarantine(corrupt)
+	return events, nil
+}
+
+// queuedKey identifies a record in one of the queue buckets.
+type queuedKey struct {
+	bucket string
+	key    []byte
+}
+
+// scanReady walks the ready buckets in drain order (high priority first, each
+// oldest first or newest first with ReadLIFO) and passes each ready event to
+// fn until fn returns false. Events are ready once
+// their ready time and retry backoff have passed. Expired events are collected
+// into expired and records that do not decode into corrupt instead of being
+// returned.
+func (s *shard) scanReady(tx *bbolt.Tx, now time.Time, expired, corrupt *[]queuedKey, fn func(*Event) bool) {
+	for _, name := range readyBuckets {
+		bucket := tx.Bucket([]byte(name))
+		if bucket == nil {
+			continue
+		}
+		cursor := bucket.Cursor()
+		first, next := cursor.First, cursor.Next
+		if s.lifo {
+			first, next = cursor.Last, cursor.Prev
+		}
+
+		for key, value := first(); key != nil; key, value = next() {
+			event, err := decodeEvent(key, value)
+			if err != nil {
+				*corrupt = append(*corrupt, queuedKey{bucket: name, key: append([]byte(nil), key...)})
+				continue
+			}
+
+			if event.Expired(now) {
+				*expired = append(*expired, queuedKey{bucket: name, key: append([]byte(nil), key...)})
+				continue
+			}
+
+			if now.Before(event.retryAt(s.retryBackoff, s.maxRetryBackoff)) {
+				continue
+			}
+
+			// Include events that are ready (null delayedUntil or delayedUntil <= now)
+			if event.DelayedUntil == nil ||
+				event.DelayedUntil.Before(now) ||
+				event.DelayedUntil.Equal(now) {
+				if !fn(event) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// readyEvents returns up to limit ready events, and at most maxBytes of them
+// when maxBytes is positive, in drain order and deletes any expired events
+// passed over on the way. Events with at least slowLane retries only fill
+// whatever room fresh events leave. When admit is set, ready events it
+// rejects are skipped and stay buffered.
+func (s *shard) readyEvents(now time.Time, limit, maxBytes, slowLane int, admit func(*Event) bool) ([]*Event, error) {
+	var events []*Event
+	var expired, corrupt []queuedKey
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		// Pre-allocate slice with capacity for better performance
+		events = make([]*Event, 0, limit)
+		var slow []*Event
+		size := 0
+
+		s.scanReady(tx, now, &expired, &corrupt, func(event *Event) bool {
+			if admit != nil && !admit(event) {
+				return true
+			}
+			if slowLane > 0 && event.Retries >= slowLane {
+				if len(slow) < limit {
+					slow = append(slow, event)
+				}
+				return true
+			}
+			if !fitsBytes(size, event.Size(), maxBytes) {
+				return false
+			}
+			events = append(events, event)
+			size += event.Size()
+			return len(events) < limit
+		})
+
+		for _, event := range slow {
+			if len(events) == limit || !fitsBytes(size, event.Size(), maxBytes) {
+				break
+			}
+			events = append(events, event)
+			size += event.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.deleteExpired(expired)
+	s.quarantine(corrupt)
+	return events, nil
+}
+
+// purgeExpired scans the queue buckets and deletes events whose TTL has
+// passed, returning how many were removed.
+func (s *shard) purgeExpired(now time.Time) (int, error) {
+	var expired, corrupt []queuedKey
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range queueBuckets {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			err := bucket.ForEach(func(key, value []byte) error {
+				var event Event
+				if err := unmarshalEvent(value, &event); err != nil {
+					corrupt = append(corrupt, queuedKey{bucket: name, key: append([]byte(nil), key...)})
+					return nil
+				}
+				if event.Expired(now) {
+					expired = append(expired, queuedKey{bucket: name, key: append([]byte(nil), key...)})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.quarantine(corrupt)
+	return s.deleteExpired(expired), nil
+}
+
+// deleteExpired removes expired events found during a read transaction. Keys
+// are collected first because bbolt does not allow writes inside View.
+func (s *shard) deleteExpired(keys []queuedKey) int {
+	if len(keys) == 0 {
+		return 0
+	}
+
+	deleted := 0
+	err := s.updateChunked(len(keys), func(tx *bbolt.Tx, lo, hi int) error {
+		for _, qk := range keys[lo:hi] {
+			bucket := tx.Bucket([]byte(qk.bucket))
+			if err := removeFromIndexes(tx, qk.key, bucket.Get(qk.key)); err != nil {
+				return err
+			}
+			if err := bucket.Delete(qk.key); err != nil {
+				return err
+			}
+		}
+		deleted = hi
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to delete %d expired events: %v", len(keys)-deleted, err)
+	}
+
+	metrics.EventsExpired.Add(float64(deleted))
+	return deleted
+}
+
+// quarantine moves queued records that failed to decode, raw bytes intact, to
+// the corrupt bucket under their original key so they stop being rescanned
+// and can be inspected.
+func (s *shard) quarantine(keys []queuedKey) {
+	if len(keys) == 0 || s.db.IsReadOnly() {
+		return
+	}
+
+	moved := 0
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		corrupt := tx.Bucket([]byte(corruptBucket))
+		for _, qk := range keys {
+			bucket := tx.Bucket([]byte(qk.bucket))
+			value := bucket.Get(qk.key)
+			if value == nil {
+				// Already moved by a concurrent reader
+				continue
+			}
+			if err := corrupt.Put(qk.key, append([]byte(nil), value...)); err != nil {
+				return err
+			}
+			if err := bucket.Delete(qk.key); err != nil {
+				return err
+			}
+			if err := removeIndexEntries(tx, qk.key); err != nil {
+				return err
+			}
+			moved++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to quarantine %d corrupt events: %v", len(keys), err)
+		return
+	}
+
+	if moved > 0 {
+		log.Printf("Quarantined %d corrupt events to the %s bucket", moved, corruptBucket)
+		metrics.EventsCorrupt.Add(float64(moved))
+	}
+}
+
+// findQueued returns the queue bucket holding key, or nil if it is in none.
+func findQueued(tx *bbolt.Tx, key []byte) *bbolt.Bucket {
+	for _, name := range queueBuckets {
+		if bucket := tx.Bucket([]byte(name)); bucket != nil && bucket.Get(key) != nil {
+			return bucket
+		}
+	}
+	return nil
+}
+
+func (s *shard) delete(event *Event) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := event.bufferKey()
+		if bucket := findQueued(tx, key); bucket != nil {
+			if err := removeFromIndexes(tx, key, bucket.Get(key)); err != nil {
+				return err
+			}
+			return bucket.Delete(key)
+		}
+		return ErrEventNotFound
+	})
+}
+
+// deleteBatch removes the queued events in transactions of up to chunkSize
+// events, skipping any that are already gone. It returns how many it removed.
+func (s *shard) deleteBatch(events []*Event) (int, error) {
+	deleted := 0
+	err := s.updateChunked(len(events), func(tx *bbolt.Tx, lo, hi int) error {
+		for _, event := range events[lo:hi] {
+			key := event.bufferKey()
+			bucket := findQueued(tx, key)
+			if bucket == nil {
+				continue
+			}
+			if err := removeFromIndexes(tx, key, bucket.Get(key)); err != nil {
+				return err
+			}
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+func (s *shard) updateRetries(target *Event, retries int, now time.Time) error {
+	return s.update(target, func(event *Event) {
+		event.Retries = retries
+		event.LastAttempt = &now
+	})
+}
+
+func (s *shard) markDelivered(target *Event, sinks []string) error {
+	return s.update(target, func(event *Event) {
+		for _, sink := range sinks {
+			if !event.DeliveredTo(sink) {
+				event.Delivered = append(event.Delivered, sink)
+			}
+		}
+	})
+}
+
+// update applies fn to the stored copy of a queued event.
+func (s *shard) update(target *Event, fn func(*Event)) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := target.bufferKey()
+
+		bucket := findQueued(tx, key)
+		if bucket == nil {
+			return ErrEventNotFound
+		}
+		value := bucket.Get(key)
+
+		event, err := decodeEvent(key, value)
+		if err != nil {
+			return err
+		}
+
+		fn(event)
+		data, err := encodeEvent(event, s.codec)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(key, data)
+	})
+}
+
+func (s *shard) moveToDeadLetter(event *Event, reason string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := event.bufferKey()
+
+		dead := *event
+		dead.DeadLetterReason = reason
+		data, err := encodeEvent(&dead, s.codec)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event: %w", err)
+		}
+
+		if err := tx.Bucket([]byte(deadLetterBucket)).Put(key, data); err != nil {
+			return err
+		}
+		if bucket := findQueued(tx, key); bucket != nil {
+			if err := removeFromIndexes(tx, key, bucket.Get(key)); err != nil {
+				return err
+			}
+			return bucket.Delete(key)
+		}
+		return nil
+	})
+}
+
+func (s *shard) requeueDeadLetter(event *Event) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		key := event.bufferKey()
+
+		deadBucket := tx.Bucket([]byte(deadLetterBucket))
+		if deadBucket.Get(key) == nil {
+			return fmt.Errorf("dead-letter %w", ErrEventNotFound)
+		}
+
+		requeued := *event
+		requeued.Retries = 0
+		requeued.LastAttempt = nil
+		requeued.DeadLetterReason = ""
+		data, err := encodeEvent(&requeued, s.codec)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event: %w", err)
+		}
+
+		if err := tx.Bucket([]byte(s.bucketFor(&requeued, s.clock.Now()))).Put(key, data); err != nil {
+			return err
+		}
+		if err := addToIndexes(tx, key, &requeued); err != nil {
+			return err
+		}
+		return deadBucket.Delete(key)
+	})
+}
+
+func (s *shard) forEach(names []string, fn func(*Event) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range names {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				// Read-only opens of files created before the bucket existed
+				continue
+			}
+			err := bucket.ForEach(func(key, value []byte) error {
+				event, err := decodeEvent(key, value)
+				if err != nil {
+					return nil
+				}
+				return fn(event)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// count returns the number of keys across the named buckets.
+func (s *shard) count(names []string) (int, error) {
+	var count int
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range names {
+			if bucket := tx.Bucket([]byte(name)); bucket != nil {
+				count += bucket.Stats().KeyN
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// oldest returns the capture time of the first event in each queue bucket,
+// whichever is older, or zero when both are empty.
+func (s *shard) oldest() (time.Time, error) {
+	var oldest time.Time
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range queueBuckets {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			key, value := bucket.Cursor().First()
+			if key == nil {
+				continue
+			}
+			event, err := decodeEvent(key, value)
+			if err != nil {
+				// Quarantined on the next read
+				continue
+			}
+			if oldest.IsZero() || event.Timestamp.Before(oldest) {
+				oldest = event.Timestamp
+			}
+		}
+		return nil
+	})
+	return oldest, err
+}
+
+// promoteScheduled moves the events in scheduledBucket that are ready at now
+// to their ready bucket, walking the ready-time index only as far as now.
+// Keys stay the same, so the other indexes need no change. Index entries of
+// events that are no longer scheduled, for instance because they were
+// queued with BUFFER_SCHEDULED_BUCKET off, are dropped on the way.
+func (s *shard) promoteScheduled(now time.Time) (int, error) {
+	type due struct {
+		indexKey []byte
+		queuedKey
+	}
+	var ready []due
+	var corrupt []queuedKey
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		index := tx.Bucket([]byte(readyTimeIndexBucket))
+		scheduled := tx.Bucket([]byte(scheduledBucket))
+		if index == nil || scheduled == nil {
+			return nil
+		}
+		cursor := index.Cursor()
+		for key, _ := cursor.First(); key != nil && len(key) >= 9; key, _ = cursor.Next() {
+			if int64(binary.BigEndian.Uint64(key[1:9])) > now.UnixNano() {
+				break
+			}
+			eventKey := append([]byte(nil), key[9:]...)
+			d := due{indexKey: append([]byte(nil), key...)}
+			if value := scheduled.Get(eventKey); value != nil {
+				event, err := decodeEvent(eventKey, value)
+				if err != nil {
+					corrupt = append(corrupt, queuedKey{bucket: scheduledBucket, key: eventKey})
+					continue
+				}
+				d.queuedKey = queuedKey{bucket: bucketFor(event), key: eventKey}
+			}
+			ready = append(ready, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	s.quarantine(corrupt)
+
+	promoted := 0
+	err = s.updateChunked(len(ready), func(tx *bbolt.Tx, lo, hi int) error {
+		scheduled := tx.Bucket([]byte(scheduledBucket))
+		index := tx.Bucket([]byte(readyTimeIndexBucket))
+		for _, d := range ready[lo:hi] {
+			if err := index.Delete(d.indexKey); err != nil {
+				return err
+			}
+			if d.bucket == "" {
+				continue
+			}
+			value := scheduled.Get(d.key)
+			if value == nil {
+				// Deleted since the scan
+				continue
+			}
+			if err := tx.Bucket([]byte(d.bucket)).Put(d.key, append([]byte(nil), value...)); err != nil {
+				return err
+			}
+			if err := scheduled.Delete(d.key); err != nil {
+				return err
+			}
+			promoted++
+		}
+		return nil
+	})
+	return promoted, err
+}
+
+// recordCheckpoints stores checkpoints under increasing sequence numbers and
+// evicts everything older than the newest max entries.
+func (s *shard) recordCheckpoints(checkpoints []Checkpoint, max int) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(checkpointBucket))
+
+		var seq uint64
+		for i := range checkpoints {
+			var err error
+			if seq, err = bucket.NextSequence(); err != nil {
+				return err
+			}
+			data, err := json.Marshal(&checkpoints[i])
+			if err != nil {
+				return fmt.Errorf("failed to marshal checkpoint: %w", err)
+			}
+			if err := bucket.Put(sequenceKey(seq), data); err != nil {
+				return err
+			}
+		}
+
+		if seq <= uint64(max) {
+			return nil
+		}
+		oldest := sequenceKey(seq - uint64(max))
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil && string(key) <= string(oldest); key, _ = cursor.First() {
+			if err := cursor.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *shard) checkpoints(limit int) ([]Checkpoint, error) {
+	var checkpoints []Checkpoint
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(checkpointBucket))
+		if bucket == nil {
+			return nil
+		}
+		cursor := bucket.Cursor()
+		for key, value := cursor.Last(); key != nil && len(checkpoints) < limit; key, value = cursor.Prev() {
+			var checkpoint Checkpoint
+			if err := json.Unmarshal(value, &checkpoint); err != nil {
+				continue
+			}
+			checkpoints = append(checkpoints, checkpoint)
+		}
+		return nil
+	})
+	return checkpoints, err
+}
+
+// sequenceKey encodes seq big-endian so keys sort in insertion order.
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
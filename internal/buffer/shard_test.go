@@ -0,0 +1,394 @@
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.etcd.io/bbolt"
+)
+
+func TestShardsSpreadAndMerge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "buffer.db")
+	b, err := New(path, &Options{Timeout: time.Second, Shards: 4})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer b.Close()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	const n = 200
+	for i := 0; i < n; i++ {
+		event := &Event{ID: fmt.Sprintf("e%03d", i), Operation: "insert", Timestamp: base.Add(time.Duration(i) * time.Millisecond)}
+		if err := b.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	for i, s := range b.shards {
+		if _, err := os.Stat(ShardPath(path, i, 4)); err != nil {
+			t.Fatalf("shard %d file: %v", i, err)
+		}
+		count, err := s.count(queueBuckets)
+		if err != nil {
+			t.Fatalf("shard %d count: %v", i, err)
+		}
+		if count == 0 {
+			t.Errorf("shard %d holds no events", i)
+		}
+	}
+
+	// Reads merge the shards back into buffered order
+	events, err := b.GetReadyEvents(n, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if len(events) != n {
+		t.Fatalf("read %d events, want %d", len(events), n)
+	}
+	for i, event := range events {
+		if want := fmt.Sprintf("e%03d", i); event.ID != want {
+			t.Fatalf("event %d is %s, want %s", i, event.ID, want)
+		}
+	}
+
+	// Deletes route to the shard the event was stored in
+	if deleted, err := b.DeleteBatch(events); err != nil || deleted != n {
+		t.Fatalf("DeleteBatch = %d, %v; want %d", deleted, err, n)
+	}
+	if count, err := b.Count(); err != nil || count != 0 {
+		t.Fatalf("Count after deleting = %d, %v; want 0", count, err)
+	}
+}
+
+// BenchmarkStoreShards measures concurrent insert throughput by shard count.
+// Each shard has its own write lock, so more shards let more stores commit
+// at once.
+func BenchmarkStoreShards(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			buf := newTestBuffer(b, &Options{Timeout: time.Second, Shards: shards})
+			now := time.Now()
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := buf.Store(&Event{ID: newULID(now), Operation: "insert", Timestamp: now}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestBulkWritesCommitInChunks(t *testing.T) {
+	const n, chunk = 1050, 100
+	// ceil(n/chunk): one transaction per chunk at the least
+	const wantCommits = (n + chunk - 1) / chunk
+
+	src := newTestBuffer(t, &Options{Timeout: time.Second, NoSync: true})
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := make([]*Event, n)
+	for i := range events {
+		events[i] = &Event{ID: fmt.Sprintf("e%04d", i), Operation: "insert", Timestamp: base.Add(time.Duration(i) * time.Millisecond)}
+	}
+	if err := src.storeBatch(events); err != nil {
+		t.Fatalf("storeBatch: %v", err)
+	}
+	var exported bytes.Buffer
+	if _, err := src.Export(&exported); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	b := newTestBuffer(t, &Options{Timeout: time.Second, NoSync: true, TxnChunkSize: chunk})
+	commits := func(name string, fn func() error) {
+		t.Helper()
+		before := lastTxID(t, b)
+		if err := fn(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := lastTxID(t, b) - before; got < wantCommits {
+			t.Errorf("%s of %d events committed %d transactions, want at least %d", name, n, got, wantCommits)
+		}
+	}
+
+	commits("Import", func() error {
+		imported, _, err := b.Import(&exported)
+		if err == nil && imported != n {
+			err = fmt.Errorf("imported %d events", imported)
+		}
+		return err
+	})
+
+	// Mark every record as written before schema versions were kept
+	if err := b.shards[0].db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(eventsBucket))
+		return bucket.ForEach(func(key, value []byte) error {
+			var event Event
+			if err := unmarshalEvent(value, &event); err != nil {
+				return err
+			}
+			event.SchemaVersion = 0
+			data, err := encodeEvent(&event, b.shards[0].codec)
+			if err != nil {
+				return err
+			}
+			return bucket.Put(key, data)
+		})
+	}); err != nil {
+		t.Fatalf("downgrade records: %v", err)
+	}
+	commits("Migrate", func() error {
+		migrated, err := b.Migrate()
+		if err == nil && migrated != n {
+			err = fmt.Errorf("migrated %d records", migrated)
+		}
+		return err
+	})
+
+	var stored []*Event
+	if err := b.ForEach(false, func(event *Event) error {
+		stored = append(stored, event)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	commits("DeleteBatch", func() error {
+		deleted, err := b.DeleteBatch(stored)
+		if err == nil && deleted != n {
+			err = fmt.Errorf("deleted %d events", deleted)
+		}
+		return err
+	})
+	if count, err := b.Count(); err != nil || count != 0 {
+		t.Fatalf("Count after DeleteBatch = %d, %v; want 0", count, err)
+	}
+}
+
+func TestCheckpointRingEvicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "buffer.db")
+	b, err := New(path, &Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	next := 0
+	record := func(n, max int) {
+		t.Helper()
+		var checkpoints []Checkpoint
+		for i := 0; i < n; i++ {
+			checkpoints = append(checkpoints, Checkpoint{EventID: fmt.Sprintf("c%d", next), Offset: int64(next)})
+			next++
+		}
+		if err := b.RecordCheckpoints(checkpoints, max); err != nil {
+			t.Fatalf("RecordCheckpoints: %v", err)
+		}
+	}
+	check := func(limit int, want ...string) {
+		t.Helper()
+		checkpoints, err := b.Checkpoints(limit)
+		if err != nil {
+			t.Fatalf("Checkpoints: %v", err)
+		}
+		var got []string
+		for _, checkpoint := range checkpoints {
+			got = append(got, checkpoint.EventID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Checkpoints(%d) = %v, want %v", limit, got, want)
+		}
+	}
+
+	record(3, 5)
+	check(10, "c2", "c1", "c0")
+	check(2, "c2", "c1")
+
+	// Filling past the limit across calls evicts the oldest
+	record(3, 5)
+	check(10, "c5", "c4", "c3", "c2", "c1")
+
+	// So does a single call larger than the ring
+	record(7, 5)
+	check(10, "c12", "c11", "c10", "c9", "c8")
+
+	// A smaller limit shrinks the ring on the next write
+	record(1, 2)
+	check(10, "c13", "c12")
+
+	// The sequence carries on after a restart, so new checkpoints still sort
+	// newest first and evict the old ones
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if b, err = New(path, &Options{Timeout: time.Second}); err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer b.Close()
+	record(2, 3)
+	check(10, "c15", "c14", "c13")
+}
+
+func TestGarbageIsQuarantined(t *testing.T) {
+	b := newTestBuffer(t, nil)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := b.Store(&Event{ID: fmt.Sprintf("good-%d", i), Operation: "insert", Timestamp: now.Add(time.Duration(i) * time.Millisecond)}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	// Garbage in both ready queues, ordered between the good events
+	garbage := []struct {
+		bucket     string
+		key, value []byte
+	}{
+		{eventsBucket, eventKey("bad-1", now.Add(500*time.Microsecond)), []byte("not an event")},
+		{priorityBucket, eventKey("bad-2", now.Add(1500*time.Microsecond)), []byte{0xff, 0x00, '{'}},
+	}
+	err := b.shards[0].db.Update(func(tx *bbolt.Tx) error {
+		for _, g := range garbage {
+			if err := tx.Bucket([]byte(g.bucket)).Put(g.key, g.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("writing garbage: %v", err)
+	}
+
+	corrupt := func() float64 { return testutil.ToFloat64(metrics.EventsCorrupt) }
+	before := corrupt()
+	events, err := b.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if got := eventIDs(events); !reflect.DeepEqual(got, []string{"good-0", "good-1", "good-2"}) {
+		t.Fatalf("read %v, want the good events around the garbage", got)
+	}
+	if got := corrupt() - before; got != 2 {
+		t.Fatalf("corrupt counter rose by %v, want 2", got)
+	}
+
+	// The raw bytes are kept under their key, and nowhere else
+	err = b.shards[0].db.View(func(tx *bbolt.Tx) error {
+		for _, g := range garbage {
+			if got := tx.Bucket([]byte(corruptBucket)).Get(g.key); !bytes.Equal(got, g.value) {
+				t.Errorf("corrupt bucket holds %q under %q, want %q", got, g.key, g.value)
+			}
+			if tx.Bucket([]byte(g.bucket)).Get(g.key) != nil {
+				t.Errorf("%q still queued in %s", g.key, g.bucket)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+
+	// Later reads no longer run into it
+	if _, err := b.GetReadyEvents(10, 0); err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if got := corrupt() - before; got != 2 {
+		t.Fatalf("corrupt counter rose by %v after rereading, want still 2", got)
+	}
+	if count, _ := b.Count(); count != 3 {
+		t.Fatalf("Count = %d, want the 3 good events", count)
+	}
+}
+
+func TestDuplicateKeyPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		// want lists the events read back after the collision, with their
+		// keys
+		want    string
+		wantErr bool
+		warning string
+	}{
+		{"", "[second@k1]", false, "WARNING: event second overwrites event first under buffer key k1"},
+		{DuplicateOverwrite, "[second@k1]", false, "WARNING: event second overwrites event first under buffer key k1"},
+		{DuplicateError, "[first@k1]", true, ""},
+		{DuplicateRename, "[first@k1 second@k1-1 third@k1-2]", false, "WARNING: buffer key k1 holds event first, storing event second as k1-1"},
+	}
+	for _, tt := range tests {
+		name := tt.policy
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			b := newTestBuffer(t, &Options{Timeout: time.Second, OnDuplicate: tt.policy})
+			now := time.Now()
+			first := &Event{Key: "k1", ID: "first", Operation: "insert", Timestamp: now}
+			if err := b.Store(first); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			// The same event stored again, as by a retried batch, is not a
+			// collision under any policy
+			policy := tt.policy
+			if policy == "" {
+				policy = DuplicateOverwrite
+			}
+			before := testutil.ToFloat64(metrics.BufferDuplicateKeys.WithLabelValues(policy))
+			if err := b.Store(&Event{Key: "k1", ID: "first", Operation: "insert", Timestamp: now}); err != nil {
+				t.Fatalf("Store of the same event: %v", err)
+			}
+			if got := testutil.ToFloat64(metrics.BufferDuplicateKeys.WithLabelValues(policy)); got != before {
+				t.Fatalf("BufferDuplicateKeys grew by %v re-storing the same event, want 0", got-before)
+			}
+
+			var out bytes.Buffer
+			writer := log.Writer()
+			log.SetOutput(&out)
+			err := b.Store(&Event{Key: "k1", ID: "second", Operation: "insert", Timestamp: now})
+			if tt.policy == DuplicateRename && err == nil {
+				err = b.Store(&Event{Key: "k1", ID: "third", Operation: "insert", Timestamp: now})
+			}
+			log.SetOutput(writer)
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrDuplicateKey) {
+					t.Errorf("Store = %v, want ErrDuplicateKey", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if !strings.Contains(out.String(), tt.warning) {
+				t.Errorf("log %q, want %q", out.String(), tt.warning)
+			}
+			collisions := 1.0
+			if tt.policy == DuplicateRename {
+				collisions = 2
+			}
+			if got := testutil.ToFloat64(metrics.BufferDuplicateKeys.WithLabelValues(policy)) - before; got != collisions {
+				t.Errorf("BufferDuplicateKeys{%s} grew by %v, want %v", policy, got, collisions)
+			}
+
+			events, err := b.GetReadyEvents(10, 0)
+			if err != nil {
+				t.Fatalf("GetReadyEvents: %v", err)
+			}
+			var got []string
+			for _, event := range events {
+				got = append(got, event.ID+"@"+event.Key)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("read %v, want %s", got, tt.want)
+			}
+			checkIndexes(t, b)
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package buffer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	gosync "sync"
+	"time"
+
+	"buffered-cdc/internal/metrics"
+)
+
+// spillPattern matches the files a Spill writes. Their names carry the time
+// they were opened, so they sort in the order they were written.
+const spillPattern = "spill-*.jsonl"
+
+// SpillOptions configures a Spill.
+type SpillOptions struct {
+	// Dir holds the spill files. It is created if missing.
+	Dir string
+	// HighWater is the queued event count at which new events start going
+	// to files instead of the buffer.
+	HighWater int
+	// LowWater is the queued event count at or below which spilled events
+	// are loaded back into the buffer.
+	LowWater int
+	// FileBytes is the size after which a spill file is closed and a new
+	// one started. Zero uses 64MB.
+	FileBytes int64
+}
+
+// Spill puts a bound on the buffer's size during a long outage. Once
+// HighWater events are queued, Store appends new events to rotating JSON
+// lines files instead, in the format of Export, and Check loads them back
+// with Import, oldest file first, once the buffer has drained to LowWater.
+// New events keep going to files until every spilled event is back, so
+// events are still buffered in capture order.
+type Spill struct {
+	buffer *Buffer
+	opts   SpillOptions
+
+	mu       gosync.Mutex
+	spilling bool
+	// file is the spill file being written, nil when none is open; size is
+	// how much has been written to it.
+	file *os.File
+	size int64
+}
+
+// NewSpill returns a Spill in front of b. Files left by an earlier run are
+// loaded back like any other, so until they are, new events are spilled too.
+func NewSpill(b *Buffer, opts SpillOptions) (*Spill, error) {
+	if opts.HighWater <= 0 || opts.LowWater < 0 || opts.LowWater >= opts.HighWater {
+		return nil, fmt.Errorf("invalid spill water marks %d/%d: need 0 <= low < high", opts.LowWater, opts.HighWater)
+	}
+	if opts.FileBytes <= 0 {
+		opts.FileBytes = 64 << 20
+	}
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spill directory: %w", err)
+	}
+
+	sp := &Spill{buffer: b, opts: opts}
+	files, err := sp.files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		log.Printf("Found %d spill files in %s; new events are spilled until they are loaded back", len(files), opts.Dir)
+		sp.spilling = true
+	}
+	sp.report(len(files))
+	return sp, nil
+}
+
+// Store writes event to a spill file while spilling and to the buffer with
+// StoreAsync otherwise.
+func (sp *Spill) Store(event *Event) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if !sp.spilling {
+		return sp.buffer.StoreAsync(event)
+	}
+
+	if sp.file == nil {
+		if err := sp.open(); err != nil {
+			return err
+		}
+	}
+	// Keyed now, so the event keeps its place in capture order when it is
+	// loaded back
+	if event.Key == "" {
+		event.Key = newULID(event.Timestamp)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	n, err := sp.file.Write(append(data, '\n'))
+	sp.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write spill file: %w", err)
+	}
+	metrics.EventsSpilled.Inc()
+	if sp.size >= sp.opts.FileBytes {
+		return sp.closeFile()
+	}
+	return nil
+}
+
+// Check starts spilling when the buffer has reached HighWater, and once it
+// has drained to LowWater loads spill files back until it is above LowWater
+// again or none are left.
+func (sp *Spill) Check() error {
+	queued, err := sp.buffer.Count()
+	if err != nil {
+		return err
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if !sp.spilling {
+		if queued >= sp.opts.HighWater {
+			log.Printf("WARNING: %d events buffered, at the spill high-water mark of %d; spilling new events to %s", queued, sp.opts.HighWater, sp.opts.Dir)
+			sp.spilling = true
+			metrics.SpillActive.Set(1)
+		}
+		return nil
+	}
+
+	for queued <= sp.opts.LowWater {
+		files, err := sp.files()
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			log.Printf("Spilled events loaded back; storing new events in the buffer again")
+			sp.spilling = false
+			sp.report(0)
+			return nil
+		}
+		// The open file is the newest, so it is finished once it is the
+		// only one left
+		if sp.file != nil && files[0] == sp.file.Name() {
+			if err := sp.closeFile(); err != nil {
+				return err
+			}
+		}
+		n, err := sp.reingest(files[0])
+		if err != nil {
+			return err
+		}
+		queued += n
+		sp.report(len(files) - 1)
+	}
+	return nil
+}
+
+// Run calls Check every interval until ctx is done.
+func (sp *Spill) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := sp.Check(); err != nil {
+				log.Printf("Failed to check buffer spill: %v", err)
+			}
+		}
+	}
+}
+
+// Close syncs and closes the open spill file. Spilled events stay on disk
+// for the next start.
+func (sp *Spill) Close() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.closeFile()
+}
+
+// reingest imports the spill file at path into the buffer and removes it,
+// returning how many events it held. A file that cannot be read to the end,
+// such as one cut short by a crash, is renamed with a .failed suffix so it
+// does not hold up the rest; what could be read is imported.
+func (sp *Spill) reingest(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open spill file: %w", err)
+	}
+	imported, skipped, err := sp.buffer.Import(f)
+	f.Close()
+	metrics.EventsReingested.Add(float64(imported))
+	if err != nil {
+		log.Printf("WARNING: failed to load spill file %s back after %d events, renaming it to %s.failed: %v", path, imported, path, err)
+		if err := os.Rename(path, path+".failed"); err != nil {
+			return imported, fmt.Errorf("failed to set aside spill file: %w", err)
+		}
+		return imported, nil
+	}
+	log.Printf("Loaded %d spilled events back from %s (%d already buffered)", imported, path, skipped)
+	if err := os.Remove(path); err != nil {
+		return imported, fmt.Errorf("failed to remove spill file: %w", err)
+	}
+	return imported, nil
+}
+
+// open starts a new spill file.
+func (sp *Spill) open() error {
+	name := filepath.Join(sp.opts.Dir, fmt.Sprintf("spill-%020d.jsonl", time.Now().UnixNano()))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create spill file: %w", err)
+	}
+	sp.file, sp.size = f, 0
+	return nil
+}
+
+// closeFile syncs and closes the open spill file, if any.
+func (sp *Spill) closeFile() error {
+	if sp.file == nil {
+		return nil
+	}
+	f := sp.file
+	sp.file = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync spill file: %w", err)
+	}
+	return f.Close()
+}
+
+// files returns the spill files in the order they were written.
+func (sp *Spill) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(sp.opts.Dir, spillPattern))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// report updates the spill gauges.
+func (sp *Spill) report(files int) {
+	active := 0.0
+	if sp.spilling {
+		active = 1
+	}
+	metrics.SpillActive.Set(active)
+	metrics.SpillFiles.Set(float64(files))
+}
@@ -0,0 +1,118 @@
+package buffer
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpillRoundTrip(t *testing.T) {
+	b := newTestBuffer(t, &Options{Timeout: time.Second, NoSync: true})
+	dir := t.TempDir()
+	sp, err := NewSpill(b, SpillOptions{Dir: dir, HighWater: 20, LowWater: 5, FileBytes: 2048})
+	if err != nil {
+		t.Fatalf("NewSpill: %v", err)
+	}
+	defer sp.Close()
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	stored := 0
+	store := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			event := &Event{ID: fmt.Sprintf("e%04d", stored), Operation: "insert", Timestamp: base.Add(time.Duration(stored) * time.Millisecond)}
+			if err := sp.Store(event); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			stored++
+		}
+	}
+	spillFiles := func() []string {
+		t.Helper()
+		files, err := filepath.Glob(filepath.Join(dir, spillPattern))
+		if err != nil {
+			t.Fatalf("Glob: %v", err)
+		}
+		return files
+	}
+	count := func() int {
+		t.Helper()
+		n, err := b.Count()
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		return n
+	}
+
+	// seen counts how often each event was read out of the buffer
+	seen := make(map[string]int)
+	var order []string
+	drain := func(to int) {
+		t.Helper()
+		for count() > to {
+			events, err := b.GetReadyEvents(count()-to, 0)
+			if err != nil {
+				t.Fatalf("GetReadyEvents: %v", err)
+			}
+			for _, event := range events {
+				seen[event.ID]++
+				order = append(order, event.ID)
+			}
+			if _, err := b.DeleteBatch(events); err != nil {
+				t.Fatalf("DeleteBatch: %v", err)
+			}
+		}
+	}
+
+	for cycle := 0; cycle < 2; cycle++ {
+		store(20)
+		if err := sp.Check(); err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		// Past the high-water mark, new events go to files
+		store(60)
+		if n := count(); n != 20 {
+			t.Fatalf("cycle %d: buffer holds %d events while spilling, want 20", cycle, n)
+		}
+		if files := spillFiles(); len(files) < 2 {
+			t.Fatalf("cycle %d: %d spill files, want the 2KB limit to rotate them", cycle, len(files))
+		}
+
+		// Draining to the low-water mark loads files back until the
+		// buffer is above it again, until none are left
+		for rounds := 0; len(spillFiles()) > 0; rounds++ {
+			if rounds > 100 {
+				t.Fatalf("cycle %d: spill files never loaded back", cycle)
+			}
+			drain(5)
+			if err := sp.Check(); err != nil {
+				t.Fatalf("Check: %v", err)
+			}
+		}
+		// Loaded back in full; the next check stops spilling
+		drain(0)
+		if err := sp.Check(); err != nil {
+			t.Fatalf("Check: %v", err)
+		}
+		store(1)
+		if n := count(); n != 1 || len(spillFiles()) != 0 {
+			t.Fatalf("cycle %d: after reingesting, a new event went to a file", cycle)
+		}
+		drain(0)
+	}
+
+	if len(seen) != stored {
+		t.Fatalf("read %d distinct events back, want all %d stored", len(seen), stored)
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("event %s read %d times, want once", id, n)
+		}
+	}
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			t.Fatalf("event %s read after %s, out of capture order", order[i], order[i-1])
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package buffer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	gosync "sync"
+	"time"
+)
+
+// crockford is the Crockford base32 alphabet ULIDs are written in. It sorts in
+// ASCII order, so the string form sorts like the underlying bytes.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulids keeps the last ULID so ones generated within the same millisecond
+// can be made strictly increasing.
+var ulids struct {
+	mu   gosync.Mutex
+	last [16]byte
+}
+
+// newULID returns a ULID for t: a 48-bit millisecond timestamp followed by 80
+// random bits, written as 26 characters that sort by time. Within one
+// millisecond the random part of the previous ULID is incremented instead of
+// drawn again, so ULIDs from this process also sort in creation order.
+func newULID(t time.Time) string {
+	var head [16]byte
+	putULIDTime(&head, uint64(t.UnixMilli()))
+	return nextULID(head, 6)
+}
+
+// ClusterKey returns a buffer key for an event that happened at the MongoDB
+// cluster time (seconds, increment). It is a ULID whose timestamp is the
+// cluster time's second and whose first 32 random bits are the increment, so
+// keys sort in cluster time order however late the event is stored. Keys
+// made one after another for the same cluster time, as for the operations of
+// one transaction, sort in the order they were made. Set it as Event.Key
+// before Store.
+func ClusterKey(seconds, increment uint32) string {
+	var head [16]byte
+	putULIDTime(&head, uint64(seconds)*1000)
+	binary.BigEndian.PutUint32(head[6:10], increment)
+	return nextULID(head, 10)
+}
+
+func putULIDTime(id *[16]byte, ms uint64) {
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+}
+
+// nextULID returns a ULID starting with the first fixed bytes of head and
+// random bits after them. When the previous ULID started with the same bytes
+// its random part is incremented instead, keeping the order of creation.
+func nextULID(head [16]byte, fixed int) string {
+	ulids.mu.Lock()
+	defer ulids.mu.Unlock()
+
+	id := head
+	if !(bytes.Equal(head[:fixed], ulids.last[:fixed]) && increment(&ulids.last, fixed)) {
+		if _, err := rand.Read(id[fixed:]); err != nil {
+			// crypto/rand does not fail on supported platforms
+			panic(err)
+		}
+		ulids.last = id
+	}
+	return encodeULID(ulids.last)
+}
+
+// increment adds one to the bytes of id from index from on, reporting false
+// if they overflowed.
+func increment(id *[16]byte, from int) bool {
+	for i := 15; i >= from; i-- {
+		id[i]++
+		if id[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeULID writes the 128 bits of id as 26 base32 characters, the first of
+// which carries only 3 bits.
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,178 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"math/big"
+	"sort"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// ulidValue returns the 128-bit value a ULID string encodes.
+func ulidValue(t *testing.T, id string) *big.Int {
+	t.Helper()
+	if len(id) != 26 {
+		t.Fatalf("ULID %q has %d characters, want 26", id, len(id))
+	}
+	v := new(big.Int)
+	for _, c := range id {
+		digit := strings.IndexRune(crockford, c)
+		if digit < 0 {
+			t.Fatalf("ULID %q has %q outside the Crockford alphabet", id, c)
+		}
+		v.Lsh(v, 5).Or(v, big.NewInt(int64(digit)))
+	}
+	return v
+}
+
+func TestULIDSortsByTime(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	offsets := []time.Duration{0, time.Millisecond, time.Second, time.Hour, 24 * time.Hour, 10 * 365 * 24 * time.Hour}
+
+	var ids []string
+	for _, offset := range offsets {
+		at := base.Add(offset)
+		id := newULID(at)
+		value := ulidValue(t, id)
+		if ms := new(big.Int).Rsh(value, 80).Uint64(); ms != uint64(at.UnixMilli()) {
+			t.Fatalf("ULID %s carries time %d, want %d", id, ms, at.UnixMilli())
+		}
+		ids = append(ids, id)
+	}
+	if !sort.StringsAreSorted(ids) {
+		t.Fatalf("ULIDs %v do not sort in time order", ids)
+	}
+
+	// Generated out of order, they still sort by their times
+	earlier := newULID(base.Add(-time.Millisecond))
+	if earlier >= ids[0] {
+		t.Fatalf("ULID %s for an earlier time sorts after %s", earlier, ids[0])
+	}
+}
+
+func TestULIDIncrementsWithinMillisecond(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	previous := ulidValue(t, newULID(at))
+	one := big.NewInt(1)
+	for i := 0; i < 100; i++ {
+		value := ulidValue(t, newULID(at.Add(time.Duration(i)*time.Microsecond)))
+		if want := new(big.Int).Add(previous, one); value.Cmp(want) != 0 {
+			t.Fatalf("ULID %d in the same millisecond is %x, want the previous one plus 1 (%x)", i, value, want)
+		}
+		previous = value
+	}
+}
+
+func TestULIDIncrementOverflow(t *testing.T) {
+	var id [16]byte
+	for i := 6; i < 16; i++ {
+		id[i] = 0xff
+	}
+	if increment(&id, 6) {
+		t.Fatal("incrementing an all-ones random part did not report the overflow")
+	}
+
+	id = [16]byte{}
+	binary.BigEndian.PutUint16(id[14:], 0x00ff)
+	if !increment(&id, 6) || id[14] != 1 || id[15] != 0 {
+		t.Fatalf("increment carried to %x, want ...0100", id[14:])
+	}
+}
+
+func TestULIDUniqueUnderConcurrency(t *testing.T) {
+	const goroutines, each = 8, 2000
+	at := time.Now()
+	var mu gosync.Mutex
+	seen := make(map[string]bool, goroutines*each)
+	var wg gosync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids := make([]string, each)
+			for i := range ids {
+				// All at the same instant, the worst case for collisions
+				ids[i] = newULID(at)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range ids {
+				if seen[id] {
+					t.Errorf("ULID %s generated twice", id)
+				}
+				seen[id] = true
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != goroutines*each {
+		t.Fatalf("%d unique ULIDs, want %d", len(seen), goroutines*each)
+	}
+}
+
+func TestDeleteByStoredKey(t *testing.T) {
+	b := newTestBuffer(t, nil)
+	event := &Event{ID: "e1", Operation: "insert", Timestamp: time.Now()}
+	if err := b.Store(event); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	// The record is found by its key, not rederived from the timestamp
+	event.Timestamp = event.Timestamp.Add(time.Hour)
+	if err := b.UpdateRetries(event, 1); err != nil {
+		t.Fatalf("UpdateRetries after the timestamp changed: %v", err)
+	}
+	if err := b.Delete(event); err != nil {
+		t.Fatalf("Delete after the timestamp changed: %v", err)
+	}
+	if count, _ := b.Count(); count != 0 {
+		t.Fatalf("Count = %d after Delete, want 0", count)
+	}
+}
+
+func TestClusterKeySortsByClusterTime(t *testing.T) {
+	type clusterTime struct{ seconds, increment uint32 }
+	// Made out of cluster time order, as after a reconnect
+	times := []clusterTime{{1714564800, 7}, {1714564799, 900}, {1714564800, 2}, {1714564800, 2}, {1714564801, 0}}
+	keys := make([]string, len(times))
+	for i, ct := range times {
+		keys[i] = ClusterKey(ct.seconds, ct.increment)
+		v := ulidValue(t, keys[i])
+		if ms := v.Rsh(v, 80).Uint64(); ms != uint64(ct.seconds)*1000 {
+			t.Errorf("key %s carries %d ms, want the cluster time's second", keys[i], ms)
+		}
+	}
+
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	// The two keys made one after another for the same cluster time keep
+	// the order they were made
+	want := []string{keys[1], keys[2], keys[3], keys[0], keys[4]}
+	for i := range want {
+		if sorted[i] != want[i] {
+			t.Fatalf("keys sort as %v, want cluster time order %v", sorted, want)
+		}
+	}
+
+	// Stored with these keys, events are read in cluster time order
+	b := newTestBuffer(t, nil)
+	now := time.Now()
+	for i, key := range keys {
+		if err := b.Store(&Event{ID: strings.Repeat("x", i+1), Key: key, Operation: "insert", Timestamp: now.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	events, err := b.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	var got []string
+	for _, event := range events {
+		got = append(got, event.Key)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("read keys %v, want %v", got, want)
+	}
+}
@@ -1,16 +1,77 @@
 package config
 
 import (
-	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// DefaultReadyTimeField is the document field MONGODB_READY_TIME_FIELD
+// names unless it is set. The load test writes delayed messages' ready time
+// there by default.
+const DefaultReadyTimeField = "delayedUntil"
+
 type Config struct {
-	MongoDB MongoDBConfig
-	Kafka   KafkaConfig
-	Buffer  BufferConfig
-	Monitor MonitorConfig
+	Source    SourceConfig
+	Capture   CaptureConfig
+	MongoDB   MongoDBConfig
+	Kafka     KafkaConfig
+	Buffer    BufferConfig
+	Monitor   MonitorConfig
+	Admin     AdminConfig
+	Service   ServiceConfig
+	Scheduler SchedulerConfig
+	Sinks     SinkConfig
+	Health    HealthConfig
+	Sync      SyncConfig
+	ClaimCheck ClaimCheckConfig
+	Log       LogConfig
+
+	// env records how the environment was read, for Validate.
+	env envReport
+}
+
+// SyncConfig bounds the work the sync worker takes on in one pass.
+type SyncConfig struct {
+	MaxInflightBatches int
+	MaxInflightBytes   int
+	// RetryRate is how many previously failed events per second may be
+	// sent again, across all events; 0 is unlimited. RetryBurst is the
+	// bucket size.
+	RetryRate  float64
+	RetryBurst int
+	// TenantField is a dotted path into fullDocument naming the tenant of
+	// an event; empty disables per-tenant limits. Every tenant may send
+	// TenantRate events per second, or its TenantRates entry
+	// (tenant=rate), with bursts of TenantBurst.
+	TenantField string
+	TenantRate  float64
+	TenantBurst int
+	TenantRates []string
+	// BatchesPerTick is how many batches the sync worker sends each second.
+	BatchesPerTick int
+	// LagSource enables the consumer lag throttle: kafka reads the
+	// committed offsets of LagGroups, admin takes reports to POST
+	// /sync/lag. Above LagThreshold messages of lag one batch is sent per
+	// tick; at LagPause (0 never) none are.
+	LagSource    string
+	LagGroups    []string
+	LagThreshold int
+	LagPause     int
+	LagInterval  time.Duration
+}
+
+// SourceConfig selects where changes are captured from.
+type SourceConfig struct {
+	Type string
+}
+
+// CaptureConfig guards against pathological documents at capture: events
+// whose data encodes to more than MaxDocBytes (0 is unlimited) are
+// dead-lettered or reduced to a reference, per OversizePolicy.
+type CaptureConfig struct {
+	MaxDocBytes    int
+	OversizePolicy string
 }
 
 type MongoDBConfig struct {
@@ -19,13 +80,46 @@ type MongoDBConfig struct {
 	Collection     string
 	MaxPoolSize    int
 	MinPoolSize    int
+	// MaxIdleTime has no driver equivalent and is not applied; the pool's
+	// idle limit is MaxConnIdleTime.
 	MaxIdleTime    time.Duration
 	MaxConnIdleTime time.Duration
+	IgnoreOperations []string
+	PriorityField      string
+	PriorityOperations []string
+	ReadyTimeField     string
+	// DelayThreshold is how far in the future a ready time must be for its
+	// event to be delayed; DelayThresholds overrides it per collection.
+	DelayThreshold     time.Duration
+	DelayThresholds    []string
+	// MaxScheduleHorizon is how far in the future a ready time may be;
+	// events due later are dead-lettered at capture. 0 allows any.
+	MaxScheduleHorizon time.Duration
+	DeleteLookup       string
+	FullDocument       string
+	MissingDocument    string
+	ConnectRetries     int
+	ConnectBackoff     time.Duration
+	ConnectTimeout     time.Duration
+	ServerSelectionTimeout time.Duration
+	Snapshot               bool
+	SnapshotBatchSize      int
+	WatchScope             string
+	OnInvalidate           string
 }
 
 type KafkaConfig struct {
 	Brokers          []string
+	// Clusters names further Kafka clusters every event is published to as
+	// well, with their brokers in ClusterBrokers. ReplicationPolicy decides
+	// which of them must acknowledge an event before it leaves the buffer.
+	Clusters          []string
+	ClusterBrokers    map[string][]string
+	ReplicationPolicy string
 	Topic            string
+	// TopicPrefix is prepended to the topic, joined with a dot.
+	TopicPrefix         string
+	TopicFromCollection bool
 	Retries          int
 	Timeout          time.Duration
 	BatchSize        int
@@ -33,25 +127,207 @@ type KafkaConfig struct {
 	CompressionType  string
 	MaxMessageBytes  int
 	Acks             int
+	// DLQAcks is the acks setting of the DLQ topic writer, KAFKA_ACKS by
+	// default.
+	DLQAcks          int
+	AllowUnsafeAcks  bool
+	KeyTemplate      string
+	// Balancer is how messages are spread across partitions when neither
+	// PreserveOrder nor StrictOrder is set.
+	Balancer         string
+	PreserveOrder    bool
+	StrictOrder      bool
+	DeleteTombstone  bool
+	// CoalesceBatch writes only the last change to each document in a
+	// batch, unless a delete comes between.
+	CoalesceBatch    bool
+	// Async writes without waiting for acknowledgements, deleting or
+	// retrying each event from the writer's completion callback. At most
+	// AsyncMaxPending events are in flight.
+	Async            bool
+	AsyncMaxPending  int
+	RetryHeader      string
+	// SigningKey is the HMAC secret messages are signed with; empty
+	// disables signing. SigningKeyID names it in a header for rotation.
+	SigningKey       string
+	SigningKeyID     string
+	// SlowWriteThreshold is the write duration above which a batch is
+	// logged with its event IDs; 0 disables it.
+	SlowWriteThreshold time.Duration
+	CreateTopic      bool
+	TopicPartitions  int
+	TopicReplication int
+	MessageTime      string
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+	JSONMode         string
+	ClientID         string
+	DLQTopic         string
+	LogLevel         string
 }
 
 type BufferConfig struct {
 	Path            string
 	BatchSize       int
+	// MaxBatchBytes ends a batch read for syncing before its stored size
+	// exceeds it; 0 limits batches by BatchSize alone.
+	MaxBatchBytes   int
 	FlushInterval   time.Duration
 	MaxBufferSize   int
+	AsyncWrites     bool
+	SyncPolicy      string
+	SyncInterval    time.Duration
 	ConcurrentReads int
+	OpenTimeout     time.Duration
+	NoSync          bool
+	InitialMmapSize int
+	EventTTL        time.Duration
+	Shards          int
+	CheckpointSize  int
+	SlowLaneRetries int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	AutoMigrate     bool
+	ReadOrder       string
+	TxnChunkSize    int
+	ScheduleDelayed bool
+	Codec           string
+	KeyTime         string
+	// OnDuplicate is what Store does when an event's key already holds a
+	// different event: overwrite, error or rename.
+	OnDuplicate     string
+	// SpillDir, when set, receives new events in JSON lines files once
+	// SpillHighWater events are queued; they are loaded back once the
+	// buffer has drained to SpillLowWater.
+	SpillDir        string
+	SpillHighWater  int
+	SpillLowWater   int
+	SpillFileBytes  int
+	SpillInterval   time.Duration
+	// MaxRedeliveries is how many failed syncs pinned on an event, rather
+	// than on an outage, it may have before it is dead-lettered; 0 retries
+	// forever.
+	MaxRedeliveries int
 }
 
 type MonitorConfig struct {
 	Interval        time.Duration
+	// InitialInterval is the probe interval used until Kafka is first
+	// reachable, so startup does not wait a full Interval.
+	InitialInterval time.Duration
 	ConnectTimeout  time.Duration
 	MaxRetries      int
 	BackoffInterval time.Duration
+	// OnlineThreshold and OfflineThreshold are the consecutive probe results
+	// needed before the connectivity status changes.
+	OnlineThreshold  int
+	OfflineThreshold int
+	ProbeKafka       bool
+	ProbeTargets     []string
+	ProbeMode        string
+}
+
+type AdminConfig struct {
+	Addr string
+}
+
+type ServiceConfig struct {
+	MaxRestarts       int
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+	RestartWindow     time.Duration
+	MaxWorkers        int
+	// Preflight checks MongoDB, Kafka and the buffer before starting, each
+	// check bounded by PreflightTimeout.
+	Preflight        bool
+	PreflightTimeout time.Duration
+	// Shutdown stops the source, the scheduler, the sync worker and the
+	// buffer in turn, each within its timeout. DrainTimeout bounds sending
+	// the ready events left in the buffer; 0 skips it.
+	StopSourceTimeout    time.Duration
+	StopSchedulerTimeout time.Duration
+	DrainTimeout         time.Duration
+	StopBufferTimeout    time.Duration
+}
+
+// LogConfig thins out the lines logged for every event or batch.
+type LogConfig struct {
+	// SampleRate logs one in SampleRate of those lines; 1 logs them all.
+	SampleRate int
+	// SummaryInterval is how often the volume behind the sampled lines is
+	// logged while SampleRate is above 1.
+	SummaryInterval time.Duration
+}
+
+// HealthConfig sets the thresholds at which /readyz reports the service as
+// degraded.
+type HealthConfig struct {
+	BufferThreshold int
+	MaxOffline      time.Duration
+	// StartupGrace is how long after start the thresholds are ignored, so a
+	// backlog recovered from disk or a connectivity probe still settling
+	// does not report a freshly started service as degraded.
+	StartupGrace time.Duration
+}
+
+// SinkConfig lists destinations that receive every event in addition to
+// Kafka, and the filter deciding which events are sent at all.
+type SinkConfig struct {
+	WebhookURLs    []string
+	WebhookTimeout time.Duration
+	WebhookRetries int
+	FilterExpr     string
+	// BusBuffer is the queue length of each in-process event bus
+	// subscriber; 0 disables the bus.
+	BusBuffer      int
+}
+
+// ClaimCheckConfig moves payloads larger than Threshold bytes to
+// S3-compatible object storage; Kafka then carries a reference to the
+// object. A Threshold of 0 sends every payload inline.
+type ClaimCheckConfig struct {
+	Threshold int
+	// Endpoint is the object store's base URL, e.g. https://s3.us-east-1.amazonaws.com
+	// or http://minio:9000. Objects are addressed path-style as
+	// <Endpoint>/<Bucket>/<Prefix><key>.json.
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Timeout   time.Duration
+}
+
+// SchedulerConfig holds cron specs for the scheduled tasks. Specs take six
+// fields (with seconds), five fields, or a descriptor such as @hourly.
+type SchedulerConfig struct {
+	BufferStatsCron      string
+	CleanupCron          string
+	HealthCheckCron      string
+	ProcessScheduledCron string
+	KafkaWriterStatsCron string
+	// ReconcileCron schedules the reconcile task, which is off when empty.
+	ReconcileCron        string
+	ReconcileLookback    time.Duration
+	TaskTimeout          time.Duration
+	AllowOverlap         []string
 }
 
 func Load() (*Config, error) {
+	envReads.reset()
+	if err := applyConfigFile(lookupEnv("CONFIG_FILE")); err != nil {
+		return nil, err
+	}
+
 	cfg := &Config{
+		Source: SourceConfig{
+			Type: getEnv("SOURCE_TYPE", "mongodb"),
+		},
+		Capture: CaptureConfig{
+			MaxDocBytes:    getEnvInt("CAPTURE_MAX_DOC_BYTES", 0),
+			OversizePolicy: getEnv("CAPTURE_OVERSIZE_POLICY", "deadletter"),
+		},
 		MongoDB: MongoDBConfig{
 			URI:             getEnv("MONGODB_URI", "mongodb://localhost:27017"),
 			Database:        getEnv("MONGODB_DATABASE", "testdb"),
@@ -60,10 +336,32 @@ func Load() (*Config, error) {
 			MinPoolSize:     getEnvInt("MONGODB_MIN_POOL_SIZE", 5),
 			MaxIdleTime:     getEnvDuration("MONGODB_MAX_IDLE_TIME", 10*time.Minute),
 			MaxConnIdleTime: getEnvDuration("MONGODB_MAX_CONN_IDLE_TIME", 5*time.Minute),
+			IgnoreOperations: getEnvList("MONGODB_IGNORE_OPERATIONS", nil),
+			PriorityField:      getEnv("MONGODB_PRIORITY_FIELD", ""),
+			PriorityOperations: getEnvList("MONGODB_PRIORITY_OPERATIONS", nil),
+			ReadyTimeField:     getEnv("MONGODB_READY_TIME_FIELD", DefaultReadyTimeField),
+			DelayThreshold:     getEnvDuration("MONITOR_DELAY_THRESHOLD", 0),
+			DelayThresholds:    getEnvList("MONITOR_DELAY_THRESHOLDS", nil),
+			MaxScheduleHorizon: getEnvDuration("MAX_SCHEDULE_HORIZON", 0),
+			DeleteLookup:       getEnv("MONGODB_DELETE_LOOKUP", "none"),
+			FullDocument:       getEnv("MONGODB_FULL_DOCUMENT", "updateLookup"),
+			MissingDocument:    getEnv("MONGODB_MISSING_DOCUMENT", "include"),
+			ConnectRetries:     getEnvInt("MONGODB_CONNECT_RETRIES", 5),
+			ConnectBackoff:     getEnvDuration("MONGODB_CONNECT_BACKOFF", 1*time.Second),
+			ConnectTimeout:     getEnvDuration("MONGODB_CONNECT_TIMEOUT", 10*time.Second),
+			ServerSelectionTimeout: getEnvDuration("MONGODB_SERVER_SELECTION_TIMEOUT", 30*time.Second),
+			Snapshot:               getEnvBool("MONGODB_SNAPSHOT", false),
+			SnapshotBatchSize:      getEnvInt("MONGODB_SNAPSHOT_BATCH_SIZE", 1000),
+			WatchScope:             getEnv("MONGODB_WATCH_SCOPE", "collection"),
+			OnInvalidate:           getEnv("MONGODB_ON_INVALIDATE", "restart"),
 		},
 		Kafka: KafkaConfig{
 			Brokers:         []string{getEnv("KAFKA_BROKERS", "localhost:9092")},
+			Clusters:          getEnvList("KAFKA_CLUSTERS", nil),
+			ReplicationPolicy: getEnv("KAFKA_REPLICATION_POLICY", "all"),
 			Topic:           getEnv("KAFKA_TOPIC", "cdc-events"),
+			TopicPrefix:         getEnv("KAFKA_TOPIC_PREFIX", ""),
+			TopicFromCollection: getEnvBool("KAFKA_TOPIC_FROM_COLLECTION", false),
 			Retries:         getEnvInt("KAFKA_RETRIES", 3),
 			Timeout:         getEnvDuration("KAFKA_TIMEOUT", 30*time.Second),
 			BatchSize:       getEnvInt("KAFKA_BATCH_SIZE", 1000),
@@ -71,45 +369,228 @@ func Load() (*Config, error) {
 			CompressionType: getEnv("KAFKA_COMPRESSION", "snappy"),
 			MaxMessageBytes: getEnvInt("KAFKA_MAX_MESSAGE_BYTES", 1000000),
 			Acks:            getEnvInt("KAFKA_ACKS", 1),
+			AllowUnsafeAcks: getEnvBool("KAFKA_ALLOW_UNSAFE_ACKS", false),
+			KeyTemplate:     getEnv("KAFKA_KEY_TEMPLATE", ""),
+			Balancer:        getEnv("KAFKA_BALANCER", "leastbytes"),
+			PreserveOrder:   getEnvBool("KAFKA_PRESERVE_ORDER", false),
+			StrictOrder:     getEnvBool("KAFKA_STRICT_ORDER", false),
+			DeleteTombstone: getEnvBool("KAFKA_DELETE_TOMBSTONE", false),
+			CoalesceBatch:   getEnvBool("KAFKA_COALESCE_BATCH", false),
+			Async:           getEnvBool("KAFKA_ASYNC", false),
+			AsyncMaxPending: getEnvInt("KAFKA_ASYNC_MAX_PENDING", 10000),
+			RetryHeader:     getEnvOrEmpty("KAFKA_RETRY_HEADER", "retry-count"),
+			SigningKey:      getEnv("EVENT_SIGNING_KEY", ""),
+			SigningKeyID:    getEnv("EVENT_SIGNING_KEY_ID", ""),
+			SlowWriteThreshold: getEnvDuration("SLOW_WRITE_THRESHOLD", 0),
+			CreateTopic:      getEnvBool("KAFKA_CREATE_TOPIC", false),
+			TopicPartitions:  getEnvInt("KAFKA_TOPIC_PARTITIONS", 0),
+			TopicReplication: getEnvInt("KAFKA_TOPIC_REPLICATION", 0),
+			MessageTime:     getEnv("KAFKA_MESSAGE_TIME", "broker"),
+			BreakerThreshold: getEnvInt("KAFKA_BREAKER_THRESHOLD", 5),
+			BreakerCooldown:  getEnvDuration("KAFKA_BREAKER_COOLDOWN", 30*time.Second),
+			JSONMode:         getEnv("KAFKA_JSON_MODE", "standard"),
+			ClientID:         getEnv("KAFKA_CLIENT_ID", "buffered-cdc"),
+			DLQTopic:         getEnv("KAFKA_DLQ_TOPIC", ""),
+			LogLevel:         getEnv("KAFKA_LOG_LEVEL", "error"),
 		},
 		Buffer: BufferConfig{
 			Path:            getEnv("BUFFER_PATH", "./buffer.db"),
 			BatchSize:       getEnvInt("BUFFER_BATCH_SIZE", 500),
+			MaxBatchBytes:   getEnvInt("BUFFER_MAX_BATCH_BYTES", 0),
 			FlushInterval:   getEnvDuration("BUFFER_FLUSH_INTERVAL", 1*time.Second),
 			MaxBufferSize:   getEnvInt("BUFFER_MAX_SIZE", 10000),
 			ConcurrentReads: getEnvInt("BUFFER_CONCURRENT_READS", 5),
+			OpenTimeout:     getEnvDuration("BUFFER_OPEN_TIMEOUT", 1*time.Second),
+			NoSync:          getEnvBool("BUFFER_NO_SYNC", false),
+			InitialMmapSize: getEnvInt("BUFFER_INITIAL_MMAP_SIZE", 1<<26),
+			EventTTL:        getEnvDuration("BUFFER_EVENT_TTL", 0),
+			Shards:          getEnvInt("BUFFER_SHARDS", 1),
+			CheckpointSize:  getEnvInt("BUFFER_CHECKPOINT_SIZE", 1000),
+			SlowLaneRetries: getEnvInt("BUFFER_SLOW_LANE_RETRIES", 3),
+			RetryBackoff:    getEnvDuration("BUFFER_RETRY_BACKOFF", 1*time.Second),
+			MaxRetryBackoff: getEnvDuration("BUFFER_MAX_RETRY_BACKOFF", 5*time.Minute),
+			AsyncWrites:     getEnvBool("BUFFER_ASYNC_WRITES", false),
+			SyncPolicy:      getEnv("BUFFER_SYNC_POLICY", "always"),
+			SyncInterval:    getEnvDuration("BUFFER_SYNC_INTERVAL", 10*time.Millisecond),
+			AutoMigrate:     getEnvBool("BUFFER_AUTO_MIGRATE", false),
+			ReadOrder:       getEnv("BUFFER_READ_ORDER", "fifo"),
+			TxnChunkSize:    getEnvInt("BUFFER_TXN_CHUNK_SIZE", 1000),
+			ScheduleDelayed: getEnvBool("BUFFER_SCHEDULED_BUCKET", true),
+			Codec:           getEnv("BUFFER_CODEC", "json"),
+			KeyTime:         getEnv("BUFFER_KEY_TIME", "capture"),
+			OnDuplicate:     getEnv("BUFFER_ON_DUPLICATE", "overwrite"),
+			SpillDir:        getEnv("BUFFER_SPILL_DIR", ""),
+			SpillHighWater:  getEnvInt("BUFFER_SPILL_HIGH_WATER", 1000000),
+			SpillLowWater:   getEnvInt("BUFFER_SPILL_LOW_WATER", 500000),
+			SpillFileBytes:  getEnvInt("BUFFER_SPILL_FILE_BYTES", 64<<20),
+			SpillInterval:   getEnvDuration("BUFFER_SPILL_INTERVAL", 5*time.Second),
+			// KAFKA_MAX_EVENT_RETRIES is the setting's former name
+			MaxRedeliveries: getEnvInt("BUFFER_MAX_REDELIVERIES", getEnvInt("KAFKA_MAX_EVENT_RETRIES", 10)),
 		},
 		Monitor: MonitorConfig{
 			Interval:        getEnvDuration("MONITOR_INTERVAL", 30*time.Second),
+			InitialInterval: getEnvDuration("MONITOR_INITIAL_INTERVAL", 1*time.Second),
 			ConnectTimeout:  getEnvDuration("CONNECT_TIMEOUT", 10*time.Second),
 			MaxRetries:      getEnvInt("MAX_RETRIES", 5),
 			BackoffInterval: getEnvDuration("BACKOFF_INTERVAL", 5*time.Second),
+			OnlineThreshold:  getEnvInt("MONITOR_ONLINE_THRESHOLD", 1),
+			OfflineThreshold: getEnvInt("MONITOR_OFFLINE_THRESHOLD", 1),
+			ProbeKafka:       getEnvBool("MONITOR_PROBE_KAFKA", true),
+			ProbeTargets:     getEnvList("MONITOR_PROBE_TARGETS", nil),
+			ProbeMode:        getEnv("MONITOR_PROBE_MODE", "any"),
+		},
+		Admin: AdminConfig{
+			Addr: getEnv("ADMIN_ADDR", ":9090"),
+		},
+		Service: ServiceConfig{
+			MaxRestarts:       getEnvInt("SERVICE_MAX_RESTARTS", 5),
+			RestartBackoff:    getEnvDuration("SERVICE_RESTART_BACKOFF", 1*time.Second),
+			MaxRestartBackoff: getEnvDuration("SERVICE_MAX_RESTART_BACKOFF", 1*time.Minute),
+			RestartWindow:     getEnvDuration("SERVICE_RESTART_WINDOW", 5*time.Minute),
+			MaxWorkers:        getEnvInt("SERVICE_MAX_WORKERS", 16),
+			Preflight:         getEnvBool("PREFLIGHT_ENABLED", false),
+			PreflightTimeout:  getEnvDuration("PREFLIGHT_TIMEOUT", 30*time.Second),
+			StopSourceTimeout:    getEnvDuration("SERVICE_STOP_SOURCE_TIMEOUT", 5*time.Second),
+			StopSchedulerTimeout: getEnvDuration("SERVICE_STOP_SCHEDULER_TIMEOUT", 5*time.Second),
+			DrainTimeout:         getEnvDuration("SERVICE_DRAIN_TIMEOUT", 15*time.Second),
+			StopBufferTimeout:    getEnvDuration("SERVICE_STOP_BUFFER_TIMEOUT", 5*time.Second),
+		},
+		Sinks: SinkConfig{
+			WebhookURLs:    getEnvList("SINK_WEBHOOK_URLS", nil),
+			WebhookTimeout: getEnvDuration("SINK_WEBHOOK_TIMEOUT", 10*time.Second),
+			WebhookRetries: getEnvInt("SINK_WEBHOOK_RETRIES", 3),
+			FilterExpr:     getEnv("SINK_FILTER_EXPR", ""),
+			BusBuffer:      getEnvInt("SINK_BUS_BUFFER", 0),
+		},
+		Sync: SyncConfig{
+			MaxInflightBatches: getEnvInt("SYNC_MAX_INFLIGHT_BATCHES", 0),
+			MaxInflightBytes:   getEnvInt("SYNC_MAX_INFLIGHT_BYTES", 0),
+			RetryRate:          getEnvFloat("SYNC_RETRY_RATE", 0),
+			RetryBurst:         getEnvInt("SYNC_RETRY_BURST", 0),
+			TenantField:        getEnv("SYNC_TENANT_FIELD", ""),
+			TenantRate:         getEnvFloat("SYNC_TENANT_RATE", 100),
+			TenantBurst:        getEnvInt("SYNC_TENANT_BURST", 0),
+			TenantRates:        getEnvList("SYNC_TENANT_RATES", nil),
+			BatchesPerTick:     getEnvInt("SYNC_BATCHES_PER_TICK", 3),
+			LagSource:          getEnv("SYNC_LAG_SOURCE", ""),
+			LagGroups:          getEnvList("SYNC_LAG_GROUPS", nil),
+			LagThreshold:       getEnvInt("SYNC_LAG_THRESHOLD", 10000),
+			LagPause:           getEnvInt("SYNC_LAG_PAUSE", 0),
+			LagInterval:        getEnvDuration("SYNC_LAG_INTERVAL", 30*time.Second),
+		},
+		ClaimCheck: ClaimCheckConfig{
+			Threshold: getEnvInt("CLAIM_CHECK_THRESHOLD", 0),
+			Endpoint:  getEnv("CLAIM_CHECK_S3_ENDPOINT", ""),
+			Bucket:    getEnv("CLAIM_CHECK_S3_BUCKET", ""),
+			Region:    getEnv("CLAIM_CHECK_S3_REGION", "us-east-1"),
+			Prefix:    getEnv("CLAIM_CHECK_S3_PREFIX", "cdc/"),
+			AccessKey: getEnv("CLAIM_CHECK_S3_ACCESS_KEY", ""),
+			SecretKey: getEnv("CLAIM_CHECK_S3_SECRET_KEY", ""),
+			Timeout:   getEnvDuration("CLAIM_CHECK_TIMEOUT", 30*time.Second),
+		},
+		Log: LogConfig{
+			SampleRate:      getEnvInt("LOG_SAMPLE_RATE", 1),
+			SummaryInterval: getEnvDuration("LOG_SUMMARY_INTERVAL", 1*time.Minute),
+		},
+		Health: HealthConfig{
+			BufferThreshold: getEnvInt("HEALTH_BUFFER_THRESHOLD", 10000),
+			MaxOffline:      getEnvDuration("HEALTH_MAX_OFFLINE", 0),
+			StartupGrace:    getEnvDuration("HEALTH_STARTUP_GRACE", 0),
+		},
+		Scheduler: SchedulerConfig{
+			BufferStatsCron:      getEnv("SCHED_BUFFER_STATS_CRON", "0 */5 * * * *"),
+			CleanupCron:          getEnv("SCHED_CLEANUP_CRON", "0 0 2 * * *"),
+			HealthCheckCron:      getEnv("SCHED_HEALTH_CHECK_CRON", "0 */1 * * * *"),
+			ProcessScheduledCron: getEnv("SCHED_PROCESS_SCHEDULED_CRON", "* * * * * *"),
+			KafkaWriterStatsCron: getEnv("SCHED_KAFKA_WRITER_STATS_CRON", "0 */1 * * * *"),
+			ReconcileCron:        getEnv("SCHED_RECONCILE_CRON", ""),
+			ReconcileLookback:    getEnvDuration("RECONCILE_LOOKBACK", 10*time.Minute),
+			TaskTimeout:          getEnvDuration("SCHED_TASK_TIMEOUT", 5*time.Minute),
+			AllowOverlap:         getEnvList("SCHED_ALLOW_OVERLAP", nil),
 		},
 	}
+	cfg.Kafka.DLQAcks = getEnvInt("KAFKA_DLQ_ACKS", cfg.Kafka.Acks)
+	cfg.Kafka.ClusterBrokers = make(map[string][]string, len(cfg.Kafka.Clusters))
+	for _, name := range cfg.Kafka.Clusters {
+		cfg.Kafka.ClusterBrokers[name] = getEnvList(ClusterBrokersEnv(name), nil)
+	}
+	cfg.env = envReads.report()
 	return cfg, nil
 }
 
 func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// getEnvOrEmpty is getEnv for settings an empty value turns off: only an
+// unset variable takes the default.
+func getEnvOrEmpty(key, defaultValue string) string {
+	if value, ok := lookupEnvSet(key); ok {
 		return value
 	}
 	return defaultValue
 }
 
 func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		if intValue, err := strconv.Atoi(value); err == nil {
 			return intValue
 		}
+		envReads.invalid(key, value, "an integer")
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := lookupEnv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+		envReads.invalid(key, value, "a number")
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := lookupEnv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+		envReads.invalid(key, value, "true or false")
 	}
 	return defaultValue
 }
 
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
-	if value := os.Getenv(key); value != "" {
+	if value := lookupEnv(key); value != "" {
 		if duration, err := time.ParseDuration(value); err == nil {
 			return duration
 		}
+		envReads.invalid(key, value, "a duration such as 30s or 5m")
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+// ClusterBrokersEnv returns the variable holding the brokers of the
+// KAFKA_CLUSTERS entry name, such as KAFKA_CLUSTER_DR_EAST_BROKERS for dr-east.
+func ClusterBrokersEnv(name string) string {
+	return "KAFKA_CLUSTER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_BROKERS"
+}
+
+func getEnvList(key string, defaultValue []string) []string {
+	value := lookupEnv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
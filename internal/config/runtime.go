@@ -0,0 +1,149 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// Runtime holds the settings that can change while the service runs. A
+// SIGHUP reloads them; every other setting keeps its startup value until a
+// restart.
+type Runtime struct {
+	SyncBatchesPerTick    int
+	SyncMaxInflightBytes  int
+	SyncLagThreshold      int
+	SyncLagPause          int
+	MaxRedeliveries       int
+	KafkaLogLevel         string
+	HealthBufferThreshold int
+	HealthMaxOffline      time.Duration
+}
+
+// runtimeFields names the Config fields copied into Runtime, so Reload does
+// not report them as ignored.
+var runtimeFields = map[string]bool{
+	"Sync.BatchesPerTick":    true,
+	"Sync.MaxInflightBytes":  true,
+	"Sync.LagThreshold":      true,
+	"Sync.LagPause":          true,
+	"Buffer.MaxRedeliveries": true,
+	"Kafka.LogLevel":         true,
+	"Health.BufferThreshold": true,
+	"Health.MaxOffline":      true,
+}
+
+// Runtime returns the reloadable part of c.
+func (c *Config) Runtime() *Runtime {
+	return &Runtime{
+		SyncBatchesPerTick:    c.Sync.BatchesPerTick,
+		SyncMaxInflightBytes:  c.Sync.MaxInflightBytes,
+		SyncLagThreshold:      c.Sync.LagThreshold,
+		SyncLagPause:          c.Sync.LagPause,
+		MaxRedeliveries:       c.Buffer.MaxRedeliveries,
+		KafkaLogLevel:         c.Kafka.LogLevel,
+		HealthBufferThreshold: c.Health.BufferThreshold,
+		HealthMaxOffline:      c.Health.MaxOffline,
+	}
+}
+
+// Reload loads the configuration again, re-reading CONFIG_FILE, and returns
+// it together with the names of the settings outside Runtime that differ from
+// current. Those only take effect on restart.
+func Reload(current *Config) (*Config, []string, error) {
+	next, err := Load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ignored []string
+	cur, nxt := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		if !cur.Type().Field(i).IsExported() {
+			continue
+		}
+		section := cur.Type().Field(i).Name
+		for j := 0; j < cur.Field(i).NumField(); j++ {
+			name := section + "." + cur.Field(i).Type().Field(j).Name
+			if runtimeFields[name] {
+				continue
+			}
+			if !reflect.DeepEqual(cur.Field(i).Field(j).Interface(), nxt.Field(i).Field(j).Interface()) {
+				ignored = append(ignored, name)
+			}
+		}
+	}
+	return next, ignored, nil
+}
+
+// fileEnv tracks the variables CONFIG_FILE has set, with the environment's
+// own values, so a variable removed from the file reverts on reload.
+var fileEnv = struct {
+	gosync.Mutex
+	original map[string]*string
+}{original: make(map[string]*string)}
+
+// applyConfigFile sets the KEY=VALUE lines of path in the environment,
+// overriding variables set there. Blank lines and lines starting with # are
+// skipped, and values may be quoted.
+func applyConfigFile(path string) error {
+	fileEnv.Lock()
+	defer fileEnv.Unlock()
+
+	values := make(map[string]string)
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open CONFIG_FILE: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+			key = strings.TrimSpace(key)
+			if !ok || key == "" {
+				return fmt.Errorf("CONFIG_FILE line %d: want KEY=VALUE", n)
+			}
+			value = strings.TrimSpace(value)
+			if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+				value = value[1 : len(value)-1]
+			}
+			values[key] = value
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+		}
+	}
+
+	for key, original := range fileEnv.original {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if original == nil {
+			os.Unsetenv(key)
+		} else {
+			os.Setenv(key, *original)
+		}
+		delete(fileEnv.original, key)
+	}
+	for key, value := range values {
+		if _, ok := fileEnv.original[key]; !ok {
+			if original, ok := os.LookupEnv(key); ok {
+				fileEnv.original[key] = &original
+			} else {
+				fileEnv.original[key] = nil
+			}
+		}
+		os.Setenv(key, value)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// envPrefixes are the prefixes of the variables this service reads. A set
+// variable with one of them that Load did not read is most likely a typo.
+var envPrefixes = []string{
+	"SOURCE_", "CAPTURE_", "MONGODB_", "KAFKA_", "BUFFER_", "MONITOR_", "SYNC_", "SINK_", "SCHED_",
+	"SERVICE_", "HEALTH_", "CLAIM_CHECK_", "PREFLIGHT_", "RECONCILE_",
+	"EVENT_SIGNING_", "ADMIN_", "MAX_SCHEDULE_", "LOG_",
+}
+
+// envReport records the variables one Load read and the values it could not
+// parse, which fell back to their defaults.
+type envReport struct {
+	read      map[string]bool
+	malformed []string
+}
+
+// envReads collects the report of the Load in progress.
+var envReads = &envTracker{}
+
+type envTracker struct {
+	mu gosync.Mutex
+	envReport
+}
+
+func (t *envTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.envReport = envReport{read: make(map[string]bool)}
+}
+
+func (t *envTracker) invalid(key, value, want string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.malformed = append(t.malformed, fmt.Sprintf("invalid %s %q: must be %s", key, value, want))
+}
+
+func (t *envTracker) report() envReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.envReport
+}
+
+// lookupEnv returns the value of key and records that it was read.
+func lookupEnv(key string) string {
+	envReads.mu.Lock()
+	if envReads.read != nil {
+		envReads.read[key] = true
+	}
+	envReads.mu.Unlock()
+	return os.Getenv(key)
+}
+
+// lookupEnvSet is lookupEnv that also reports whether key is set at all, so
+// an empty value can be told apart from an unset one.
+func lookupEnvSet(key string) (string, bool) {
+	value := lookupEnv(key)
+	_, ok := os.LookupEnv(key)
+	return value, ok
+}
+
+// Validate reports every problem Load found without failing: values that do
+// not parse and fell back to their defaults, unknown variables that look like
+// misspelled settings, and values outside their allowed range. It does not
+// connect to anything.
+func (c *Config) Validate() error {
+	var errs []error
+	for _, problem := range c.env.malformed {
+		errs = append(errs, errors.New(problem))
+	}
+	for _, key := range c.unknownEnv() {
+		errs = append(errs, fmt.Errorf("unknown variable %s", key))
+	}
+
+	oneOf := func(key, value string, allowed ...string) {
+		if !slices.Contains(allowed, value) {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be one of %s", key, value, strings.Join(allowed, ", ")))
+		}
+	}
+	atLeast := func(key string, value, min int) {
+		if value < min {
+			errs = append(errs, fmt.Errorf("invalid %s %d: must be at least %d", key, value, min))
+		}
+	}
+	positive := func(key string, value time.Duration) {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %v: must be positive", key, value))
+		}
+	}
+	notNegative := func(key string, value time.Duration) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %v: must not be negative", key, value))
+		}
+	}
+
+	atLeast("CAPTURE_MAX_DOC_BYTES", c.Capture.MaxDocBytes, 0)
+	oneOf("CAPTURE_OVERSIZE_POLICY", c.Capture.OversizePolicy, "deadletter", "reference")
+
+	oneOf("MONGODB_DELETE_LOOKUP", c.MongoDB.DeleteLookup, "none", "buffer", "preimage")
+	oneOf("MONGODB_FULL_DOCUMENT", c.MongoDB.FullDocument, "default", "updateLookup", "whenAvailable", "required")
+	oneOf("MONGODB_MISSING_DOCUMENT", c.MongoDB.MissingDocument, "include", "skip", "requery")
+	oneOf("MONGODB_WATCH_SCOPE", c.MongoDB.WatchScope, "collection", "database", "deployment")
+	oneOf("MONGODB_ON_INVALIDATE", c.MongoDB.OnInvalidate, "restart", "stop")
+	if c.MongoDB.Snapshot && c.MongoDB.WatchScope != "collection" {
+		errs = append(errs, fmt.Errorf("MONGODB_SNAPSHOT requires MONGODB_WATCH_SCOPE=collection, got %q", c.MongoDB.WatchScope))
+	}
+	notNegative("MONITOR_DELAY_THRESHOLD", c.MongoDB.DelayThreshold)
+	for _, entry := range c.MongoDB.DelayThresholds {
+		collection, value, ok := strings.Cut(entry, "=")
+		if d, err := time.ParseDuration(strings.TrimSpace(value)); !ok || strings.TrimSpace(collection) == "" || err != nil || d < 0 {
+			errs = append(errs, fmt.Errorf("invalid MONITOR_DELAY_THRESHOLDS entry %q: want collection=duration", entry))
+		}
+	}
+	notNegative("MAX_SCHEDULE_HORIZON", c.MongoDB.MaxScheduleHorizon)
+	atLeast("MONGODB_SNAPSHOT_BATCH_SIZE", c.MongoDB.SnapshotBatchSize, 1)
+	atLeast("MONGODB_CONNECT_RETRIES", c.MongoDB.ConnectRetries, 0)
+
+	oneOf("KAFKA_COMPRESSION", c.Kafka.CompressionType, "gzip", "snappy", "lz4", "zstd")
+	oneOf("KAFKA_MESSAGE_TIME", c.Kafka.MessageTime, "broker", "buffer", "cluster")
+	oneOf("KAFKA_JSON_MODE", c.Kafka.JSONMode, "standard", "extended", "canonical")
+	oneOf("KAFKA_BALANCER", c.Kafka.Balancer, "leastbytes", "hash", "sticky")
+	if c.Kafka.Balancer == "sticky" && (c.Kafka.PreserveOrder || c.Kafka.StrictOrder) {
+		errs = append(errs, fmt.Errorf("KAFKA_BALANCER=sticky cannot be combined with KAFKA_PRESERVE_ORDER or KAFKA_STRICT_ORDER"))
+	}
+	if c.Kafka.Async {
+		atLeast("KAFKA_ASYNC_MAX_PENDING", c.Kafka.AsyncMaxPending, 1)
+		if len(c.Sinks.WebhookURLs) > 0 || len(c.Kafka.Clusters) > 0 || c.Kafka.CoalesceBatch || c.Kafka.PreserveOrder || c.Kafka.StrictOrder {
+			errs = append(errs, fmt.Errorf("KAFKA_ASYNC cannot be combined with SINK_WEBHOOK_URLS, KAFKA_CLUSTERS, KAFKA_COALESCE_BATCH, KAFKA_PRESERVE_ORDER or KAFKA_STRICT_ORDER"))
+		}
+	}
+	oneOf("KAFKA_REPLICATION_POLICY", c.Kafka.ReplicationPolicy, "all", "any", "primary")
+	for _, name := range c.Kafka.Clusters {
+		if len(c.Kafka.ClusterBrokers[name]) == 0 {
+			errs = append(errs, fmt.Errorf("KAFKA_CLUSTERS names %s, but %s is not set", name, ClusterBrokersEnv(name)))
+		}
+	}
+	oneOf("KAFKA_LOG_LEVEL", c.Kafka.LogLevel, "none", "error", "debug")
+	oneOf("KAFKA_ACKS", fmt.Sprint(c.Kafka.Acks), "-1", "0", "1")
+	oneOf("KAFKA_DLQ_ACKS", fmt.Sprint(c.Kafka.DLQAcks), "-1", "0", "1")
+	atLeast("KAFKA_BATCH_SIZE", c.Kafka.BatchSize, 1)
+	atLeast("KAFKA_RETRIES", c.Kafka.Retries, 0)
+	positive("KAFKA_TIMEOUT", c.Kafka.Timeout)
+	notNegative("SLOW_WRITE_THRESHOLD", c.Kafka.SlowWriteThreshold)
+	if c.Kafka.SigningKeyID != "" && c.Kafka.SigningKey == "" {
+		errs = append(errs, fmt.Errorf("EVENT_SIGNING_KEY_ID requires EVENT_SIGNING_KEY"))
+	}
+
+	oneOf("BUFFER_SYNC_POLICY", c.Buffer.SyncPolicy, "always", "interval", "never")
+	oneOf("BUFFER_READ_ORDER", c.Buffer.ReadOrder, "fifo", "lifo")
+	oneOf("BUFFER_CODEC", c.Buffer.Codec, "json", "bson")
+	notNegative("HEALTH_STARTUP_GRACE", c.Health.StartupGrace)
+	atLeast("LOG_SAMPLE_RATE", c.Log.SampleRate, 1)
+	positive("LOG_SUMMARY_INTERVAL", c.Log.SummaryInterval)
+	oneOf("BUFFER_ON_DUPLICATE", c.Buffer.OnDuplicate, "overwrite", "error", "rename")
+	if c.Buffer.SpillDir != "" {
+		atLeast("BUFFER_SPILL_HIGH_WATER", c.Buffer.SpillHighWater, 1)
+		atLeast("BUFFER_SPILL_LOW_WATER", c.Buffer.SpillLowWater, 0)
+		if c.Buffer.SpillLowWater >= c.Buffer.SpillHighWater {
+			errs = append(errs, fmt.Errorf("BUFFER_SPILL_LOW_WATER (%d) must be below BUFFER_SPILL_HIGH_WATER (%d)", c.Buffer.SpillLowWater, c.Buffer.SpillHighWater))
+		}
+		atLeast("BUFFER_SPILL_FILE_BYTES", c.Buffer.SpillFileBytes, 1)
+		positive("BUFFER_SPILL_INTERVAL", c.Buffer.SpillInterval)
+	}
+	oneOf("BUFFER_KEY_TIME", c.Buffer.KeyTime, "capture", "cluster")
+	atLeast("BUFFER_BATCH_SIZE", c.Buffer.BatchSize, 1)
+	atLeast("BUFFER_MAX_BATCH_BYTES", c.Buffer.MaxBatchBytes, 0)
+	atLeast("BUFFER_SHARDS", c.Buffer.Shards, 1)
+	atLeast("BUFFER_CONCURRENT_READS", c.Buffer.ConcurrentReads, 1)
+	atLeast("BUFFER_TXN_CHUNK_SIZE", c.Buffer.TxnChunkSize, 1)
+	atLeast("BUFFER_MAX_REDELIVERIES", c.Buffer.MaxRedeliveries, 0)
+	notNegative("BUFFER_EVENT_TTL", c.Buffer.EventTTL)
+	if c.Buffer.SyncPolicy == "interval" {
+		positive("BUFFER_SYNC_INTERVAL", c.Buffer.SyncInterval)
+	}
+
+	notNegative("SERVICE_STOP_SOURCE_TIMEOUT", c.Service.StopSourceTimeout)
+	notNegative("SERVICE_STOP_SCHEDULER_TIMEOUT", c.Service.StopSchedulerTimeout)
+	notNegative("SERVICE_DRAIN_TIMEOUT", c.Service.DrainTimeout)
+	notNegative("SERVICE_STOP_BUFFER_TIMEOUT", c.Service.StopBufferTimeout)
+
+	oneOf("MONITOR_PROBE_MODE", c.Monitor.ProbeMode, "any", "all")
+	positive("MONITOR_INTERVAL", c.Monitor.Interval)
+	atLeast("MONITOR_ONLINE_THRESHOLD", c.Monitor.OnlineThreshold, 1)
+	atLeast("MONITOR_OFFLINE_THRESHOLD", c.Monitor.OfflineThreshold, 1)
+
+	atLeast("SYNC_BATCHES_PER_TICK", c.Sync.BatchesPerTick, 1)
+	if c.Sync.LagSource != "" {
+		oneOf("SYNC_LAG_SOURCE", c.Sync.LagSource, "kafka", "admin")
+		if c.Sync.LagSource == "kafka" && len(c.Sync.LagGroups) == 0 {
+			errs = append(errs, fmt.Errorf("SYNC_LAG_SOURCE=kafka requires SYNC_LAG_GROUPS"))
+		}
+		atLeast("SYNC_LAG_THRESHOLD", c.Sync.LagThreshold, 1)
+		if c.Sync.LagPause != 0 && c.Sync.LagPause <= c.Sync.LagThreshold {
+			errs = append(errs, fmt.Errorf("SYNC_LAG_PAUSE (%d) must be above SYNC_LAG_THRESHOLD (%d)", c.Sync.LagPause, c.Sync.LagThreshold))
+		}
+		positive("SYNC_LAG_INTERVAL", c.Sync.LagInterval)
+	}
+
+	atLeast("CLAIM_CHECK_THRESHOLD", c.ClaimCheck.Threshold, 0)
+	if c.ClaimCheck.Threshold > 0 && (c.ClaimCheck.Endpoint == "" || c.ClaimCheck.Bucket == "") {
+		errs = append(errs, fmt.Errorf("CLAIM_CHECK_THRESHOLD requires CLAIM_CHECK_S3_ENDPOINT and CLAIM_CHECK_S3_BUCKET"))
+	}
+	if (c.ClaimCheck.AccessKey == "") != (c.ClaimCheck.SecretKey == "") {
+		errs = append(errs, fmt.Errorf("CLAIM_CHECK_S3_ACCESS_KEY and CLAIM_CHECK_S3_SECRET_KEY must be set together"))
+	}
+
+	atLeast("SINK_BUS_BUFFER", c.Sinks.BusBuffer, 0)
+	for _, raw := range c.Sinks.WebhookURLs {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("invalid SINK_WEBHOOK_URLS entry %q: want an http or https URL", RedactURI(raw)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// unknownEnv returns the set variables with a prefix of this service that
+// Load did not read.
+func (c *Config) unknownEnv() []string {
+	if c.env.read == nil {
+		return nil
+	}
+	var unknown []string
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if c.env.read[key] {
+			continue
+		}
+		for _, prefix := range envPrefixes {
+			if strings.HasPrefix(key, prefix) {
+				unknown = append(unknown, key)
+				break
+			}
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Redacted returns a copy of c with credentials masked, for printing.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.MongoDB.URI = RedactURI(c.MongoDB.URI)
+	r.Kafka.SigningKey = redactSecret(c.Kafka.SigningKey)
+	r.Kafka.Brokers = redactURIs(c.Kafka.Brokers)
+	// The copy shares c's map, so it gets a new one
+	r.Kafka.ClusterBrokers = make(map[string][]string, len(c.Kafka.ClusterBrokers))
+	for name, brokers := range c.Kafka.ClusterBrokers {
+		r.Kafka.ClusterBrokers[name] = redactURIs(brokers)
+	}
+	r.ClaimCheck.Endpoint = RedactURI(c.ClaimCheck.Endpoint)
+	r.ClaimCheck.AccessKey = redactSecret(c.ClaimCheck.AccessKey)
+	r.ClaimCheck.SecretKey = redactSecret(c.ClaimCheck.SecretKey)
+	r.Sinks.WebhookURLs = redactURIs(c.Sinks.WebhookURLs)
+	return &r
+}
+
+// redactURIs applies RedactURI to each of uris, returning a new slice.
+func redactURIs(uris []string) []string {
+	if uris == nil {
+		return nil
+	}
+	redacted := make([]string, len(uris))
+	for i, u := range uris {
+		redacted[i] = RedactURI(u)
+	}
+	return redacted
+}
+
+// Print writes every setting of c as one "Section.Field = value" line.
+// Call it on Redacted unless credentials may be shown.
+func (c *Config) Print(w io.Writer) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Type().Field(i).IsExported() {
+			continue
+		}
+		section := v.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			name := v.Type().Field(i).Name + "." + section.Type().Field(j).Name
+			if _, err := fmt.Fprintf(w, "%s = %v\n", name, section.Field(j).Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// RedactURI masks the password in the user info of a URL or connection
+// string, such as a mongodb:// or mongodb+srv:// URI, for logging. It does not
+// parse the URL, since MongoDB URIs list several hosts, which net/url rejects.
+func RedactURI(raw string) string {
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok {
+		return raw
+	}
+	authority, path, _ := strings.Cut(rest, "/")
+	at := strings.LastIndex(authority, "@")
+	if at < 0 {
+		return raw
+	}
+	user, _, hasPassword := strings.Cut(authority[:at], ":")
+	if !hasPassword {
+		return raw
+	}
+	redacted := scheme + "://" + user + ":REDACTED" + authority[at:]
+	if len(rest) > len(authority) {
+		redacted += "/" + path
+	}
+	return redacted
+}
@@ -0,0 +1,94 @@
+// Package logging thins out the log lines written for every event, which
+// would otherwise flood log pipelines at high throughput.
+package logging
+
+import (
+	"context"
+	"log"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+)
+
+// rate is LOG_SAMPLE_RATE: one in rate sampled lines is written.
+var rate atomic.Int64
+
+func init() {
+	rate.Store(1)
+}
+
+// SetSampleRate makes every Sampler write one in n lines; n <= 1 writes all
+// of them.
+func SetSampleRate(n int) {
+	rate.Store(int64(max(n, 1)))
+}
+
+// SampleRate returns the rate set by SetSampleRate.
+func SampleRate() int {
+	return int(rate.Load())
+}
+
+// samplers lists every Sampler, for Summarize.
+var samplers struct {
+	mu   gosync.Mutex
+	list []*Sampler
+}
+
+// Sampler writes one in SampleRate of the lines passed to Printf and counts
+// them all, so Summarize can report the volume behind the lines written.
+type Sampler struct {
+	what string
+	seen atomic.Uint64
+	// since is seen at the last Summarize.
+	since atomic.Uint64
+}
+
+// NewSampler returns a Sampler whose summary reports its lines as what,
+// such as "change events stored".
+func NewSampler(what string) *Sampler {
+	s := &Sampler{what: what}
+	samplers.mu.Lock()
+	samplers.list = append(samplers.list, s)
+	samplers.mu.Unlock()
+	return s
+}
+
+// Printf writes the line if it is the first of the current group of
+// SampleRate lines.
+func (s *Sampler) Printf(format string, args ...interface{}) {
+	if (s.seen.Add(1)-1)%uint64(rate.Load()) == 0 {
+		log.Printf(format, args...)
+	}
+}
+
+// Summarize logs, for every Sampler that saw lines since the last call, how
+// many it saw. interval is only used in the message.
+func Summarize(interval time.Duration) {
+	samplers.mu.Lock()
+	list := append([]*Sampler(nil), samplers.list...)
+	samplers.mu.Unlock()
+
+	n := rate.Load()
+	for _, s := range list {
+		seen := s.seen.Load()
+		count := seen - s.since.Swap(seen)
+		if count == 0 {
+			continue
+		}
+		log.Printf("Last %s: %d %s (logging 1 in %d)", interval, count, s.what, n)
+	}
+}
+
+// Run calls Summarize every interval until ctx is done.
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Summarize(interval)
+		}
+	}
+}
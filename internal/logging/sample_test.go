@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+)
+
+// captureLog sends the standard logger's output to the returned buffer until
+// the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	writer, flags := log.Writer(), log.Flags()
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(writer)
+		log.SetFlags(flags)
+		SetSampleRate(1)
+	})
+	return &out
+}
+
+func TestSamplerWritesOneInRate(t *testing.T) {
+	const lines, writers = 10000, 8
+	for _, n := range []int{1, 10, 100, 3} {
+		t.Run(fmt.Sprintf("rate=%d", n), func(t *testing.T) {
+			out := captureLog(t)
+			SetSampleRate(n)
+			s := NewSampler("test lines")
+
+			var wg gosync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < lines/writers; i++ {
+						s.Printf("line %d", i)
+					}
+				}()
+			}
+			wg.Wait()
+
+			got := strings.Count(out.String(), "\n")
+			want := float64(lines) / float64(n)
+			if diff := float64(got) - want; diff < -1 || diff > 1 {
+				t.Fatalf("wrote %d of %d lines at rate %d, want about %.0f", got, lines, n, want)
+			}
+
+			// The summary counts every line, written or not
+			out.Reset()
+			Summarize(time.Minute)
+			summary := fmt.Sprintf("Last 1m0s: %d test lines (logging 1 in %d)\n", lines, n)
+			if !strings.Contains(out.String(), summary) {
+				t.Fatalf("Summarize wrote %q, want %q", out.String(), summary)
+			}
+		})
+	}
+}
+
+func TestSetSampleRateFloor(t *testing.T) {
+	captureLog(t)
+	for _, n := range []int{0, -5} {
+		SetSampleRate(n)
+		if got := SampleRate(); got != 1 {
+			t.Errorf("SetSampleRate(%d) left SampleRate() = %d, want 1", n, got)
+		}
+	}
+}
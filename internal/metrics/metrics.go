@@ -0,0 +1,295 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "buffered_cdc"
+
+var (
+	EventsCaptured = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_captured_total",
+		Help:      "Change events stored in the buffer, by operation type.",
+	}, []string{"operation"})
+
+	EventsMissingDocument = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_missing_document_total",
+		Help:      "Insert, replace and update events captured without their fullDocument, by MONGODB_MISSING_DOCUMENT.",
+	}, []string{"policy"})
+
+	StreamInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "change_stream_invalidations_total",
+		Help:      "Change streams ended by an invalidate event (the watched collection or database was dropped or renamed).",
+	})
+
+	EventsIgnored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_ignored_total",
+		Help:      "Change events dropped at capture by MONGODB_IGNORE_OPERATIONS, by operation type.",
+	}, []string{"operation"})
+
+	EventsOversized = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_oversized_total",
+		Help:      "Change events whose data exceeded CAPTURE_MAX_DOC_BYTES at capture, by CAPTURE_OVERSIZE_POLICY.",
+	}, []string{"policy"})
+
+	BufferDuplicateKeys = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_duplicate_keys_total",
+		Help:      "Events stored under a key that already held a different event, by BUFFER_ON_DUPLICATE.",
+	}, []string{"policy"})
+
+	EventsBeyondHorizon = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_beyond_horizon_total",
+		Help:      "Change events dead-lettered at capture because their ready time was beyond MAX_SCHEDULE_HORIZON.",
+	})
+
+	EventsCoalesced = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_coalesced_total",
+		Help:      "Events not written to Kafka because a later event in the same batch carried their document, with KAFKA_COALESCE_BATCH.",
+	})
+
+	EventsSynced = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_synced_total",
+		Help:      "Events delivered to Kafka and every additional sink and removed from the buffer, by operation type.",
+	}, []string{"operation"})
+
+	EventsFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_filtered_total",
+		Help:      "Events dropped from the buffer without being sent because they failed SINK_FILTER_EXPR, by operation type.",
+	}, []string{"operation"})
+
+	SinkFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sink_failures_total",
+		Help:      "Failed batch writes to an additional sink, by sink name.",
+	}, []string{"sink"})
+
+	BusEventsPublished = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bus_events_published_total",
+		Help:      "Synced events queued for an in-process subscriber, counted once per subscriber.",
+	})
+
+	BusEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bus_events_dropped_total",
+		Help:      "Synced events an in-process subscriber missed because its queue was full.",
+	})
+
+	BusSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bus_subscribers",
+		Help:      "In-process event bus subscribers.",
+	})
+
+	EventsCorrupt = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_corrupt_total",
+		Help:      "Buffered records that could not be decoded and were moved to the corrupt bucket.",
+	})
+
+	EventsExpired = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_expired_total",
+		Help:      "Events removed from the buffer because their TTL passed before delivery.",
+	})
+
+	KafkaWrites = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_writes_total",
+		Help:      "Produce requests sent by the Kafka writer.",
+	})
+
+	KafkaMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_messages_total",
+		Help:      "Messages written by the Kafka writer.",
+	})
+
+	KafkaBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_bytes_total",
+		Help:      "Message bytes written by the Kafka writer.",
+	})
+
+	KafkaErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_errors_total",
+		Help:      "Errors reported by the Kafka writer.",
+	})
+
+	KafkaRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_retries_total",
+		Help:      "Produce request retries made internally by the Kafka writer.",
+	})
+
+	KafkaBatchSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_batch_seconds",
+		Help:      "Average time to fill a batch over the last stats interval.",
+	})
+
+	KafkaWriteSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_write_seconds",
+		Help:      "Average produce request latency over the last stats interval.",
+	})
+
+	KafkaBatchSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_writer_batch_size",
+		Help:      "Average messages per batch over the last stats interval.",
+	})
+
+	KafkaBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_breaker_state",
+		Help:      "Kafka sink circuit breaker state: 0 closed, 1 half-open, 2 open.",
+	})
+
+	KafkaAsyncPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_async_pending",
+		Help:      "Events handed to the async Kafka writer whose delivery has not completed yet.",
+	})
+
+	KafkaAsyncCompletions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_async_completions_total",
+		Help:      "Events whose async Kafka write completed, by result: delivered or failed.",
+	}, []string{"result"})
+
+	KafkaSyncPaused = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_sync_paused",
+		Help:      "1 while publishing to Kafka is paused through the admin API, 0 otherwise.",
+	})
+
+	WorkersActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workers_active",
+		Help:      "Tasks currently running on the shared worker pool.",
+	})
+
+	ScheduledRunsSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "scheduler_runs_skipped_total",
+		Help:      "Scheduled task runs skipped because the previous run had not finished, by task.",
+	}, []string{"task"})
+
+	SyncInflightBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_inflight_bytes",
+		Help:      "Stored size of the events the current sync pass is sending.",
+	})
+
+	RetriesDeferred = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_retries_deferred_total",
+		Help:      "Events left for a later sync pass because the SYNC_RETRY_RATE budget was exhausted.",
+	})
+
+	ConsumerLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_consumer_lag",
+		Help:      "Consumer lag last read by the SYNC_LAG_SOURCE throttle; -1 while unknown.",
+	})
+
+	SyncBatchesPerTick = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_batches_per_tick",
+		Help:      "Batches the sync worker sends per tick after the consumer lag throttle.",
+	})
+
+	KafkaSlowWrites = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_slow_writes_total",
+		Help:      "Kafka write attempts that took longer than SLOW_WRITE_THRESHOLD.",
+	})
+
+	ClaimChecks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "claim_checks_total",
+		Help:      "Events whose payload was uploaded to object storage and sent to Kafka as a reference.",
+	})
+
+	EventAge = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "buffer_event_age_seconds",
+		Help:      "Time from capture to successful sync of each event.",
+		// 10ms up to about two days
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 13),
+	})
+
+	EventsSpilled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_events_spilled_total",
+		Help:      "Events written to spill files because the buffer was above BUFFER_SPILL_HIGH_WATER.",
+	})
+
+	EventsReingested = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "buffer_events_reingested_total",
+		Help:      "Spilled events loaded back into the buffer.",
+	})
+
+	SpillActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_spill_active",
+		Help:      "1 while new events are written to spill files instead of the buffer.",
+	})
+
+	SpillFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_spill_files",
+		Help:      "Spill files waiting to be loaded back into the buffer.",
+	})
+
+	OldestEventAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "buffer_oldest_event_age_seconds",
+		Help:      "Age of the oldest queued event at the last buffer stats run; 0 when the buffer is empty.",
+	})
+
+	ReconcileMissing = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reconcile_missing_events",
+		Help:      "Events recorded as synced within the reconcile lookback that the last reconcile run could not find in Kafka.",
+	})
+
+	TenantEventsDeferred = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sync_tenant_events_deferred_total",
+		Help:      "Events left for a later sync pass because their tenant was over SYNC_TENANT_RATE.",
+	})
+
+	HealthDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "health_degraded",
+		Help:      "1 while the last health check found the service degraded, 0 otherwise.",
+	})
+
+	ComponentRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "component_restarts_total",
+		Help:      "Times a supervised component was restarted after exiting unexpectedly.",
+	}, []string{"component"})
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -2,6 +2,7 @@ package monitor
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net"
 	"strings"
@@ -18,29 +19,74 @@ const (
 	StatusOnline
 )
 
+// Values for MONITOR_PROBE_MODE.
+const (
+	// ProbeAny is online when at least one probe target is reachable.
+	ProbeAny = "any"
+	// ProbeAll is online only when every probe target is reachable.
+	ProbeAll = "all"
+)
+
 type ConnectivityMonitor struct {
 	config   *config.MonitorConfig
 	kafka    *config.KafkaConfig
 	status   ConnectivityStatus
 	mu       sync.RWMutex
 	watchers []chan ConnectivityStatus
+
+	// offlineSince is when the status last became offline; zero while online.
+	offlineSince time.Time
+	// successes and failures count consecutive probe results; the status
+	// only changes once the matching threshold is reached.
+	successes int
+	failures  int
+	// probeMu serializes probes, so a forced recheck and a scheduled probe
+	// are recorded one after the other.
+	probeMu sync.Mutex
 }
 
-func NewConnectivityMonitor(cfg *config.Config) *ConnectivityMonitor {
-	return &ConnectivityMonitor{
-		config: &cfg.Monitor,
-		kafka:  &cfg.Kafka,
-		status: StatusOffline,
+func NewConnectivityMonitor(cfg *config.Config) (*ConnectivityMonitor, error) {
+	switch cfg.Monitor.ProbeMode {
+	case ProbeAny, ProbeAll:
+	default:
+		return nil, fmt.Errorf("invalid MONITOR_PROBE_MODE %q: must be any or all", cfg.Monitor.ProbeMode)
+	}
+	if !cfg.Monitor.ProbeKafka && len(cfg.Monitor.ProbeTargets) == 0 {
+		return nil, fmt.Errorf("MONITOR_PROBE_KAFKA is false and MONITOR_PROBE_TARGETS is empty: nothing to probe")
 	}
+	for _, target := range cfg.Monitor.ProbeTargets {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, fmt.Errorf("invalid MONITOR_PROBE_TARGETS entry %q: want host:port: %w", target, err)
+		}
+	}
+
+	return &ConnectivityMonitor{
+		config:       &cfg.Monitor,
+		kafka:        &cfg.Kafka,
+		status:       StatusOffline,
+		offlineSince: time.Now(),
+	}, nil
 }
 
+// Start probes immediately, then every MONITOR_INITIAL_INTERVAL until Kafka
+// is first reachable and every MONITOR_INTERVAL after that.
 func (cm *ConnectivityMonitor) Start(ctx context.Context) {
-	ticker := time.NewTicker(cm.config.Interval)
+	interval := cm.config.Interval
+	initial := cm.config.InitialInterval > 0 && cm.config.InitialInterval < interval
+	if initial {
+		interval = cm.config.InitialInterval
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	cm.checkConnectivity()
 
 	for {
+		if initial && cm.IsOnline() {
+			initial = false
+			ticker.Reset(cm.config.Interval)
+		}
+
 		select {
 		case <-ctx.Done():
 			return
@@ -50,25 +96,95 @@ func (cm *ConnectivityMonitor) Start(ctx context.Context) {
 	}
 }
 
-func (cm *ConnectivityMonitor) checkConnectivity() {
-	isOnline := cm.checkKafkaConnectivity()
-	
+func (cm *ConnectivityMonitor) checkConnectivity() bool {
+	cm.probeMu.Lock()
+	defer cm.probeMu.Unlock()
+	reachable := cm.probe(cm.dial)
+	cm.recordProbe(reachable)
+	return reachable
+}
+
+// Recheck probes now instead of waiting for the next interval and reports
+// whether the probe targets were reachable. It is safe to call from any
+// goroutine. The result counts like any other probe, so the status only
+// changes once the MONITOR_ONLINE_THRESHOLD or MONITOR_OFFLINE_THRESHOLD is
+// reached; watchers are notified when it does.
+func (cm *ConnectivityMonitor) Recheck() bool {
+	return cm.checkConnectivity()
+}
+
+// probe checks the Kafka brokers, counted as one target that is reachable
+// when any broker is, and each of MONITOR_PROBE_TARGETS, then combines the
+// results according to MONITOR_PROBE_MODE.
+func (cm *ConnectivityMonitor) probe(dial func(address string) bool) bool {
+	var results []bool
+	if cm.config.ProbeKafka {
+		results = append(results, cm.checkKafkaConnectivity(dial))
+	}
+	for _, target := range cm.config.ProbeTargets {
+		results = append(results, dial(target))
+	}
+
+	if cm.config.ProbeMode == ProbeAll {
+		for _, ok := range results {
+			if !ok {
+				return false
+			}
+		}
+		return len(results) > 0
+	}
+	for _, ok := range results {
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dial reports whether a TCP connection to address succeeds within
+// CONNECT_TIMEOUT.
+func (cm *ConnectivityMonitor) dial(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, cm.config.ConnectTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// recordProbe counts a probe result and changes the status once
+// MONITOR_ONLINE_THRESHOLD successes or MONITOR_OFFLINE_THRESHOLD failures
+// have been seen in a row, so a flaky network does not flip it on every probe.
+func (cm *ConnectivityMonitor) recordProbe(isOnline bool) {
 	cm.mu.Lock()
 	oldStatus := cm.status
 	if isOnline {
-		cm.status = StatusOnline
+		cm.successes++
+		cm.failures = 0
+		if cm.successes >= cm.config.OnlineThreshold {
+			cm.status = StatusOnline
+		}
 	} else {
-		cm.status = StatusOffline
+		cm.failures++
+		cm.successes = 0
+		if cm.failures >= cm.config.OfflineThreshold {
+			cm.status = StatusOffline
+		}
 	}
-	
+
 	if oldStatus != cm.status {
+		if isOnline {
+			cm.offlineSince = time.Time{}
+		} else {
+			cm.offlineSince = time.Now()
+		}
 		log.Printf("Connectivity status changed: %s", cm.statusString())
 		cm.notifyWatchers()
 	}
 	cm.mu.Unlock()
 }
 
-func (cm *ConnectivityMonitor) checkKafkaConnectivity() bool {
+func (cm *ConnectivityMonitor) checkKafkaConnectivity(dial func(address string) bool) bool {
 	for _, broker := range cm.kafka.Brokers {
 		host := strings.Split(broker, ":")[0]
 		port := "9092"
@@ -76,12 +192,9 @@ func (cm *ConnectivityMonitor) checkKafkaConnectivity() bool {
 			port = parts[1]
 		}
 
-		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), cm.config.ConnectTimeout)
-		if err != nil {
-			continue
+		if dial(net.JoinHostPort(host, port)) {
+			return true
 		}
-		conn.Close()
-		return true
 	}
 	return false
 }
@@ -92,6 +205,17 @@ func (cm *ConnectivityMonitor) IsOnline() bool {
 	return cm.status == StatusOnline
 }
 
+// OfflineFor returns how long Kafka has been unreachable, or 0 while it is
+// reachable. The service starts offline until the first check succeeds.
+func (cm *ConnectivityMonitor) OfflineFor() time.Duration {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	if cm.status == StatusOnline {
+		return 0
+	}
+	return time.Since(cm.offlineSince)
+}
+
 func (cm *ConnectivityMonitor) Subscribe() <-chan ConnectivityStatus {
 	cm.mu.Lock()
 	defer cm.mu.Unlock()
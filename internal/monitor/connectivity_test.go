@@ -0,0 +1,268 @@
+package monitor
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/config"
+)
+
+// newTestConnectivity returns a monitor probing targets only, with the given
+// thresholds.
+func newTestConnectivity(t *testing.T, online, offline int, targets ...string) *ConnectivityMonitor {
+	t.Helper()
+	cm, err := NewConnectivityMonitor(&config.Config{Monitor: config.MonitorConfig{
+		Interval:         time.Hour,
+		ConnectTimeout:   time.Second,
+		OnlineThreshold:  online,
+		OfflineThreshold: offline,
+		ProbeTargets:     targets,
+		ProbeMode:        ProbeAny,
+	}})
+	if err != nil {
+		t.Fatalf("NewConnectivityMonitor: %v", err)
+	}
+	return cm
+}
+
+// listen returns the address of a local port that accepts connections until
+// the test ends.
+func listen(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRecordProbeDebounces(t *testing.T) {
+	tests := []struct {
+		name            string
+		online, offline int
+		probes          []bool
+		// want is the status after each probe
+		want []bool
+	}{
+		{
+			name:   "flapping never goes online",
+			online: 2, offline: 2,
+			probes: []bool{true, false, true, false, true, false},
+			want:   []bool{false, false, false, false, false, false},
+		},
+		{
+			name:   "online after consecutive successes",
+			online: 3, offline: 1,
+			probes: []bool{true, true, false, true, true, true},
+			want:   []bool{false, false, false, false, false, true},
+		},
+		{
+			name:   "flapping while online stays online",
+			online: 1, offline: 3,
+			probes: []bool{true, false, false, true, false, false, true},
+			want:   []bool{true, true, true, true, true, true, true},
+		},
+		{
+			name:   "offline after consecutive failures",
+			online: 1, offline: 2,
+			probes: []bool{true, false, true, false, false, true},
+			want:   []bool{true, true, true, true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestConnectivity(t, tt.online, tt.offline, "127.0.0.1:1")
+			for i, probe := range tt.probes {
+				cm.recordProbe(probe)
+				if got := cm.IsOnline(); got != tt.want[i] {
+					t.Fatalf("after probes %v: online = %v, want %v", tt.probes[:i+1], got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestProbeModes(t *testing.T) {
+	up := map[string]bool{"broker:9092": true, "proxy:8080": true}
+	dial := func(address string) bool { return up[address] }
+
+	tests := []struct {
+		name       string
+		mode       string
+		probeKafka bool
+		brokers    []string
+		targets    []string
+		want       bool
+	}{
+		{"kafka only, reachable", ProbeAny, true, []string{"down:9092", "broker"}, nil, true},
+		{"kafka only, unreachable", ProbeAny, true, []string{"down:9092"}, nil, false},
+		{"any with one target up", ProbeAny, true, []string{"down:9092"}, []string{"proxy:8080"}, true},
+		{"any with every target down", ProbeAny, false, nil, []string{"down:1", "down:2"}, false},
+		{"all with every target up", ProbeAll, true, []string{"broker:9092"}, []string{"proxy:8080"}, true},
+		{"all with one target down", ProbeAll, true, []string{"broker:9092"}, []string{"proxy:8080", "down:1"}, false},
+		{"all with kafka down", ProbeAll, true, []string{"down:9092"}, []string{"proxy:8080"}, false},
+		{"targets instead of kafka", ProbeAll, false, []string{"down:9092"}, []string{"proxy:8080"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := &ConnectivityMonitor{
+				config: &config.MonitorConfig{ProbeMode: tt.mode, ProbeKafka: tt.probeKafka, ProbeTargets: tt.targets},
+				kafka:  &config.KafkaConfig{Brokers: tt.brokers},
+			}
+			if got := cm.probe(dial); got != tt.want {
+				t.Fatalf("probe = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnlineQuicklyAtStartup(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial time.Duration
+		// online is whether it goes online well within the hour-long
+		// regular interval
+		online bool
+	}{
+		{"initial interval", 10 * time.Millisecond, true},
+		{"regular interval only", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Two probes are needed, so going online waits for the first tick
+			cm := newTestConnectivity(t, 2, 1, listen(t))
+			cm.config.InitialInterval = tt.initial
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go cm.Start(ctx)
+
+			wait := time.Second
+			if !tt.online {
+				wait = 200 * time.Millisecond
+			}
+			start := time.Now()
+			waitCtx, waitCancel := context.WithTimeout(ctx, wait)
+			defer waitCancel()
+			err := cm.WaitForOnline(waitCtx)
+			if !tt.online {
+				if err == nil {
+					t.Fatal("online before the regular interval without an initial interval")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("not online within a second of start: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("online after %v, want about one initial interval", elapsed)
+			}
+			if cm.OfflineFor() != 0 {
+				t.Fatalf("OfflineFor = %v while online", cm.OfflineFor())
+			}
+		})
+	}
+
+	t.Setenv("CONFIG_FILE", "")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	if cfg.Monitor.InitialInterval <= 0 || cfg.Monitor.InitialInterval >= cfg.Monitor.Interval {
+		t.Errorf("default MONITOR_INITIAL_INTERVAL %v, want shorter than MONITOR_INTERVAL %v", cfg.Monitor.InitialInterval, cfg.Monitor.Interval)
+	}
+}
+
+func TestRecheckUpdatesStatusAndNotifies(t *testing.T) {
+	cm := newTestConnectivity(t, 1, 1, listen(t))
+	watcher := cm.Subscribe()
+	if status := <-watcher; status != StatusOffline {
+		t.Fatalf("initial status %v, want offline", status)
+	}
+
+	if !cm.Recheck() {
+		t.Fatal("Recheck reported the listening target unreachable")
+	}
+	if !cm.IsOnline() {
+		t.Fatal("still offline after a successful recheck")
+	}
+	select {
+	case status := <-watcher:
+		if status != StatusOnline {
+			t.Fatalf("watcher got %v, want online", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher was not notified of the change")
+	}
+
+	// A target that stops listening takes it offline again on the next
+	// recheck
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	cm.config.ProbeTargets = []string{closed.Addr().String()}
+	closed.Close()
+	if cm.Recheck() {
+		t.Fatal("Recheck reported a closed port reachable")
+	}
+	select {
+	case status := <-watcher:
+		if status != StatusOffline {
+			t.Fatalf("watcher got %v, want offline", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher was not notified of going offline")
+	}
+}
+
+func TestProbeModeAgainstListeners(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	down := closed.Addr().String()
+	closed.Close()
+	up := listen(t)
+
+	for _, tt := range []struct {
+		mode string
+		want bool
+	}{
+		{ProbeAny, true},
+		{ProbeAll, false},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			cm := newTestConnectivity(t, 1, 1, up, down)
+			cm.config.ProbeMode = tt.mode
+			if got := cm.Recheck(); got != tt.want {
+				t.Fatalf("Recheck with %s up and %s down = %v, want %v", up, down, got, tt.want)
+			}
+			if cm.IsOnline() != tt.want {
+				t.Fatalf("online = %v, want %v", cm.IsOnline(), tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidProbeModeRejected(t *testing.T) {
+	_, err := NewConnectivityMonitor(&config.Config{Monitor: config.MonitorConfig{
+		ProbeTargets: []string{"127.0.0.1:1"},
+		ProbeMode:    "most",
+	}})
+	if err == nil {
+		t.Fatal("NewConnectivityMonitor accepted MONITOR_PROBE_MODE=most")
+	}
+}
@@ -2,71 +2,408 @@ package monitor
 
 import (
 	"context"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
 	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/logging"
+	"buffered-cdc/internal/metrics"
+	"buffered-cdc/internal/workers"
 
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type MongoMonitor struct {
-	client     *mongo.Client
-	database   *mongo.Database
-	collection *mongo.Collection
-	buffer     *buffer.Buffer
-	config     *config.MongoDBConfig
+	client      *mongo.Client
+	database    *mongo.Database
+	collection  *mongo.Collection
+	buffer      *buffer.Buffer
+	config      *config.MongoDBConfig
+	ignoreOps   map[string]bool
+	priorityOps map[string]bool
+	defaultTTL  time.Duration
+	clock       clock.Clock
+	jsonMode    string
+	pool        *workers.Pool
+	// snapshotDone is set once the snapshot has been taken and the change
+	// stream opened after it, so supervisor restarts do not repeat it.
+	snapshotDone bool
+	// resumeToken is the token of the last change handled. A restarted
+	// stream resumes after it instead of starting from the current time.
+	resumeToken bson.Raw
+	// invalidated is set when the last stream ended with an invalidate
+	// event. Its token cannot be resumed after, only started after.
+	invalidated bool
+	// emit stores captured events; it is set by Start.
+	emit func(*buffer.Event) error
+	// keyTime is BUFFER_KEY_TIME, which orders the buffer.
+	keyTime string
+	// maxDocBytes and oversizePolicy are CAPTURE_MAX_DOC_BYTES and
+	// CAPTURE_OVERSIZE_POLICY.
+	maxDocBytes    int
+	oversizePolicy string
+	// delayThresholds are the MONITOR_DELAY_THRESHOLDS overrides, by
+	// collection.
+	delayThresholds map[string]time.Duration
 }
 
+// ErrInvalidated is returned by Start when the change stream was invalidated
+// and MONGODB_ON_INVALIDATE=stop.
+var ErrInvalidated = errors.New("change stream invalidated")
+
+// Values for MONGODB_WATCH_SCOPE, which selects what the change stream covers.
+const (
+	WatchScopeCollection = "collection"
+	// WatchScopeDatabase watches every collection in MONGODB_DATABASE.
+	WatchScopeDatabase = "database"
+	// WatchScopeDeployment watches every database except admin, local and
+	// config.
+	WatchScopeDeployment = "deployment"
+)
+
+// Values for MONGODB_ON_INVALIDATE, which controls what happens when the
+// watched collection or database is dropped or renamed.
+const (
+	// InvalidateRestart opens a new stream after the invalidate event, which
+	// picks up the collection or database once it is created again.
+	InvalidateRestart = "restart"
+	// InvalidateStop stops capture and shuts the service down.
+	InvalidateStop = "stop"
+)
+
+// Values for MONGODB_DELETE_LOOKUP, which controls how the deleted document is
+// attached to delete events as fullDocumentBeforeChange.
+const (
+	DeleteLookupNone = "none"
+	// DeleteLookupBuffer reuses the fullDocument of the newest insert, update
+	// or replace of the same document that is still waiting in the buffer.
+	DeleteLookupBuffer = "buffer"
+	// DeleteLookupPreImage asks MongoDB for the pre-image. The collection must
+	// have changeStreamPreAndPostImages enabled (MongoDB 6.0+).
+	DeleteLookupPreImage = "preimage"
+)
+
+// Values for BUFFER_KEY_TIME, which decides the time events are keyed, and
+// so ordered, by in the buffer.
+const (
+	// KeyTimeCapture keys events by when they were captured.
+	KeyTimeCapture = "capture"
+	// KeyTimeCluster keys events by their clusterTime, so a backlog read
+	// after a reconnect or a resume is still ordered as MongoDB applied the
+	// changes. Events without one fall back to their capture time.
+	KeyTimeCluster = "cluster"
+)
+
+// Values for CAPTURE_OVERSIZE_POLICY, which decides what happens to an event
+// whose data exceeds CAPTURE_MAX_DOC_BYTES.
+const (
+	// OversizeDeadLetter stores the event in the dead-letter bucket as it
+	// is, so it can be inspected and requeued.
+	OversizeDeadLetter = "deadletter"
+	// OversizeReference sends the event without its documents: documentKey,
+	// namespace and cluster time are kept so consumers can fetch the
+	// document from MongoDB.
+	OversizeReference = "reference"
+)
+
+// Values for MONGODB_MISSING_DOCUMENT, which decides what happens to an
+// insert, replace or update that arrives without the fullDocument it should
+// carry, typically an update whose document was deleted before the lookup.
+const (
+	// MissingDocumentInclude buffers the event without a document.
+	MissingDocumentInclude = "include"
+	// MissingDocumentSkip drops the event.
+	MissingDocumentSkip = "skip"
+	// MissingDocumentRequery reads the document by its documentKey. The
+	// result is the document as it is now, which may include later writes.
+	// When it is gone the event is buffered without one.
+	MissingDocumentRequery = "requery"
+)
+
+// Values for MONGODB_FULL_DOCUMENT, which controls whether update events carry
+// the whole document as well as their updateDescription.
+const (
+	// FullDocumentDefault sends updates with only the updateDescription delta.
+	FullDocumentDefault = "default"
+	// FullDocumentUpdateLookup looks up the current document for each update.
+	// It may reflect later writes than the update itself.
+	FullDocumentUpdateLookup = "updateLookup"
+	// FullDocumentWhenAvailable and FullDocumentRequired use post-images,
+	// which need changeStreamPreAndPostImages enabled (MongoDB 6.0+).
+	FullDocumentWhenAvailable = "whenAvailable"
+	FullDocumentRequired      = "required"
+)
+
+// Values for KAFKA_JSON_MODE, which controls how BSON values in the event data
+// are represented in JSON.
+const (
+	JSONModeStandard = "standard"
+	// JSONModeExtended uses relaxed Extended JSON: {"$oid": ...} and
+	// {"$date": ...} wrappers, with plain JSON numbers.
+	JSONModeExtended = "extended"
+	// JSONModeCanonical uses canonical Extended JSON, which also keeps
+	// numeric types such as {"$numberLong": ...}.
+	JSONModeCanonical = "canonical"
+)
+
 type ChangeStreamEvent struct {
 	ID            interface{}            `bson:"_id"`
 	OperationType string                 `bson:"operationType"`
 	FullDocument  map[string]interface{} `bson:"fullDocument,omitempty"`
+	FullDocumentBeforeChange map[string]interface{} `bson:"fullDocumentBeforeChange,omitempty"`
+	// UpdateDescription is the delta of an update: updatedFields,
+	// removedFields and truncatedArrays.
+	UpdateDescription map[string]interface{} `bson:"updateDescription,omitempty"`
 	DocumentKey   map[string]interface{} `bson:"documentKey"`
 	ClusterTime   interface{}            `bson:"clusterTime"`
+	// Namespace is the database and collection the change happened in. It
+	// is missing for events such as dropDatabase that have no collection.
+	Namespace Namespace `bson:"ns"`
 }
 
-func NewMongoMonitor(cfg *config.Config, buf *buffer.Buffer) (*MongoMonitor, error) {
-	clientOptions := options.Client().
-		ApplyURI(cfg.MongoDB.URI).
-		SetMaxPoolSize(uint64(cfg.MongoDB.MaxPoolSize)).
-		SetMinPoolSize(uint64(cfg.MongoDB.MinPoolSize)).
-		SetMaxConnIdleTime(cfg.MongoDB.MaxConnIdleTime).
-		SetMaxConnecting(uint64(cfg.MongoDB.MaxPoolSize/2)).
-		SetRetryWrites(true).
-		SetRetryReads(true)
-		
-	client, err := mongo.Connect(context.Background(), clientOptions)
+// Namespace identifies a collection in a change stream event.
+type Namespace struct {
+	DB   string `bson:"db"`
+	Coll string `bson:"coll,omitempty"`
+}
+
+func NewMongoMonitor(ctx context.Context, cfg *config.Config, buf *buffer.Buffer, clk clock.Clock, pool *workers.Pool) (*MongoMonitor, error) {
+	switch cfg.Kafka.JSONMode {
+	case JSONModeStandard, JSONModeExtended, JSONModeCanonical:
+	default:
+		return nil, fmt.Errorf("invalid KAFKA_JSON_MODE %q: must be standard, extended or canonical", cfg.Kafka.JSONMode)
+	}
+
+	switch cfg.MongoDB.FullDocument {
+	case FullDocumentDefault, FullDocumentUpdateLookup, FullDocumentWhenAvailable, FullDocumentRequired:
+	default:
+		return nil, fmt.Errorf("invalid MONGODB_FULL_DOCUMENT %q: must be default, updateLookup, whenAvailable or required", cfg.MongoDB.FullDocument)
+	}
+
+	switch cfg.Capture.OversizePolicy {
+	case OversizeDeadLetter, OversizeReference:
+	default:
+		return nil, fmt.Errorf("invalid CAPTURE_OVERSIZE_POLICY %q: must be deadletter or reference", cfg.Capture.OversizePolicy)
+	}
+
+	switch cfg.MongoDB.MissingDocument {
+	case MissingDocumentInclude, MissingDocumentSkip, MissingDocumentRequery:
+	default:
+		return nil, fmt.Errorf("invalid MONGODB_MISSING_DOCUMENT %q: must be include, skip or requery", cfg.MongoDB.MissingDocument)
+	}
+
+	switch cfg.Buffer.KeyTime {
+	case KeyTimeCapture, KeyTimeCluster:
+	default:
+		return nil, fmt.Errorf("invalid BUFFER_KEY_TIME %q: must be capture or cluster", cfg.Buffer.KeyTime)
+	}
+
+	switch cfg.MongoDB.OnInvalidate {
+	case InvalidateRestart, InvalidateStop:
+	default:
+		return nil, fmt.Errorf("invalid MONGODB_ON_INVALIDATE %q: must be restart or stop", cfg.MongoDB.OnInvalidate)
+	}
+
+	switch cfg.MongoDB.WatchScope {
+	case WatchScopeCollection:
+	case WatchScopeDatabase, WatchScopeDeployment:
+		if cfg.MongoDB.Snapshot {
+			return nil, fmt.Errorf("MONGODB_SNAPSHOT requires MONGODB_WATCH_SCOPE=collection, got %q", cfg.MongoDB.WatchScope)
+		}
+	default:
+		return nil, fmt.Errorf("invalid MONGODB_WATCH_SCOPE %q: must be collection, database or deployment", cfg.MongoDB.WatchScope)
+	}
+
+	delayThresholds, err := parseDelayThresholds(cfg.MongoDB.DelayThresholds)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+		return nil, err
+	}
+
+	log.Printf("Connecting to MongoDB at %s", config.RedactURI(cfg.MongoDB.URI))
+	client, err := connectWithRetry(ctx, &cfg.MongoDB, dialMongo(clientOptions(&cfg.MongoDB), cfg.MongoDB.ConnectTimeout))
+	if err != nil {
+		return nil, err
 	}
 
 	database := client.Database(cfg.MongoDB.Database)
 	collection := database.Collection(cfg.MongoDB.Collection)
 
+	ignoreOps := make(map[string]bool)
+	for _, op := range cfg.MongoDB.IgnoreOperations {
+		ignoreOps[op] = true
+	}
+
+	priorityOps := make(map[string]bool)
+	for _, op := range cfg.MongoDB.PriorityOperations {
+		priorityOps[op] = true
+	}
+
 	return &MongoMonitor{
-		client:     client,
-		database:   database,
-		collection: collection,
-		buffer:     buf,
-		config:     &cfg.MongoDB,
+		client:          client,
+		database:        database,
+		collection:      collection,
+		buffer:          buf,
+		config:          &cfg.MongoDB,
+		ignoreOps:       ignoreOps,
+		priorityOps:     priorityOps,
+		defaultTTL:      cfg.Buffer.EventTTL,
+		clock:           clk,
+		jsonMode:        cfg.Kafka.JSONMode,
+		pool:            pool,
+		keyTime:         cfg.Buffer.KeyTime,
+		maxDocBytes:     cfg.Capture.MaxDocBytes,
+		oversizePolicy:  cfg.Capture.OversizePolicy,
+		delayThresholds: delayThresholds,
 	}, nil
 }
 
-func (mm *MongoMonitor) Start(ctx context.Context) error {
+// clientOptions builds the driver options from the config. Settings in the URI
+// are overridden by the explicit pool settings.
+func clientOptions(cfg *config.MongoDBConfig) *options.ClientOptions {
+	opts := options.Client().
+		ApplyURI(cfg.URI).
+		SetMaxPoolSize(uint64(cfg.MaxPoolSize)).
+		SetMinPoolSize(uint64(cfg.MinPoolSize)).
+		SetMaxConnIdleTime(cfg.MaxConnIdleTime).
+		SetMaxConnecting(uint64(cfg.MaxPoolSize/2)).
+		SetRetryWrites(true).
+		SetRetryReads(true)
+
+	if cfg.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(cfg.ServerSelectionTimeout)
+	}
+	return opts
+}
+
+// errInvalidOptions marks a dial failure that retrying will not fix.
+var errInvalidOptions = errors.New("invalid MongoDB client options")
+
+// dialFunc connects to MongoDB and returns the client once the server has
+// answered.
+type dialFunc func(ctx context.Context) (*mongo.Client, error)
+
+// dialMongo connects with opts and pings the server within timeout.
+// mongo.Connect does not dial, so the ping is what proves the server is up.
+func dialMongo(opts *options.ClientOptions, timeout time.Duration) dialFunc {
+	return func(ctx context.Context) (*mongo.Client, error) {
+		client, err := mongo.Connect(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidOptions, err)
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		err = client.Ping(pingCtx, nil)
+		cancel()
+		if err != nil {
+			client.Disconnect(context.Background())
+			return nil, err
+		}
+		return client, nil
+	}
+}
+
+// connectWithRetry dials MongoDB, retrying with exponential backoff so the
+// service survives MongoDB starting slightly after it. It gives up after
+// MONGODB_CONNECT_RETRIES retries, or as soon as ctx is done.
+func connectWithRetry(ctx context.Context, cfg *config.MongoDBConfig, dial dialFunc) (*mongo.Client, error) {
+	backoff := cfg.ConnectBackoff
+	var lastErr error
+
+	for attempt := 0; attempt <= cfg.ConnectRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("MongoDB connect attempt %d failed: %v - retrying in %v", attempt, lastErr, backoff)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("stopped connecting to MongoDB after %d attempts: %w (last error: %v)", attempt, ctx.Err(), lastErr)
+			case <-timer.C:
+			}
+			backoff *= 2
+			if backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+		}
+
+		client, err := dial(ctx)
+		if err == nil {
+			return client, nil
+		}
+		if errors.Is(err, errInvalidOptions) || ctx.Err() != nil {
+			return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+		}
+		lastErr = err
+	}
+
+	return nil, fmt.Errorf("failed to connect to MongoDB after %d attempts: %w", cfg.ConnectRetries+1, lastErr)
+}
+
+// Start watches the change stream, emitting every change that is not
+// ignored, until ctx is done or the stream fails.
+func (mm *MongoMonitor) Start(ctx context.Context, emit func(*buffer.Event) error) error {
 	log.Println("Starting MongoDB change stream monitor")
+	mm.emit = emit
 
+	for {
+		if err := mm.stream(ctx); err != nil {
+			return err
+		}
+		if !mm.invalidated || ctx.Err() != nil {
+			return nil
+		}
+		if mm.config.OnInvalidate == InvalidateStop {
+			return ErrInvalidated
+		}
+		log.Println("Reopening the change stream after the invalidate event")
+	}
+}
+
+// stream opens one change stream and handles its events until it ends. An
+// invalidate event ends it with mm.invalidated set.
+func (mm *MongoMonitor) stream(ctx context.Context) error {
 	pipeline := mongo.Pipeline{}
-	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	opts := options.ChangeStream().SetFullDocument(options.FullDocument(mm.config.FullDocument))
+	if mm.config.DeleteLookup == DeleteLookupPreImage {
+		opts.SetFullDocumentBeforeChange(options.WhenAvailable)
+	}
+
+	if mm.config.Snapshot && !mm.snapshotDone {
+		startAt, err := mm.snapshot(ctx)
+		if err != nil {
+			return fmt.Errorf("snapshot failed: %w", err)
+		}
+		opts.SetStartAtOperationTime(startAt)
+	}
+
+	// A restart continues after the last handled change. The token is valid
+	// for the same scope it came from, which cannot change while running.
+	// resumeAfter rejects the token of an invalidate event, so after one
+	// the stream is started after it instead.
+	if mm.resumeToken != nil {
+		if mm.invalidated {
+			opts.SetStartAfter(mm.resumeToken)
+		} else {
+			opts.SetResumeAfter(mm.resumeToken)
+		}
+	}
 
-	changeStream, err := mm.collection.Watch(ctx, pipeline, opts)
+	changeStream, err := mm.watch(ctx, pipeline, opts)
 	if err != nil {
 		return fmt.Errorf("failed to create change stream: %w", err)
 	}
 	defer changeStream.Close(ctx)
+	mm.snapshotDone = true
+	mm.setResumeToken(changeStream.ResumeToken())
 
 	for changeStream.Next(ctx) {
 		var event ChangeStreamEvent
@@ -75,9 +412,19 @@ func (mm *MongoMonitor) Start(ctx context.Context) error {
 			continue
 		}
 
-		if err := mm.handleChangeEvent(&event); err != nil {
+		if event.OperationType == "invalidate" {
+			// The server closes the stream after this event
+			log.Printf("Change stream invalidated: the watched collection or database was dropped or renamed")
+			metrics.StreamInvalidations.Inc()
+			mm.resumeToken = changeStream.ResumeToken()
+			mm.invalidated = true
+			return nil
+		}
+
+		if err := mm.handleChangeEvent(ctx, &event); err != nil {
 			log.Printf("Failed to handle change event: %v", err)
 		}
+		mm.setResumeToken(changeStream.ResumeToken())
 	}
 
 	if err := changeStream.Err(); err != nil {
@@ -87,60 +434,400 @@ func (mm *MongoMonitor) Start(ctx context.Context) error {
 	return nil
 }
 
-func (mm *MongoMonitor) handleChangeEvent(event *ChangeStreamEvent) error {
+// setResumeToken records the token to resume from. A stream started after an
+// invalidate event reports that event's token until it has read past it, so
+// the stream only counts as recovered once the token moves on.
+func (mm *MongoMonitor) setResumeToken(token bson.Raw) {
+	if token == nil {
+		return
+	}
+	if mm.invalidated && !bytes.Equal(token, mm.resumeToken) {
+		mm.invalidated = false
+	}
+	mm.resumeToken = token
+}
+
+// watch opens the change stream on the collection, database or whole
+// deployment according to MONGODB_WATCH_SCOPE.
+func (mm *MongoMonitor) watch(ctx context.Context, pipeline mongo.Pipeline, opts *options.ChangeStreamOptions) (*mongo.ChangeStream, error) {
+	switch mm.config.WatchScope {
+	case WatchScopeDatabase:
+		log.Printf("Watching all collections in database %s", mm.config.Database)
+		return mm.database.Watch(ctx, pipeline, opts)
+	case WatchScopeDeployment:
+		log.Println("Watching all databases in the deployment")
+		return mm.client.Watch(ctx, pipeline, opts)
+	default:
+		log.Printf("Watching collection %s.%s", mm.config.Database, mm.config.Collection)
+		return mm.collection.Watch(ctx, pipeline, opts)
+	}
+}
+
+// storedLog samples the line logged for every stored change.
+var storedLog = logging.NewSampler("change events stored")
+
+// handleChangeEvent converts a change to a buffer event and emits it.
+func (mm *MongoMonitor) handleChangeEvent(ctx context.Context, event *ChangeStreamEvent) error {
+	if mm.ignoreOps[event.OperationType] {
+		metrics.EventsIgnored.WithLabelValues(event.OperationType).Inc()
+		return nil
+	}
+	if mm.missingDocument(event) && !mm.resolveMissingDocument(ctx, event) {
+		return nil
+	}
+
+	bufferEvent, err := mm.bufferEvent(event)
+	if err != nil {
+		return err
+	}
+	if err := mm.limitSize(bufferEvent); err != nil {
+		return err
+	}
+
+	if err := mm.emit(bufferEvent); err != nil {
+		return fmt.Errorf("failed to store event in buffer: %w", err)
+	}
+	if bufferEvent.DeadLetterReason != "" {
+		log.Printf("Dead-lettered change event: %s for document %v in %s.%s: %s",
+			event.OperationType, event.DocumentKey, event.Namespace.DB, event.Namespace.Coll, bufferEvent.DeadLetterReason)
+	} else if bufferEvent.DelayedUntil != nil && bufferEvent.DelayedUntil.After(bufferEvent.Timestamp) {
+		storedLog.Printf("Stored delayed change event: %s for document %v in %s.%s, ready at %v",
+			event.OperationType, event.DocumentKey, event.Namespace.DB, event.Namespace.Coll, bufferEvent.DelayedUntil)
+	} else {
+		storedLog.Printf("Stored immediate change event: %s for document %v in %s.%s",
+			event.OperationType, event.DocumentKey, event.Namespace.DB, event.Namespace.Coll)
+	}
+
+	metrics.EventsCaptured.WithLabelValues(event.OperationType).Inc()
+	return nil
+}
+
+// missingDocument reports whether event should carry a fullDocument but has
+// none. Deletes never do, and updates only when MONGODB_FULL_DOCUMENT asks
+// for one.
+func (mm *MongoMonitor) missingDocument(event *ChangeStreamEvent) bool {
+	if event.FullDocument != nil || event.DocumentKey == nil {
+		return false
+	}
+	switch event.OperationType {
+	case "insert", "replace":
+		return true
+	case "update":
+		return mm.config.FullDocument != FullDocumentDefault
+	}
+	return false
+}
+
+// resolveMissingDocument applies MONGODB_MISSING_DOCUMENT to an event
+// without its fullDocument, reporting whether the event should be buffered.
+// A failed requery is logged and the event is buffered without a document.
+func (mm *MongoMonitor) resolveMissingDocument(ctx context.Context, event *ChangeStreamEvent) bool {
+	policy := mm.config.MissingDocument
+	metrics.EventsMissingDocument.WithLabelValues(policy).Inc()
+	switch policy {
+	case MissingDocumentSkip:
+		log.Printf("Skipping %s event without a document for %v in %s.%s", event.OperationType, event.DocumentKey, event.Namespace.DB, event.Namespace.Coll)
+		return false
+	case MissingDocumentRequery:
+		var doc map[string]interface{}
+		coll := mm.client.Database(event.Namespace.DB).Collection(event.Namespace.Coll)
+		err := coll.FindOne(ctx, event.DocumentKey).Decode(&doc)
+		switch {
+		case err == nil:
+			event.FullDocument = doc
+		case errors.Is(err, mongo.ErrNoDocuments):
+			log.Printf("Document %v in %s.%s no longer exists, buffering %s event without it", event.DocumentKey, event.Namespace.DB, event.Namespace.Coll, event.OperationType)
+		default:
+			log.Printf("WARNING: failed to look up document %v in %s.%s, buffering %s event without it: %v", event.DocumentKey, event.Namespace.DB, event.Namespace.Coll, event.OperationType, err)
+		}
+	}
+	return true
+}
+
+// bufferEvent builds the buffer event for a change: its ready time, expiry
+// and priority, and the data sent downstream.
+func (mm *MongoMonitor) bufferEvent(event *ChangeStreamEvent) (*buffer.Event, error) {
 	var delayedUntil *time.Time
 	
-	// Extract delayedUntil from fullDocument if it exists
+	now := mm.clock.Now()
+
+	// Extract the ready time from fullDocument if it exists. One within the
+	// collection's delay threshold is not worth holding back.
+	var deadLetterReason string
 	if event.FullDocument != nil {
-		if delayTimeVal, exists := event.FullDocument["delayedUntil"]; exists && delayTimeVal != nil {
-			if delayTimeStr, ok := delayTimeVal.(string); ok {
-				if parsedTime, err := time.Parse(time.RFC3339, delayTimeStr); err == nil {
-					delayedUntil = &parsedTime
-				}
+		if readyTime, ok := parseReadyTime(lookupPath(event.FullDocument, mm.config.ReadyTimeField)); ok &&
+			readyTime.Sub(now) > mm.delayThreshold(event.Namespace.Coll) {
+			delayedUntil = &readyTime
+			// Rather than let it sit in the buffer for years
+			if horizon := mm.config.MaxScheduleHorizon; horizon > 0 && readyTime.Sub(now) > horizon {
+				metrics.EventsBeyondHorizon.Inc()
+				deadLetterReason = fmt.Sprintf("ready time %s is beyond MAX_SCHEDULE_HORIZON (%s)", readyTime.UTC().Format(time.RFC3339), horizon)
 			}
 		}
 	}
 
+	var expiresAt *time.Time
+	if ttl := mm.eventTTL(event); ttl > 0 {
+		expiry := now.Add(ttl)
+		expiresAt = &expiry
+	}
+
 	bufferEvent := &buffer.Event{
 		ID:          fmt.Sprintf("%v", event.ID),
 		Operation:   event.OperationType,
-		Timestamp:   time.Now(),
+		Timestamp:   now,
+		ExpiresAt:   expiresAt,
+		Priority:    mm.eventPriority(event),
 		DelayedUntil: delayedUntil,
+		DeadLetterReason: deadLetterReason,
 		Data: map[string]interface{}{
 			"documentKey":   event.DocumentKey,
 			"fullDocument":  event.FullDocument,
 			"clusterTime":   event.ClusterTime,
 			"operationType": event.OperationType,
+			"ns": map[string]interface{}{
+				"db":   event.Namespace.DB,
+				"coll": event.Namespace.Coll,
+			},
 		},
 		Retries: 0,
 	}
 
-	// Check if we should send immediately or delay
-	shouldDelay := false
-	if delayedUntil != nil {
-		// Delay if delayedUntil is in the future
-		if delayedUntil.After(time.Now()) {
-			shouldDelay = true
+	// Otherwise the buffer keys the event by its capture time on Store
+	if ts, ok := event.ClusterTime.(primitive.Timestamp); ok && ts.T != 0 && mm.keyTime == KeyTimeCluster {
+		bufferEvent.Key = buffer.ClusterKey(ts.T, ts.I)
+	}
+
+	if event.UpdateDescription != nil {
+		bufferEvent.Data["updateDescription"] = event.UpdateDescription
+	}
+
+	if event.OperationType == "delete" && mm.config.DeleteLookup == DeleteLookupPreImage && event.FullDocumentBeforeChange != nil {
+		bufferEvent.Data["fullDocumentBeforeChange"] = event.FullDocumentBeforeChange
+	}
+
+	data, err := mm.encodeData(bufferEvent.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event data: %w", err)
+	}
+	bufferEvent.Data = data
+
+	// Buffered documents are already encoded, so this is added afterwards
+	if before := mm.bufferedBeforeChange(event); before != nil {
+		bufferEvent.Data["fullDocumentBeforeChange"] = before
+	}
+
+	return bufferEvent, nil
+}
+
+// oversizedFields are the documents dropped from an event under
+// OversizeReference.
+var oversizedFields = []string{"fullDocument", "fullDocumentBeforeChange", "updateDescription"}
+
+// limitSize applies CAPTURE_MAX_DOC_BYTES to event. The limit is on the JSON
+// encoding of its data, which is what the buffer and Kafka carry.
+func (mm *MongoMonitor) limitSize(event *buffer.Event) error {
+	if mm.maxDocBytes <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return fmt.Errorf("failed to encode event data: %w", err)
+	}
+	if len(data) <= mm.maxDocBytes {
+		return nil
+	}
+
+	metrics.EventsOversized.WithLabelValues(mm.oversizePolicy).Inc()
+	reason := fmt.Sprintf("event data is %d bytes, above CAPTURE_MAX_DOC_BYTES (%d)", len(data), mm.maxDocBytes)
+	if mm.oversizePolicy == OversizeDeadLetter {
+		event.DeadLetterReason = reason
+		return nil
+	}
+
+	log.Printf("WARNING: sending event %s without its documents: %s", event.ID, reason)
+	for _, field := range oversizedFields {
+		delete(event.Data, field)
+	}
+	event.Data["oversized"] = map[string]interface{}{"bytes": len(data)}
+	return nil
+}
+
+// bufferedBeforeChange returns the document a delete removed when
+// MONGODB_DELETE_LOOKUP=buffer and an earlier change to it is still buffered.
+// This is best-effort: the buffer only holds changes that have not been synced
+// yet. (With preimage, MongoDB supplies fullDocumentBeforeChange itself, for
+// collections configured to record pre-images.)
+func (mm *MongoMonitor) bufferedBeforeChange(event *ChangeStreamEvent) interface{} {
+	if event.OperationType != "delete" || mm.config.DeleteLookup != DeleteLookupBuffer {
+		return nil
+	}
+
+	// Stored events have been through encodeData and JSON, so compare
+	// documentKeys after the same conversion.
+	encoded, err := mm.encodeData(map[string]interface{}{"documentKey": event.DocumentKey})
+	if err != nil {
+		return nil
+	}
+	// documentKeys are only unique within a collection
+	previous, err := mm.buffer.LatestForDocument(event.Namespace.DB, event.Namespace.Coll, encoded["documentKey"], func(buffered *buffer.Event) bool {
+		return buffered.Data["fullDocument"] != nil
+	})
+	if err != nil {
+		log.Printf("Failed to look up buffered document for delete %v: %v", event.DocumentKey, err)
+		return nil
+	}
+	if previous == nil {
+		return nil
+	}
+	return previous.Data["fullDocument"]
+}
+
+// encodeData converts the BSON values in an event's data to MongoDB Extended
+// JSON documents when KAFKA_JSON_MODE asks for it. This happens at capture so
+// the buffered JSON and the message sent to Kafka are the same; encoding/json
+// would otherwise reduce ObjectIDs, dates and Decimal128 values to plain
+// strings. In standard mode data is returned unchanged.
+func (mm *MongoMonitor) encodeData(data map[string]interface{}) (map[string]interface{}, error) {
+	if mm.jsonMode == JSONModeStandard {
+		return data, nil
+	}
+
+	extJSON, err := bson.MarshalExtJSON(data, mm.jsonMode == JSONModeCanonical, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded map[string]interface{}
+	if err := json.Unmarshal(extJSON, &encoded); err != nil {
+		return nil, err
+	}
+	return encoded, nil
+}
+
+// lookupPath resolves a dotted path such as "meta.deliverAt" in doc. It returns
+// nil when any segment is missing or an intermediate value is not a document.
+func lookupPath(doc map[string]interface{}, path string) interface{} {
+	var current interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		switch d := current.(type) {
+		case map[string]interface{}:
+			current = d[key]
+		case primitive.M:
+			current = d[key]
+		case primitive.D:
+			var found interface{}
+			for _, elem := range d {
+				if elem.Key == key {
+					found = elem.Value
+					break
+				}
+			}
+			current = found
+		default:
+			return nil
 		}
 	}
+	return current
+}
 
-	if shouldDelay {
-		// Store in buffer for delayed processing
-		if err := mm.buffer.Store(bufferEvent); err != nil {
-			return fmt.Errorf("failed to store delayed event in buffer: %w", err)
+// parseReadyTime converts a ready-time field to a time. It accepts BSON dates
+// (decoded as primitive.DateTime), time.Time, RFC3339 strings and numeric Unix
+// epochs; numbers above 1e12 are taken as milliseconds, smaller ones as seconds.
+func parseReadyTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case primitive.DateTime:
+		return v.Time(), true
+	case time.Time:
+		return v, true
+	case string:
+		if parsed, err := time.Parse(time.RFC3339, v); err == nil {
+			return parsed, true
 		}
-		log.Printf("Stored delayed change event: %s for document %v, ready at %v", 
-			event.OperationType, event.DocumentKey, delayedUntil)
-	} else {
-		// Send immediately (for now, still store in buffer - the sync service will handle immediate sending)
-		if err := mm.buffer.Store(bufferEvent); err != nil {
-			return fmt.Errorf("failed to store immediate event in buffer: %w", err)
+	case int32:
+		return epochTime(float64(v)), true
+	case int64:
+		return epochTime(float64(v)), true
+	case float64:
+		return epochTime(v), true
+	}
+	return time.Time{}, false
+}
+
+func epochTime(v float64) time.Time {
+	if v > 1e12 {
+		return time.UnixMilli(int64(v))
+	}
+	return time.Unix(0, int64(v*float64(time.Second)))
+}
+
+// delayThreshold returns how far in the future a ready time in collection
+// must be for the event to be delayed: its MONITOR_DELAY_THRESHOLDS entry, or
+// MONITOR_DELAY_THRESHOLD.
+func (mm *MongoMonitor) delayThreshold(collection string) time.Duration {
+	if threshold, ok := mm.delayThresholds[collection]; ok {
+		return threshold
+	}
+	return mm.config.DelayThreshold
+}
+
+// parseDelayThresholds parses MONITOR_DELAY_THRESHOLDS entries of the form
+// collection=duration.
+func parseDelayThresholds(entries []string) (map[string]time.Duration, error) {
+	thresholds := make(map[string]time.Duration, len(entries))
+	for _, entry := range entries {
+		collection, value, ok := strings.Cut(entry, "=")
+		threshold, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || strings.TrimSpace(collection) == "" || err != nil || threshold < 0 {
+			return nil, fmt.Errorf("invalid MONITOR_DELAY_THRESHOLDS entry %q: want collection=duration", entry)
 		}
-		log.Printf("Stored immediate change event: %s for document %v", 
-			event.OperationType, event.DocumentKey)
+		thresholds[strings.TrimSpace(collection)] = threshold
 	}
+	return thresholds, nil
+}
 
-	return nil
+// eventTTL returns the document's expiresAfter value, which may be a duration
+// string ("15m") or a number of seconds, falling back to BUFFER_EVENT_TTL.
+func (mm *MongoMonitor) eventTTL(event *ChangeStreamEvent) time.Duration {
+	if event.FullDocument != nil {
+		switch v := event.FullDocument["expiresAfter"].(type) {
+		case string:
+			if ttl, err := time.ParseDuration(v); err == nil {
+				return ttl
+			}
+		case int32:
+			return time.Duration(v) * time.Second
+		case int64:
+			return time.Duration(v) * time.Second
+		case float64:
+			return time.Duration(v * float64(time.Second))
+		}
+	}
+	return mm.defaultTTL
+}
+
+// eventPriority marks an event high priority when its operation type is listed
+// in MONGODB_PRIORITY_OPERATIONS or the MONGODB_PRIORITY_FIELD of the document
+// is true or "high".
+func (mm *MongoMonitor) eventPriority(event *ChangeStreamEvent) string {
+	if mm.priorityOps[event.OperationType] {
+		return buffer.PriorityHigh
+	}
+
+	if mm.config.PriorityField != "" && event.FullDocument != nil {
+		switch v := event.FullDocument[mm.config.PriorityField].(type) {
+		case bool:
+			if v {
+				return buffer.PriorityHigh
+			}
+		case string:
+			if v == buffer.PriorityHigh {
+				return buffer.PriorityHigh
+			}
+		}
+	}
+
+	return buffer.PriorityNormal
 }
 
 func (mm *MongoMonitor) Close() error {
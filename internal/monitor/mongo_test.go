@@ -0,0 +1,986 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// newTestMonitor returns a monitor over a temporary buffer, with no MongoDB
+// connection, for testing how changes are turned into buffer events.
+func newTestMonitor(t *testing.T, cfg config.MongoDBConfig, jsonMode string) *MongoMonitor {
+	t.Helper()
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	t.Cleanup(func() { buf.Close() })
+	return &MongoMonitor{
+		buffer:   buf,
+		config:   &cfg,
+		clock:    clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)),
+		jsonMode: jsonMode,
+		keyTime:  KeyTimeCapture,
+	}
+}
+
+func TestDeleteAfterBufferedUpdate(t *testing.T) {
+	for _, mode := range []string{JSONModeStandard, JSONModeExtended} {
+		t.Run(mode, func(t *testing.T) {
+			mm := newTestMonitor(t, config.MongoDBConfig{DeleteLookup: DeleteLookupBuffer}, mode)
+			fake := mm.clock.(*clock.Fake)
+			id := primitive.NewObjectID()
+			orders := Namespace{DB: "app", Coll: "orders"}
+
+			capture := func(change *ChangeStreamEvent) *buffer.Event {
+				t.Helper()
+				fake.Advance(time.Second)
+				event, err := mm.bufferEvent(change)
+				if err != nil {
+					t.Fatalf("bufferEvent(%s): %v", change.OperationType, err)
+				}
+				if err := mm.buffer.Store(event); err != nil {
+					t.Fatalf("Store(%s): %v", change.OperationType, err)
+				}
+				return event
+			}
+
+			capture(&ChangeStreamEvent{ID: "1", OperationType: "insert", Namespace: orders,
+				DocumentKey: map[string]interface{}{"_id": id}, FullDocument: map[string]interface{}{"_id": id, "status": "new"}})
+			capture(&ChangeStreamEvent{ID: "2", OperationType: "update", Namespace: orders,
+				DocumentKey: map[string]interface{}{"_id": id}, FullDocument: map[string]interface{}{"_id": id, "status": "paid"}})
+			// Changes to another document, and to the same _id in another
+			// collection, must not be picked up
+			capture(&ChangeStreamEvent{ID: "3", OperationType: "update", Namespace: orders,
+				DocumentKey: map[string]interface{}{"_id": primitive.NewObjectID()}, FullDocument: map[string]interface{}{"status": "other"}})
+			capture(&ChangeStreamEvent{ID: "4", OperationType: "update", Namespace: Namespace{DB: "app", Coll: "invoices"},
+				DocumentKey: map[string]interface{}{"_id": id}, FullDocument: map[string]interface{}{"_id": id, "status": "invoiced"}})
+
+			deleted := capture(&ChangeStreamEvent{ID: "5", OperationType: "delete", Namespace: orders,
+				DocumentKey: map[string]interface{}{"_id": id}})
+			before, ok := deleted.Data["fullDocumentBeforeChange"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("delete has no fullDocumentBeforeChange: %v", deleted.Data)
+			}
+			if before["status"] != "paid" {
+				t.Fatalf("fullDocumentBeforeChange = %v, want the buffered update", before)
+			}
+
+			// Once the delete is buffered too it has no fullDocument, so a
+			// second delete still finds the update
+			again := capture(&ChangeStreamEvent{ID: "6", OperationType: "delete", Namespace: orders,
+				DocumentKey: map[string]interface{}{"_id": id}})
+			if before, _ := again.Data["fullDocumentBeforeChange"].(map[string]interface{}); before["status"] != "paid" {
+				t.Fatalf("second delete fullDocumentBeforeChange = %v, want the buffered update", before)
+			}
+		})
+	}
+}
+
+func TestDeleteWithoutBufferedChange(t *testing.T) {
+	mm := newTestMonitor(t, config.MongoDBConfig{DeleteLookup: DeleteLookupBuffer}, JSONModeStandard)
+	event, err := mm.bufferEvent(&ChangeStreamEvent{ID: "1", OperationType: "delete", Namespace: Namespace{DB: "app", Coll: "orders"},
+		DocumentKey: map[string]interface{}{"_id": primitive.NewObjectID()}})
+	if err != nil {
+		t.Fatalf("bufferEvent: %v", err)
+	}
+	if before, ok := event.Data["fullDocumentBeforeChange"]; ok {
+		t.Fatalf("fullDocumentBeforeChange = %v with nothing buffered", before)
+	}
+}
+
+// mockDialer fails its first failures dials with err, then succeeds.
+type mockDialer struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (d *mockDialer) dial(ctx context.Context) (*mongo.Client, error) {
+	d.calls++
+	if d.calls <= d.failures {
+		return nil, d.err
+	}
+	return &mongo.Client{}, nil
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	unreachable := errors.New("server selection timeout")
+	tests := []struct {
+		name      string
+		retries   int
+		dialer    mockDialer
+		wantCalls int
+		wantErr   bool
+	}{
+		{"first attempt", 3, mockDialer{}, 1, false},
+		{"fails then succeeds", 3, mockDialer{failures: 2, err: unreachable}, 3, false},
+		{"out of retries", 2, mockDialer{failures: 5, err: unreachable}, 3, true},
+		{"invalid options are not retried", 3, mockDialer{failures: 5, err: errInvalidOptions}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.MongoDBConfig{ConnectRetries: tt.retries, ConnectBackoff: time.Millisecond}
+			client, err := connectWithRetry(context.Background(), cfg, tt.dialer.dial)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("connectWithRetry error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && client == nil {
+				t.Fatal("connectWithRetry returned no client")
+			}
+			if tt.dialer.calls != tt.wantCalls {
+				t.Fatalf("dialed %d times, want %d", tt.dialer.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestConnectWithRetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dialer := &mockDialer{failures: 100, err: errors.New("connection refused")}
+	cfg := &config.MongoDBConfig{ConnectRetries: 100, ConnectBackoff: time.Hour}
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+	done := make(chan error, 1)
+	go func() {
+		_, err := connectWithRetry(ctx, cfg, dialer.dial)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("connectWithRetry error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connectWithRetry kept waiting out its backoff after ctx was canceled")
+	}
+	if dialer.calls != 1 {
+		t.Fatalf("dialed %d times, want 1", dialer.calls)
+	}
+}
+
+// captureInto makes mm emit into a slice, as Start would into the buffer.
+func captureInto(mm *MongoMonitor) *[]*buffer.Event {
+	var emitted []*buffer.Event
+	mm.emit = func(event *buffer.Event) error {
+		emitted = append(emitted, event)
+		return nil
+	}
+	return &emitted
+}
+
+func TestIgnoredOperations(t *testing.T) {
+	tests := []struct {
+		name   string
+		ignore []string
+		want   []string
+	}{
+		{"nothing ignored", nil, []string{"insert", "update", "delete", "delete"}},
+		{"deletes ignored", []string{"delete"}, []string{"insert", "update"}},
+		{"several ignored", []string{"update", "delete"}, []string{"insert"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mm := newTestMonitor(t, config.MongoDBConfig{}, JSONModeStandard)
+			mm.ignoreOps = make(map[string]bool)
+			for _, op := range tt.ignore {
+				mm.ignoreOps[op] = true
+			}
+			emitted := captureInto(mm)
+
+			ignoredBefore := make(map[string]float64)
+			capturedBefore := make(map[string]float64)
+			for _, op := range []string{"insert", "update", "delete"} {
+				ignoredBefore[op] = testutil.ToFloat64(metrics.EventsIgnored.WithLabelValues(op))
+				capturedBefore[op] = testutil.ToFloat64(metrics.EventsCaptured.WithLabelValues(op))
+			}
+
+			id := primitive.NewObjectID()
+			for i, op := range []string{"insert", "update", "delete", "delete"} {
+				change := &ChangeStreamEvent{ID: i, OperationType: op, Namespace: Namespace{DB: "app", Coll: "orders"},
+					DocumentKey: map[string]interface{}{"_id": id}}
+				if op != "delete" {
+					change.FullDocument = map[string]interface{}{"_id": id, "status": op}
+				}
+				if err := mm.handleChangeEvent(context.Background(), change); err != nil {
+					t.Fatalf("handleChangeEvent(%s): %v", op, err)
+				}
+			}
+
+			var got []string
+			for _, event := range *emitted {
+				got = append(got, event.Operation)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("emitted %v, want %v", got, tt.want)
+			}
+
+			sent := map[string]float64{"insert": 1, "update": 1, "delete": 2}
+			for op, n := range sent {
+				wantIgnored, wantCaptured := 0.0, n
+				if mm.ignoreOps[op] {
+					wantIgnored, wantCaptured = n, 0
+				}
+				if got := testutil.ToFloat64(metrics.EventsIgnored.WithLabelValues(op)) - ignoredBefore[op]; got != wantIgnored {
+					t.Errorf("ignored %s counter rose by %v, want %v", op, got, wantIgnored)
+				}
+				if got := testutil.ToFloat64(metrics.EventsCaptured.WithLabelValues(op)) - capturedBefore[op]; got != wantCaptured {
+					t.Errorf("captured %s counter rose by %v, want %v", op, got, wantCaptured)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyTimeAgainstTheFakeClock(t *testing.T) {
+	mm := newTestMonitor(t, config.MongoDBConfig{ReadyTimeField: "deliverAt"}, JSONModeStandard)
+	fake := mm.clock.(*clock.Fake)
+	deliverAt := fake.Now().Add(30 * time.Minute)
+
+	capture := func() *buffer.Event {
+		t.Helper()
+		event, err := mm.bufferEvent(&ChangeStreamEvent{ID: "1", OperationType: "insert", Namespace: Namespace{DB: "app", Coll: "orders"},
+			FullDocument: map[string]interface{}{"deliverAt": deliverAt}})
+		if err != nil {
+			t.Fatalf("bufferEvent: %v", err)
+		}
+		return event
+	}
+
+	event := capture()
+	if event.DelayedUntil == nil || !event.DelayedUntil.Equal(deliverAt) {
+		t.Fatalf("DelayedUntil = %v 30 minutes before the ready time, want %v", event.DelayedUntil, deliverAt)
+	}
+	if !event.Timestamp.Equal(fake.Now()) {
+		t.Fatalf("Timestamp = %v, want the fake clock's %v", event.Timestamp, fake.Now())
+	}
+
+	fake.Set(deliverAt)
+	if event := capture(); event.DelayedUntil != nil {
+		t.Fatalf("DelayedUntil = %v at the ready time, want none", event.DelayedUntil)
+	}
+	fake.Advance(time.Minute)
+	if event := capture(); event.DelayedUntil != nil {
+		t.Fatalf("DelayedUntil = %v after the ready time, want none", event.DelayedUntil)
+	}
+}
+
+func TestEncodeDataPerType(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("65f1c0a2b3d4e5f601234567")
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	decimal, _ := primitive.ParseDecimal128("12.50")
+	type m = map[string]interface{}
+
+	tests := []struct {
+		name      string
+		value     interface{}
+		extended  interface{}
+		canonical interface{}
+	}{
+		{"objectId", oid, m{"$oid": "65f1c0a2b3d4e5f601234567"}, m{"$oid": "65f1c0a2b3d4e5f601234567"}},
+		{"date", primitive.NewDateTimeFromTime(date), m{"$date": "2024-05-01T12:00:00Z"}, m{"$date": m{"$numberLong": "1714564800000"}}},
+		{"time", date, m{"$date": "2024-05-01T12:00:00Z"}, m{"$date": m{"$numberLong": "1714564800000"}}},
+		{"decimal128", decimal, m{"$numberDecimal": "12.50"}, m{"$numberDecimal": "12.50"}},
+		{"int64", int64(42), 42.0, m{"$numberLong": "42"}},
+		{"int32", int32(7), 7.0, m{"$numberInt": "7"}},
+		{"double", 1.5, 1.5, m{"$numberDouble": "1.5"}},
+		{"string", "paid", "paid", "paid"},
+		{"bool", true, true, true},
+		{"null", nil, nil, nil},
+		{"binary", primitive.Binary{Data: []byte("hi")}, m{"$binary": m{"base64": "aGk=", "subType": "00"}}, m{"$binary": m{"base64": "aGk=", "subType": "00"}}},
+		{"document", m{"n": int32(1)}, m{"n": 1.0}, m{"n": m{"$numberInt": "1"}}},
+		{"array", primitive.A{int32(1), "a"}, []interface{}{1.0, "a"}, []interface{}{m{"$numberInt": "1"}, "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for mode, want := range map[string]interface{}{
+				JSONModeStandard:  tt.value,
+				JSONModeExtended:  tt.extended,
+				JSONModeCanonical: tt.canonical,
+			} {
+				mm := &MongoMonitor{jsonMode: mode}
+				got, err := mm.encodeData(m{"field": tt.value})
+				if err != nil {
+					t.Fatalf("%s: encodeData: %v", mode, err)
+				}
+				if !reflect.DeepEqual(got["field"], want) {
+					t.Errorf("%s: encoded %#v, want %#v", mode, got["field"], want)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	deliverAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	doc := map[string]interface{}{
+		"deliverAt": deliverAt,
+		"meta":      map[string]interface{}{"deliverAt": deliverAt, "tags": []interface{}{"a"}},
+		"bsonM":     primitive.M{"inner": primitive.M{"deliverAt": deliverAt}},
+		"bsonD":     primitive.D{{Key: "deliverAt", Value: deliverAt}},
+		"status":    "paid",
+		"empty":     nil,
+	}
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"deliverAt", deliverAt},
+		{"meta.deliverAt", deliverAt},
+		{"bsonM.inner.deliverAt", deliverAt},
+		{"bsonD.deliverAt", deliverAt},
+		// Absent at each depth
+		{"missing", nil},
+		{"meta.missing", nil},
+		{"missing.deliverAt", nil},
+		{"bsonD.missing", nil},
+		// Intermediate values that are not documents
+		{"status.deliverAt", nil},
+		{"meta.tags.deliverAt", nil},
+		{"empty.deliverAt", nil},
+	}
+	for _, tt := range tests {
+		if got := lookupPath(doc, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookupPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestClientOptionsFromConfig(t *testing.T) {
+	cfg := &config.MongoDBConfig{
+		// The URI's pool settings are overridden by the explicit ones
+		URI:                    "mongodb://localhost:27017/?maxPoolSize=7&minPoolSize=1",
+		MaxPoolSize:            40,
+		MinPoolSize:            4,
+		MaxConnIdleTime:        90 * time.Second,
+		ServerSelectionTimeout: 3 * time.Second,
+	}
+	opts := clientOptions(cfg)
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	if opts.MaxPoolSize == nil || *opts.MaxPoolSize != 40 {
+		t.Errorf("MaxPoolSize = %v, want 40", opts.MaxPoolSize)
+	}
+	if opts.MinPoolSize == nil || *opts.MinPoolSize != 4 {
+		t.Errorf("MinPoolSize = %v, want 4", opts.MinPoolSize)
+	}
+	if opts.MaxConnIdleTime == nil || *opts.MaxConnIdleTime != 90*time.Second {
+		t.Errorf("MaxConnIdleTime = %v, want 90s", opts.MaxConnIdleTime)
+	}
+	if opts.MaxConnecting == nil || *opts.MaxConnecting != 20 {
+		t.Errorf("MaxConnecting = %v, want half of MaxPoolSize", opts.MaxConnecting)
+	}
+	if opts.ServerSelectionTimeout == nil || *opts.ServerSelectionTimeout != 3*time.Second {
+		t.Errorf("ServerSelectionTimeout = %v, want 3s", opts.ServerSelectionTimeout)
+	}
+
+	// Without a timeout configured the URI's, or the driver default, applies
+	cfg.URI = "mongodb://localhost:27017/?serverSelectionTimeoutMS=5000"
+	cfg.ServerSelectionTimeout = 0
+	opts = clientOptions(cfg)
+	if opts.ServerSelectionTimeout == nil || *opts.ServerSelectionTimeout != 5*time.Second {
+		t.Errorf("ServerSelectionTimeout = %v, want the URI's 5s", opts.ServerSelectionTimeout)
+	}
+}
+
+func TestObjectIDAndDateRoundTrip(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("65f1c0a2b3d4e5f601234567")
+	created := primitive.NewDateTimeFromTime(time.Date(2024, 5, 1, 12, 0, 0, 123e6, time.UTC))
+
+	for _, mode := range []string{JSONModeExtended, JSONModeCanonical} {
+		t.Run(mode, func(t *testing.T) {
+			mm := newTestMonitor(t, config.MongoDBConfig{}, mode)
+			event, err := mm.bufferEvent(&ChangeStreamEvent{
+				ID:            "change-1",
+				OperationType: "insert",
+				FullDocument:  map[string]interface{}{"_id": oid, "createdAt": created},
+				DocumentKey:   map[string]interface{}{"_id": oid},
+			})
+			if err != nil {
+				t.Fatalf("bufferEvent: %v", err)
+			}
+			if err := mm.buffer.Store(event); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			stored, err := mm.buffer.GetReadyEvents(1, 0)
+			if err != nil || len(stored) != 1 {
+				t.Fatalf("GetReadyEvents = %d events, %v", len(stored), err)
+			}
+
+			// As the message value carries it
+			value, err := json.Marshal(stored[0].Data["fullDocument"])
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			var doc struct {
+				ID        primitive.ObjectID `bson:"_id"`
+				CreatedAt primitive.DateTime `bson:"createdAt"`
+			}
+			if err := bson.UnmarshalExtJSON(value, mode == JSONModeCanonical, &doc); err != nil {
+				t.Fatalf("UnmarshalExtJSON(%s): %v", value, err)
+			}
+			if doc.ID != oid || doc.CreatedAt != created {
+				t.Errorf("round trip gave _id %v and createdAt %v, want %v and %v", doc.ID, doc.CreatedAt, oid, created)
+			}
+		})
+	}
+}
+
+func TestUpdateDescriptionFlowsThrough(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: bson.D{{Key: "_data", Value: "token-1"}}},
+		{Key: "operationType", Value: "update"},
+		{Key: "documentKey", Value: bson.D{{Key: "_id", Value: "o1"}}},
+		{Key: "ns", Value: bson.D{{Key: "db", Value: "shop"}, {Key: "coll", Value: "orders"}}},
+		{Key: "updateDescription", Value: bson.D{
+			{Key: "updatedFields", Value: bson.D{{Key: "status", Value: "shipped"}, {Key: "items.2.qty", Value: int32(3)}}},
+			{Key: "removedFields", Value: bson.A{"coupon"}},
+			{Key: "truncatedArrays", Value: bson.A{bson.D{{Key: "field", Value: "history"}, {Key: "newSize", Value: int32(5)}}}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("bson.Marshal: %v", err)
+	}
+	var change ChangeStreamEvent
+	if err := bson.Unmarshal(raw, &change); err != nil {
+		t.Fatalf("decoding the change event: %v", err)
+	}
+
+	// With MONGODB_FULL_DOCUMENT=default the delta is the whole payload
+	mm := newTestMonitor(t, config.MongoDBConfig{FullDocument: FullDocumentDefault}, JSONModeStandard)
+	mm.emit = mm.buffer.Store
+	if err := mm.handleChangeEvent(context.Background(), &change); err != nil {
+		t.Fatalf("handleChangeEvent: %v", err)
+	}
+	stored, err := mm.buffer.GetReadyEvents(1, 0)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("GetReadyEvents = %d events, %v", len(stored), err)
+	}
+
+	data := stored[0].Data
+	if data["fullDocument"] != nil {
+		t.Errorf("fullDocument = %v, want none", data["fullDocument"])
+	}
+	want := map[string]interface{}{
+		"updatedFields":   map[string]interface{}{"status": "shipped", "items.2.qty": 3.0},
+		"removedFields":   []interface{}{"coupon"},
+		"truncatedArrays": []interface{}{map[string]interface{}{"field": "history", "newSize": 5.0}},
+	}
+	if got := data["updateDescription"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("updateDescription = %#v, want %#v", got, want)
+	}
+}
+
+func TestWatchScopeOpensStreamOnScope(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	tests := []struct {
+		scope string
+		// db and target are where the change stream's aggregate is sent
+		db     func(mt *mtest.T) string
+		target func(mt *mtest.T) interface{}
+		// allChanges is whether the stream covers the whole cluster
+		allChanges bool
+	}{
+		{WatchScopeCollection, func(mt *mtest.T) string { return mt.DB.Name() }, func(mt *mtest.T) interface{} { return mt.Coll.Name() }, false},
+		{WatchScopeDatabase, func(mt *mtest.T) string { return mt.DB.Name() }, func(*mtest.T) interface{} { return int32(1) }, false},
+		{WatchScopeDeployment, func(*mtest.T) string { return "admin" }, func(*mtest.T) interface{} { return int32(1) }, true},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.scope, func(mt *mtest.T) {
+			mm := newTestMonitor(mt.T, config.MongoDBConfig{
+				Database: mt.DB.Name(), Collection: mt.Coll.Name(), WatchScope: tt.scope, FullDocument: "default",
+			}, JSONModeStandard)
+			mm.client, mm.database, mm.collection = mt.Client, mt.DB, mt.Coll
+			mm.emit = func(*buffer.Event) error { return nil }
+
+			mt.AddMockResponses(mtest.CreateCursorResponse(0, mt.DB.Name()+"."+mt.Coll.Name(), mtest.FirstBatch))
+			mm.stream(context.Background())
+
+			started := mt.GetStartedEvent()
+			if started == nil || started.CommandName != "aggregate" {
+				mt.Fatalf("first command %v, want the change stream's aggregate", started)
+			}
+			if started.DatabaseName != tt.db(mt) {
+				mt.Errorf("aggregate sent to database %q, want %q", started.DatabaseName, tt.db(mt))
+			}
+			var cmd struct {
+				Aggregate interface{} `bson:"aggregate"`
+				Pipeline  []struct {
+					ChangeStream struct {
+						AllChangesForCluster bool `bson:"allChangesForCluster"`
+					} `bson:"$changeStream"`
+				} `bson:"pipeline"`
+			}
+			if err := bson.Unmarshal(started.Command, &cmd); err != nil {
+				mt.Fatalf("decode aggregate: %v", err)
+			}
+			if !reflect.DeepEqual(cmd.Aggregate, tt.target(mt)) {
+				mt.Errorf("aggregate target %#v, want %#v", cmd.Aggregate, tt.target(mt))
+			}
+			if len(cmd.Pipeline) == 0 || cmd.Pipeline[0].ChangeStream.AllChangesForCluster != tt.allChanges {
+				mt.Errorf("change stream stage %s, want allChangesForCluster %v", started.Command, tt.allChanges)
+			}
+		})
+	}
+}
+
+func TestWatchScopeValidated(t *testing.T) {
+	tests := []struct {
+		scope    string
+		snapshot bool
+	}{
+		{"cluster", false},
+		{WatchScopeDatabase, true},
+		{WatchScopeDeployment, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("CONFIG_FILE", "")
+		t.Setenv("MONGODB_WATCH_SCOPE", tt.scope)
+		t.Setenv("MONGODB_SNAPSHOT", strconv.FormatBool(tt.snapshot))
+		cfg, err := config.Load()
+		if err != nil {
+			t.Fatalf("config.Load: %v", err)
+		}
+		// Rejected before connecting, so no MongoDB is needed
+		if _, err := NewMongoMonitor(context.Background(), cfg, nil, nil, nil); err == nil {
+			t.Errorf("NewMongoMonitor accepted MONGODB_WATCH_SCOPE=%s with MONGODB_SNAPSHOT=%v", tt.scope, tt.snapshot)
+		}
+	}
+}
+
+func TestInvalidateResumesWithStartAfter(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	change := func(mt *mtest.T, token, op string, id int32) bson.D {
+		doc := bson.D{
+			{Key: "_id", Value: bson.D{{Key: "_data", Value: token}}},
+			{Key: "operationType", Value: op},
+		}
+		if op != "invalidate" {
+			doc = append(doc,
+				bson.E{Key: "ns", Value: bson.D{{Key: "db", Value: mt.DB.Name()}, {Key: "coll", Value: mt.Coll.Name()}}},
+				bson.E{Key: "documentKey", Value: bson.D{{Key: "_id", Value: id}}},
+				bson.E{Key: "fullDocument", Value: bson.D{{Key: "_id", Value: id}}})
+		}
+		return doc
+	}
+	// changeStreamStage decodes the resume options of a change stream's
+	// aggregate.
+	changeStreamStage := func(mt *mtest.T) bson.M {
+		started := mt.GetStartedEvent()
+		if started == nil || started.CommandName != "aggregate" {
+			mt.Fatalf("command %v, want the change stream's aggregate", started)
+		}
+		var cmd struct {
+			Pipeline []struct {
+				ChangeStream bson.M `bson:"$changeStream"`
+			} `bson:"pipeline"`
+		}
+		if err := bson.Unmarshal(started.Command, &cmd); err != nil || len(cmd.Pipeline) == 0 {
+			mt.Fatalf("decode aggregate %s: %v", started.Command, err)
+		}
+		return cmd.Pipeline[0].ChangeStream
+	}
+	ns := func(mt *mtest.T) string { return mt.DB.Name() + "." + mt.Coll.Name() }
+
+	mt.Run("restart", func(mt *mtest.T) {
+		mm := newTestMonitor(mt.T, config.MongoDBConfig{
+			Database: mt.DB.Name(), Collection: mt.Coll.Name(), FullDocument: "default", OnInvalidate: InvalidateRestart,
+		}, JSONModeStandard)
+		mm.client, mm.database, mm.collection = mt.Client, mt.DB, mt.Coll
+		invalidationsBefore := testutil.ToFloat64(metrics.StreamInvalidations)
+
+		// The collection is dropped after one insert, then recreated
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, ns(mt), mtest.FirstBatch, change(mt, "t1", "insert", 1), change(mt, "t2", "invalidate", 0)),
+			mtest.CreateCursorResponse(0, ns(mt), mtest.FirstBatch, change(mt, "t3", "insert", 2)),
+		)
+		var emitted []*buffer.Event
+		err := mm.Start(context.Background(), func(event *buffer.Event) error {
+			emitted = append(emitted, event)
+			return nil
+		})
+		if err != nil {
+			mt.Fatalf("Start: %v", err)
+		}
+		if len(emitted) != 2 {
+			mt.Fatalf("emitted %d events, want the insert on each side of the invalidate", len(emitted))
+		}
+		if got := testutil.ToFloat64(metrics.StreamInvalidations) - invalidationsBefore; got != 1 {
+			mt.Errorf("StreamInvalidations grew by %v, want 1", got)
+		}
+
+		if stage := changeStreamStage(mt); stage["startAfter"] != nil || stage["resumeAfter"] != nil {
+			mt.Errorf("first stream opened with %v, want no resume token", stage)
+		}
+		// resumeAfter would reject the invalidate event's token
+		stage := changeStreamStage(mt)
+		if stage["resumeAfter"] != nil {
+			mt.Errorf("reopened with resumeAfter %v, want startAfter", stage["resumeAfter"])
+		}
+		if token, ok := stage["startAfter"].(bson.M); !ok || token["_data"] != "t2" {
+			mt.Errorf("reopened with startAfter %v, want the invalidate event's token t2", stage["startAfter"])
+		}
+		if mm.invalidated {
+			mt.Error("still invalidated after reading past the invalidate event")
+		}
+	})
+
+	mt.Run("stop", func(mt *mtest.T) {
+		mm := newTestMonitor(mt.T, config.MongoDBConfig{
+			Database: mt.DB.Name(), Collection: mt.Coll.Name(), FullDocument: "default", OnInvalidate: InvalidateStop,
+		}, JSONModeStandard)
+		mm.client, mm.database, mm.collection = mt.Client, mt.DB, mt.Coll
+
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns(mt), mtest.FirstBatch, change(mt, "t1", "invalidate", 0)))
+		if err := mm.Start(context.Background(), func(*buffer.Event) error { return nil }); !errors.Is(err, ErrInvalidated) {
+			mt.Fatalf("Start = %v, want ErrInvalidated", err)
+		}
+	})
+}
+
+func TestKeyTimeOrdersBuffer(t *testing.T) {
+	tests := []struct {
+		keyTime string
+		want    []string
+	}{
+		// Captured order
+		{KeyTimeCapture, []string{"late", "early", "none"}},
+		// Cluster time order; an event without one falls back to when it
+		// was captured, which is after both cluster times
+		{KeyTimeCluster, []string{"early", "late", "none"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.keyTime, func(t *testing.T) {
+			mm := newTestMonitor(t, config.MongoDBConfig{}, JSONModeStandard)
+			mm.keyTime = tt.keyTime
+			fake := mm.clock.(*clock.Fake)
+			orders := Namespace{DB: "app", Coll: "orders"}
+			clusterSecond := uint32(fake.Now().Add(-time.Hour).Unix())
+
+			for _, change := range []*ChangeStreamEvent{
+				// A change replayed after a reconnect arrives after a newer one
+				{ID: "late", ClusterTime: primitive.Timestamp{T: clusterSecond, I: 2}},
+				{ID: "early", ClusterTime: primitive.Timestamp{T: clusterSecond, I: 1}},
+				{ID: "none"},
+			} {
+				change.OperationType, change.Namespace = "insert", orders
+				change.DocumentKey = map[string]interface{}{"_id": change.ID}
+				change.FullDocument = map[string]interface{}{"_id": change.ID}
+				fake.Advance(time.Second)
+				event, err := mm.bufferEvent(change)
+				if err != nil {
+					t.Fatalf("bufferEvent: %v", err)
+				}
+				if (event.Key != "") != (tt.keyTime == KeyTimeCluster && change.ClusterTime != nil) {
+					t.Errorf("%s keyed %q", change.ID, event.Key)
+				}
+				if err := mm.buffer.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+
+			events, err := mm.buffer.GetReadyEvents(10, 0)
+			if err != nil {
+				t.Fatalf("GetReadyEvents: %v", err)
+			}
+			var got []string
+			for _, event := range events {
+				got = append(got, event.ID)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("read %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOversizedDocument(t *testing.T) {
+	orders := Namespace{DB: "app", Coll: "orders"}
+	change := func(id string, size int) *ChangeStreamEvent {
+		return &ChangeStreamEvent{
+			ID: id, OperationType: "update", Namespace: orders,
+			ClusterTime:       primitive.Timestamp{T: 1714564800, I: 1},
+			DocumentKey:       map[string]interface{}{"_id": id},
+			FullDocument:      map[string]interface{}{"_id": id, "blob": strings.Repeat("x", size)},
+			UpdateDescription: map[string]interface{}{"updatedFields": map[string]interface{}{"blob": strings.Repeat("x", size)}},
+		}
+	}
+
+	for _, policy := range []string{OversizeDeadLetter, OversizeReference} {
+		t.Run(policy, func(t *testing.T) {
+			mm := newTestMonitor(t, config.MongoDBConfig{}, JSONModeStandard)
+			mm.maxDocBytes, mm.oversizePolicy = 4096, policy
+			mm.emit = mm.buffer.Store
+			oversizedBefore := testutil.ToFloat64(metrics.EventsOversized.WithLabelValues(policy))
+
+			var out bytes.Buffer
+			writer := log.Writer()
+			log.SetOutput(&out)
+			for _, event := range []*ChangeStreamEvent{change("small", 100), change("large", 1<<20)} {
+				if err := mm.handleChangeEvent(context.Background(), event); err != nil {
+					t.Fatalf("handleChangeEvent(%s): %v", event.ID, err)
+				}
+			}
+			log.SetOutput(writer)
+
+			if got := testutil.ToFloat64(metrics.EventsOversized.WithLabelValues(policy)) - oversizedBefore; got != 1 {
+				t.Errorf("EventsOversized{policy=%s} grew by %v, want 1", policy, got)
+			}
+			ready, err := mm.buffer.GetReadyEvents(10, 0)
+			if err != nil {
+				t.Fatalf("GetReadyEvents: %v", err)
+			}
+			byID := make(map[string]*buffer.Event)
+			for _, event := range ready {
+				byID[event.ID] = event
+			}
+			if small := byID["small"]; small == nil || small.Data["fullDocument"] == nil {
+				t.Fatalf("small event read as %+v, want it buffered with its document", small)
+			}
+
+			var dead []*buffer.Event
+			if err := mm.buffer.ForEach(true, func(event *buffer.Event) error {
+				dead = append(dead, event)
+				return nil
+			}); err != nil {
+				t.Fatalf("ForEach: %v", err)
+			}
+
+			switch policy {
+			case OversizeDeadLetter:
+				// Kept whole where it can be inspected, never synced
+				if _, ok := byID["large"]; ok {
+					t.Error("oversized event queued for sync")
+				}
+				if len(dead) != 1 || dead[0].ID != "large" || !strings.Contains(dead[0].DeadLetterReason, "above CAPTURE_MAX_DOC_BYTES (4096)") {
+					t.Fatalf("dead letters %+v, want the large event with the size as its reason", dead)
+				}
+				if doc, _ := dead[0].Data["fullDocument"].(map[string]interface{}); len(doc["blob"].(string)) != 1<<20 {
+					t.Error("dead-lettered event lost its document")
+				}
+				if !strings.Contains(out.String(), "Dead-lettered change event: update") {
+					t.Errorf("dead-lettering not logged:\n%s", out.String())
+				}
+			case OversizeReference:
+				// Sent without its documents but with enough to fetch them
+				large := byID["large"]
+				if large == nil || len(dead) != 0 {
+					t.Fatalf("large event read as %+v with %d dead letters, want it queued", large, len(dead))
+				}
+				for _, field := range oversizedFields {
+					if _, ok := large.Data[field]; ok {
+						t.Errorf("reference still carries %s", field)
+					}
+				}
+				for _, field := range []string{"documentKey", "ns", "clusterTime", "operationType"} {
+					if large.Data[field] == nil {
+						t.Errorf("reference lost %s", field)
+					}
+				}
+				if oversized, _ := large.Data["oversized"].(map[string]interface{}); oversized["bytes"].(float64) <= 1<<21 {
+					t.Errorf("reference reports %v, want the original size", large.Data["oversized"])
+				}
+				if !strings.Contains(out.String(), "WARNING: sending event large without its documents") {
+					t.Errorf("reference not warned about:\n%s", out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestDelayThresholdPerCollection(t *testing.T) {
+	mm := newTestMonitor(t, config.MongoDBConfig{ReadyTimeField: "deliverAt", DelayThreshold: 10 * time.Minute}, JSONModeStandard)
+	thresholds, err := parseDelayThresholds([]string{"notifications=1m", " reports = 1h", "audit=0s"})
+	if err != nil {
+		t.Fatalf("parseDelayThresholds: %v", err)
+	}
+	mm.delayThresholds = thresholds
+	now := mm.clock.Now()
+
+	tests := []struct {
+		collection string
+		readyIn    time.Duration
+		delayed    bool
+	}{
+		{"notifications", 5 * time.Minute, true},
+		{"notifications", 30 * time.Second, false},
+		{"reports", 30 * time.Minute, false},
+		{"reports", 2 * time.Hour, true},
+		{"audit", time.Second, true},
+		// Without an override the global MONITOR_DELAY_THRESHOLD applies
+		{"orders", 5 * time.Minute, false},
+		{"orders", 30 * time.Minute, true},
+	}
+	for _, tt := range tests {
+		deliverAt := now.Add(tt.readyIn)
+		event, err := mm.bufferEvent(&ChangeStreamEvent{ID: "1", OperationType: "insert", Namespace: Namespace{DB: "app", Coll: tt.collection},
+			FullDocument: map[string]interface{}{"deliverAt": deliverAt}})
+		if err != nil {
+			t.Fatalf("bufferEvent: %v", err)
+		}
+		if delayed := event.DelayedUntil != nil; delayed != tt.delayed {
+			t.Errorf("%s event ready in %s: delayed = %v, want %v", tt.collection, tt.readyIn, delayed, tt.delayed)
+		}
+	}
+
+	for _, entries := range [][]string{{"reports"}, {"=1h"}, {"reports=soon"}, {"reports=-1m"}} {
+		if _, err := parseDelayThresholds(entries); err == nil {
+			t.Errorf("parseDelayThresholds(%q) succeeded, want an error", entries)
+		}
+	}
+}
+
+func TestMissingDocumentPolicies(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	found := func(mt *mtest.T) bson.D {
+		return mtest.CreateCursorResponse(0, "app.orders", mtest.FirstBatch, bson.D{{Key: "_id", Value: "o1"}, {Key: "status", Value: "paid"}})
+	}
+	gone := func(mt *mtest.T) bson.D { return mtest.CreateCursorResponse(0, "app.orders", mtest.FirstBatch) }
+	failed := func(mt *mtest.T) bson.D {
+		return mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 13, Message: "not authorized"})
+	}
+
+	tests := []struct {
+		name     string
+		policy   string
+		response func(*mtest.T) bson.D
+		// buffered is whether the update is stored, and status the status
+		// of the document it carries, or "" for none
+		buffered bool
+		status   string
+		logged   string
+	}{
+		{"include", MissingDocumentInclude, nil, true, "", ""},
+		{"skip", MissingDocumentSkip, nil, false, "", "Skipping update event without a document"},
+		{"requery finds the document", MissingDocumentRequery, found, true, "paid", ""},
+		{"requery finds it deleted", MissingDocumentRequery, gone, true, "", "no longer exists"},
+		{"requery fails", MissingDocumentRequery, failed, true, "", "WARNING: failed to look up document"},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mm := newTestMonitor(mt.T, config.MongoDBConfig{FullDocument: "updateLookup", MissingDocument: tt.policy}, JSONModeStandard)
+			mm.client = mt.Client
+			mm.emit = mm.buffer.Store
+			if tt.response != nil {
+				mt.AddMockResponses(tt.response(mt))
+			}
+			missingBefore := testutil.ToFloat64(metrics.EventsMissingDocument.WithLabelValues(tt.policy))
+
+			var out bytes.Buffer
+			writer := log.Writer()
+			log.SetOutput(&out)
+			// The document was deleted before the update's lookup ran
+			err := mm.handleChangeEvent(context.Background(), &ChangeStreamEvent{ID: "u1", OperationType: "update",
+				Namespace: Namespace{DB: "app", Coll: "orders"}, DocumentKey: map[string]interface{}{"_id": "o1"}})
+			// A delete never carries a document, so no policy applies to it
+			if err == nil {
+				err = mm.handleChangeEvent(context.Background(), &ChangeStreamEvent{ID: "d1", OperationType: "delete",
+					Namespace: Namespace{DB: "app", Coll: "orders"}, DocumentKey: map[string]interface{}{"_id": "o1"}})
+			}
+			log.SetOutput(writer)
+			if err != nil {
+				mt.Fatalf("handleChangeEvent: %v", err)
+			}
+
+			if got := testutil.ToFloat64(metrics.EventsMissingDocument.WithLabelValues(tt.policy)) - missingBefore; got != 1 {
+				mt.Errorf("EventsMissingDocument{policy=%s} grew by %v, want only the update counted", tt.policy, got)
+			}
+			events, err := mm.buffer.GetReadyEvents(10, 0)
+			if err != nil {
+				mt.Fatalf("GetReadyEvents: %v", err)
+			}
+			byID := make(map[string]*buffer.Event)
+			for _, event := range events {
+				byID[event.ID] = event
+			}
+			if byID["d1"] == nil {
+				mt.Error("delete not buffered")
+			}
+			update, buffered := byID["u1"]
+			if buffered != tt.buffered {
+				mt.Fatalf("update buffered = %v, want %v", buffered, tt.buffered)
+			}
+			if buffered {
+				doc, _ := update.Data["fullDocument"].(map[string]interface{})
+				if status, _ := doc["status"].(string); status != tt.status {
+					mt.Errorf("update buffered with fullDocument %v, want status %q", update.Data["fullDocument"], tt.status)
+				}
+			}
+			if !strings.Contains(out.String(), tt.logged) {
+				mt.Errorf("log does not mention %q:\n%s", tt.logged, out.String())
+			}
+
+			if tt.policy == MissingDocumentRequery {
+				// Looked up by its documentKey
+				started := mt.GetStartedEvent()
+				if started == nil || started.CommandName != "find" {
+					mt.Fatalf("command %v, want a find", started)
+				}
+				filter, _ := started.Command.Lookup("filter").Document().Lookup("_id").StringValueOK()
+				if filter != "o1" || started.DatabaseName != "app" {
+					mt.Errorf("find %s on %s, want _id o1 on app", started.Command, started.DatabaseName)
+				}
+			}
+		})
+	}
+}
+
+func TestReadyTimeBeyondHorizonDeadLettered(t *testing.T) {
+	mm := newTestMonitor(t, config.MongoDBConfig{ReadyTimeField: "requestedReadyTime", MaxScheduleHorizon: 30 * 24 * time.Hour}, JSONModeStandard)
+	mm.emit = mm.buffer.Store
+	now := mm.clock.Now()
+	beyondBefore := testutil.ToFloat64(metrics.EventsBeyondHorizon)
+
+	for id, readyIn := range map[string]time.Duration{
+		"soon":    time.Hour,
+		"horizon": 30 * 24 * time.Hour,
+		"years":   5 * 365 * 24 * time.Hour,
+	} {
+		if err := mm.handleChangeEvent(context.Background(), &ChangeStreamEvent{ID: id, OperationType: "insert",
+			Namespace: Namespace{DB: "app", Coll: "orders"}, DocumentKey: map[string]interface{}{"_id": id},
+			FullDocument: map[string]interface{}{"_id": id, "requestedReadyTime": now.Add(readyIn)}}); err != nil {
+			t.Fatalf("handleChangeEvent(%s): %v", id, err)
+		}
+	}
+
+	if got := testutil.ToFloat64(metrics.EventsBeyondHorizon) - beyondBefore; got != 1 {
+		t.Errorf("EventsBeyondHorizon grew by %v, want 1", got)
+	}
+	var dead []*buffer.Event
+	if err := mm.buffer.ForEach(true, func(event *buffer.Event) error {
+		dead = append(dead, event)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	if len(dead) != 1 || dead[0].ID != "years" || !strings.Contains(dead[0].DeadLetterReason, "beyond MAX_SCHEDULE_HORIZON (720h0m0s)") {
+		t.Fatalf("dead letters %+v, want only the far-future event with the horizon as its reason", dead)
+	}
+	// Events within the horizon wait for their ready time as usual
+	if count, _ := mm.buffer.Count(); count != 2 {
+		t.Errorf("%d events queued, want the 2 within the horizon", count)
+	}
+}
@@ -0,0 +1,44 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Preflight checks that MongoDB answers a ping, that the watched collection
+// exists for the collection scope, and that a change stream can be opened
+// with the configured scope, which needs a replica set or sharded cluster and
+// the changeStream and find privileges.
+func (mm *MongoMonitor) Preflight(ctx context.Context) error {
+	if err := mm.client.Ping(ctx, nil); err != nil {
+		return fmt.Errorf("cannot reach MongoDB: %w (check MONGODB_URI and network access)", err)
+	}
+
+	if mm.config.WatchScope == WatchScopeCollection {
+		names, err := mm.database.ListCollectionNames(ctx, bson.D{{Key: "name", Value: mm.config.Collection}})
+		if err != nil {
+			return fmt.Errorf("cannot list collections in %s: %w (grant listCollections on the database)", mm.config.Database, err)
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("collection %s.%s does not exist (check MONGODB_DATABASE and MONGODB_COLLECTION)", mm.config.Database, mm.config.Collection)
+		}
+	}
+
+	var stream *mongo.ChangeStream
+	var err error
+	switch mm.config.WatchScope {
+	case WatchScopeDatabase:
+		stream, err = mm.database.Watch(ctx, mongo.Pipeline{})
+	case WatchScopeDeployment:
+		stream, err = mm.client.Watch(ctx, mongo.Pipeline{})
+	default:
+		stream, err = mm.collection.Watch(ctx, mongo.Pipeline{})
+	}
+	if err != nil {
+		return fmt.Errorf("cannot open a %s change stream: %w (change streams need a replica set or sharded cluster and the changeStream privilege)", mm.config.WatchScope, err)
+	}
+	return stream.Close(ctx)
+}
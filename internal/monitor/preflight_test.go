@@ -0,0 +1,73 @@
+package monitor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"buffered-cdc/internal/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestMongoPreflight(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	ok := func(*mtest.T) bson.D { return mtest.CreateSuccessResponse() }
+	fail := func(code int32, message string) func(*mtest.T) bson.D {
+		return func(*mtest.T) bson.D {
+			return mtest.CreateCommandErrorResponse(mtest.CommandError{Code: code, Message: message})
+		}
+	}
+	collections := func(names ...string) func(*mtest.T) bson.D {
+		return func(mt *mtest.T) bson.D {
+			var docs []bson.D
+			for _, name := range names {
+				docs = append(docs, bson.D{{Key: "name", Value: name}, {Key: "type", Value: "collection"}})
+			}
+			return mtest.CreateCursorResponse(0, mt.DB.Name()+".$cmd.listCollections", mtest.FirstBatch, docs...)
+		}
+	}
+	stream := func(mt *mtest.T) bson.D {
+		return mtest.CreateCursorResponse(0, mt.DB.Name()+"."+mt.Coll.Name(), mtest.FirstBatch)
+	}
+	const notReplicaSet = "The $changeStream stage is only supported on replica sets"
+
+	tests := []struct {
+		name  string
+		scope string
+		// responses answer the ping, the collection lookup for the
+		// collection scope, and the change stream, in that order
+		responses []func(*mtest.T) bson.D
+		// want is a fragment of the error, or "" when preflight passes
+		want string
+	}{
+		{"passes", WatchScopeCollection, []func(*mtest.T) bson.D{ok, collections("orders"), stream}, ""},
+		{"ping fails", WatchScopeCollection, []func(*mtest.T) bson.D{fail(18, "Authentication failed")}, "cannot reach MongoDB"},
+		{"collection missing", WatchScopeCollection, []func(*mtest.T) bson.D{ok, collections()}, "does not exist"},
+		{"collections not listable", WatchScopeCollection, []func(*mtest.T) bson.D{ok, fail(13, "not authorized")}, "grant listCollections"},
+		{"standalone server", WatchScopeCollection, []func(*mtest.T) bson.D{ok, collections("orders"), fail(40573, notReplicaSet)}, "need a replica set"},
+		// The database scope does not look for the collection
+		{"database scope", WatchScopeDatabase, []func(*mtest.T) bson.D{ok, stream}, ""},
+		{"change streams not permitted", WatchScopeDeployment, []func(*mtest.T) bson.D{ok, fail(13, "not authorized on admin")}, "changeStream privilege"},
+	}
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mm := newTestMonitor(mt.T, config.MongoDBConfig{Database: mt.DB.Name(), Collection: "orders", WatchScope: tt.scope}, JSONModeStandard)
+			mm.client, mm.database, mm.collection = mt.Client, mt.DB, mt.Coll
+			for _, response := range tt.responses {
+				mt.AddMockResponses(response(mt))
+			}
+
+			err := mm.Preflight(context.Background())
+			if tt.want == "" {
+				if err != nil {
+					mt.Fatalf("Preflight: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				mt.Fatalf("Preflight = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// snapshot buffers every document currently in the collection as a synthetic
+// insert event and returns the operation time captured before the scan. The
+// change stream is then started at that time, so every write made during the
+// scan is also delivered as a change and nothing falls in between; a document
+// written mid-scan may be sent twice.
+func (mm *MongoMonitor) snapshot(ctx context.Context) (*primitive.Timestamp, error) {
+	startAt, err := mm.operationTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Starting snapshot of %s.%s", mm.config.Database, mm.config.Collection)
+
+	findOpts := options.Find().SetBatchSize(int32(mm.config.SnapshotBatchSize))
+	cursor, err := mm.collection.Find(ctx, bson.D{}, findOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot cursor: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	// Documents are buffered in parallel on the worker pool; their order does
+	// not matter since each is a different document.
+	group := mm.pool.Group(ctx)
+	count := 0
+	for cursor.Next(ctx) {
+		var doc map[string]interface{}
+		if err := cursor.Decode(&doc); err != nil {
+			log.Printf("Failed to decode snapshot document: %v", err)
+			continue
+		}
+
+		event := &ChangeStreamEvent{
+			ID:            fmt.Sprintf("snapshot:%v", doc["_id"]),
+			OperationType: "insert",
+			FullDocument:  doc,
+			DocumentKey:   map[string]interface{}{"_id": doc["_id"]},
+			ClusterTime:   *startAt,
+			Namespace:     Namespace{DB: mm.config.Database, Coll: mm.config.Collection},
+		}
+		group.Go(func() error {
+			if err := mm.handleChangeEvent(ctx, event); err != nil {
+				return fmt.Errorf("failed to buffer snapshot document %v: %w", doc["_id"], err)
+			}
+			return nil
+		})
+
+		count++
+		if count%10000 == 0 {
+			log.Printf("Snapshot progress: %d documents buffered", count)
+		}
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("snapshot cursor error: %w", err)
+	}
+
+	log.Printf("Snapshot complete: %d documents buffered", count)
+	return startAt, nil
+}
+
+// operationTime returns the cluster's current operation time, read from a
+// ping run in a causally consistent session.
+func (mm *MongoMonitor) operationTime(ctx context.Context) (*primitive.Timestamp, error) {
+	session, err := mm.client.StartSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start session: %w", err)
+	}
+	defer session.EndSession(ctx)
+
+	err = mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+		return mm.database.RunCommand(sc, bson.D{{Key: "ping", Value: 1}}).Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read operation time: %w", err)
+	}
+
+	startAt := session.OperationTime()
+	if startAt == nil {
+		return nil, fmt.Errorf("server did not report an operation time (snapshots require a replica set)")
+	}
+	return startAt, nil
+}
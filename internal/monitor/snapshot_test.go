@@ -0,0 +1,114 @@
+package monitor
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/workers"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSnapshotThenTail(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("handoff", func(mt *mtest.T) {
+		mm := newTestMonitor(mt.T, config.MongoDBConfig{
+			Database: "shop", Collection: "orders", Snapshot: true, SnapshotBatchSize: 2, FullDocument: "updateLookup",
+		}, JSONModeStandard)
+		mm.client, mm.database, mm.collection = mt.Client, mt.DB, mt.Coll
+		mm.pool = workers.New(4)
+		var mu sync.Mutex
+		var emitted []*buffer.Event
+		mm.emit = func(event *buffer.Event) error {
+			mu.Lock()
+			defer mu.Unlock()
+			emitted = append(emitted, event)
+			return nil
+		}
+
+		ns := mt.DB.Name() + "." + mt.Coll.Name()
+		startAt := primitive.Timestamp{T: 1714564800, I: 7}
+		mt.AddMockResponses(
+			// The ping the snapshot's start time is read from
+			mtest.CreateSuccessResponse(bson.E{Key: "operationTime", Value: startAt}),
+			mtest.CreateCursorResponse(0, ns, mtest.FirstBatch,
+				bson.D{{Key: "_id", Value: "o1"}, {Key: "status", Value: "new"}},
+				bson.D{{Key: "_id", Value: "o2"}, {Key: "status", Value: "paid"}},
+			),
+			// A change made while the snapshot was read
+			mtest.CreateCursorResponse(1, ns, mtest.FirstBatch, bson.D{
+				{Key: "_id", Value: bson.D{{Key: "_data", Value: "token-1"}}},
+				{Key: "operationType", Value: "update"},
+				{Key: "fullDocument", Value: bson.D{{Key: "_id", Value: "o1"}, {Key: "status", Value: "shipped"}}},
+				{Key: "documentKey", Value: bson.D{{Key: "_id", Value: "o1"}}},
+				{Key: "clusterTime", Value: primitive.Timestamp{T: startAt.T, I: startAt.I + 1}},
+				{Key: "ns", Value: bson.D{{Key: "db", Value: "shop"}, {Key: "coll", Value: "orders"}}},
+			}),
+		)
+		// The stream ends once the mock runs out of responses
+		mm.stream(context.Background())
+
+		if len(emitted) != 3 {
+			mt.Fatalf("emitted %d events, want 2 snapshot inserts and the update", len(emitted))
+		}
+		snapshot := map[string]bool{}
+		for _, event := range emitted[:2] {
+			if event.Operation != "insert" {
+				mt.Errorf("snapshot emitted a %s, want insert", event.Operation)
+			}
+			snapshot[event.ID] = true
+		}
+		if !snapshot["snapshot:o1"] || !snapshot["snapshot:o2"] {
+			mt.Errorf("snapshot emitted %v, want o1 and o2", snapshot)
+		}
+		if update := emitted[2]; update.Operation != "update" {
+			mt.Errorf("after the snapshot emitted a %s, want the update", update.Operation)
+		}
+
+		// The stream starts at the time read before the snapshot, so changes
+		// made during it are not missed
+		var commands []string
+		var aggregate bson.Raw
+		for _, started := range mt.GetAllStartedEvents() {
+			commands = append(commands, started.CommandName)
+			if started.CommandName == "aggregate" && aggregate == nil {
+				aggregate = started.Command
+			}
+		}
+		if len(commands) < 3 || !slices.Equal(commands[:3], []string{"ping", "find", "aggregate"}) {
+			mt.Fatalf("commands %v, want ping, find, then the change stream's aggregate", commands)
+		}
+		var cmd struct {
+			Pipeline []struct {
+				ChangeStream struct {
+					StartAtOperationTime primitive.Timestamp `bson:"startAtOperationTime"`
+				} `bson:"$changeStream"`
+			} `bson:"pipeline"`
+		}
+		if err := bson.Unmarshal(aggregate, &cmd); err != nil {
+			mt.Fatalf("decode aggregate: %v", err)
+		}
+		if len(cmd.Pipeline) == 0 || cmd.Pipeline[0].ChangeStream.StartAtOperationTime != startAt {
+			mt.Fatalf("change stream started with %s, want startAtOperationTime %v", aggregate, startAt)
+		}
+
+		// A restart resumes the stream without taking the snapshot again
+		mt.ClearEvents()
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, ns, mtest.FirstBatch))
+		mm.stream(context.Background())
+		for _, started := range mt.GetAllStartedEvents() {
+			if started.CommandName != "aggregate" && started.CommandName != "killCursors" {
+				mt.Errorf("restart ran %s, want only the change stream", started.CommandName)
+			}
+		}
+		if len(emitted) != 3 {
+			mt.Errorf("restart emitted %d more events", len(emitted)-3)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/workers"
+)
+
+// SourceMongoDB is the SOURCE_TYPE of the MongoDB change stream.
+const SourceMongoDB = "mongodb"
+
+// Source captures changes from a database and hands them on as buffer
+// events. Start runs until ctx is done or capture fails, calling emit once per
+// change in the order the changes happened; emit stores the event and fails
+// only when it could not. The service restarts a Start that returns an
+// error, so a Source should resume where it stopped.
+type Source interface {
+	Start(ctx context.Context, emit func(*buffer.Event) error) error
+	Close() error
+}
+
+// SourceFactory builds a Source from the configuration. buf is for sources
+// that look up what is still buffered, not for storing events, which goes
+// through emit. ctx bounds any connecting the factory does.
+type SourceFactory func(ctx context.Context, cfg *config.Config, buf *buffer.Buffer, clk clock.Clock, pool *workers.Pool) (Source, error)
+
+var sources = map[string]SourceFactory{
+	SourceMongoDB: func(ctx context.Context, cfg *config.Config, buf *buffer.Buffer, clk clock.Clock, pool *workers.Pool) (Source, error) {
+		mm, err := NewMongoMonitor(ctx, cfg, buf, clk, pool)
+		if err != nil {
+			return nil, err
+		}
+		return mm, nil
+	},
+}
+
+// RegisterSource makes a source available as SOURCE_TYPE=name. It must be
+// called before NewSource, typically from an init function.
+func RegisterSource(name string, factory SourceFactory) {
+	sources[name] = factory
+}
+
+// NewSource builds the source selected by SOURCE_TYPE.
+func NewSource(ctx context.Context, cfg *config.Config, buf *buffer.Buffer, clk clock.Clock, pool *workers.Pool) (Source, error) {
+	factory, ok := sources[cfg.Source.Type]
+	if !ok {
+		names := make([]string, 0, len(sources))
+		for name := range sources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("invalid SOURCE_TYPE %q: must be %s", cfg.Source.Type, strings.Join(names, " or "))
+	}
+	return factory(ctx, cfg, buf, clk, pool)
+}
@@ -0,0 +1,128 @@
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/workers"
+)
+
+// mockSource emits total synthetic inserts, failing once after failAfter of
+// them when failAfter is positive, and resumes after the last one emitted
+// when started again.
+type mockSource struct {
+	total     int
+	failAfter int
+	next      int
+	closed    bool
+}
+
+var errMockCapture = errors.New("capture failed")
+
+func (m *mockSource) Start(ctx context.Context, emit func(*buffer.Event) error) error {
+	for ; m.next < m.total; m.next++ {
+		if m.failAfter > 0 && m.next == m.failAfter {
+			m.failAfter = 0
+			return errMockCapture
+		}
+		event := &buffer.Event{
+			ID:        fmt.Sprintf("mock-%d", m.next),
+			Operation: "insert",
+			Timestamp: time.Now(),
+			Data: map[string]interface{}{
+				"documentKey": map[string]interface{}{"_id": m.next},
+				"ns":          map[string]interface{}{"db": "mock", "coll": "items"},
+			},
+		}
+		if err := emit(event); err != nil {
+			return err
+		}
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func (m *mockSource) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestMockSourceEmitsIntoBuffer(t *testing.T) {
+	mock := &mockSource{total: 25, failAfter: 10}
+	RegisterSource("mock", func(ctx context.Context, cfg *config.Config, buf *buffer.Buffer, clk clock.Clock, pool *workers.Pool) (Source, error) {
+		return mock, nil
+	})
+	t.Cleanup(func() { delete(sources, "mock") })
+
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	defer buf.Close()
+
+	cfg := &config.Config{Source: config.SourceConfig{Type: "mock"}}
+	source, err := NewSource(context.Background(), cfg, buf, clock.New(), workers.New(1))
+	if err != nil {
+		t.Fatalf("NewSource: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// The first run fails part way, as a dropped stream would, and the
+	// restart resumes where it stopped
+	if err := source.Start(ctx, buf.Store); !errors.Is(err, errMockCapture) {
+		t.Fatalf("first Start = %v, want the capture failure", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- source.Start(ctx, buf.Store) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, err := buf.Count()
+		if err != nil {
+			t.Fatalf("Count: %v", err)
+		}
+		if count == mock.total {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("buffer holds %d events, want %d", count, mock.total)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Start after cancel = %v, want nil", err)
+	}
+	if err := source.Close(); err != nil || !mock.closed {
+		t.Fatalf("Close = %v, closed %v", err, mock.closed)
+	}
+
+	events, err := buf.GetReadyEvents(100, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	for i, event := range events {
+		if want := fmt.Sprintf("mock-%d", i); event.ID != want {
+			t.Fatalf("event %d is %s, want %s in emit order", i, event.ID, want)
+		}
+		if event.Collection() != "items" {
+			t.Fatalf("event %s collection = %q, want items", event.ID, event.Collection())
+		}
+	}
+}
+
+func TestNewSourceRejectsUnknownType(t *testing.T) {
+	cfg := &config.Config{Source: config.SourceConfig{Type: "postgres"}}
+	_, err := NewSource(context.Background(), cfg, nil, clock.New(), workers.New(1))
+	if err == nil || !strings.Contains(err.Error(), `invalid SOURCE_TYPE "postgres"`) || !strings.Contains(err.Error(), SourceMongoDB) {
+		t.Fatalf("NewSource = %v, want an error listing the known sources", err)
+	}
+}
@@ -0,0 +1,109 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"buffered-cdc/internal/metrics"
+)
+
+// HealthCheck configures when the health check task reports the service as
+// degraded.
+type HealthCheck struct {
+	// BufferThreshold is the queued event count above which the service is
+	// degraded.
+	BufferThreshold int
+	// MaxOffline is how long Kafka may be unreachable before the service is
+	// degraded. Zero disables the check.
+	MaxOffline time.Duration
+	// OfflineFor reports how long Kafka has been unreachable, or 0 while it
+	// is reachable. It may be nil when MaxOffline is zero.
+	OfflineFor func() time.Duration
+	// Started reports whether the components the service runs have all
+	// started. Until they have the service is degraded, within the startup
+	// grace period too. Nil counts as started.
+	Started func() bool
+}
+
+// HealthStatus is the result of the most recent health check.
+type HealthStatus struct {
+	Healthy bool     `json:"healthy"`
+	Reasons []string `json:"reasons,omitempty"`
+	// StartupGrace is set while the thresholds are ignored after start.
+	StartupGrace bool      `json:"startupGrace,omitempty"`
+	CheckedAt    time.Time `json:"checkedAt"`
+}
+
+type healthState struct {
+	mu     sync.RWMutex
+	status HealthStatus
+}
+
+func (h *healthState) get() HealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.status
+}
+
+func (h *healthState) set(status HealthStatus) {
+	h.mu.Lock()
+	h.status = status
+	h.mu.Unlock()
+
+	if status.Healthy {
+		metrics.HealthDegraded.Set(0)
+	} else {
+		metrics.HealthDegraded.Set(1)
+	}
+}
+
+// SetHealthCheck replaces the health check thresholds. It may be called while
+// running; the next health check uses the new ones.
+func (s *Scheduler) SetHealthCheck(check HealthCheck) {
+	s.healthCheck.Store(&check)
+}
+
+// SetStartupGrace makes health checks within d of Start report the service
+// healthy whatever the thresholds once its components have started; only a
+// buffer error or a component still starting degrades it then. It must be
+// called before Start.
+func (s *Scheduler) SetStartupGrace(d time.Duration) {
+	s.startupGrace = d
+}
+
+// Health returns the result of the most recent health check. Until the first
+// check has run the service is reported healthy.
+func (s *Scheduler) Health() HealthStatus {
+	return s.health.get()
+}
+
+// evaluateHealth checks that the components have started and compares count
+// and the offline duration against the configured thresholds, unless the
+// startup grace period is still running.
+func (s *Scheduler) evaluateHealth(count int) HealthStatus {
+	status := HealthStatus{Healthy: true, CheckedAt: s.clock.Now()}
+	check := s.healthCheck.Load()
+	if check.Started != nil && !check.Started() {
+		status.Reasons = append(status.Reasons, "components have not all started")
+	}
+	if status.CheckedAt.Before(s.graceUntil) {
+		status.StartupGrace = true
+		status.Healthy = len(status.Reasons) == 0
+		return status
+	}
+
+	if count > check.BufferThreshold {
+		status.Reasons = append(status.Reasons,
+			fmt.Sprintf("buffer holds %d events (threshold %d)", count, check.BufferThreshold))
+	}
+	if check.MaxOffline > 0 && check.OfflineFor != nil {
+		if offline := check.OfflineFor(); offline > check.MaxOffline {
+			status.Reasons = append(status.Reasons,
+				fmt.Sprintf("kafka offline for %s (threshold %s)", offline.Round(time.Second), check.MaxOffline))
+		}
+	}
+
+	status.Healthy = len(status.Reasons) == 0
+	return status
+}
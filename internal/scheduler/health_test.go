@@ -0,0 +1,72 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHealthThresholdCrossingAndRecovery(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := newTestScheduler(t, clk, 3)
+	var offline atomic.Int64
+	s.SetHealthCheck(HealthCheck{
+		BufferThreshold: 3,
+		MaxOffline:      time.Minute,
+		OfflineFor:      func() time.Duration { return time.Duration(offline.Load()) },
+	})
+	s.Start(context.Background())
+	defer s.Stop()
+
+	check := func(wantHealthy bool, wantReason string) {
+		t.Helper()
+		if err := s.RunTaskNow(context.Background(), TaskHealthCheck); err != nil {
+			t.Fatalf("RunTaskNow: %v", err)
+		}
+		status := s.Health()
+		if status.Healthy != wantHealthy {
+			t.Fatalf("Health = %+v, want healthy %v", status, wantHealthy)
+		}
+		if wantReason != "" && (len(status.Reasons) != 1 || !strings.Contains(status.Reasons[0], wantReason)) {
+			t.Fatalf("Reasons = %q, want one mentioning %q", status.Reasons, wantReason)
+		}
+		wantGauge := 0.0
+		if !wantHealthy {
+			wantGauge = 1
+		}
+		if got := testutil.ToFloat64(metrics.HealthDegraded); got != wantGauge {
+			t.Fatalf("degraded gauge = %v, want %v", got, wantGauge)
+		}
+	}
+
+	// At the threshold is still healthy
+	check(true, "")
+
+	extra := &buffer.Event{ID: "extra", Operation: "insert", Timestamp: clk.Now()}
+	if err := s.buffer.Store(extra); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	check(false, "buffer holds 4 events (threshold 3)")
+
+	if err := s.buffer.Delete(extra); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	check(true, "")
+
+	// Offline up to MaxOffline is tolerated, beyond it is not
+	offline.Store(int64(30 * time.Second))
+	check(true, "")
+	offline.Store(int64(2 * time.Minute))
+	check(false, fmt.Sprintf("kafka offline for 2m0s (threshold %s)", time.Minute))
+	offline.Store(0)
+	check(true, "")
+}
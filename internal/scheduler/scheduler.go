@@ -2,152 +2,444 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/metrics"
 
 	"github.com/robfig/cron/v3"
 )
 
 type Task func(ctx context.Context) error
 
+// DefaultTaskTimeout bounds a single run of a task that was added without
+// WithTimeout.
+const DefaultTaskTimeout = 5 * time.Minute
+
+// TaskOption customises a task added with AddTask.
+type TaskOption func(*taskOptions)
+
+type taskOptions struct {
+	timeout      time.Duration
+	allowOverlap bool
+}
+
+// WithTimeout cancels a run's context after d. Zero disables the timeout, so
+// the run is only cancelled by Stop.
+func WithTimeout(d time.Duration) TaskOption {
+	return func(o *taskOptions) { o.timeout = d }
+}
+
+// ErrUnknownTask is returned by RunTaskNow for a name no task was added under.
+var ErrUnknownTask = errors.New("unknown task")
+
+// ErrTaskRunning is returned by RunTaskNow when the task does not allow
+// overlapping runs and one is in progress.
+var ErrTaskRunning = errors.New("task already running")
+
+// AllowOverlap lets a run start while the previous one is still going. By
+// default such runs are skipped and counted in
+// buffered_cdc_scheduler_runs_skipped_total.
+func AllowOverlap() TaskOption {
+	return func(o *taskOptions) { o.allowOverlap = true }
+}
+
+// Names of the built-in tasks, for SetSchedule.
+const (
+	TaskBufferStats      = "buffer_stats"
+	TaskCleanup          = "cleanup_old_events"
+	TaskHealthCheck      = "health_check"
+	TaskProcessScheduled = "process_scheduled_events"
+)
+
+// specParser matches the parser cron.WithSeconds installs, so ValidateSpec
+// accepts exactly what AddTask does.
+var specParser = cron.NewParser(
+	cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
 type Scheduler struct {
-	cron   *cron.Cron
-	buffer *buffer.Buffer
-	tasks  map[string]Task
+	cron      *cron.Cron
+	buffer    *buffer.Buffer
+	tasks     map[string]*scheduledTask
+	schedules map[string]string
+	timeout   time.Duration
+	overlap   map[string]bool
+	clock     clock.Clock
+
+	healthCheck atomic.Pointer[HealthCheck]
+	health      healthState
+
+	// startupGrace is HEALTH_STARTUP_GRACE; graceUntil is when it ends, set
+	// by Start, and graceTimer runs the health check then.
+	startupGrace time.Duration
+	graceUntil   time.Time
+	graceTimer   *time.Timer
+
+	// maxRedeliveries is BUFFER_MAX_REDELIVERIES, enforced by cleanup.
+	maxRedeliveries atomic.Int64
+
+	// onDemand is held for reading by every RunTaskNow, so Stop can wait for
+	// them by taking it for writing.
+	onDemand sync.RWMutex
+
+	// ctx is the parent of every run's context; cancel is called by Stop.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func New(buf *buffer.Buffer) *Scheduler {
+func New(buf *buffer.Buffer, clk clock.Clock) *Scheduler {
 	c := cron.New(cron.WithSeconds())
+	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Scheduler{
+	s := &Scheduler{
 		cron:   c,
 		buffer: buf,
-		tasks:  make(map[string]Task),
+		tasks:  make(map[string]*scheduledTask),
+		schedules: map[string]string{
+			TaskBufferStats:      "0 */5 * * * *",
+			TaskCleanup:          "0 0 2 * * *",
+			TaskHealthCheck:      "0 */1 * * * *",
+			TaskProcessScheduled: "* * * * * *",
+		},
+		timeout: DefaultTaskTimeout,
+		overlap: make(map[string]bool),
+		health: healthState{status: HealthStatus{Healthy: true}},
+		clock:  clk,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.SetHealthCheck(HealthCheck{BufferThreshold: 10000})
+	return s
+}
+
+// NormalizeSpec turns a standard 5-field spec into the 6-field form the
+// scheduler uses by adding a seconds field of 0. Descriptors such as @daily
+// and specs that already have 6 fields are returned unchanged.
+func NormalizeSpec(spec string) string {
+	fields := strings.Fields(spec)
+	var tz string
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "TZ=") || strings.HasPrefix(fields[0], "CRON_TZ=")) {
+		tz, fields = fields[0]+" ", fields[1:]
+	}
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	}
+	return tz + strings.Join(fields, " ")
+}
+
+// ValidateSpec reports whether spec, after NormalizeSpec, is a schedule the
+// scheduler can run.
+func ValidateSpec(spec string) error {
+	if strings.TrimSpace(spec) == "" {
+		return fmt.Errorf("cron spec is empty")
+	}
+	if _, err := specParser.Parse(NormalizeSpec(spec)); err != nil {
+		return fmt.Errorf("invalid cron spec %q (want \"sec min hour dom month dow\", \"min hour dom month dow\" or a descriptor like @hourly): %w", spec, err)
 	}
+	return nil
 }
 
-func (s *Scheduler) Start() {
+// SetSchedule overrides the spec of a built-in task. It must be called before
+// Start.
+func (s *Scheduler) SetSchedule(name, spec string) error {
+	if _, ok := s.schedules[name]; !ok {
+		return fmt.Errorf("unknown scheduled task %s", name)
+	}
+	if err := ValidateSpec(spec); err != nil {
+		return fmt.Errorf("task %s: %w", name, err)
+	}
+	s.schedules[name] = NormalizeSpec(spec)
+	return nil
+}
+
+// SetTaskTimeout sets the timeout used by tasks added without WithTimeout,
+// including the built-in ones. It must be called before Start.
+func (s *Scheduler) SetTaskTimeout(d time.Duration) {
+	s.timeout = d
+}
+
+// SetAllowOverlap makes the named tasks behave as if added with AllowOverlap.
+// It must be called before the tasks are added, so before Start for the
+// built-in ones.
+func (s *Scheduler) SetAllowOverlap(names ...string) {
+	for _, name := range names {
+		s.overlap[name] = true
+	}
+}
+
+// Start runs the scheduled tasks until Stop is called or ctx is cancelled.
+// Each run gets a context derived from ctx.
+func (s *Scheduler) Start(ctx context.Context) {
 	log.Println("Starting task scheduler")
-	s.registerDefaultTasks()
+	s.cancel()
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if s.startupGrace > 0 {
+		s.graceUntil = s.clock.Now().Add(s.startupGrace)
+	}
+	// Serve a real result from /readyz before the first scheduled check.
+	if err := s.healthCheckTask(s.ctx); err != nil {
+		log.Printf("Initial health check failed: %v", err)
+	}
+	if err := s.registerDefaultTasks(); err != nil {
+		log.Printf("Failed to register scheduled tasks: %v", err)
+	}
+	if s.startupGrace > 0 {
+		// Apply the thresholds as soon as the grace period is over rather
+		// than at the next scheduled check
+		s.graceTimer = time.AfterFunc(s.startupGrace, s.checkAfterGrace)
+	}
 	s.cron.Start()
 }
 
+// checkAfterGrace runs the health check task when the startup grace period
+// ends. Like RunTaskNow it holds onDemand, so Stop waits for it.
+func (s *Scheduler) checkAfterGrace() {
+	s.onDemand.RLock()
+	defer s.onDemand.RUnlock()
+	t, ok := s.tasks[TaskHealthCheck]
+	if !ok || s.ctx.Err() != nil {
+		return
+	}
+	// A scheduled check already running will be followed by the next one
+	if err := s.runTask(s.ctx, t); err != nil && !errors.Is(err, ErrTaskRunning) {
+		log.Printf("Health check after startup grace failed: %v", err)
+	}
+}
+
 func (s *Scheduler) Stop() {
 	log.Println("Stopping task scheduler")
-	s.cron.Stop()
+	s.cancel()
+	if s.graceTimer != nil {
+		s.graceTimer.Stop()
+	}
+	// Wait for in-flight runs, scheduled, on demand or after the startup
+	// grace, so none touch the buffer after it is closed.
+	<-s.cron.Stop().Done()
+	s.onDemand.Lock()
+	s.onDemand.Unlock()
 }
 
-func (s *Scheduler) AddTask(name, cronSpec string, task Task) error {
-	_, err := s.cron.AddFunc(cronSpec, func() {
-		ctx := context.Background()
-		if err := task(ctx); err != nil {
+func (s *Scheduler) AddTask(name, cronSpec string, task Task, opts ...TaskOption) error {
+	if err := ValidateSpec(cronSpec); err != nil {
+		return fmt.Errorf("failed to add task %s: %w", name, err)
+	}
+	cronSpec = NormalizeSpec(cronSpec)
+
+	t := &scheduledTask{name: name, task: task, opts: taskOptions{timeout: s.timeout, allowOverlap: s.overlap[name]}}
+	for _, opt := range opts {
+		opt(&t.opts)
+	}
+
+	job := cron.FuncJob(func() {
+		err := s.runTask(s.ctx, t)
+		switch {
+		case errors.Is(err, ErrTaskRunning):
+			metrics.ScheduledRunsSkipped.WithLabelValues(name).Inc()
+			log.Printf("Skipping run of task %s: previous run still in progress", name)
+		case err != nil:
 			log.Printf("Task %s failed: %v", name, err)
 		}
 	})
 
+	_, err := s.cron.AddJob(cronSpec, job)
 	if err != nil {
 		return fmt.Errorf("failed to add task %s: %w", name, err)
 	}
 
-	s.tasks[name] = task
+	s.tasks[name] = t
 	log.Printf("Added scheduled task: %s with spec: %s", name, cronSpec)
 	return nil
 }
 
-func (s *Scheduler) registerDefaultTasks() {
-	s.AddTask("buffer_stats", "0 */5 * * * *", s.bufferStatsTask)
-
-	s.AddTask("cleanup_old_events", "0 0 2 * * *", s.cleanupTask)
+// scheduledTask is a task added with AddTask and its options.
+type scheduledTask struct {
+	name string
+	task Task
+	opts taskOptions
+	// running is set while a run of a task that does not allow overlapping
+	// runs is in progress, whether scheduled or started by RunTaskNow.
+	running atomic.Bool
+}
 
-	s.AddTask("health_check", "0 */1 * * * *", s.healthCheckTask)
+// runTask runs t once with a context derived from ctx, returning
+// ErrTaskRunning without running it if it is still running and may not
+// overlap.
+func (s *Scheduler) runTask(ctx context.Context, t *scheduledTask) error {
+	if !t.opts.allowOverlap {
+		if !t.running.CompareAndSwap(false, true) {
+			return ErrTaskRunning
+		}
+		defer t.running.Store(false)
+	}
 
-	s.AddTask("process_scheduled_events", "* * * * * *", s.processScheduledEventsTask)
+	ctx, cancel := context.WithCancel(ctx)
+	if t.opts.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.opts.timeout)
+	}
+	defer cancel()
+	return t.task(ctx)
 }
 
-func (s *Scheduler) bufferStatsTask(ctx context.Context) error {
-	count, err := s.buffer.Count()
-	if err != nil {
-		return fmt.Errorf("failed to get buffer count: %w", err)
+// RunTaskNow runs the task added under name once, now, and waits for it to
+// finish, for forcing a cleanup or stats run without waiting for its
+// schedule. The run gets the task's timeout and is cancelled by ctx or Stop.
+// A task that does not allow overlapping runs returns ErrTaskRunning while a
+// run is in progress; an unknown name returns ErrUnknownTask.
+func (s *Scheduler) RunTaskNow(ctx context.Context, name string) error {
+	s.onDemand.RLock()
+	defer s.onDemand.RUnlock()
+	if s.ctx.Err() != nil {
+		return fmt.Errorf("cannot run task %s: scheduler stopped", name)
 	}
+	t, ok := s.tasks[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownTask, name)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(s.ctx, cancel)
+	defer stop()
 
-	log.Printf("Buffer statistics - Events in queue: %d", count)
+	log.Printf("Running task %s on demand", name)
+	if err := s.runTask(ctx, t); err != nil {
+		if errors.Is(err, ErrTaskRunning) {
+			return fmt.Errorf("%w: %s", ErrTaskRunning, name)
+		}
+		return fmt.Errorf("task %s failed: %w", name, err)
+	}
 	return nil
 }
 
-func (s *Scheduler) cleanupTask(ctx context.Context) error {
-	log.Println("Running cleanup task - checking for old failed events")
+func (s *Scheduler) registerDefaultTasks() error {
+	defaults := []struct {
+		name string
+		task Task
+	}{
+		{TaskBufferStats, s.bufferStatsTask},
+		{TaskCleanup, s.cleanupTask},
+		{TaskHealthCheck, s.healthCheckTask},
+		{TaskProcessScheduled, s.processScheduledEventsTask},
+	}
 
-	events, err := s.buffer.GetBatch(1000)
+	var errs []error
+	for _, d := range defaults {
+		if err := s.AddTask(d.name, s.schedules[d.name], d.task); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Scheduler) bufferStatsTask(ctx context.Context) error {
+	stats, err := s.buffer.Stats()
 	if err != nil {
-		return fmt.Errorf("failed to get events for cleanup: %w", err)
+		return fmt.Errorf("failed to get buffer stats: %w", err)
+	}
+
+	var age time.Duration
+	if !stats.Oldest.IsZero() {
+		age = s.clock.Now().Sub(stats.Oldest)
 	}
+	metrics.OldestEventAge.Set(age.Seconds())
+
+	log.Printf("Buffer statistics - Events in queue: %d, dead-lettered: %d, oldest: %s", stats.Queued, stats.DeadLettered, age.Round(time.Second))
+	return nil
+}
+
+// SetMaxRedeliveries sets the failed syncs after which cleanup dead-letters
+// an event; 0 never does. It may be called while running.
+func (s *Scheduler) SetMaxRedeliveries(max int) {
+	s.maxRedeliveries.Store(int64(max))
+}
 
-	cutoff := time.Now().Add(-24 * time.Hour)
-	cleanedCount := 0
+func (s *Scheduler) cleanupTask(ctx context.Context) error {
+	log.Println("Running cleanup task - checking for events over the redelivery limit")
+
+	// The sync worker dead-letters events as they reach the limit; this
+	// catches those left over it by a lowered limit or an older version.
+	if max := int(s.maxRedeliveries.Load()); max > 0 {
+		events, err := s.buffer.GetBatch(1000)
+		if err != nil {
+			return fmt.Errorf("failed to get events for cleanup: %w", err)
+		}
 
-	for _, event := range events {
-		if event.Retries > 10 && event.Timestamp.Before(cutoff) {
-			if err := s.buffer.Delete(event.ID, event.Timestamp); err != nil {
-				log.Printf("Failed to delete old event %s: %v", event.ID, err)
+		var deadLettered int
+		for _, event := range events {
+			if event.Retries < max {
+				continue
+			}
+			reason := fmt.Sprintf("exceeded BUFFER_MAX_REDELIVERIES (%d) after %d failed syncs", max, event.Retries)
+			if err := s.buffer.MoveToDeadLetter(event, reason); err != nil {
+				log.Printf("Failed to dead-letter event %s: %v", event.ID, err)
 				continue
 			}
-			cleanedCount++
+			deadLettered++
+		}
+
+		if deadLettered > 0 {
+			log.Printf("Dead-lettered %d events over the redelivery limit", deadLettered)
 		}
 	}
 
-	if cleanedCount > 0 {
-		log.Printf("Cleaned up %d old failed events", cleanedCount)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("cleanup interrupted before purging expired events: %w", err)
+	}
+
+	expiredCount, err := s.buffer.PurgeExpired()
+	if err != nil {
+		return fmt.Errorf("failed to purge expired events: %w", err)
+	}
+	if expiredCount > 0 {
+		log.Printf("Purged %d expired events", expiredCount)
 	}
 
 	return nil
 }
 
+// healthCheckTask updates the state served by Health. Changes between
+// healthy and degraded are logged.
 func (s *Scheduler) healthCheckTask(ctx context.Context) error {
+	previous := s.health.get()
+
 	count, err := s.buffer.Count()
 	if err != nil {
+		s.health.set(HealthStatus{
+			Reasons:   []string{fmt.Sprintf("buffer error: %v", err)},
+			CheckedAt: s.clock.Now(),
+		})
 		return fmt.Errorf("health check failed - buffer error: %w", err)
 	}
 
-	if count > 10000 {
-		log.Printf("WARNING: Buffer contains %d events - consider investigating connectivity issues", count)
+	status := s.evaluateHealth(count)
+	s.health.set(status)
+
+	switch {
+	case !status.Healthy && previous.Healthy:
+		log.Printf("WARNING: Service degraded: %s", strings.Join(status.Reasons, "; "))
+	case status.Healthy && !previous.Healthy:
+		log.Println("Service healthy again")
 	}
 
 	return nil
 }
 
+// processScheduledEventsTask moves delayed events whose ready time has
+// passed into the queue the sync worker reads.
 func (s *Scheduler) processScheduledEventsTask(ctx context.Context) error {
-	events, err := s.buffer.GetBatch(1000)
-	if err != nil {
-		return fmt.Errorf("failed to get events for scheduled processing: %w", err)
-	}
-
-	now := time.Now()
-	processedCount := 0
-
-	for _, event := range events {
-		// Check if this event has a delayedUntil and if it's ready
-		if event.DelayedUntil != nil {
-			// Event is ready if delayedUntil <= current time
-			if event.DelayedUntil.After(now) {
-				// Event is not ready yet, skip
-				continue
-			}
-
-			// Event is ready to be processed - the sync service will pick it up via GetReadyEvents
-			log.Printf("Scheduled event %s is now ready for processing (delayedUntil: %v, now: %v)", 
-				event.ID, event.DelayedUntil, now)
-			processedCount++
-		}
-	}
-
-	if processedCount > 0 {
-		log.Printf("Processed %d scheduled events that are now ready", processedCount)
+	promoted, err := s.buffer.PromoteScheduled()
+	if promoted > 0 {
+		log.Printf("Promoted %d scheduled events that are now ready", promoted)
 	}
-
-	return nil
+	return err
 }
 
 func (s *Scheduler) GetTaskNames() []string {
@@ -0,0 +1,543 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newTestScheduler returns a scheduler over a temporary buffer holding
+// queued events, with a threshold of one so its health check is degraded
+// once the startup grace is over.
+func newTestScheduler(t *testing.T, clk clock.Clock, queued int) *Scheduler {
+	t.Helper()
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	t.Cleanup(func() { buf.Close() })
+	for i := 0; i < queued; i++ {
+		if err := buf.Store(&buffer.Event{ID: fmt.Sprint(i), Operation: "insert", Timestamp: clk.Now()}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	s := New(buf, clk)
+	s.SetHealthCheck(HealthCheck{BufferThreshold: 1})
+	return s
+}
+
+func TestStartupGrace(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := newTestScheduler(t, clk, 3)
+	s.SetStartupGrace(time.Hour)
+	s.Start(context.Background())
+	defer s.Stop()
+
+	if status := s.Health(); !status.Healthy || !status.StartupGrace {
+		t.Fatalf("Health within the grace period = %+v, want healthy in grace", status)
+	}
+
+	clk.Advance(30 * time.Minute)
+	if err := s.RunTaskNow(context.Background(), TaskHealthCheck); err != nil {
+		t.Fatalf("RunTaskNow: %v", err)
+	}
+	if status := s.Health(); !status.Healthy || !status.StartupGrace {
+		t.Fatalf("Health later in the grace period = %+v, want healthy in grace", status)
+	}
+
+	clk.Advance(time.Hour)
+	if err := s.RunTaskNow(context.Background(), TaskHealthCheck); err != nil {
+		t.Fatalf("RunTaskNow: %v", err)
+	}
+	if status := s.Health(); status.Healthy || status.StartupGrace || len(status.Reasons) == 0 {
+		t.Fatalf("Health after the grace period = %+v, want degraded", status)
+	}
+}
+
+func TestStartupGraceWaitsForComponents(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	clk := clock.NewFake(start)
+	s := newTestScheduler(t, clk, 3)
+	var started atomic.Bool
+	s.SetHealthCheck(HealthCheck{BufferThreshold: 1, Started: started.Load})
+	s.SetStartupGrace(time.Hour)
+	s.Start(context.Background())
+	defer s.Stop()
+
+	check := func(at time.Time) HealthStatus {
+		t.Helper()
+		clk.Set(at)
+		if err := s.RunTaskNow(context.Background(), TaskHealthCheck); err != nil {
+			t.Fatalf("RunTaskNow: %v", err)
+		}
+		return s.Health()
+	}
+	notStarted := func(status HealthStatus) bool {
+		for _, reason := range status.Reasons {
+			if strings.Contains(reason, "not all started") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if status := s.Health(); status.Healthy || !status.StartupGrace || !notStarted(status) {
+		t.Fatalf("Health at start before the components = %+v, want unhealthy in grace", status)
+	}
+	if status := check(start.Add(time.Minute)); status.Healthy || !notStarted(status) {
+		t.Fatalf("Health in grace before the components = %+v, want unhealthy", status)
+	}
+
+	started.Store(true)
+	if status := check(start.Add(time.Minute)); !status.Healthy || !status.StartupGrace {
+		t.Fatalf("Health in grace once started = %+v, want healthy in grace", status)
+	}
+	if status := check(start.Add(time.Hour - time.Nanosecond)); !status.Healthy || !status.StartupGrace {
+		t.Fatalf("Health at the end of the grace period = %+v, want healthy in grace", status)
+	}
+	if status := check(start.Add(time.Hour)); status.Healthy || status.StartupGrace || notStarted(status) {
+		t.Fatalf("Health once the grace period is over = %+v, want degraded by the threshold only", status)
+	}
+
+	started.Store(false)
+	if status := check(start.Add(2 * time.Hour)); status.Healthy || !notStarted(status) || len(status.Reasons) != 2 {
+		t.Fatalf("Health after the grace period before the components = %+v, want both reasons", status)
+	}
+}
+
+func TestCheckRunsWhenGraceEnds(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 3)
+	s.SetStartupGrace(50 * time.Millisecond)
+	s.Start(context.Background())
+	defer s.Stop()
+
+	if status := s.Health(); !status.StartupGrace {
+		t.Fatalf("Health at start = %+v, want in grace", status)
+	}
+	// The scheduled check runs once a minute, so only the check at the end
+	// of the grace period can degrade it this soon
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Health().StartupGrace {
+		if time.Now().After(deadline) {
+			t.Fatal("health still in grace long after the grace period ended")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status := s.Health(); status.Healthy {
+		t.Fatalf("Health after the grace period = %+v, want degraded", status)
+	}
+}
+
+func TestStopWaitsForGraceCheck(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 0)
+	s.SetStartupGrace(time.Millisecond)
+
+	// Checks within the grace period skip the thresholds, so the first call
+	// is from the check at the end of it; hold that check until released
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	s.SetHealthCheck(HealthCheck{BufferThreshold: 1, MaxOffline: time.Hour, OfflineFor: func() time.Duration {
+		once.Do(func() { close(started) })
+		<-release
+		return 0
+	}})
+	s.Start(context.Background())
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("health check did not run when the grace period ended")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop returned while the health check after the grace period was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not return after the health check finished")
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	valid := []string{
+		"0 0 2 * * *",
+		"*/15 * * * *",
+		"0 9 * * MON-FRI",
+		"@daily",
+		"@every 90s",
+		"CRON_TZ=Europe/London 0 2 * * *",
+	}
+	for _, spec := range valid {
+		if err := ValidateSpec(spec); err != nil {
+			t.Errorf("ValidateSpec(%q) = %v, want nil", spec, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"   ",
+		"* * *",
+		"* * * * * * *",
+		"61 * * * *",
+		"0 25 * * *",
+		"@often",
+		"@every soon",
+		"TZ=Nowhere/Special 0 2 * * *",
+	}
+	for _, spec := range invalid {
+		err := ValidateSpec(spec)
+		if err == nil {
+			t.Errorf("ValidateSpec(%q) succeeded, want an error", spec)
+			continue
+		}
+		if strings.TrimSpace(spec) != "" && !strings.Contains(err.Error(), fmt.Sprintf("%q", spec)) {
+			t.Errorf("ValidateSpec(%q) = %v, want the spec named in the error", spec, err)
+		}
+	}
+}
+
+func TestNormalizeSpec(t *testing.T) {
+	tests := []struct{ spec, want string }{
+		{"*/15 * * * *", "0 */15 * * * *"},
+		{"30 */15 * * * *", "30 */15 * * * *"},
+		{"@hourly", "@hourly"},
+		{"TZ=UTC 0 2 * * *", "TZ=UTC 0 0 2 * * *"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeSpec(tt.spec); got != tt.want {
+			t.Errorf("NormalizeSpec(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleSpecsAreValidated(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 0)
+	defer s.Stop()
+
+	if err := s.SetSchedule(TaskCleanup, "0 3 * * *"); err != nil {
+		t.Fatalf("SetSchedule with a 5-field spec: %v", err)
+	}
+	if got := s.schedules[TaskCleanup]; got != "0 0 3 * * *" {
+		t.Errorf("cleanup scheduled at %q, want the normalized spec", got)
+	}
+	if err := s.SetSchedule(TaskCleanup, "0 3 * *"); err == nil || !strings.Contains(err.Error(), TaskCleanup) {
+		t.Errorf("SetSchedule with a bad spec = %v, want an error naming the task", err)
+	}
+	if got := s.schedules[TaskCleanup]; got != "0 0 3 * * *" {
+		t.Errorf("a rejected spec replaced the schedule with %q", got)
+	}
+	if err := s.SetSchedule("nightly_report", "@daily"); err == nil {
+		t.Error("SetSchedule accepted an unknown task")
+	}
+
+	noop := func(context.Context) error { return nil }
+	if err := s.AddTask("report", "@fortnightly", noop); err == nil || !strings.Contains(err.Error(), "report") {
+		t.Errorf("AddTask with a bad spec = %v, want an error naming the task", err)
+	}
+	if err := s.AddTask("report", "*/5 * * * *", noop); err != nil {
+		t.Errorf("AddTask with a 5-field spec: %v", err)
+	}
+}
+
+// blockingTask returns a task that signals started and then waits for its
+// context, returning the context's error, and the channel it signals on.
+func blockingTask() (Task, chan struct{}) {
+	started := make(chan struct{}, 1)
+	return func(ctx context.Context) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		return ctx.Err()
+	}, started
+}
+
+func TestTaskTimeoutCancelsRun(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 0)
+	s.SetTaskTimeout(100 * time.Millisecond)
+	slow, _ := blockingTask()
+	if err := s.AddTask("slow", "@every 1h", slow, WithTimeout(20*time.Millisecond)); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	defaulted, _ := blockingTask()
+	if err := s.AddTask("defaulted", "@every 1h", defaulted); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	s.Start(context.Background())
+	defer s.Stop()
+
+	tests := []struct {
+		name    string
+		timeout time.Duration
+	}{
+		{"slow", 20 * time.Millisecond},
+		// SetTaskTimeout applies to tasks added without WithTimeout
+		{"defaulted", 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		start := time.Now()
+		err := s.RunTaskNow(context.Background(), tt.name)
+		elapsed := time.Since(start)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("%s: RunTaskNow = %v, want context.DeadlineExceeded", tt.name, err)
+		}
+		if elapsed < tt.timeout || elapsed > tt.timeout+time.Second {
+			t.Errorf("%s: cancelled after %v, want its %v timeout", tt.name, elapsed, tt.timeout)
+		}
+	}
+}
+
+func TestStopCancelsRunningTask(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 0)
+	slow, started := blockingTask()
+	var result atomic.Value
+	task := func(ctx context.Context) error {
+		err := slow(ctx)
+		result.Store(err)
+		return err
+	}
+	if err := s.AddTask("slow", "* * * * * *", task, WithTimeout(time.Hour)); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	s.Start(context.Background())
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled task did not run")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not cancel the running task")
+	}
+	// Stop returns only once the run has finished
+	if err, _ := result.Load().(error); !errors.Is(err, context.Canceled) {
+		t.Fatalf("task ended with %v, want context.Canceled", err)
+	}
+}
+
+func TestCleanupStopsWhenCancelled(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.cleanupTask(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cleanupTask with a cancelled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestOverlappingRunsSkipped(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		t.Run(fmt.Sprintf("allowOverlap=%v", allow), func(t *testing.T) {
+			s := newTestScheduler(t, clock.New(), 0)
+			const name = "slow"
+			if allow {
+				s.SetAllowOverlap(name)
+			}
+			release := make(chan struct{})
+			started := make(chan struct{}, 3)
+			var runs atomic.Int32
+			task := func(ctx context.Context) error {
+				runs.Add(1)
+				started <- struct{}{}
+				<-release
+				return nil
+			}
+			if err := s.AddTask(name, "@every 1h", task); err != nil {
+				t.Fatalf("AddTask: %v", err)
+			}
+			// Fire the cron job directly, as the schedule would each time it
+			// comes round
+			entries := s.cron.Entries()
+			if len(entries) != 1 {
+				t.Fatalf("%d cron entries, want the one task", len(entries))
+			}
+			fire := entries[0].Job.Run
+			skipped := func() float64 { return testutil.ToFloat64(metrics.ScheduledRunsSkipped.WithLabelValues(name)) }
+			before := skipped()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fire()
+			}()
+			<-started
+			// The schedule comes round twice more while the first run is going
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					fire()
+				}()
+			}
+
+			wantRuns, wantSkipped := int32(1), 0.0
+			if allow {
+				wantRuns = 3
+				<-started
+				<-started
+			} else {
+				wantSkipped = 2
+				deadline := time.Now().Add(5 * time.Second)
+				for skipped()-before < wantSkipped && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			if got := runs.Load(); got != wantRuns {
+				t.Errorf("%d runs in progress at once, want %d", got, wantRuns)
+			}
+			if got := skipped() - before; got != wantSkipped {
+				t.Errorf("skipped counter rose by %v, want %v", got, wantSkipped)
+			}
+			close(release)
+			wg.Wait()
+		})
+	}
+}
+
+func TestBufferStatsSetsOldestEventAge(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	s := newTestScheduler(t, clk, 0)
+	for i, age := range []time.Duration{time.Minute, 5 * time.Minute, 0} {
+		if err := s.buffer.Store(&buffer.Event{ID: fmt.Sprint(i), Operation: "insert", Timestamp: clk.Now().Add(-age)}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	if err := s.bufferStatsTask(context.Background()); err != nil {
+		t.Fatalf("bufferStatsTask: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.OldestEventAge); got != 300 {
+		t.Errorf("OldestEventAge = %v, want the 5 minute old event's 300", got)
+	}
+
+	// The age grows while the event waits
+	clk.Advance(time.Minute)
+	if err := s.bufferStatsTask(context.Background()); err != nil {
+		t.Fatalf("bufferStatsTask: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.OldestEventAge); got != 360 {
+		t.Errorf("OldestEventAge = %v a minute later, want 360", got)
+	}
+
+	empty := newTestScheduler(t, clk, 0)
+	if err := empty.bufferStatsTask(context.Background()); err != nil {
+		t.Fatalf("bufferStatsTask: %v", err)
+	}
+	if got := testutil.ToFloat64(metrics.OldestEventAge); got != 0 {
+		t.Errorf("OldestEventAge = %v for an empty buffer, want 0", got)
+	}
+}
+
+func TestRunTaskNow(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 0)
+	var runs atomic.Int32
+	if err := s.AddTask("count", "@every 1h", func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	}); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	boom := errors.New("boom")
+	if err := s.AddTask("failing", "@every 1h", func(ctx context.Context) error { return boom }); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+
+	// A task runs at once, well before its schedule, and RunTaskNow waits
+	// for it
+	if err := s.RunTaskNow(context.Background(), "count"); err != nil {
+		t.Fatalf("RunTaskNow: %v", err)
+	}
+	if got := runs.Load(); got != 1 {
+		t.Errorf("task ran %d times, want once", got)
+	}
+	if err := s.RunTaskNow(context.Background(), "failing"); !errors.Is(err, boom) {
+		t.Errorf("RunTaskNow of a failing task = %v, want its error", err)
+	}
+
+	err := s.RunTaskNow(context.Background(), "nonexistent")
+	if !errors.Is(err, ErrUnknownTask) || !strings.Contains(err.Error(), "nonexistent") {
+		t.Errorf("RunTaskNow of an unknown name = %v, want ErrUnknownTask naming it", err)
+	}
+
+	s.Stop()
+	if err := s.RunTaskNow(context.Background(), "count"); err == nil || runs.Load() != 1 {
+		t.Errorf("RunTaskNow after Stop = %v with %d runs, want an error and no run", err, runs.Load())
+	}
+}
+
+func TestRunTaskNowConflictsWithScheduledRun(t *testing.T) {
+	s := newTestScheduler(t, clock.New(), 0)
+	const name = "slow"
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	task := func(ctx context.Context) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+	if err := s.AddTask(name, "@every 1h", task); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	fire := s.cron.Entries()[0].Job.Run
+	skipped := func() float64 { return testutil.ToFloat64(metrics.ScheduledRunsSkipped.WithLabelValues(name)) }
+
+	// A scheduled run is in progress, so the on-demand one is refused
+	done := make(chan struct{})
+	go func() {
+		fire()
+		close(done)
+	}()
+	<-started
+	if err := s.RunTaskNow(context.Background(), name); !errors.Is(err, ErrTaskRunning) {
+		t.Errorf("RunTaskNow during a scheduled run = %v, want ErrTaskRunning", err)
+	}
+	release <- struct{}{}
+	<-done
+
+	// And the other way round: the schedule skips while an on-demand run is
+	// going
+	before := skipped()
+	result := make(chan error, 1)
+	go func() { result <- s.RunTaskNow(context.Background(), name) }()
+	<-started
+	fire()
+	if got := skipped() - before; got != 1 {
+		t.Errorf("skipped counter rose by %v during an on-demand run, want 1", got)
+	}
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("RunTaskNow: %v", err)
+	}
+	if len(started) != 0 {
+		t.Error("the skipped scheduled run started anyway")
+	}
+}
@@ -2,58 +2,478 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"buffered-cdc/internal/admin"
 	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
 	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/logging"
 	"buffered-cdc/internal/monitor"
 	"buffered-cdc/internal/scheduler"
+	"buffered-cdc/internal/workers"
 	kafkasync "buffered-cdc/internal/sync"
 )
 
 type Service struct {
 	config          *config.Config
 	buffer          *buffer.Buffer
-	mongoMonitor    *monitor.MongoMonitor
+	// spill is nil unless BUFFER_SPILL_DIR is set.
+	spill           *buffer.Spill
+	source          monitor.Source
 	connMonitor     *monitor.ConnectivityMonitor
 	kafkaSync       *kafkasync.KafkaSync
 	scheduler       *scheduler.Scheduler
+	admin           *admin.Server
 	
-	cancelFuncs     []context.CancelFunc
+	components      []*component
+	started         atomic.Bool
 	wg              sync.WaitGroup
+	failures        chan error
+
+	// reloadMu serializes Reload. loaded is the configuration last read,
+	// which the next reload compares against so a setting that needs a
+	// restart is reported once; the components keep using config.
+	reloadMu sync.Mutex
+	loaded   *config.Config
 }
 
-func New(cfg *config.Config) (*Service, error) {
-	buf, err := buffer.New(cfg.Buffer.Path)
+func New(ctx context.Context, cfg *config.Config) (*Service, error) {
+	clk := clock.New()
+	logging.SetSampleRate(cfg.Log.SampleRate)
+
+	buf, err := buffer.New(cfg.Buffer.Path, &buffer.Options{
+		Timeout:         cfg.Buffer.OpenTimeout,
+		NoSync:          cfg.Buffer.NoSync,
+		SyncPolicy:      cfg.Buffer.SyncPolicy,
+		SyncInterval:    cfg.Buffer.SyncInterval,
+		InitialMmapSize: cfg.Buffer.InitialMmapSize,
+		Shards:          cfg.Buffer.Shards,
+		Clock:           clk,
+		SlowLaneRetries: cfg.Buffer.SlowLaneRetries,
+		RetryBackoff:    cfg.Buffer.RetryBackoff,
+		MaxRetryBackoff: cfg.Buffer.MaxRetryBackoff,
+		ReadOrder:       cfg.Buffer.ReadOrder,
+		TxnChunkSize:    cfg.Buffer.TxnChunkSize,
+		ScheduleDelayed: cfg.Buffer.ScheduleDelayed,
+		Codec:           cfg.Buffer.Codec,
+		OnDuplicate:     cfg.Buffer.OnDuplicate,
+		AsyncWrites:     cfg.Buffer.AsyncWrites,
+		FlushInterval:   cfg.Buffer.FlushInterval,
+		FlushSize:       cfg.Buffer.BatchSize,
+		MaxPending:      cfg.Buffer.MaxBufferSize,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create buffer: %w", err)
 	}
+	if cfg.Buffer.AutoMigrate {
+		migrated, err := buf.Migrate()
+		if err != nil {
+			buf.Close()
+			return nil, err
+		}
+		if migrated > 0 {
+			log.Printf("Migrated %d buffered events to schema version %d", migrated, buffer.CurrentSchemaVersion)
+		}
+	}
+
+	var spill *buffer.Spill
+	if cfg.Buffer.SpillDir != "" {
+		spill, err = buffer.NewSpill(buf, buffer.SpillOptions{
+			Dir:       cfg.Buffer.SpillDir,
+			HighWater: cfg.Buffer.SpillHighWater,
+			LowWater:  cfg.Buffer.SpillLowWater,
+			FileBytes: int64(cfg.Buffer.SpillFileBytes),
+		})
+		if err != nil {
+			buf.Close()
+			return nil, err
+		}
+	}
+
+	// Bounds the batch writes and snapshot documents in flight; long-running
+	// components run outside it so they cannot hold slots forever.
+	pool := workers.New(cfg.Service.MaxWorkers)
 
-	mongoMonitor, err := monitor.NewMongoMonitor(cfg, buf)
+	source, err := monitor.NewSource(ctx, cfg, buf, clk, pool)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create mongo monitor: %w", err)
+		return nil, fmt.Errorf("failed to create %s source: %w", cfg.Source.Type, err)
 	}
 
-	connMonitor := monitor.NewConnectivityMonitor(cfg)
-	kafkaSync := kafkasync.NewKafkaSync(cfg, buf, connMonitor)
-	sched := scheduler.New(buf)
+	connMonitor, err := monitor.NewConnectivityMonitor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create connectivity monitor: %w", err)
+	}
+	kafkaSync, err := kafkasync.NewKafkaSync(cfg, buf, connMonitor, pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka sync: %w", err)
+	}
+	sched := scheduler.New(buf, clk)
+	sched.SetTaskTimeout(cfg.Scheduler.TaskTimeout)
+	sched.SetAllowOverlap(cfg.Scheduler.AllowOverlap...)
+	sched.SetMaxRedeliveries(cfg.Buffer.MaxRedeliveries)
+	sched.SetStartupGrace(cfg.Health.StartupGrace)
+	schedules := map[string]string{
+		scheduler.TaskBufferStats:      cfg.Scheduler.BufferStatsCron,
+		scheduler.TaskCleanup:          cfg.Scheduler.CleanupCron,
+		scheduler.TaskHealthCheck:      cfg.Scheduler.HealthCheckCron,
+		scheduler.TaskProcessScheduled: cfg.Scheduler.ProcessScheduledCron,
+	}
+	for name, spec := range schedules {
+		if err := sched.SetSchedule(name, spec); err != nil {
+			return nil, fmt.Errorf("invalid schedule: %w", err)
+		}
+	}
+	if err := sched.AddTask("kafka_writer_stats", cfg.Scheduler.KafkaWriterStatsCron, kafkaSync.ReportStats); err != nil {
+		return nil, err
+	}
+	if cfg.Scheduler.ReconcileCron != "" {
+		if err := sched.AddTask("reconcile", cfg.Scheduler.ReconcileCron, kafkaSync.Reconcile); err != nil {
+			return nil, err
+		}
+	}
 
-	return &Service{
+	s := &Service{
 		config:       cfg,
+		loaded:       cfg,
 		buffer:       buf,
-		mongoMonitor: mongoMonitor,
+		spill:        spill,
+		source:       source,
 		connMonitor:  connMonitor,
 		kafkaSync:    kafkaSync,
 		scheduler:    sched,
-	}, nil
+		admin:        admin.New(cfg),
+		failures:     make(chan error, 1),
+	}
+	sched.SetHealthCheck(scheduler.HealthCheck{
+		BufferThreshold: cfg.Health.BufferThreshold,
+		MaxOffline:      cfg.Health.MaxOffline,
+		OfflineFor:      connMonitor.OfflineFor,
+		Started:         s.started.Load,
+	})
+	s.admin.HandleFunc("/checkpoints", s.handleCheckpoints)
+	s.admin.HandleFunc("/events", s.handleEvents)
+	s.admin.HandleFunc("/readyz", s.handleReadyz)
+	s.admin.HandleFunc("/sync", s.handleSyncState)
+	s.admin.HandleFunc("/sync/pause", s.handleSyncPause)
+	s.admin.HandleFunc("/sync/resume", s.handleSyncResume)
+	s.admin.HandleFunc("/sync/lag", s.handleSyncLag)
+	s.admin.HandleFunc("/connectivity/recheck", s.handleConnectivityRecheck)
+	s.admin.HandleFunc("/tasks/{name}/run", s.handleTaskRun)
+
+	return s, nil
+}
+
+// EventBus returns the bus synced events are published on, for code
+// embedding the service. It is nil unless SINK_BUS_BUFFER is set.
+func (s *Service) EventBus() *kafkasync.EventBus {
+	return s.kafkaSync.EventBus()
+}
+
+// Reload re-reads the configuration, including CONFIG_FILE, and applies the
+// settings in config.Runtime without touching the change stream or the
+// buffer. Other settings that changed are logged and keep their current
+// values until a restart. Nothing is applied if the new settings are invalid.
+func (s *Service) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	next, ignored, err := config.Reload(s.loaded)
+	if err != nil {
+		return fmt.Errorf("failed to reload configuration: %w", err)
+	}
+	rt := next.Runtime()
+	for _, name := range ignored {
+		log.Printf("WARNING: %s changed but cannot be reloaded; the new value takes effect on restart", name)
+	}
+
+	if err := s.kafkaSync.SetRuntime(rt); err != nil {
+		return fmt.Errorf("failed to reload configuration: %w", err)
+	}
+	s.scheduler.SetMaxRedeliveries(rt.MaxRedeliveries)
+	s.scheduler.SetHealthCheck(scheduler.HealthCheck{
+		BufferThreshold: rt.HealthBufferThreshold,
+		MaxOffline:      rt.HealthMaxOffline,
+		OfflineFor:      s.connMonitor.OfflineFor,
+		Started:         s.started.Load,
+	})
+	s.loaded = next
+
+	log.Println("Configuration reloaded")
+	return nil
+}
+
+// handleCheckpoints returns the most recent Kafka checkpoints, newest first,
+// for reconciling the buffer against the topic. ?limit= caps the count.
+func (s *Service) handleCheckpoints(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	checkpoints, err := s.buffer.Checkpoints(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(checkpoints); err != nil {
+		log.Printf("Failed to write checkpoints response: %v", err)
+	}
+}
+
+// handleEvents lists queued events by operation or collection and capture
+// time, e.g. /events?operation=delete&since=1h. from and to take RFC3339
+// times; since is a duration back from now and overrides from.
+func (s *Service) handleEvents(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := buffer.Query{
+		Operation:  params.Get("operation"),
+		Collection: params.Get("collection"),
+		Limit:      100,
+	}
+
+	for name, target := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if value := params.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, name+" must be an RFC3339 time", http.StatusBadRequest)
+				return
+			}
+			*target = t
+		}
+	}
+	if value := params.Get("since"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "since must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		q.From = time.Now().Add(-d)
+	}
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		q.Limit = n
+	}
+
+	events, err := s.buffer.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		log.Printf("Failed to write events response: %v", err)
+	}
+}
+
+// handleReadyz serves the result of the last health check: 200 while
+// healthy, 503 with the reasons while degraded.
+func (s *Service) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := s.scheduler.Health()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Printf("Failed to write readiness response: %v", err)
+	}
+}
+
+// handleSyncState reports whether publishing to Kafka is paused.
+func (s *Service) handleSyncState(w http.ResponseWriter, r *http.Request) {
+	s.writeSyncState(w)
+}
+
+// handleSyncPause stops publishing to Kafka; capture keeps filling the buffer.
+func (s *Service) handleSyncPause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.kafkaSync.Pause()
+	s.writeSyncState(w)
+}
+
+// handleSyncResume lets publishing continue and drains the buffer.
+func (s *Service) handleSyncResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.kafkaSync.Resume()
+	s.writeSyncState(w)
+}
+
+// handleConnectivityRecheck probes Kafka and the other probe targets now,
+// so a fixed network is noticed without waiting for MONITOR_INTERVAL.
+func (s *Service) handleConnectivityRecheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	reachable := s.connMonitor.Recheck()
+
+	w.Header().Set("Content-Type", "application/json")
+	state := struct {
+		Reachable      bool    `json:"reachable"`
+		Online         bool    `json:"online"`
+		OfflineSeconds float64 `json:"offlineSeconds"`
+	}{
+		Reachable:      reachable,
+		Online:         s.connMonitor.IsOnline(),
+		OfflineSeconds: s.connMonitor.OfflineFor().Seconds(),
+	}
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Printf("Failed to write connectivity response: %v", err)
+	}
+}
+
+// handleTaskRun runs the named scheduled task now and reports how long it
+// took once it is done.
+func (s *Service) handleTaskRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.PathValue("name")
+	start := time.Now()
+	if err := s.scheduler.RunTaskNow(r.Context(), name); err != nil {
+		switch {
+		case errors.Is(err, scheduler.ErrUnknownTask):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, scheduler.ErrTaskRunning):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	result := struct {
+		Task            string  `json:"task"`
+		DurationSeconds float64 `json:"durationSeconds"`
+	}{
+		Task:            name,
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("Failed to write task run response: %v", err)
+	}
+}
+
+// handleSyncLag takes a consumer lag report, {"lag": N}, for
+// SYNC_LAG_SOURCE=admin.
+func (s *Service) handleSyncLag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var report struct {
+		Lag *int64 `json:"lag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.Lag == nil {
+		http.Error(w, `body must be {"lag": <messages>}`, http.StatusBadRequest)
+		return
+	}
+	if err := s.kafkaSync.ReportLag(*report.Lag); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) writeSyncState(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	state := struct {
+		Paused bool `json:"paused"`
+	}{Paused: s.kafkaSync.Paused()}
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Printf("Failed to write sync state response: %v", err)
+	}
+}
+
+// Preflight checks that the buffer accepts writes, the source is reachable
+// (for sources with a Preflight method, such as MongoDB, which must also be
+// watchable), and Kafka is reachable with the topics in place, so
+// misconfiguration fails at startup rather than once events flow. Every check
+// runs and the failures are returned together.
+func (s *Service) Preflight(ctx context.Context) error {
+	type preflightCheck struct {
+		name  string
+		check func(context.Context) error
+	}
+	checks := []preflightCheck{
+		{"buffer", func(context.Context) error { return s.buffer.CheckWritable() }},
+	}
+	if source, ok := s.source.(interface{ Preflight(context.Context) error }); ok {
+		checks = append(checks, preflightCheck{s.config.Source.Type, source.Preflight})
+	}
+	checks = append(checks, preflightCheck{"kafka", s.kafkaSync.Preflight})
+
+	var errs []error
+	for _, c := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, s.config.Service.PreflightTimeout)
+		err := c.check(checkCtx)
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.name, err))
+			continue
+		}
+		log.Printf("Preflight %s check passed", c.name)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("preflight failed: %w", errors.Join(errs...))
+	}
+	return nil
 }
 
 func (s *Service) Start(ctx context.Context) error {
 	log.Println("Starting buffered CDC service")
 
-	s.scheduler.Start()
+	if s.config.Service.Preflight {
+		if err := s.Preflight(ctx); err != nil {
+			s.shutdown()
+			return err
+		}
+	}
+
+	s.scheduler.Start(ctx)
+
+	if s.config.Admin.Addr != "" {
+		s.startComponent("admin server", func(ctx context.Context) {
+			if err := s.admin.Start(ctx); err != nil {
+				log.Printf("Admin server error: %v", err)
+			}
+		})
+	}
+
+	if logging.SampleRate() > 1 {
+		s.startComponent("log summary", func(ctx context.Context) {
+			logging.Run(ctx, s.config.Log.SummaryInterval)
+		})
+	}
 
 	s.startComponent("connectivity monitor", func(ctx context.Context) {
 		s.connMonitor.Start(ctx)
@@ -63,63 +483,156 @@ func (s *Service) Start(ctx context.Context) error {
 		s.kafkaSync.Start(ctx)
 	})
 
-	s.startComponent("mongo monitor", func(ctx context.Context) {
-		if err := s.mongoMonitor.Start(ctx); err != nil {
-			log.Printf("MongoDB monitor error: %v", err)
+	store := s.buffer.StoreAsync
+	if s.spill != nil {
+		store = s.spill.Store
+		s.startComponent("buffer spill", func(ctx context.Context) {
+			s.spill.Run(ctx, s.config.Buffer.SpillInterval)
+		})
+	}
+
+	s.superviseComponent(s.config.Source.Type+" source", func(ctx context.Context) error {
+		err := s.source.Start(ctx, store)
+		if errors.Is(err, monitor.ErrInvalidated) {
+			// MONGODB_ON_INVALIDATE=stop
+			return fmt.Errorf("%w: %w", errNoRestart, err)
 		}
+		return err
 	})
 
-	<-ctx.Done()
-	log.Println("Shutdown signal received, stopping service...")
+	// The scheduler's first health check ran before any component existed,
+	// so check again once they are all running for /readyz to report ready.
+	for _, c := range s.components {
+		<-c.running
+	}
+	s.started.Store(true)
+	if err := s.scheduler.RunTaskNow(ctx, scheduler.TaskHealthCheck); err != nil {
+		log.Printf("WARNING: health check after startup failed: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Println("Shutdown signal received, stopping service...")
+	case err := <-s.failures:
+		log.Printf("Critical component failed, stopping service: %v", err)
+		s.shutdown()
+		return err
+	}
 
 	return s.shutdown()
 }
 
+// component is a long-running part of the service started by startComponent.
+type component struct {
+	name    string
+	cancel  context.CancelFunc
+	running chan struct{}
+	done    chan struct{}
+}
+
 func (s *Service) startComponent(name string, fn func(context.Context)) {
 	ctx, cancel := context.WithCancel(context.Background())
-	s.cancelFuncs = append(s.cancelFuncs, cancel)
+	c := &component{name: name, cancel: cancel, running: make(chan struct{}), done: make(chan struct{})}
+	s.components = append(s.components, c)
 	
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
+		defer close(c.done)
 		log.Printf("Starting %s", name)
+		close(c.running)
 		fn(ctx)
 		log.Printf("Stopped %s", name)
 	}()
 }
 
+// stopComponent cancels the named component and waits up to timeout for it
+// to return, reporting whether it did. A component that was never started
+// counts as stopped.
+func (s *Service) stopComponent(name string, timeout time.Duration) bool {
+	for _, c := range s.components {
+		if c.name == name {
+			c.cancel()
+			return stopWithin(name, timeout, func() { <-c.done })
+		}
+	}
+	return true
+}
+
+// shutdown stops the service in order, so nothing is lost between the steps:
+// the source first, so no new events arrive; then the scheduler; then the
+// sync worker, which sends what is ready while Kafka is reachable; and the
+// buffer last. Each step is bounded by its own timeout, and a step that
+// overruns is abandoned with a warning.
 func (s *Service) shutdown() error {
 	log.Println("Initiating graceful shutdown...")
+	cfg := s.config.Service
 
-	for _, cancel := range s.cancelFuncs {
-		cancel()
+	source := s.config.Source.Type + " source"
+	s.stopComponent(source, cfg.StopSourceTimeout)
+	if err := s.source.Close(); err != nil {
+		log.Printf("Error closing %s: %v", source, err)
 	}
-
-	done := make(chan struct{})
-	go func() {
-		s.wg.Wait()
-		close(done)
-	}()
-
-	select {
-	case <-done:
-		log.Println("All components stopped gracefully")
+	if s.spill != nil {
+		if err := s.spill.Close(); err != nil {
+			log.Printf("Error closing spill file: %v", err)
+		}
 	}
+	s.buffer.Flush()
 
-	s.scheduler.Stop()
+	stopWithin("scheduler", cfg.StopSchedulerTimeout, s.scheduler.Stop)
 
+	// Drain only once the sync loop has returned, so the two never read the
+	// same events
+	deadline := time.Now().Add(cfg.DrainTimeout)
+	stopped := s.stopComponent("kafka sync", cfg.DrainTimeout)
+	if stopped && cfg.DrainTimeout > 0 {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		if err := s.kafkaSync.Drain(ctx); err != nil {
+			log.Printf("WARNING: buffer not fully drained at shutdown, events stay buffered for the next start: %v", err)
+		}
+		cancel()
+	}
 	if err := s.kafkaSync.Close(); err != nil {
 		log.Printf("Error closing Kafka sync: %v", err)
 	}
 
-	if err := s.mongoMonitor.Close(); err != nil {
-		log.Printf("Error closing MongoDB monitor: %v", err)
-	}
-
-	if err := s.buffer.Close(); err != nil {
-		log.Printf("Error closing buffer: %v", err)
+	// The admin server reads the buffer too, so it stops with it
+	for _, c := range s.components {
+		c.cancel()
 	}
+	stopWithin("buffer", cfg.StopBufferTimeout, func() {
+		s.wg.Wait()
+		log.Println("All components stopped gracefully")
+		if err := s.buffer.Close(); err != nil {
+			log.Printf("Error closing buffer: %v", err)
+		}
+	})
 
 	log.Println("Service shutdown complete")
 	return nil
-}
\ No newline at end of file
+}
+
+// stopWithin runs stop and waits up to timeout for it to return, so one
+// stuck step cannot hold up the rest of the shutdown; 0 waits as long as it
+// takes. It reports whether stop returned in time.
+func stopWithin(name string, timeout time.Duration, stop func()) bool {
+	done := make(chan struct{})
+	go func() {
+		stop()
+		close(done)
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-done:
+		return true
+	case <-expired:
+		log.Printf("WARNING: %s did not stop within %v, continuing shutdown", name, timeout)
+		return false
+	}
+}
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/monitor"
+	"buffered-cdc/internal/scheduler"
+	kafkasync "buffered-cdc/internal/sync"
+	"buffered-cdc/internal/workers"
+)
+
+// writeConfigFile replaces the CONFIG_FILE at path with lines.
+func writeConfigFile(t *testing.T, path string, lines ...string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatalf("write CONFIG_FILE: %v", err)
+	}
+}
+
+// newReloadService builds the parts of a service that Reload touches, from
+// the configuration in a CONFIG_FILE, without connecting to anything. The
+// buffer holds three events.
+func newReloadService(t *testing.T, lines ...string) (*Service, string) {
+	t.Helper()
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "service.env")
+	writeConfigFile(t, configFile, lines...)
+	t.Setenv("CONFIG_FILE", configFile)
+	t.Setenv("BUFFER_PATH", filepath.Join(dir, "buffer.db"))
+
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	buf, err := buffer.New(cfg.Buffer.Path, nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	t.Cleanup(func() { buf.Close() })
+	for i := 0; i < 3; i++ {
+		if err := buf.Store(&buffer.Event{ID: fmt.Sprint(i), Operation: "insert", Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	connMonitor, err := monitor.NewConnectivityMonitor(cfg)
+	if err != nil {
+		t.Fatalf("NewConnectivityMonitor: %v", err)
+	}
+	kafkaSync, err := kafkasync.NewKafkaSync(cfg, buf, connMonitor, workers.New(1))
+	if err != nil {
+		t.Fatalf("NewKafkaSync: %v", err)
+	}
+	t.Cleanup(func() { kafkaSync.Close() })
+
+	sched := scheduler.New(buf, clock.New())
+	sched.SetHealthCheck(scheduler.HealthCheck{BufferThreshold: cfg.Health.BufferThreshold})
+	sched.Start(context.Background())
+	t.Cleanup(sched.Stop)
+
+	return &Service{
+		config:      cfg,
+		loaded:      cfg,
+		buffer:      buf,
+		connMonitor: connMonitor,
+		kafkaSync:   kafkaSync,
+		scheduler:   sched,
+	}, configFile
+}
+
+// captureLog returns what the standard logger writes until the test ends.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &out
+}
+
+func TestReloadAppliesRuntimeSettings(t *testing.T) {
+	s, configFile := newReloadService(t, "HEALTH_BUFFER_THRESHOLD=100")
+	checkHealth := func() scheduler.HealthStatus {
+		t.Helper()
+		if err := s.scheduler.RunTaskNow(context.Background(), scheduler.TaskHealthCheck); err != nil {
+			t.Fatalf("RunTaskNow: %v", err)
+		}
+		return s.scheduler.Health()
+	}
+	if status := checkHealth(); !status.Healthy {
+		t.Fatalf("Health before reload = %+v, want healthy under a threshold of 100", status)
+	}
+
+	writeConfigFile(t, configFile, "HEALTH_BUFFER_THRESHOLD=1")
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if status := checkHealth(); status.Healthy {
+		t.Fatalf("Health after reload = %+v, want degraded over a threshold of 1", status)
+	}
+	if s.loaded.Health.BufferThreshold != 1 {
+		t.Fatalf("loaded HEALTH_BUFFER_THRESHOLD = %d, want 1", s.loaded.Health.BufferThreshold)
+	}
+}
+
+func TestReloadWarnsOncePerChange(t *testing.T) {
+	s, configFile := newReloadService(t, "KAFKA_TOPIC=orders")
+	out := captureLog(t)
+
+	writeConfigFile(t, configFile, "KAFKA_TOPIC=invoices")
+	for i := 0; i < 3; i++ {
+		if err := s.Reload(); err != nil {
+			t.Fatalf("Reload %d: %v", i, err)
+		}
+	}
+	if n := strings.Count(out.String(), "WARNING: Kafka.Topic changed"); n != 1 {
+		t.Fatalf("Kafka.Topic change reported %d times over three reloads, want once:\n%s", n, out)
+	}
+	// The running components keep the value they started with
+	if s.config.Kafka.Topic != "orders" {
+		t.Fatalf("running KAFKA_TOPIC = %q, want orders until restart", s.config.Kafka.Topic)
+	}
+
+	writeConfigFile(t, configFile, "KAFKA_TOPIC=payments")
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if n := strings.Count(out.String(), "WARNING: Kafka.Topic changed"); n != 2 {
+		t.Fatalf("a second change to Kafka.Topic was reported %d times in total, want 2", n)
+	}
+}
+
+func TestReloadRejectsInvalidSettings(t *testing.T) {
+	s, configFile := newReloadService(t, "SYNC_BATCHES_PER_TICK=3")
+	loaded := s.loaded
+
+	writeConfigFile(t, configFile, "SYNC_BATCHES_PER_TICK=0")
+	if err := s.Reload(); err == nil {
+		t.Fatal("Reload accepted SYNC_BATCHES_PER_TICK=0")
+	}
+	if s.loaded != loaded {
+		t.Fatal("a rejected reload replaced the loaded configuration")
+	}
+}
+
+// fakeSource stands in for the change stream. Each run of Start calls run
+// when it is set, and otherwise emits events as fast as the buffer takes them
+// until it is stopped. Close logs, so tests can read the shutdown order from
+// the log.
+type fakeSource struct {
+	run func(ctx context.Context, n int) error
+
+	buf     *buffer.Buffer
+	runs    atomic.Int32
+	emitted atomic.Int64
+}
+
+func (f *fakeSource) Start(ctx context.Context, emit func(*buffer.Event) error) error {
+	n := int(f.runs.Add(1))
+	if f.run != nil {
+		return f.run(ctx, n)
+	}
+	for i := 0; ctx.Err() == nil; i++ {
+		event := &buffer.Event{ID: fmt.Sprintf("run%d-%d", n, i), Operation: "insert", Timestamp: time.Now()}
+		if err := emit(event); err != nil {
+			return err
+		}
+		f.emitted.Add(1)
+	}
+	return nil
+}
+
+func (f *fakeSource) Close() error {
+	if _, err := f.buf.Count(); err != nil {
+		log.Printf("Fake source closed after the buffer: %v", err)
+	}
+	log.Println("Closed fake source")
+	return nil
+}
+
+// nextSource is the source the next service built with SOURCE_TYPE=fake uses.
+var nextSource *fakeSource
+
+func init() {
+	monitor.RegisterSource("fake", func(ctx context.Context, cfg *config.Config, buf *buffer.Buffer, clk clock.Clock, pool *workers.Pool) (monitor.Source, error) {
+		nextSource.buf = buf
+		return nextSource, nil
+	})
+}
+
+// newFakeService builds a service around src with the settings in env, on
+// top of ones that keep it from reaching anything: Kafka is at an address
+// nothing listens on, so it stays offline, and the admin server is off.
+func newFakeService(t *testing.T, src *fakeSource, env ...string) *Service {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("SOURCE_TYPE", "fake")
+	t.Setenv("BUFFER_PATH", filepath.Join(t.TempDir(), "buffer.db"))
+	t.Setenv("KAFKA_BROKERS", "127.0.0.1:1")
+	t.Setenv("ADMIN_ADDR", "")
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		t.Setenv(name, value)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	nextSource = src
+	s, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func TestShutdownOrderKeepsEvents(t *testing.T) {
+	out := captureLog(t)
+	src := &fakeSource{}
+	s := newFakeService(t, src, "BUFFER_ASYNC_WRITES=true", "SERVICE_DRAIN_TIMEOUT=1s")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Start(ctx) }()
+	for deadline := time.Now().Add(10 * time.Second); src.emitted.Load() < 1000; {
+		if time.Now().After(deadline) {
+			t.Fatalf("source emitted only %d events", src.emitted.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Stop while the source is still emitting
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+
+	logged := out.String()
+	if strings.Contains(logged, "Fake source closed after the buffer") {
+		t.Fatal("the buffer was closed before the source")
+	}
+	steps := []string{
+		"Stopped fake source",
+		"Closed fake source",
+		"Stopping task scheduler",
+		"Stopped kafka sync",
+		"All components stopped gracefully",
+		"Service shutdown complete",
+	}
+	last := -1
+	for _, step := range steps {
+		at := strings.Index(logged, step)
+		if at < 0 {
+			t.Fatalf("shutdown never logged %q:\n%s", step, logged)
+		}
+		if at < last {
+			t.Fatalf("%q logged out of order; want %s", step, strings.Join(steps, ", then "))
+		}
+		last = at
+	}
+
+	// Kafka was offline, so every event emitted must still be buffered
+	buf, err := buffer.New(s.config.Buffer.Path, nil)
+	if err != nil {
+		t.Fatalf("reopen buffer: %v", err)
+	}
+	defer buf.Close()
+	count, err := buf.Count()
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if int64(count) != src.emitted.Load() {
+		t.Fatalf("buffer holds %d events after shutdown, want the %d emitted", count, src.emitted.Load())
+	}
+}
+
+func TestPreflightFailsStart(t *testing.T) {
+	captureLog(t)
+	src := &fakeSource{}
+	s := newFakeService(t, src, "PREFLIGHT_ENABLED=true", "PREFLIGHT_TIMEOUT=500ms")
+
+	// The buffer is writable, but nothing listens where Kafka is expected
+	done := make(chan error, 1)
+	go func() { done <- s.Start(context.Background()) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start did not fail fast")
+	}
+	if err == nil || !strings.Contains(err.Error(), "kafka: cannot reach Kafka brokers") {
+		t.Fatalf("Start = %v, want the kafka preflight check to fail", err)
+	}
+	if strings.Contains(err.Error(), "buffer:") {
+		t.Errorf("Start = %v, want the buffer check to pass", err)
+	}
+	if runs := src.runs.Load(); runs != 0 {
+		t.Errorf("source started %d times after preflight failed", runs)
+	}
+}
+
+func TestConnectivityRecheckEndpoint(t *testing.T) {
+	captureLog(t)
+	kafka, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer kafka.Close()
+	s := newFakeService(t, &fakeSource{}, "KAFKA_BROKERS="+kafka.Addr().String())
+	defer s.buffer.Close()
+	watcher := s.connMonitor.Subscribe()
+	if status := <-watcher; status != monitor.StatusOffline {
+		t.Fatalf("initial status %v, want offline before any probe", status)
+	}
+
+	recheck := func(method string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		s.handleConnectivityRecheck(rec, httptest.NewRequest(method, "/connectivity/recheck", nil))
+		var state map[string]interface{}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+				t.Fatalf("decode %s: %v", rec.Body, err)
+			}
+		}
+		return rec.Code, state
+	}
+
+	if code, _ := recheck(http.MethodGet); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET answered %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+	code, state := recheck(http.MethodPost)
+	if code != http.StatusOK {
+		t.Fatalf("POST answered %d, want %d", code, http.StatusOK)
+	}
+	if state["reachable"] != true || state["online"] != true || state["offlineSeconds"] != 0.0 {
+		t.Errorf("recheck reported %v, want Kafka reachable and online", state)
+	}
+	select {
+	case status := <-watcher:
+		if status != monitor.StatusOnline {
+			t.Fatalf("watcher got %v, want online", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher was not notified by the forced check")
+	}
+
+	// Once Kafka goes away the next forced check takes it offline
+	kafka.Close()
+	if _, state := recheck(http.MethodPost); state["reachable"] != false || state["online"] != false {
+		t.Errorf("recheck with Kafka down reported %v, want unreachable and offline", state)
+	}
+	select {
+	case status := <-watcher:
+		if status != monitor.StatusOffline {
+			t.Fatalf("watcher got %v, want offline", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher was not notified of going offline")
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"buffered-cdc/internal/metrics"
+)
+
+// errNoRestart marks a component error that restarting cannot fix. It stops
+// the service straight away instead of counting towards MaxRestarts.
+var errNoRestart = errors.New("not restartable")
+
+// superviseComponent runs a critical component and restarts it with
+// exponential backoff whenever it returns before its context is cancelled.
+// A run that lasts longer than the restart window resets the restart count.
+// Once the count exceeds MaxRestarts the failure is reported on s.failures so
+// Start can stop the whole service.
+func (s *Service) superviseComponent(name string, fn func(context.Context) error) {
+	s.startComponent(name, func(ctx context.Context) {
+		cfg := s.config.Service
+		restarts := 0
+		backoff := cfg.RestartBackoff
+
+		for {
+			started := time.Now()
+			err := fn(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+
+			if time.Since(started) >= cfg.RestartWindow {
+				restarts = 0
+				backoff = cfg.RestartBackoff
+			}
+
+			if err == nil {
+				err = fmt.Errorf("exited unexpectedly")
+			}
+
+			if restarts >= cfg.MaxRestarts || errors.Is(err, errNoRestart) {
+				select {
+				case s.failures <- fmt.Errorf("%s failed after %d restarts: %w", name, restarts, err):
+				default:
+					// Another component already triggered shutdown
+				}
+				return
+			}
+
+			restarts++
+			metrics.ComponentRestarts.WithLabelValues(name).Inc()
+			log.Printf("%s stopped: %v - restarting in %v (attempt %d/%d)", name, err, backoff, restarts, cfg.MaxRestarts)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > cfg.MaxRestartBackoff {
+				backoff = cfg.MaxRestartBackoff
+			}
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newSupervisedService returns a service that only supervises, allowing
+// maxRestarts restarts a millisecond apart.
+func newSupervisedService(maxRestarts int) *Service {
+	return &Service{
+		config: &config.Config{Service: config.ServiceConfig{
+			MaxRestarts:       maxRestarts,
+			RestartBackoff:    time.Millisecond,
+			MaxRestartBackoff: 4 * time.Millisecond,
+			RestartWindow:     time.Hour,
+		}},
+		failures: make(chan error, 1),
+	}
+}
+
+// flaky fails its first failures runs with err, then runs until cancelled.
+type flaky struct {
+	failures int
+	err      error
+	runs     atomic.Int32
+	running  chan struct{}
+}
+
+func newFlaky(failures int, err error) *flaky {
+	return &flaky{failures: failures, err: err, running: make(chan struct{})}
+}
+
+func (f *flaky) run(ctx context.Context) error {
+	if int(f.runs.Add(1)) <= f.failures {
+		return f.err
+	}
+	close(f.running)
+	<-ctx.Done()
+	return nil
+}
+
+func TestSuperviseRestartsUntilRunning(t *testing.T) {
+	const name = "flaky source"
+	s := newSupervisedService(3)
+	restarts := testutil.ToFloat64(metrics.ComponentRestarts.WithLabelValues(name))
+	f := newFlaky(3, errors.New("stream closed"))
+	s.superviseComponent(name, f.run)
+	defer s.stopComponent(name, time.Second)
+
+	select {
+	case <-f.running:
+	case err := <-s.failures:
+		t.Fatalf("supervisor gave up within MaxRestarts: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("component not restarted after failing")
+	}
+	if got := f.runs.Load(); got != 4 {
+		t.Errorf("ran %d times, want 3 failures and 1 success", got)
+	}
+	if got := testutil.ToFloat64(metrics.ComponentRestarts.WithLabelValues(name)) - restarts; got != 3 {
+		t.Errorf("restart counter rose by %v, want 3", got)
+	}
+
+	if !s.stopComponent(name, time.Second) {
+		t.Fatal("running component did not stop when cancelled")
+	}
+	select {
+	case err := <-s.failures:
+		t.Fatalf("stopping the component reported a failure: %v", err)
+	default:
+	}
+}
+
+func TestSuperviseGivesUp(t *testing.T) {
+	stopped := fmt.Errorf("%w: %w", errNoRestart, errors.New("invalidated"))
+	tests := []struct {
+		name     string
+		err      error
+		wantRuns int32
+	}{
+		{"after MaxRestarts", errors.New("stream closed"), 3},
+		{"at once when not restartable", stopped, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSupervisedService(2)
+			f := newFlaky(100, tt.err)
+			s.superviseComponent("failing source", f.run)
+
+			select {
+			case err := <-s.failures:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("failure = %v, want it to wrap %v", err, tt.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("supervisor did not report the failure")
+			}
+			if !s.stopComponent("failing source", time.Second) {
+				t.Fatal("supervisor kept running after giving up")
+			}
+			if got := f.runs.Load(); got != tt.wantRuns {
+				t.Errorf("ran %d times, want %d", got, tt.wantRuns)
+			}
+		})
+	}
+}
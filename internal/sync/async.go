@@ -0,0 +1,211 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/logging"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// asyncMessage is the WriterData of a message written with KAFKA_ASYNC: the
+// event it carries, which the completion callback settles, and its batch for
+// stickyBalancer.
+type asyncMessage struct {
+	event *buffer.Event
+	batch stickyBatch
+}
+
+// asyncDelivery tracks the events written with KAFKA_ASYNC whose completion
+// has not run yet. They stay buffered until it does, so reads skip them
+// rather than sending them again.
+type asyncDelivery struct {
+	max int
+
+	mu      gosync.Mutex
+	pending map[string]bool
+
+	// failures counts failed completions since the sync loop last looked,
+	// so they still count against the circuit breaker, which is only used
+	// from the loop.
+	failures atomic.Int64
+}
+
+// newAsyncDelivery returns the tracker for KAFKA_ASYNC. Async writes settle
+// each event on its own, so they cannot be combined with settings that tie
+// an event's fate to other events or other sinks.
+func newAsyncDelivery(cfg *config.Config) (*asyncDelivery, error) {
+	switch {
+	case len(cfg.Sinks.WebhookURLs) > 0:
+		return nil, fmt.Errorf("KAFKA_ASYNC cannot be combined with SINK_WEBHOOK_URLS")
+	case len(cfg.Kafka.Clusters) > 0:
+		return nil, fmt.Errorf("KAFKA_ASYNC cannot be combined with KAFKA_CLUSTERS")
+	case cfg.Kafka.CoalesceBatch:
+		return nil, fmt.Errorf("KAFKA_ASYNC cannot be combined with KAFKA_COALESCE_BATCH")
+	case cfg.Kafka.PreserveOrder || cfg.Kafka.StrictOrder:
+		return nil, fmt.Errorf("KAFKA_ASYNC cannot be combined with KAFKA_PRESERVE_ORDER or KAFKA_STRICT_ORDER")
+	}
+	return &asyncDelivery{max: cfg.Kafka.AsyncMaxPending, pending: make(map[string]bool)}, nil
+}
+
+// room returns how many more events may be written before completions catch
+// up.
+func (a *asyncDelivery) room() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return max(a.max-len(a.pending), 0)
+}
+
+// admitter wraps admit, which may be nil, to skip events in flight.
+func (a *asyncDelivery) admitter(admit func(*buffer.Event) bool) func(*buffer.Event) bool {
+	return func(event *buffer.Event) bool {
+		a.mu.Lock()
+		inflight := a.pending[event.Key]
+		a.mu.Unlock()
+		return !inflight && (admit == nil || admit(event))
+	}
+}
+
+func (a *asyncDelivery) track(events []*buffer.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, event := range events {
+		a.pending[event.Key] = true
+	}
+	metrics.KafkaAsyncPending.Set(float64(len(a.pending)))
+}
+
+func (a *asyncDelivery) untrack(events []*buffer.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, event := range events {
+		delete(a.pending, event.Key)
+	}
+	metrics.KafkaAsyncPending.Set(float64(len(a.pending)))
+}
+
+// wait blocks until no event is in flight or ctx is done.
+func (a *asyncDelivery) wait(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for a.room() < a.max {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queuedLog samples the line logged for every batch handed to the async
+// writer.
+var queuedLog = logging.NewSampler("batches queued for async delivery")
+
+// syncAsync reads the next events that are not in flight and hands them to
+// the async writer, which batches and sends them in the background. The
+// events are deleted or retried by completeAsync.
+func (ks *KafkaSync) syncAsync(ctx context.Context) error {
+	if n := ks.async.failures.Swap(0); n > 0 {
+		return fmt.Errorf("%w: %d async writes failed since the last pass", ErrSinkUnavailable, n)
+	}
+	room := ks.async.room()
+	if room == 0 {
+		return nil
+	}
+
+	var admit func(*buffer.Event) bool
+	if ks.tenants != nil {
+		admit = ks.tenants.admitter()
+	}
+	batches, err := ks.buffer.GetAdmittedEvents(min(ks.readBatchSize, room), ks.readMaxBytes, 1, ks.async.admitter(admit))
+	if err != nil {
+		return fmt.Errorf("failed to get ready events from buffer: %w", err)
+	}
+	batches = ks.limitRetries(ks.limitInflight(batches))
+	defer metrics.SyncInflightBytes.Set(0)
+	if len(batches) == 0 {
+		return nil
+	}
+
+	events := ks.dropUnmarshallable(ctx, ks.dropUnroutable(ctx, ks.applyFilter(batches[0])))
+	messages, sent, err := ks.buildMessages(ctx, events)
+	if err != nil || len(messages) == 0 {
+		return err
+	}
+	for i := range messages {
+		messages[i].WriterData = asyncMessage{event: sent[i], batch: messages[i].WriterData.(stickyBatch)}
+	}
+
+	ks.async.track(sent)
+	ks.createTopics(ctx, ks.clusters[0], messages)
+	// Only checks that fail the whole call, such as an oversized message,
+	// are reported here; nothing has been sent then
+	if err := ks.writer.WriteMessages(ctx, messages...); err != nil {
+		ks.async.untrack(sent)
+		if rejected := permanentFailures(err, messages); rejected != nil {
+			ks.deadLetterRejected(ctx, sent, rejected)
+			return fmt.Errorf("%w: %w", ErrMessageRejected, err)
+		}
+		return fmt.Errorf("%w: %w", ErrSinkUnavailable, err)
+	}
+	queuedLog.Printf("Queued %d events for async Kafka delivery", len(sent))
+	return nil
+}
+
+// completeAsync settles the events of one partition batch once the async
+// writer is done with it: they are deleted on success, dead-lettered when
+// Kafka rejected them for good, and left to be read again otherwise. It runs
+// on the writer's goroutines.
+func (ks *KafkaSync) completeAsync(messages []kafka.Message, err error) {
+	events := make([]*buffer.Event, 0, len(messages))
+	for _, msg := range messages {
+		if m, ok := msg.WriterData.(asyncMessage); ok {
+			events = append(events, m.event)
+		}
+	}
+	// Untracked only once the buffer reflects the outcome, so a read cannot
+	// pick an event up again in between
+	defer ks.async.untrack(events)
+	ctx := context.Background()
+
+	if err != nil {
+		metrics.KafkaAsyncCompletions.WithLabelValues("failed").Add(float64(len(events)))
+		if isPermanent(err) {
+			for _, event := range events {
+				log.Printf("Event %s rejected by Kafka: %v", event.ID, err)
+				ks.deadLetter(ctx, event, err.Error())
+			}
+			return
+		}
+		// A partition batch fails as a whole, which cannot be pinned on
+		// any one event, so the events are read again without counting a
+		// retry against them
+		log.Printf("Async Kafka write of %d events failed, retrying later: %v", len(events), err)
+		ks.async.failures.Add(1)
+		return
+	}
+
+	metrics.KafkaAsyncCompletions.WithLabelValues("delivered").Add(float64(len(events)))
+	now := time.Now()
+	for _, event := range events {
+		metrics.EventsSynced.WithLabelValues(event.Operation).Inc()
+		metrics.EventAge.Observe(now.Sub(event.Timestamp).Seconds())
+	}
+	if _, err := ks.buffer.DeleteBatch(events); err != nil {
+		log.Printf("Failed to delete synced events from buffer: %v", err)
+	}
+	if ks.checkpointSize > 0 {
+		ks.recordCheckpoints()
+	}
+	if ks.bus != nil {
+		ks.bus.Publish(sinkPayload(events))
+	}
+}
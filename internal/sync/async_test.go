@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// storeInCollections buffers n events from each of colls, with IDs
+// <coll>-<i>, so KAFKA_TOPIC_FROM_COLLECTION sends each collection to its
+// own topic.
+func storeInCollections(t *testing.T, buf *buffer.Buffer, n int, colls ...string) {
+	t.Helper()
+	base := time.Now()
+	for c, coll := range colls {
+		for i := 0; i < n; i++ {
+			event := &buffer.Event{
+				ID:        fmt.Sprintf("%s-%d", coll, i),
+				Operation: "insert",
+				Timestamp: base.Add(time.Duration(c*n+i) * time.Microsecond),
+				Data:      map[string]interface{}{"ns": map[string]interface{}{"db": "app", "coll": coll}},
+			}
+			if err := buf.Store(event); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+	}
+}
+
+// sentEventIDs returns the IDs of events, in order.
+func sentEventIDs(events []*buffer.Event) []string {
+	ids := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+	return ids
+}
+
+func TestAsyncMixedCompletions(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	// orders are delivered, invoices fail for now and refunds are rejected
+	// for good
+	var recovered atomic.Bool
+	broker.fail = func(topic string) kafka.Error {
+		switch {
+		case topic == "invoices" && !recovered.Load():
+			return kafka.LeaderNotAvailable
+		case topic == "refunds":
+			return kafka.MessageSizeTooLarge
+		}
+		return 0
+	}
+	ks := newBrokerSync(t, buf, broker, "KAFKA_ASYNC=true", "KAFKA_TOPIC_FROM_COLLECTION=true")
+	storeInCollections(t, buf, 3, "orders", "invoices", "refunds")
+	delivered := testutil.ToFloat64(metrics.KafkaAsyncCompletions.WithLabelValues("delivered"))
+	failed := testutil.ToFloat64(metrics.KafkaAsyncCompletions.WithLabelValues("failed"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ks.syncAsync(ctx); err != nil {
+		t.Fatalf("syncAsync: %v", err)
+	}
+	ks.async.wait(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("completions did not run")
+	}
+
+	if got := testutil.ToFloat64(metrics.KafkaAsyncCompletions.WithLabelValues("delivered")) - delivered; got != 3 {
+		t.Errorf("%v completions delivered, want the 3 orders", got)
+	}
+	if got := testutil.ToFloat64(metrics.KafkaAsyncCompletions.WithLabelValues("failed")) - failed; got != 6 {
+		t.Errorf("%v completions failed, want the 3 invoices and 3 refunds", got)
+	}
+	// Only the delivered events are deleted; the failed ones stay without a
+	// retry counted against them and the rejected ones are dead-lettered
+	pending, err := buf.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if got := fmt.Sprint(sentEventIDs(pending)); got != "[invoices-0 invoices-1 invoices-2]" {
+		t.Errorf("buffered %s, want the invoices", got)
+	}
+	for _, event := range pending {
+		if event.Retries != 0 {
+			t.Errorf("%s has %d retries, want 0", event.ID, event.Retries)
+		}
+	}
+	var dead []*buffer.Event
+	buf.ForEach(true, func(event *buffer.Event) error {
+		dead = append(dead, event)
+		return nil
+	})
+	if got := fmt.Sprint(sentEventIDs(dead)); got != "[refunds-0 refunds-1 refunds-2]" {
+		t.Errorf("dead-lettered %s, want the refunds", got)
+	}
+
+	// The failure counts against the next pass, which then sends the
+	// invoices again
+	if err := ks.syncAsync(ctx); !errors.Is(err, ErrSinkUnavailable) {
+		t.Errorf("syncAsync after a failed completion = %v, want ErrSinkUnavailable", err)
+	}
+	recovered.Store(true)
+	if err := ks.syncAsync(ctx); err != nil {
+		t.Fatalf("syncAsync: %v", err)
+	}
+	ks.async.wait(ctx)
+	if count, _ := buf.Count(); count != 0 {
+		t.Errorf("%d events left buffered, want none", count)
+	}
+	sent := make(map[string]int)
+	for _, msg := range broker.messages() {
+		sent[msg.Headers["id"]]++
+	}
+	for i := 0; i < 3; i++ {
+		if n := sent[fmt.Sprintf("orders-%d", i)]; n != 1 {
+			t.Errorf("orders-%d delivered %d times, want once", i, n)
+		}
+		if n := sent[fmt.Sprintf("invoices-%d", i)]; n != 1 {
+			t.Errorf("invoices-%d delivered %d times, want once", i, n)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package sync
+
+import (
+	"log"
+	"time"
+
+	"buffered-cdc/internal/metrics"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is a circuit breaker around the Kafka sink. After threshold
+// consecutive failures it opens and syncs are skipped for cooldown; the next
+// sync after that is a half-open probe whose result closes or reopens it.
+// It is only used from the sync loop and is not safe for concurrent use.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	b := &breaker{threshold: threshold, cooldown: cooldown}
+	b.setState(breakerClosed)
+	return b
+}
+
+// Allow reports whether a sync may be attempted now.
+func (b *breaker) Allow() bool {
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		return true
+	case breakerHalfOpen:
+		// A probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *breaker) Success() {
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *breaker) Failure() {
+	b.failures++
+	if b.state == breakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold) {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// Reset closes the breaker, e.g. when connectivity is known to be restored.
+func (b *breaker) Reset() {
+	b.Success()
+}
+
+func (b *breaker) setState(state breakerState) {
+	if state != b.state {
+		log.Printf("Kafka circuit breaker %s (consecutive failures: %d)", state, b.failures)
+	}
+	b.state = state
+	metrics.KafkaBreakerState.Set(float64(state))
+}
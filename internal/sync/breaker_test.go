@@ -0,0 +1,73 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	const cooldown = 100 * time.Millisecond
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	broker.down.Store(true)
+	ks := newBrokerSync(t, buf, broker, "KAFKA_BREAKER_THRESHOLD=3", "KAFKA_BREAKER_COOLDOWN="+cooldown.String())
+	storeEvents(t, buf, 2)
+	ctx := context.Background()
+
+	state := func() breakerState { return breakerState(testutil.ToFloat64(metrics.KafkaBreakerState)) }
+	for i := 1; i <= 3; i++ {
+		if err := ks.guardedSyncBatch(ctx); !errors.Is(err, ErrSinkUnavailable) {
+			t.Fatalf("sync %d = %v, want ErrSinkUnavailable", i, err)
+		}
+		want := breakerClosed
+		if i == 3 {
+			want = breakerOpen
+		}
+		if ks.breaker.state != want || state() != want {
+			t.Fatalf("after %d failures breaker is %v (gauge %v), want %v", i, ks.breaker.state, state(), want)
+		}
+	}
+
+	// While open, syncs do not reach the broker at all
+	calls := broker.calls.Load()
+	for i := 0; i < 3; i++ {
+		if err := ks.guardedSyncBatch(ctx); err != nil {
+			t.Fatalf("sync with the breaker open = %v, want nil", err)
+		}
+	}
+	if got := broker.calls.Load(); got != calls {
+		t.Fatalf("%d requests reached the broker with the breaker open", got-calls)
+	}
+
+	// A failed half-open probe reopens it for another cooldown
+	time.Sleep(cooldown)
+	if err := ks.guardedSyncBatch(ctx); !errors.Is(err, ErrSinkUnavailable) {
+		t.Fatalf("probe = %v, want ErrSinkUnavailable", err)
+	}
+	if ks.breaker.state != breakerOpen {
+		t.Fatalf("breaker %v after a failed probe, want open", ks.breaker.state)
+	}
+	calls = broker.calls.Load()
+	if err := ks.guardedSyncBatch(ctx); err != nil || broker.calls.Load() != calls {
+		t.Fatalf("sync right after a failed probe = %v and reached the broker", err)
+	}
+
+	// A successful probe after the cooldown closes it
+	broker.down.Store(false)
+	time.Sleep(cooldown)
+	if err := ks.guardedSyncBatch(ctx); err != nil {
+		t.Fatalf("probe = %v", err)
+	}
+	if ks.breaker.state != breakerClosed || state() != breakerClosed {
+		t.Fatalf("breaker %v after a successful probe, want closed", ks.breaker.state)
+	}
+	if got := len(broker.messages()); got != 2 {
+		t.Fatalf("delivered %d messages after recovering, want 2", got)
+	}
+}
@@ -0,0 +1,112 @@
+package sync
+
+import (
+	gosync "sync"
+	"sync/atomic"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+)
+
+// EventBus hands synced events to subscribers in the same process, such as a
+// local cache that must be invalidated. Events are published once every sink
+// has acknowledged them. Delivery is best-effort: each subscriber has a
+// bounded queue, and an event that finds it full is dropped for that
+// subscriber rather than holding up the sync.
+type EventBus struct {
+	size int
+
+	mu     gosync.RWMutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// NewEventBus returns a bus whose subscribers queue up to size events.
+func NewEventBus(size int) *EventBus {
+	if size < 1 {
+		size = 1
+	}
+	return &EventBus{size: size, subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives the events published after Subscribe. Its channel is
+// closed by Unsubscribe and when the bus is closed.
+type Subscription struct {
+	bus     *EventBus
+	ch      chan *buffer.Event
+	dropped atomic.Int64
+}
+
+// Subscribe registers a new subscriber. On a closed bus the subscription's
+// channel is already closed.
+func (b *EventBus) Subscribe() *Subscription {
+	sub := &Subscription{bus: b, ch: make(chan *buffer.Event, b.size)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.ch)
+		return sub
+	}
+	b.subs[sub] = struct{}{}
+	metrics.BusSubscribers.Set(float64(len(b.subs)))
+	return sub
+}
+
+// Events returns the channel events are delivered on. Events are shared
+// between subscribers and must not be modified.
+func (s *Subscription) Events() <-chan *buffer.Event {
+	return s.ch
+}
+
+// Dropped returns how many events this subscriber missed because its queue
+// was full.
+func (s *Subscription) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Unsubscribe stops delivery and closes the channel. It may be called more
+// than once.
+func (s *Subscription) Unsubscribe() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	close(s.ch)
+	metrics.BusSubscribers.Set(float64(len(b.subs)))
+}
+
+// Publish offers events to every subscriber without blocking.
+func (b *EventBus) Publish(events []*buffer.Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		for _, event := range events {
+			select {
+			case sub.ch <- event:
+				metrics.BusEventsPublished.Inc()
+			default:
+				sub.dropped.Add(1)
+				metrics.BusEventsDropped.Inc()
+			}
+		}
+	}
+}
+
+// Close unsubscribes everyone. Later subscriptions are closed at once and
+// later events are discarded.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subs {
+		close(sub.ch)
+	}
+	b.subs = nil
+	metrics.BusSubscribers.Set(0)
+}
@@ -0,0 +1,149 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// busEvents returns n events with IDs from prefix.
+func busEvents(prefix string, n int) []*buffer.Event {
+	events := make([]*buffer.Event, n)
+	for i := range events {
+		events[i] = &buffer.Event{ID: fmt.Sprintf("%s%d", prefix, i), Operation: "insert"}
+	}
+	return events
+}
+
+// receive reads what is queued for sub without waiting for more.
+func receive(sub *Subscription) []string {
+	var ids []string
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return ids
+			}
+			ids = append(ids, event.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestEventBusSubscribeUnsubscribe(t *testing.T) {
+	bus := NewEventBus(10)
+	defer bus.Close()
+
+	bus.Publish(busEvents("before", 1))
+	first := bus.Subscribe()
+	second := bus.Subscribe()
+	if got := testutil.ToFloat64(metrics.BusSubscribers); got != 2 {
+		t.Errorf("BusSubscribers = %v, want 2", got)
+	}
+
+	// Each subscriber gets every event published after it subscribed
+	bus.Publish(busEvents("a", 3))
+	for name, sub := range map[string]*Subscription{"first": first, "second": second} {
+		if got := fmt.Sprint(receive(sub)); got != "[a0 a1 a2]" {
+			t.Errorf("%s subscriber got %s, want [a0 a1 a2]", name, got)
+		}
+	}
+
+	first.Unsubscribe()
+	first.Unsubscribe()
+	if _, ok := <-first.Events(); ok {
+		t.Error("channel still open after Unsubscribe")
+	}
+	if got := testutil.ToFloat64(metrics.BusSubscribers); got != 1 {
+		t.Errorf("BusSubscribers = %v after one unsubscribed, want 1", got)
+	}
+	bus.Publish(busEvents("b", 1))
+	if got := fmt.Sprint(receive(second)); got != "[b0]" {
+		t.Errorf("remaining subscriber got %s, want [b0]", got)
+	}
+
+	// Closing the bus closes every subscription, and later ones at once
+	bus.Close()
+	if _, ok := <-second.Events(); ok {
+		t.Error("channel still open after the bus closed")
+	}
+	if _, ok := <-bus.Subscribe().Events(); ok {
+		t.Error("subscription to a closed bus is open")
+	}
+	bus.Publish(busEvents("c", 1))
+}
+
+func TestEventBusDropsForSlowSubscriber(t *testing.T) {
+	bus := NewEventBus(3)
+	defer bus.Close()
+	slow := bus.Subscribe()
+	fast := bus.Subscribe()
+	droppedBefore := testutil.ToFloat64(metrics.BusEventsDropped)
+
+	// The fast subscriber keeps up while the slow one reads nothing
+	var fastGot []string
+	for i := 0; i < 5; i++ {
+		published := make(chan struct{})
+		go func() {
+			bus.Publish(busEvents(fmt.Sprintf("e%d-", i), 2))
+			close(published)
+		}()
+		select {
+		case <-published:
+		case <-time.After(time.Second):
+			t.Fatal("Publish blocked on a full subscriber")
+		}
+		fastGot = append(fastGot, receive(fast)...)
+	}
+
+	if len(fastGot) != 10 || fast.Dropped() != 0 {
+		t.Errorf("fast subscriber got %d events and dropped %d, want all 10", len(fastGot), fast.Dropped())
+	}
+	// The slow one holds the first events that fit and misses the rest
+	if got := fmt.Sprint(receive(slow)); got != "[e0-0 e0-1 e1-0]" {
+		t.Errorf("slow subscriber got %s, want the first 3 events", got)
+	}
+	if slow.Dropped() != 7 {
+		t.Errorf("slow subscriber dropped %d, want 7", slow.Dropped())
+	}
+	if got := testutil.ToFloat64(metrics.BusEventsDropped) - droppedBefore; got != 7 {
+		t.Errorf("BusEventsDropped grew by %v, want 7", got)
+	}
+
+	// Once it catches up it receives again
+	bus.Publish(busEvents("later", 1))
+	if got := fmt.Sprint(receive(slow)); got != "[later0]" {
+		t.Errorf("slow subscriber got %s after draining, want [later0]", got)
+	}
+}
+
+func TestSyncPublishesToBus(t *testing.T) {
+	buf := newTestBuffer(t)
+	ks := newBrokerSync(t, buf, newFakeBroker(1), "SINK_BUS_BUFFER=100")
+	sub := ks.EventBus().Subscribe()
+	sink := &recordingSink{fail: func(events []*buffer.Event) bool {
+		for _, event := range events {
+			if event.ID == "e002" {
+				return true
+			}
+		}
+		return false
+	}}
+	ks.sinks = []Sink{sink}
+	storeEvents(t, buf, 5)
+
+	if err := ks.syncBatch(context.Background()); err == nil {
+		t.Fatal("syncBatch succeeded although the sink refused e002")
+	}
+	// Only what every sink acknowledged is published
+	if got := fmt.Sprint(receive(sub)); got != "[e000 e001 e003 e004]" {
+		t.Errorf("bus got %s, want the synced events without the refused e002", got)
+	}
+}
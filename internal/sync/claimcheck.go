@@ -0,0 +1,207 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+)
+
+// Uploader stores a payload under key and returns the URL it can be fetched
+// from. Put must be idempotent: an event whose write to Kafka fails is
+// uploaded again under the same key. Implementations must be safe for
+// concurrent use.
+type Uploader interface {
+	Put(ctx context.Context, key string, body []byte) (string, error)
+}
+
+// claimCheck replaces payloads larger than threshold with a reference to a
+// copy uploaded to object storage.
+type claimCheck struct {
+	threshold int
+	prefix    string
+	uploader  Uploader
+}
+
+// claimCheckRef is the Kafka message value sent instead of a large payload.
+type claimCheckRef struct {
+	ID         string    `json:"id"`
+	Operation  string    `json:"operation"`
+	Timestamp  time.Time `json:"timestamp"`
+	ClaimCheck struct {
+		URL    string `json:"url"`
+		Bytes  int    `json:"bytes"`
+		SHA256 string `json:"sha256"`
+	} `json:"claimCheck"`
+}
+
+// newClaimCheck returns the claim check for CLAIM_CHECK_THRESHOLD, or nil
+// when it is 0.
+func newClaimCheck(cfg *config.ClaimCheckConfig) (*claimCheck, error) {
+	if cfg.Threshold == 0 {
+		return nil, nil
+	}
+	if cfg.Threshold < 0 {
+		return nil, fmt.Errorf("invalid CLAIM_CHECK_THRESHOLD %d: must not be negative", cfg.Threshold)
+	}
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("CLAIM_CHECK_THRESHOLD requires CLAIM_CHECK_S3_ENDPOINT and CLAIM_CHECK_S3_BUCKET")
+	}
+	if (cfg.AccessKey == "") != (cfg.SecretKey == "") {
+		return nil, fmt.Errorf("CLAIM_CHECK_S3_ACCESS_KEY and CLAIM_CHECK_S3_SECRET_KEY must be set together")
+	}
+
+	return &claimCheck{
+		threshold: cfg.Threshold,
+		prefix:    cfg.Prefix,
+		uploader: &s3Uploader{
+			endpoint:  strings.TrimRight(cfg.Endpoint, "/"),
+			bucket:    cfg.Bucket,
+			region:    cfg.Region,
+			accessKey: cfg.AccessKey,
+			secretKey: cfg.SecretKey,
+			client:    &http.Client{Timeout: cfg.Timeout},
+		},
+	}, nil
+}
+
+// apply returns value unchanged when it is within the threshold. Otherwise
+// it uploads value and returns the reference to send in its place, and the
+// object's URL.
+func (cc *claimCheck) apply(ctx context.Context, event *buffer.Event, value []byte) ([]byte, string, error) {
+	if len(value) <= cc.threshold {
+		return value, "", nil
+	}
+
+	// The buffer key is unique and stays the same across retries
+	key := event.Key
+	if key == "" {
+		key = event.ID
+	}
+	url, err := cc.uploader.Put(ctx, cc.prefix+key+".json", value)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to upload claim check payload for event %s: %w", event.ID, err)
+	}
+
+	sum := sha256.Sum256(value)
+	ref := claimCheckRef{ID: event.ID, Operation: event.Operation, Timestamp: event.Timestamp}
+	ref.ClaimCheck.URL = url
+	ref.ClaimCheck.Bytes = len(value)
+	ref.ClaimCheck.SHA256 = hex.EncodeToString(sum[:])
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal claim check reference: %w", err)
+	}
+	return data, url, nil
+}
+
+// s3Uploader PUTs objects to an S3-compatible store, path-style, signing
+// requests with AWS Signature Version 4 when credentials are set.
+type s3Uploader struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (u *s3Uploader) Put(ctx context.Context, key string, body []byte) (string, error) {
+	path := "/" + s3Escape(u.bucket) + "/" + s3Escape(key)
+	url := u.endpoint + path
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if u.accessKey != "" {
+		u.sign(req, path, body, time.Now().UTC())
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("object store responded %s", resp.Status)
+	}
+	return url, nil
+}
+
+// sign adds the SigV4 headers for a request to path with body.
+func (u *s3Uploader) sign(req *http.Request, path string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		"", // no query string
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + u.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	signingKey := hmacSHA256([]byte("AWS4"+u.secretKey), day)
+	signingKey = hmacSHA256(signingKey, u.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		u.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Escape percent-encodes everything but unreserved characters and slashes,
+// as SigV4 expects of S3 object paths.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+)
+
+// memStore is an Uploader keeping objects in memory.
+type memStore struct {
+	mu      gosync.Mutex
+	fail    bool
+	objects map[string][]byte
+}
+
+func (m *memStore) Put(ctx context.Context, key string, body []byte) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return "", errors.New("object store unavailable")
+	}
+	if m.objects == nil {
+		m.objects = make(map[string][]byte)
+	}
+	m.objects[key] = append([]byte(nil), body...)
+	return "mem://cdc/" + key, nil
+}
+
+// storeSized buffers an insert for each id whose data is a string of size
+// bytes.
+func storeSized(t *testing.T, buf *buffer.Buffer, sizes map[string]int) {
+	t.Helper()
+	for id, size := range sizes {
+		event := &buffer.Event{
+			ID:        id,
+			Operation: "insert",
+			Timestamp: time.Now(),
+			Data:      map[string]interface{}{"fullDocument": map[string]interface{}{"blob": strings.Repeat("x", size)}},
+		}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+}
+
+func TestClaimCheck(t *testing.T) {
+	env := []string{"CLAIM_CHECK_THRESHOLD=1024", "CLAIM_CHECK_S3_ENDPOINT=http://store.invalid", "CLAIM_CHECK_S3_BUCKET=cdc"}
+
+	t.Run("inline and claim check", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		ks := newBrokerSync(t, buf, broker, env...)
+		store := &memStore{}
+		ks.claims.uploader = store
+		storeSized(t, buf, map[string]int{"small": 100, "large": 4096})
+
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		produced := make(map[string]producedMessage)
+		for _, msg := range broker.messages() {
+			produced[msg.Headers["id"]] = msg
+		}
+
+		// Small events go inline as before
+		small := produced["small"]
+		var inline buffer.Event
+		if err := json.Unmarshal(small.Value, &inline); err != nil || inline.ID != "small" || inline.Data == nil {
+			t.Errorf("small event sent as %s, want the event itself", small.Value)
+		}
+		if _, ok := small.Headers["claim-check"]; ok {
+			t.Error("small event has a claim-check header")
+		}
+
+		// Large ones are uploaded and referenced
+		large := produced["large"]
+		var ref claimCheckRef
+		if err := json.Unmarshal(large.Value, &ref); err != nil {
+			t.Fatalf("decode reference %s: %v", large.Value, err)
+		}
+		if len(store.objects) != 1 {
+			t.Fatalf("uploaded %d objects, want only the large event", len(store.objects))
+		}
+		// Objects are named by buffer key, which stays the same on a retry
+		var key string
+		var object []byte
+		for k, v := range store.objects {
+			key, object = k, v
+		}
+		if !strings.HasPrefix(key, "cdc/") || !strings.HasSuffix(key, ".json") || strings.Contains(key, "large") {
+			t.Errorf("uploaded as %s, want cdc/<buffer key>.json", key)
+		}
+		var uploaded buffer.Event
+		if err := json.Unmarshal(object, &uploaded); err != nil || uploaded.ID != "large" {
+			t.Errorf("uploaded %.100s, want the large event", object)
+		}
+		sum := sha256.Sum256(object)
+		if ref.ID != "large" || ref.ClaimCheck.URL != "mem://cdc/"+key ||
+			ref.ClaimCheck.Bytes != len(object) || ref.ClaimCheck.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("reference %+v does not describe the uploaded %d bytes", ref, len(object))
+		}
+		if large.Headers["claim-check"] != ref.ClaimCheck.URL {
+			t.Errorf("claim-check header %q, want %q", large.Headers["claim-check"], ref.ClaimCheck.URL)
+		}
+		if len(large.Value) > 1024 {
+			t.Errorf("reference is %d bytes, over the threshold", len(large.Value))
+		}
+		if count, _ := buf.Count(); count != 0 {
+			t.Errorf("%d events left buffered, want both synced", count)
+		}
+	})
+
+	t.Run("upload fails", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		ks := newBrokerSync(t, buf, broker, env...)
+		ks.claims.uploader = &memStore{fail: true}
+		storeSized(t, buf, map[string]int{"large": 4096})
+
+		if err := ks.syncBatch(context.Background()); err == nil {
+			t.Fatal("syncBatch succeeded although the upload failed")
+		}
+		// Sending the event without its payload would lose it
+		if n := len(broker.messages()); n != 0 {
+			t.Errorf("produced %d messages, want none", n)
+		}
+		if count, _ := buf.Count(); count != 1 {
+			t.Errorf("%d events buffered, want the large event kept for a retry", count)
+		}
+	})
+
+	t.Run("s3 uploader", func(t *testing.T) {
+		var path, auth string
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPut {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			path, auth = r.URL.Path, r.Header.Get("Authorization")
+			body, _ = io.ReadAll(r.Body)
+		}))
+		defer server.Close()
+
+		cc, err := newClaimCheck(&config.ClaimCheckConfig{
+			Threshold: 10, Endpoint: server.URL + "/", Bucket: "cdc", Region: "us-east-1", Prefix: "events/",
+			AccessKey: "AKID", SecretKey: "secret", Timeout: time.Second,
+		})
+		if err != nil {
+			t.Fatalf("newClaimCheck: %v", err)
+		}
+		value := []byte(`{"id":"e 1","data":"more than ten bytes"}`)
+		_, url, err := cc.apply(context.Background(), &buffer.Event{ID: "e 1", Operation: "insert"}, value)
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		if path != "/cdc/events/e 1.json" || url != server.URL+"/cdc/events/e%201.json" {
+			t.Errorf("uploaded to %q with URL %q, want /cdc/events/e 1.json", path, url)
+		}
+		if string(body) != string(value) {
+			t.Errorf("uploaded %s, want %s", body, value)
+		}
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("Authorization %q, want a SigV4 signature", auth)
+		}
+	})
+}
+
+func TestNewClaimCheckValidates(t *testing.T) {
+	for _, cfg := range []config.ClaimCheckConfig{
+		{Threshold: -1, Endpoint: "http://store", Bucket: "cdc"},
+		{Threshold: 1024, Bucket: "cdc"},
+		{Threshold: 1024, Endpoint: "http://store"},
+		{Threshold: 1024, Endpoint: "http://store", Bucket: "cdc", AccessKey: "AKID"},
+	} {
+		if _, err := newClaimCheck(&cfg); err == nil {
+			t.Errorf("newClaimCheck(%+v) succeeded, want an error", cfg)
+		}
+	}
+	if cc, err := newClaimCheck(&config.ClaimCheckConfig{}); cc != nil || err != nil {
+		t.Errorf("newClaimCheck without a threshold = %v, %v; want no claim check", cc, err)
+	}
+}
@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Values for KAFKA_REPLICATION_POLICY, which decides the Kafka clusters that
+// must acknowledge an event before it is removed from the buffer. Every
+// cluster is written in every sync whatever the policy; the policy only
+// decides when the buffer lets go.
+const (
+	// ReplicationAll waits for every cluster.
+	ReplicationAll = "all"
+	// ReplicationAny waits for the first cluster to acknowledge.
+	ReplicationAny = "any"
+	// ReplicationPrimary waits for the KAFKA_BROKERS cluster only. The
+	// others are written best-effort.
+	ReplicationPrimary = "primary"
+)
+
+// kafkaCluster is one Kafka cluster events are published to. The first of
+// KafkaSync.clusters is the primary, KAFKA_BROKERS; the rest are the
+// KAFKA_CLUSTERS mirrors.
+type kafkaCluster struct {
+	// name identifies the cluster in buffer.Event.Delivered: kafka for the
+	// primary and kafka-<name> for a mirror.
+	name    string
+	writer  *kafka.Writer
+	creator *topicCreator
+}
+
+// newMirrors builds a cluster for each of KAFKA_CLUSTERS, with a writer set up
+// like primary but for the cluster's own brokers.
+func newMirrors(cfg *config.KafkaConfig, primary *kafka.Writer) ([]*kafkaCluster, error) {
+	switch cfg.ReplicationPolicy {
+	case ReplicationAll, ReplicationAny, ReplicationPrimary:
+	default:
+		return nil, fmt.Errorf("invalid KAFKA_REPLICATION_POLICY %q: must be all, any or primary", cfg.ReplicationPolicy)
+	}
+
+	var mirrors []*kafkaCluster
+	for _, name := range cfg.Clusters {
+		brokers := cfg.ClusterBrokers[name]
+		if len(brokers) == 0 {
+			return nil, fmt.Errorf("Kafka cluster %s has no brokers: set %s", name, config.ClusterBrokersEnv(name))
+		}
+		writer := &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        primary.Topic,
+			Balancer:     primary.Balancer,
+			BatchTimeout: primary.BatchTimeout,
+			BatchSize:    primary.BatchSize,
+			RequiredAcks: primary.RequiredAcks,
+			WriteTimeout: primary.WriteTimeout,
+			Compression:  primary.Compression,
+			Transport: &kafka.Transport{
+				ClientID: cfg.ClientID,
+			},
+			Logger:      primary.Logger,
+			ErrorLogger: primary.ErrorLogger,
+		}
+		mirrors = append(mirrors, &kafkaCluster{
+			name:    kafkaSinkName + "-" + name,
+			writer:  writer,
+			creator: newTopicCreator(cfg, &kafka.Client{Addr: writer.Addr, Transport: writer.Transport}),
+		})
+		log.Printf("Publishing events to Kafka cluster %s at %s as well (KAFKA_REPLICATION_POLICY=%s)", name, writer.Addr, cfg.ReplicationPolicy)
+	}
+	return mirrors, nil
+}
+
+// pendingClusters returns the clusters that still have to acknowledge event
+// under KAFKA_REPLICATION_POLICY, counting those in acked as done.
+func (ks *KafkaSync) pendingClusters(event *buffer.Event, acked []string) []string {
+	delivered := func(name string) bool {
+		return event.DeliveredTo(name) || slices.Contains(acked, name)
+	}
+
+	var pending []string
+	switch ks.config.ReplicationPolicy {
+	case ReplicationPrimary:
+		if !delivered(kafkaSinkName) {
+			pending = append(pending, kafkaSinkName)
+		}
+	case ReplicationAny:
+		for _, cluster := range ks.clusters {
+			if delivered(cluster.name) {
+				return nil
+			}
+		}
+		for _, cluster := range ks.clusters {
+			pending = append(pending, cluster.name)
+		}
+	default:
+		for _, cluster := range ks.clusters {
+			if !delivered(cluster.name) {
+				pending = append(pending, cluster.name)
+			}
+		}
+	}
+	return pending
+}
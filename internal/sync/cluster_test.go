@@ -0,0 +1,85 @@
+package sync
+
+import (
+	"context"
+	"testing"
+)
+
+// sentIDs counts the messages broker took, by event ID.
+func sentIDs(broker *fakeBroker) map[string]int {
+	sent := make(map[string]int)
+	for _, msg := range broker.messages() {
+		sent[msg.Headers["id"]]++
+	}
+	return sent
+}
+
+func TestReplicationPolicies(t *testing.T) {
+	tests := []struct {
+		policy string
+		// failing is the cluster that is down for the first sync
+		failing string
+		// deleted is whether the first sync removes the events from the
+		// buffer
+		deleted bool
+	}{
+		{ReplicationAll, "primary", false},
+		{ReplicationAll, "mirror", false},
+		{ReplicationAny, "primary", true},
+		{ReplicationAny, "mirror", true},
+		{ReplicationPrimary, "primary", false},
+		{ReplicationPrimary, "mirror", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.failing+" down", func(t *testing.T) {
+			buf := newTestBuffer(t)
+			primary, mirror := newFakeBroker(1), newFakeBroker(1)
+			ks := newBrokerSync(t, buf, primary, "KAFKA_CLUSTERS=dr", "KAFKA_CLUSTER_DR_BROKERS=dr:9092",
+				"KAFKA_REPLICATION_POLICY="+tt.policy)
+			if len(ks.clusters) != 2 || ks.clusters[1].name != "kafka-dr" {
+				t.Fatalf("clusters %v, want the primary and kafka-dr", ks.clusters)
+			}
+			mirror.serve(ks.clusters[1])
+			down, up := primary, mirror
+			if tt.failing == "mirror" {
+				down, up = mirror, primary
+			}
+			down.down.Store(true)
+			storeEvents(t, buf, 5)
+
+			if err := ks.syncBatch(context.Background()); err == nil {
+				t.Error("syncBatch succeeded with a cluster down")
+			}
+			if got := sentIDs(up); len(got) != 5 {
+				t.Fatalf("the healthy cluster took %v, want all 5 events", got)
+			}
+			count, _ := buf.Count()
+			if deleted := count == 0; deleted != tt.deleted {
+				t.Fatalf("%d events left buffered, want deleted = %v", count, tt.deleted)
+			}
+			if tt.deleted {
+				return
+			}
+
+			// The buffer remembers who has the events, so once the failed
+			// cluster is back only it is written
+			down.down.Store(false)
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch after recovering: %v", err)
+			}
+			if count, _ := buf.Count(); count != 0 {
+				t.Fatalf("%d events left buffered after recovering, want none", count)
+			}
+			for name, broker := range map[string]*fakeBroker{"primary": primary, "mirror": mirror} {
+				for id, n := range sentIDs(broker) {
+					if n != 1 {
+						t.Errorf("%s took %s %d times, want once", name, id, n)
+					}
+				}
+				if got := sentIDs(broker); len(got) != 5 {
+					t.Errorf("%s took %d events, want 5", name, len(got))
+				}
+			}
+		})
+	}
+}
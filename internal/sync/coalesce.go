@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"encoding/json"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+)
+
+// coalesce returns events without those superseded later in the same batch,
+// for KAFKA_COALESCE_BATCH. An event is superseded by a later event for the
+// same document that carries the whole document, unless a delete of the
+// document comes between them. Deletes, and updates carrying only their
+// updateDescription, are always kept: nothing later repeats what they say.
+// The events kept stay in order.
+func coalesce(events []*buffer.Event) []*buffer.Event {
+	// superseded[doc] is set while walking back from a full-document event
+	// to the previous delete of doc.
+	superseded := make(map[string]bool)
+	keep := make([]bool, len(events))
+	dropped := 0
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		doc, ok := documentID(event)
+		switch {
+		case !ok:
+			keep[i] = true
+		case event.Operation == "delete":
+			keep[i] = true
+			superseded[doc] = false
+		case superseded[doc]:
+			dropped++
+		default:
+			keep[i] = true
+			if event.Data["fullDocument"] != nil {
+				superseded[doc] = true
+			}
+		}
+	}
+	if dropped == 0 {
+		return events
+	}
+
+	kept := make([]*buffer.Event, 0, len(events)-dropped)
+	for i, event := range events {
+		if keep[i] {
+			kept = append(kept, event)
+		}
+	}
+	metrics.EventsCoalesced.Add(float64(dropped))
+	return kept
+}
+
+// documentID identifies the document an event changed by its namespace and
+// documentKey. Events without a documentKey, such as drops, have none.
+func documentID(event *buffer.Event) (string, bool) {
+	key := event.Data["documentKey"]
+	if key == nil {
+		return "", false
+	}
+	id, err := json.Marshal([]interface{}{event.Data["ns"], jsonValue(key)})
+	if err != nil {
+		return "", false
+	}
+	return string(id), true
+}
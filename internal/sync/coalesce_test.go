@@ -0,0 +1,154 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// docEvent returns a change to document doc in app.orders. With full set it
+// carries the whole document, otherwise only its updateDescription.
+func docEvent(id, op, doc string, full bool) *buffer.Event {
+	data := map[string]interface{}{
+		"documentKey": map[string]interface{}{"_id": doc},
+		"ns":          map[string]interface{}{"db": "app", "coll": "orders"},
+	}
+	switch {
+	case op == "delete":
+	case full:
+		data["fullDocument"] = map[string]interface{}{"_id": doc, "version": id}
+	default:
+		data["updateDescription"] = map[string]interface{}{"updatedFields": map[string]interface{}{"version": id}}
+	}
+	return &buffer.Event{ID: id, Operation: op, Data: data}
+}
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []*buffer.Event
+		want   string
+	}{
+		{
+			name: "several updates",
+			events: []*buffer.Event{
+				docEvent("u1", "update", "a", true),
+				docEvent("u2", "update", "a", true),
+				docEvent("u3", "update", "a", true),
+			},
+			want: "[u3]",
+		},
+		{
+			name: "insert then updates",
+			events: []*buffer.Event{
+				docEvent("i1", "insert", "a", true),
+				docEvent("u1", "update", "a", true),
+				docEvent("u2", "replace", "a", true),
+			},
+			want: "[u2]",
+		},
+		{
+			// The delete says the document is gone, which the update before
+			// it does not repeat
+			name: "update then delete",
+			events: []*buffer.Event{
+				docEvent("u1", "update", "a", true),
+				docEvent("u2", "update", "a", true),
+				docEvent("d1", "delete", "a", false),
+			},
+			want: "[u2 d1]",
+		},
+		{
+			name: "recreated after a delete",
+			events: []*buffer.Event{
+				docEvent("i1", "insert", "a", true),
+				docEvent("u1", "update", "a", true),
+				docEvent("d1", "delete", "a", false),
+				docEvent("i2", "insert", "a", true),
+			},
+			want: "[u1 d1 i2]",
+		},
+		{
+			name: "other documents kept",
+			events: []*buffer.Event{
+				docEvent("a1", "update", "a", true),
+				docEvent("b1", "update", "b", true),
+				docEvent("a2", "update", "a", true),
+			},
+			want: "[b1 a2]",
+		},
+		{
+			// Only the updated fields are known, so nothing replaces them
+			name: "partial updates",
+			events: []*buffer.Event{
+				docEvent("u1", "update", "a", false),
+				docEvent("u2", "update", "a", false),
+			},
+			want: "[u1 u2]",
+		},
+		{
+			name: "without a documentKey",
+			events: []*buffer.Event{
+				{ID: "drop1", Operation: "drop", Data: map[string]interface{}{}},
+				{ID: "drop2", Operation: "drop", Data: map[string]interface{}{}},
+			},
+			want: "[drop1 drop2]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(metrics.EventsCoalesced)
+			got := coalesce(tt.events)
+			var ids []string
+			for _, event := range got {
+				ids = append(ids, event.ID)
+			}
+			if fmt.Sprint(ids) != tt.want {
+				t.Fatalf("coalesce kept %v, want %s", ids, tt.want)
+			}
+			if dropped := testutil.ToFloat64(metrics.EventsCoalesced) - before; dropped != float64(len(tt.events)-len(got)) {
+				t.Errorf("EventsCoalesced grew by %v, want %d", dropped, len(tt.events)-len(got))
+			}
+		})
+	}
+}
+
+func TestCoalescedEventsAcknowledged(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	ks := newBrokerSync(t, buf, broker, "KAFKA_COALESCE_BATCH=true")
+	base := time.Now()
+	for i, event := range []*buffer.Event{
+		docEvent("u1", "update", "a", true),
+		docEvent("u2", "update", "a", true),
+		docEvent("b1", "insert", "b", true),
+		docEvent("u3", "update", "a", true),
+		docEvent("d1", "delete", "b", false),
+	} {
+		event.Timestamp = base.Add(time.Duration(i) * time.Millisecond)
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+	var sent []string
+	for _, msg := range broker.messages() {
+		sent = append(sent, msg.Headers["id"])
+	}
+	if got := fmt.Sprint(sent); got != "[b1 u3 d1]" {
+		t.Errorf("sent %s, want [b1 u3 d1]", got)
+	}
+	// The superseded updates are removed with the one that replaced them
+	if count, _ := buf.Count(); count != 0 {
+		t.Errorf("%d events left buffered, want none", count)
+	}
+}
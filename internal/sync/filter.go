@@ -0,0 +1,178 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+)
+
+// filterOperators is ordered so two-character operators match before their
+// one-character prefixes.
+var filterOperators = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+// eventFilter is a SINK_FILTER_EXPR predicate of the form "field op value",
+// e.g. `status == "active"` or `order.total >= 100`. The field is a dotted
+// path into the event's fullDocument and the value a JSON literal (string,
+// number, true, false or null); an unquoted word is taken as a string.
+type eventFilter struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+// parseFilter validates a filter expression. An empty expression returns nil,
+// meaning every event is sent.
+func parseFilter(expr string) (*eventFilter, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, nil
+	}
+
+	i, op := findOperator(expr)
+	if i < 0 {
+		return nil, fmt.Errorf("invalid filter %q: no operator (one of %s)", expr, strings.Join(filterOperators, " "))
+	}
+
+	field := strings.TrimSpace(expr[:i])
+	literal := strings.TrimSpace(expr[i+len(op):])
+	if field == "" || literal == "" {
+		return nil, fmt.Errorf("invalid filter %q: want \"field op value\"", expr)
+	}
+	path := strings.Split(field, ".")
+	for _, segment := range path {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid filter %q: bad field %q", expr, field)
+		}
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(literal), &value); err != nil {
+		if strings.ContainsAny(literal, "\"' ") {
+			return nil, fmt.Errorf("invalid filter %q: bad value %s", expr, literal)
+		}
+		value = literal
+	}
+	switch value.(type) {
+	case string, float64, bool, nil:
+	default:
+		return nil, fmt.Errorf("invalid filter %q: value must be a string, number, boolean or null", expr)
+	}
+
+	return &eventFilter{path: path, op: op, value: value}, nil
+}
+
+// findOperator returns the position of the leftmost operator in expr, so
+// operator characters inside the value are left alone.
+func findOperator(expr string) (int, string) {
+	for i := range expr {
+		for _, op := range filterOperators {
+			if strings.HasPrefix(expr[i:], op) {
+				return i, op
+			}
+		}
+	}
+	return -1, ""
+}
+
+// match reports whether event should be sent. Events without a fullDocument,
+// such as deletes, have nothing to test and always match. A missing field
+// compares as null, so it fails == on anything but null and every ordering.
+func (f *eventFilter) match(event *buffer.Event) bool {
+	doc, ok := event.Data["fullDocument"].(map[string]interface{})
+	if !ok {
+		return true
+	}
+
+	var current interface{} = doc
+	for _, segment := range f.path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			current = nil
+			break
+		}
+		current = m[segment]
+	}
+	current = jsonValue(current)
+
+	switch f.op {
+	case "==":
+		return filterEqual(current, f.value)
+	case "!=":
+		return !filterEqual(current, f.value)
+	}
+
+	cmp, ok := filterCompare(current, f.value)
+	if !ok {
+		return false
+	}
+	switch f.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp <= 0
+	}
+}
+
+func filterEqual(actual, want interface{}) bool {
+	switch actual.(type) {
+	case string, float64, bool, nil:
+		return actual == want
+	}
+	return false
+}
+
+// filterCompare orders two numbers or two strings. Other combinations are not
+// comparable.
+func filterCompare(actual, want interface{}) (int, bool) {
+	switch a := actual.(type) {
+	case float64:
+		w, ok := want.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < w:
+			return -1, true
+		case a > w:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		w, ok := want.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, w), true
+	}
+	return 0, false
+}
+
+// applyFilter deletes the events the filter rejects from the buffer and
+// returns the rest.
+func (ks *KafkaSync) applyFilter(events []*buffer.Event) []*buffer.Event {
+	if ks.filter == nil {
+		return events
+	}
+
+	kept := events[:0:0]
+	for _, event := range events {
+		if ks.filter.match(event) {
+			kept = append(kept, event)
+			continue
+		}
+		if err := ks.buffer.Delete(event); err != nil {
+			log.Printf("Failed to delete filtered event %s from buffer: %v", event.ID, err)
+			continue
+		}
+		metrics.EventsFiltered.WithLabelValues(event.Operation).Inc()
+	}
+	return kept
+}
@@ -0,0 +1,121 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseFilterRejectsMalformed(t *testing.T) {
+	for _, expr := range []string{
+		"status",
+		"== active",
+		"status ==",
+		"order..total > 1",
+		`status == "active`,
+		"status == two words",
+		"tags == [1]",
+	} {
+		if _, err := parseFilter(expr); err == nil {
+			t.Errorf("parseFilter(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	event := &buffer.Event{ID: "e1", Operation: "update", Data: map[string]interface{}{
+		"fullDocument": map[string]interface{}{
+			"status": "active",
+			"order":  map[string]interface{}{"total": float64(150)},
+			"note":   nil,
+		},
+	}}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// Matching
+		{`status == "active"`, true},
+		{"status == active", true},
+		{"order.total >= 150", true},
+		{"order.total < 200", true},
+		{"note == null", true},
+		// Not matching
+		{`status == "archived"`, false},
+		{"status != active", false},
+		{"order.total > 150", false},
+		{"status > 5", false},
+		// Missing fields compare as null
+		{"region == eu", false},
+		{"region != eu", true},
+		{"region == null", true},
+		{"order.discount >= 0", false},
+		{"status.code == 1", false},
+	}
+	for _, tt := range tests {
+		filter, err := parseFilter(tt.expr)
+		if err != nil {
+			t.Fatalf("parseFilter(%q): %v", tt.expr, err)
+		}
+		if got := filter.match(event); got != tt.want {
+			t.Errorf("%q matched %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	// Deletes have no fullDocument to test
+	filter, _ := parseFilter(`status == "active"`)
+	if !filter.match(&buffer.Event{ID: "e2", Operation: "delete", Data: map[string]interface{}{}}) {
+		t.Error("delete without a fullDocument was filtered out")
+	}
+}
+
+func TestFilteredEventsAreDeleted(t *testing.T) {
+	buf := newTestBuffer(t)
+	sink := &recordingSink{}
+	ks := newConcurrentSync(buf, sink, 1, 10)
+	var err error
+	if ks.filter, err = parseFilter(`status == "active"`); err != nil {
+		t.Fatalf("parseFilter: %v", err)
+	}
+
+	base := time.Now()
+	docs := []struct {
+		id  string
+		doc map[string]interface{}
+	}{
+		{"active", map[string]interface{}{"status": "active"}},
+		{"archived", map[string]interface{}{"status": "archived"}},
+		{"no-status", map[string]interface{}{}},
+	}
+	for i, d := range docs {
+		event := &buffer.Event{
+			ID:        d.id,
+			Operation: "insert",
+			Timestamp: base.Add(time.Duration(i) * time.Microsecond),
+			Data:      map[string]interface{}{"fullDocument": d.doc},
+		}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	filtered := func() float64 { return testutil.ToFloat64(metrics.EventsFiltered.WithLabelValues("insert")) }
+	before := filtered()
+
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+	if len(sink.written) != 1 || sink.written["active"] != 1 {
+		t.Fatalf("sink got %v, want only the active event", sink.written)
+	}
+	if count, _ := buf.Count(); count != 0 {
+		t.Fatalf("%d events left buffered, want the filtered ones deleted", count)
+	}
+	if got := filtered() - before; got != 2 {
+		t.Fatalf("filtered counter rose by %v, want 2", got)
+	}
+}
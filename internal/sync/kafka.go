@@ -3,15 +3,77 @@ package sync
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
 	"time"
 
 	"buffered-cdc/internal/buffer"
 	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/logging"
+	"buffered-cdc/internal/metrics"
 	"buffered-cdc/internal/monitor"
+	"buffered-cdc/internal/workers"
 
 	"github.com/segmentio/kafka-go"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/time/rate"
+)
+
+// maxSlowWriteLogged caps the event IDs one slow write warning lists.
+const maxSlowWriteLogged = 20
+
+// Values for KAFKA_MESSAGE_TIME, the source of each message's timestamp.
+const (
+	// MessageTimeBroker leaves the time unset so the broker assigns it.
+	MessageTimeBroker = "broker"
+	// MessageTimeBuffer uses the time the event was captured into the buffer.
+	MessageTimeBuffer = "buffer"
+	// MessageTimeCluster uses MongoDB's clusterTime for the change, falling
+	// back to the buffer time when it is missing.
+	MessageTimeCluster = "cluster"
+)
+
+// Values for KAFKA_BALANCER, how messages are spread across partitions.
+// KAFKA_PRESERVE_ORDER and KAFKA_STRICT_ORDER choose their own.
+const (
+	// BalancerLeastBytes sends each message to the partition that has been
+	// sent the fewest bytes.
+	BalancerLeastBytes = "leastbytes"
+	// BalancerHash partitions by a hash of the message key.
+	BalancerHash = "hash"
+	// BalancerSticky sends a whole sync batch to one partition and moves to
+	// the next partition with the next batch, so each batch is one produce
+	// request.
+	BalancerSticky = "sticky"
+)
+
+// Values for KAFKA_LOG_LEVEL, which controls how much of kafka-go's own
+// logging reaches the service log.
+const (
+	KafkaLogNone  = "none"
+	KafkaLogError = "error"
+	// KafkaLogDebug also logs the writer's routine activity, which is verbose.
+	KafkaLogDebug = "debug"
+)
+
+var (
+	// ErrSinkUnavailable means a batch could not be written because Kafka
+	// kept failing with transient errors; the events stay buffered for retry.
+	ErrSinkUnavailable = errors.New("kafka sink unavailable")
+	// ErrMessageRejected means Kafka refused one or more messages with an
+	// error that retrying cannot fix; those events were dead-lettered.
+	ErrMessageRejected = errors.New("kafka rejected messages")
+	// ErrSinkWriteFailed means an additional sink failed to take a batch. It
+	// does not count against the Kafka circuit breaker.
+	ErrSinkWriteFailed = errors.New("sink write failed")
 )
 
 type KafkaSync struct {
@@ -19,9 +81,144 @@ type KafkaSync struct {
 	config     *config.KafkaConfig
 	connMonitor *monitor.ConnectivityMonitor
 	writer     *kafka.Writer
+	topics     *topicRouter
+	// dlqWriter publishes dead-lettered events to KAFKA_DLQ_TOPIC; nil keeps
+	// them in the local dead-letter bucket only.
+	dlqWriter *kafka.Writer
+	keyTemplate *keyTemplate
+	breaker    *breaker
+	// sinks receive every event in addition to Kafka. An event is deleted
+	// from the buffer once Kafka and all of them have acknowledged it.
+	sinks []Sink
+	// pool bounds the batch writes running at once across the service.
+	pool *workers.Pool
+	// filter drops events that fail SINK_FILTER_EXPR before any sink sees them.
+	filter *eventFilter
+
+	// readBatchSize is how many events syncBatch reads from the buffer in one
+	// transaction. The writer groups them into Kafka batches on its own
+	// according to KafkaConfig.BatchSize and BatchTimeout. readMaxBytes,
+	// BUFFER_MAX_BATCH_BYTES, also ends a batch once its stored size would
+	// exceed it.
+	readBatchSize  int
+	readMaxBytes   int
+	// concurrency is how many batches are written to Kafka in parallel,
+	// at most SYNC_MAX_INFLIGHT_BATCHES.
+	concurrency    int
+	// retryBudget rate-limits events sent again after a failed sync; nil
+	// is unlimited.
+	retryBudget *rate.Limiter
+	// creator creates missing topics; nil unless KAFKA_CREATE_TOPIC is set.
+	creator *topicCreator
+	// claims moves large payloads to object storage; nil unless
+	// CLAIM_CHECK_THRESHOLD is set.
+	claims *claimCheck
+	// signer signs message values; nil unless EVENT_SIGNING_KEY is set.
+	signer *signer
+	// runtime holds the settings reloaded on SIGHUP, see SetRuntime.
+	runtime *atomic.Pointer[config.Runtime]
+	// lag lowers the batches per tick while consumers are behind; nil
+	// unless SYNC_LAG_SOURCE is set.
+	lag *lagThrottle
+	// tenants rate-limits each tenant's events; nil when SYNC_TENANT_FIELD
+	// is unset.
+	tenants *tenantLimiter
+	// clusters are the Kafka clusters events are written to, the primary
+	// first.
+	clusters []*kafkaCluster
+	// async tracks the events in flight with KAFKA_ASYNC; nil when writes
+	// are synchronous.
+	async *asyncDelivery
+	// bus hands synced events to in-process subscribers; nil unless
+	// SINK_BUS_BUFFER is set.
+	bus *EventBus
+	// batches numbers the batches written, for KAFKA_BALANCER=sticky.
+	batches atomic.Uint64
+	checkpointSize int
+	// reconcileLookback is how far back Reconcile checks synced events.
+	reconcileLookback time.Duration
+	deliveredMu    gosync.Mutex
+	delivered      []kafka.Message
+
+	// paused stops the sync loop from publishing while capture keeps filling
+	// the buffer. resumeCh wakes the loop to drain as soon as it is cleared.
+	paused   atomic.Bool
+	resumeCh chan struct{}
 }
 
-func NewKafkaSync(cfg *config.Config, buf *buffer.Buffer, connMonitor *monitor.ConnectivityMonitor) *KafkaSync {
+func NewKafkaSync(cfg *config.Config, buf *buffer.Buffer, connMonitor *monitor.ConnectivityMonitor, pool *workers.Pool) (*KafkaSync, error) {
+	template := cfg.Kafka.KeyTemplate
+	if (cfg.Kafka.PreserveOrder || cfg.Kafka.DeleteTombstone) && template == "" {
+		template = documentKeyTemplate
+	}
+	keyTemplate, err := parseKeyTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+
+	topics, err := newTopicRouter(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := parseFilter(cfg.Sinks.FilterExpr)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := newTenantLimiter(&cfg.Sync)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := newClaimCheck(&cfg.ClaimCheck)
+	if err != nil {
+		return nil, err
+	}
+	// Settings a SIGHUP may change are read through runtime
+	runtime := &atomic.Pointer[config.Runtime]{}
+	rt := cfg.Runtime()
+	if err := validateRuntime(rt, cfg.Sync.LagSource != LagSourceNone); err != nil {
+		return nil, err
+	}
+	runtime.Store(rt)
+	logger := kafkaLogger("kafka: ", runtime, KafkaLogDebug)
+	errorLogger := kafkaLogger("kafka error: ", runtime, KafkaLogDebug, KafkaLogError)
+
+	switch cfg.Kafka.MessageTime {
+	case MessageTimeBroker, MessageTimeBuffer, MessageTimeCluster:
+	default:
+		return nil, fmt.Errorf("invalid KAFKA_MESSAGE_TIME %q: must be broker, buffer or cluster", cfg.Kafka.MessageTime)
+	}
+
+	// LeastBytes spreads load best but ignores keys. Ordering needs every
+	// message with the same key on the same partition, which Hash provides.
+	var balancer kafka.Balancer
+	switch cfg.Kafka.Balancer {
+	case BalancerLeastBytes:
+		balancer = &kafka.LeastBytes{}
+	case BalancerHash:
+		balancer = &kafka.Hash{}
+	case BalancerSticky:
+		if cfg.Kafka.PreserveOrder || cfg.Kafka.StrictOrder {
+			return nil, fmt.Errorf("KAFKA_BALANCER=sticky cannot be combined with KAFKA_PRESERVE_ORDER or KAFKA_STRICT_ORDER")
+		}
+		balancer = stickyBalancer{}
+	default:
+		return nil, fmt.Errorf("invalid KAFKA_BALANCER %q: must be leastbytes, hash or sticky", cfg.Kafka.Balancer)
+	}
+	if cfg.Kafka.PreserveOrder {
+		balancer = &kafka.Hash{}
+	}
+	if cfg.Kafka.StrictOrder {
+		balancer = firstPartition{}
+	}
+	// Dead-letter messages are written one at a time, outside any batch
+	dlqBalancer := balancer
+	if _, ok := balancer.(stickyBalancer); ok {
+		dlqBalancer = &kafka.LeastBytes{}
+	}
+
 	// Parse compression type
 	var compression kafka.Compression
 	switch cfg.Kafka.CompressionType {
@@ -37,36 +234,370 @@ func NewKafkaSync(cfg *config.Config, buf *buffer.Buffer, connMonitor *monitor.C
 		compression = kafka.Snappy
 	}
 
-	// Parse required acks
-	var requiredAcks kafka.RequiredAcks
-	switch cfg.Kafka.Acks {
-	case 0:
-		requiredAcks = kafka.RequireNone
-	case 1:
-		requiredAcks = kafka.RequireOne
-	case -1:
+	requiredAcks := parseAcks(cfg.Kafka.Acks)
+	dlqAcks := parseAcks(cfg.Kafka.DLQAcks)
+
+	concurrency := cfg.Buffer.ConcurrentReads
+	if max := cfg.Sync.MaxInflightBatches; max > 0 && concurrency > max {
+		concurrency = max
+	}
+	if cfg.Kafka.StrictOrder {
+		log.Printf("WARNING: KAFKA_STRICT_ORDER is set: every message goes to partition 0 of %s, " +
+			"one batch at a time, acknowledged by all in-sync replicas. Throughput is limited to a single " +
+			"partition leader and consumers cannot scale past one instance", topics.defaultTopic())
 		requiredAcks = kafka.RequireAll
-	default:
-		requiredAcks = kafka.RequireOne
+		concurrency = 1
+	}
+	if err := checkAcks(&cfg.Kafka, "KAFKA_ACKS", requiredAcks); err != nil {
+		return nil, err
+	}
+	if cfg.Kafka.DLQTopic != "" {
+		if err := checkAcks(&cfg.Kafka, "KAFKA_DLQ_ACKS", dlqAcks); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Buffer.ReadOrder == buffer.ReadLIFO && (cfg.Kafka.PreserveOrder || cfg.Kafka.StrictOrder) {
+		log.Printf("WARNING: BUFFER_READ_ORDER is lifo: buffered changes are delivered newest first, " +
+			"so consumers see changes to a document out of order despite KAFKA_PRESERVE_ORDER or KAFKA_STRICT_ORDER")
+	}
+
+	// kafka-go rejects messages that set a topic when the writer has one
+	writerTopic := topics.defaultTopic()
+	if topics.perEvent() {
+		writerTopic = ""
 	}
 
 	writer := &kafka.Writer{
 		Addr:         kafka.TCP(cfg.Kafka.Brokers...),
-		Topic:        cfg.Kafka.Topic,
-		Balancer:     &kafka.LeastBytes{},
+		Topic:        writerTopic,
+		Balancer:     balancer,
 		BatchTimeout: cfg.Kafka.BatchTimeout,
 		BatchSize:    cfg.Kafka.BatchSize,
 		RequiredAcks: requiredAcks,
 		WriteTimeout: cfg.Kafka.Timeout,
 		Compression:  compression,
-		Async:        false, // Keep synchronous for reliability
+		// ClientID is sent with every request so broker logs and quotas can
+		// be tied to this producer.
+		Transport: &kafka.Transport{
+			ClientID: cfg.Kafka.ClientID,
+		},
+		Logger:      logger,
+		ErrorLogger: errorLogger,
+		// Synchronous writes let syncBatch delete events only once Kafka has
+		// acknowledged them. With KAFKA_ASYNC the completion callback does so
+		// instead. Delivery is at-least-once either way: kafka-go cannot
+		// produce transactionally, see "Delivery Guarantees" in the README.
+		Async:        cfg.Kafka.Async,
+	}
+
+	var dlqWriter *kafka.Writer
+	if cfg.Kafka.DLQTopic != "" {
+		dlqWriter = &kafka.Writer{
+			Addr:         writer.Addr,
+			Topic:        cfg.Kafka.DLQTopic,
+			Balancer:     dlqBalancer,
+			BatchTimeout: cfg.Kafka.BatchTimeout,
+			RequiredAcks: dlqAcks,
+			WriteTimeout: cfg.Kafka.Timeout,
+			Compression:  compression,
+			Transport:    writer.Transport,
+			Logger:       logger,
+			ErrorLogger:  errorLogger,
+		}
+	}
+
+	if topics.perEvent() {
+		log.Printf("Publishing events to per-collection Kafka topics, %s for %s", topics.defaultTopic(), cfg.MongoDB.Collection)
+	} else {
+		log.Printf("Publishing events to Kafka topic %s", topics.defaultTopic())
+	}
+
+	ks := &KafkaSync{
+		buffer:         buf,
+		config:         &cfg.Kafka,
+		connMonitor:    connMonitor,
+		writer:         writer,
+		topics:         topics,
+		dlqWriter:      dlqWriter,
+		keyTemplate:    keyTemplate,
+		breaker:        newBreaker(cfg.Kafka.BreakerThreshold, cfg.Kafka.BreakerCooldown),
+		sinks:          newSinks(&cfg.Sinks),
+		filter:         filter,
+		pool:           pool,
+		readBatchSize:  cfg.Buffer.BatchSize,
+		readMaxBytes:   cfg.Buffer.MaxBatchBytes,
+		concurrency:    concurrency,
+		retryBudget:      newRetryBudget(cfg.Sync.RetryRate, cfg.Sync.RetryBurst),
+		tenants:          tenants,
+		claims:           claims,
+		signer:           newSigner(&cfg.Kafka),
+		runtime:          runtime,
+		creator:          newTopicCreator(&cfg.Kafka, &kafka.Client{Addr: writer.Addr, Transport: writer.Transport}),
+		checkpointSize: cfg.Buffer.CheckpointSize,
+		reconcileLookback: cfg.Scheduler.ReconcileLookback,
+		resumeCh:       make(chan struct{}, 1),
+	}
+	if ks.lag, err = newLagThrottle(&cfg.Sync, &kafka.Client{Addr: writer.Addr, Transport: writer.Transport}); err != nil {
+		return nil, err
+	}
+	if cfg.Sinks.BusBuffer > 0 {
+		ks.bus = NewEventBus(cfg.Sinks.BusBuffer)
+	}
+	mirrors, err := newMirrors(&cfg.Kafka, writer)
+	if err != nil {
+		return nil, err
+	}
+	ks.clusters = append([]*kafkaCluster{{name: kafkaSinkName, writer: writer, creator: ks.creator}}, mirrors...)
+	if cfg.Kafka.Async {
+		if ks.async, err = newAsyncDelivery(cfg); err != nil {
+			return nil, err
+		}
+		log.Printf("Writing to Kafka asynchronously, up to %d events in flight", cfg.Kafka.AsyncMaxPending)
+	}
+	if ks.checkpointSize > 0 || ks.async != nil {
+		writer.Completion = ks.onCompletion
+	}
+	return ks, nil
+}
+
+// parseAcks maps a KAFKA_ACKS value to kafka-go's setting. Anything other
+// than 0, 1 or -1 means 1.
+func parseAcks(acks int) kafka.RequiredAcks {
+	switch acks {
+	case 0:
+		return kafka.RequireNone
+	case -1:
+		return kafka.RequireAll
+	default:
+		return kafka.RequireOne
+	}
+}
+
+// checkAcks refuses acks=0 for a writer unless KAFKA_ALLOW_UNSAFE_ACKS is set.
+// Events are deleted from the buffer once their write returns, and with
+// acks=0 it returns before the broker has stored anything, so a broker
+// failure loses them with nothing left to resend.
+func checkAcks(cfg *config.KafkaConfig, name string, acks kafka.RequiredAcks) error {
+	if acks != kafka.RequireNone {
+		return nil
+	}
+	if !cfg.AllowUnsafeAcks {
+		return fmt.Errorf("%s=0 deletes events from the buffer before Kafka has stored them and loses them if a broker fails; "+
+			"use 1 or -1, or set KAFKA_ALLOW_UNSAFE_ACKS=true to accept the risk", name)
+	}
+	log.Printf("WARNING: %s=0: events are deleted from the buffer without a broker acknowledgement and are lost if a broker fails", name)
+	return nil
+}
+
+// firstPartition sends every message to the lowest-numbered partition, so a
+// topic with any number of partitions is consumed in one global order.
+type firstPartition struct{}
+
+func (firstPartition) Balance(msg kafka.Message, partitions ...int) int {
+	first := partitions[0]
+	for _, p := range partitions[1:] {
+		if p < first {
+			first = p
+		}
+	}
+	return first
+}
+
+// stickyBatch is the WriterData of every message of one writeKafka call,
+// numbering the batch for stickyBalancer.
+type stickyBatch uint64
+
+// stickyBalancer sends every message of a batch to the same partition,
+// rotating through the partitions batch by batch. A retried batch keeps its
+// partition. Messages outside a batch go to the first partition.
+type stickyBalancer struct{}
+
+func (stickyBalancer) Balance(msg kafka.Message, partitions ...int) int {
+	batch, _ := msg.WriterData.(stickyBatch)
+	if m, ok := msg.WriterData.(asyncMessage); ok {
+		batch = m.batch
+	}
+	return partitions[int(uint64(batch)%uint64(len(partitions)))]
+}
+
+// kafkaLogger routes kafka-go's log lines to the standard logger while
+// KAFKA_LOG_LEVEL is one of levels. The level is checked on every line, so a
+// reload applies at once.
+func kafkaLogger(prefix string, runtime *atomic.Pointer[config.Runtime], levels ...string) kafka.Logger {
+	return kafka.LoggerFunc(func(msg string, args ...interface{}) {
+		if slices.Contains(levels, runtime.Load().KafkaLogLevel) {
+			log.Printf(prefix+msg, args...)
+		}
+	})
+}
+
+// validateRuntime checks the settings that can be reloaded. lagEnabled says
+// whether SYNC_LAG_SOURCE is set, which is when the lag thresholds matter.
+func validateRuntime(rt *config.Runtime, lagEnabled bool) error {
+	switch rt.KafkaLogLevel {
+	case KafkaLogNone, KafkaLogError, KafkaLogDebug:
+	default:
+		return fmt.Errorf("invalid KAFKA_LOG_LEVEL %q: must be none, error or debug", rt.KafkaLogLevel)
+	}
+	if rt.SyncBatchesPerTick < 1 {
+		return fmt.Errorf("invalid SYNC_BATCHES_PER_TICK %d: must be at least 1", rt.SyncBatchesPerTick)
+	}
+	if lagEnabled {
+		if rt.SyncLagThreshold <= 0 {
+			return fmt.Errorf("invalid SYNC_LAG_THRESHOLD %d: must be positive", rt.SyncLagThreshold)
+		}
+		if rt.SyncLagPause > 0 && rt.SyncLagPause <= rt.SyncLagThreshold {
+			return fmt.Errorf("SYNC_LAG_PAUSE (%d) must be above SYNC_LAG_THRESHOLD (%d)", rt.SyncLagPause, rt.SyncLagThreshold)
+		}
+	}
+	return nil
+}
+
+// SetRuntime applies reloaded settings. Syncs already running finish with
+// the settings they started with. Invalid settings are rejected as a whole.
+func (ks *KafkaSync) SetRuntime(rt *config.Runtime) error {
+	if err := validateRuntime(rt, ks.lag != nil); err != nil {
+		return err
 	}
+	ks.runtime.Store(rt)
+	if ks.lag != nil {
+		ks.lag.setLimits(int64(rt.SyncLagThreshold), int64(rt.SyncLagPause))
+	}
+	return nil
+}
 
-	return &KafkaSync{
-		buffer:      buf,
-		config:      &cfg.Kafka,
-		connMonitor: connMonitor,
-		writer:      writer,
+// onCompletion collects successfully written messages, which the writer has
+// stamped with their partition and offset. WriteMessages does not return
+// offsets, but it blocks until Completion has run for every partition batch,
+// so the messages are all collected by the time it returns. With KAFKA_ASYNC
+// it also settles the messages' events. It is called from the writer's
+// per-partition goroutines.
+func (ks *KafkaSync) onCompletion(messages []kafka.Message, err error) {
+	if err == nil && ks.checkpointSize > 0 {
+		ks.deliveredMu.Lock()
+		ks.delivered = append(ks.delivered, messages...)
+		ks.deliveredMu.Unlock()
+	}
+	if ks.async != nil {
+		ks.completeAsync(messages, err)
+	}
+}
+
+// messageKey renders KAFKA_KEY_TEMPLATE for event, falling back to the event
+// ID when no template is set or a field it references is missing. A delete
+// carries no fullDocument, so one the template cannot be rendered for is
+// keyed by documentKey._id instead: with a template of {documentKey._id}
+// that is the key of the document's other changes, and otherwise it is at
+// least the same for every delete of the document.
+func (ks *KafkaSync) messageKey(event *buffer.Event) []byte {
+	if ks.keyTemplate != nil {
+		if key, ok := ks.keyTemplate.render(event); ok {
+			return key
+		}
+		if event.Operation == "delete" {
+			if id, ok := keyField(event, documentIDPath); ok {
+				return []byte(id)
+			}
+		}
+	}
+	return []byte(event.ID)
+}
+
+// tombstoneKey returns the key for a tombstone replacing event's message when
+// KAFKA_DELETE_TOMBSTONE is set and event is a delete. The key comes from the
+// same template as the document's inserts and updates; when the template
+// cannot be rendered for the delete a tombstone under the event ID would
+// compact nothing, so the event is sent as a normal message instead.
+func (ks *KafkaSync) tombstoneKey(event *buffer.Event) ([]byte, bool) {
+	if !ks.config.DeleteTombstone || event.Operation != "delete" {
+		return nil, false
+	}
+	key, ok := ks.keyTemplate.render(event)
+	if !ok {
+		log.Printf("Sending delete %s as a normal message: key template cannot be rendered without the deleted document", event.ID)
+		return nil, false
+	}
+	return key, true
+}
+
+// messageTime returns the timestamp for event's message according to
+// KAFKA_MESSAGE_TIME. The zero time lets the broker assign one.
+func (ks *KafkaSync) messageTime(event *buffer.Event) time.Time {
+	switch ks.config.MessageTime {
+	case MessageTimeBuffer:
+		return event.Timestamp
+	case MessageTimeCluster:
+		if t, ok := clusterTime(event.Data["clusterTime"]); ok {
+			return t
+		}
+		return event.Timestamp
+	}
+	return time.Time{}
+}
+
+// clusterTime converts a change event's clusterTime, a BSON timestamp, to a
+// time. Buffered events have been through JSON, where the timestamp becomes
+// {"T": seconds, "I": increment}, or {"$timestamp": {"t": ..., "i": ...}} in
+// Extended JSON mode.
+func clusterTime(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case primitive.Timestamp:
+		return time.Unix(int64(v.T), 0), v.T != 0
+	case map[string]interface{}:
+		if ext, ok := v["$timestamp"].(map[string]interface{}); ok {
+			v = map[string]interface{}{"T": ext["t"]}
+		}
+		if seconds, ok := v["T"].(float64); ok && seconds > 0 {
+			return time.Unix(int64(seconds), 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func headerValue(msg kafka.Message, key string) string {
+	for _, header := range msg.Headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// recordCheckpoints saves the positions of messages delivered since the last
+// call to the buffer's checkpoint ring.
+func (ks *KafkaSync) recordCheckpoints() {
+	ks.deliveredMu.Lock()
+	delivered := ks.delivered
+	ks.delivered = nil
+	ks.deliveredMu.Unlock()
+
+	if len(delivered) == 0 {
+		return
+	}
+
+	now := time.Now()
+	checkpoints := make([]buffer.Checkpoint, 0, len(delivered))
+	for _, msg := range delivered {
+		cp := buffer.Checkpoint{
+			EventID:   headerValue(msg, "id"),
+			Topic:     msg.Topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+			SyncedAt:  now,
+		}
+		if ks.writer.RequiredAcks == kafka.RequireNone {
+			// The broker does not answer, so the writer never learns where
+			// the message went
+			cp.Partition, cp.Offset = -1, -1
+		}
+		if cp.Topic == "" {
+			cp.Topic = ks.writer.Topic
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+
+	if err := ks.buffer.RecordCheckpoints(checkpoints, ks.checkpointSize); err != nil {
+		log.Printf("Failed to record %d checkpoints: %v", len(checkpoints), err)
 	}
 }
 
@@ -78,16 +609,19 @@ func (ks *KafkaSync) Start(ctx context.Context) {
 	defer ticker.Stop()
 
 	statusCh := ks.connMonitor.Subscribe()
+	if ks.lag != nil {
+		go ks.lag.run(ctx)
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if ks.connMonitor.IsOnline() {
+			if ks.connMonitor.IsOnline() && !ks.Paused() {
 				// Process multiple batches per tick for higher throughput
-				for i := 0; i < 3; i++ {
-					if err := ks.syncBatch(ctx); err != nil {
+				for i := 0; i < ks.tickBatches(); i++ {
+					if err := ks.guardedSyncBatch(ctx); err != nil {
 						log.Printf("Failed to sync batch %d: %v", i+1, err)
 						break // Stop on error to avoid cascading failures
 					}
@@ -96,64 +630,633 @@ func (ks *KafkaSync) Start(ctx context.Context) {
 		case status := <-statusCh:
 			if status == monitor.StatusOnline {
 				log.Println("Connectivity restored, starting sync process")
-				if err := ks.syncBatch(ctx); err != nil {
+				ks.breaker.Reset()
+				if ks.Paused() {
+					continue
+				}
+				if err := ks.guardedSyncBatch(ctx); err != nil {
 					log.Printf("Failed to sync batch after connectivity restore: %v", err)
 				}
 			}
+		case <-ks.resumeCh:
+			if ks.connMonitor.IsOnline() && !ks.Paused() {
+				if err := ks.guardedSyncBatch(ctx); err != nil {
+					log.Printf("Failed to sync batch after resume: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// Drain syncs batch after batch until a pass makes no progress, a sync
+// fails, Kafka is offline or ctx is done. It is called at shutdown, after
+// Start has returned, so ready events are sent rather than left in the
+// buffer. Delayed events that are not ready yet stay buffered.
+func (ks *KafkaSync) Drain(ctx context.Context) error {
+	drained := 0
+	for ctx.Err() == nil && ks.connMonitor.IsOnline() && !ks.Paused() {
+		before, err := ks.buffer.Count()
+		if err != nil {
+			return err
+		}
+		if before == 0 {
+			break
+		}
+		if err := ks.guardedSyncBatch(ctx); err != nil {
+			return fmt.Errorf("drained %d events: %w", drained, err)
+		}
+		if ks.async != nil {
+			ks.async.wait(ctx)
+		}
+		after, err := ks.buffer.Count()
+		if err != nil {
+			return err
+		}
+		if after >= before {
+			break
+		}
+		drained += before - after
+	}
+	log.Printf("Drained %d events from the buffer", drained)
+	return ctx.Err()
+}
+
+// tickBatches returns how many batches to send this tick: SYNC_BATCHES_PER_TICK,
+// lowered by the consumer lag throttle while consumers are behind.
+func (ks *KafkaSync) tickBatches() int {
+	n := ks.runtime.Load().SyncBatchesPerTick
+	if ks.lag != nil {
+		n = ks.lag.batches(n)
+	}
+	metrics.SyncBatchesPerTick.Set(float64(n))
+	return n
+}
+
+// ReportLag records consumer lag reported through the admin API. It fails
+// unless SYNC_LAG_SOURCE=admin.
+func (ks *KafkaSync) ReportLag(lag int64) error {
+	if ks.lag == nil {
+		return fmt.Errorf("SYNC_LAG_SOURCE is not admin")
+	}
+	reported, ok := ks.lag.source.(*reportedLag)
+	if !ok {
+		return fmt.Errorf("SYNC_LAG_SOURCE is not admin")
+	}
+	if lag < 0 {
+		return fmt.Errorf("lag must not be negative")
+	}
+	reported.report(lag)
+	// Apply it now rather than at the next poll
+	ks.lag.poll(context.Background())
+	return nil
+}
+
+// Pause stops publishing to Kafka until Resume. Capture is unaffected, so the
+// buffer keeps growing while paused. A batch already being written finishes.
+func (ks *KafkaSync) Pause() {
+	if ks.paused.CompareAndSwap(false, true) {
+		log.Println("Kafka sync paused")
+		metrics.KafkaSyncPaused.Set(1)
+	}
+}
+
+// Resume lets the sync loop publish again and starts draining immediately
+// instead of waiting for the next tick.
+func (ks *KafkaSync) Resume() {
+	if ks.paused.CompareAndSwap(true, false) {
+		log.Println("Kafka sync resumed")
+		metrics.KafkaSyncPaused.Set(0)
+		select {
+		case ks.resumeCh <- struct{}{}:
+		default:
 		}
 	}
 }
 
+// Paused reports whether publishing is paused.
+func (ks *KafkaSync) Paused() bool {
+	return ks.paused.Load()
+}
+
+// guardedSyncBatch runs syncBatch through the circuit breaker, quietly doing
+// nothing while it is open. Only sink failures count against the breaker;
+// rejected messages and buffer errors say nothing about Kafka's availability.
+func (ks *KafkaSync) guardedSyncBatch(ctx context.Context) error {
+	if !ks.breaker.Allow() {
+		return nil
+	}
+
+	err := ks.syncBatch(ctx)
+	if errors.Is(err, ErrSinkUnavailable) {
+		ks.breaker.Failure()
+	} else {
+		ks.breaker.Success()
+	}
+	return err
+}
+
 func (ks *KafkaSync) syncBatch(ctx context.Context) error {
-	events, err := ks.buffer.GetReadyEvents(ks.config.BatchSize)
+	if ks.async != nil {
+		return ks.syncAsync(ctx)
+	}
+	if ks.concurrency > 1 {
+		return ks.syncConcurrent(ctx)
+	}
+
+	batches, err := ks.readBatches(1)
+	if err != nil {
+		return fmt.Errorf("failed to get ready events from buffer: %w", err)
+	}
+	var events []*buffer.Event
+	if batches = ks.limitRetries(ks.limitInflight(batches)); len(batches) > 0 {
+		events = batches[0]
+	}
+	defer metrics.SyncInflightBytes.Set(0)
+
+	return ks.pool.Do(ctx, func() error {
+		return ks.syncEvents(ctx, events)
+	})
+}
+
+// syncConcurrent reads up to concurrency batches in one buffer transaction and
+// writes them to Kafka in parallel, as many at once as the worker pool allows.
+// Each batch deletes only its own events after its own write succeeds, so a
+// failed batch leaves the others unaffected.
+func (ks *KafkaSync) syncConcurrent(ctx context.Context) error {
+	batches, err := ks.readBatches(ks.concurrency)
 	if err != nil {
 		return fmt.Errorf("failed to get ready events from buffer: %w", err)
 	}
 
+	batches = ks.limitRetries(ks.limitInflight(batches))
+	defer metrics.SyncInflightBytes.Set(0)
+	if ks.config.PreserveOrder {
+		batches = ks.regroupByKey(batches)
+	}
+
+	group := ks.pool.Group(ctx)
+	for _, batch := range batches {
+		group.Go(func() error {
+			return ks.syncEvents(ctx, batch)
+		})
+	}
+	return group.Wait()
+}
+
+// readBatches reads up to n batches of ready events. With SYNC_TENANT_FIELD
+// set, the read skips past tenants that have used up their rate, so other
+// tenants' events behind them are still sent.
+func (ks *KafkaSync) readBatches(n int) ([][]*buffer.Event, error) {
+	var admit func(*buffer.Event) bool
+	if ks.tenants != nil {
+		admit = ks.tenants.admitter()
+	}
+	return ks.buffer.GetAdmittedEvents(ks.readBatchSize, ks.readMaxBytes, n, admit)
+}
+
+// limitInflight keeps the longest prefix of batches, in buffered order, whose
+// events fit in SYNC_MAX_INFLIGHT_BYTES, always including the first event so
+// an oversized one cannot stall the buffer. The events cut off stay buffered
+// for the next pass, which also keeps KAFKA_PRESERVE_ORDER intact.
+func (ks *KafkaSync) limitInflight(batches [][]*buffer.Event) [][]*buffer.Event {
+	maxInflightBytes := ks.runtime.Load().SyncMaxInflightBytes
+	total := 0
+	for i, batch := range batches {
+		for j, event := range batch {
+			if maxInflightBytes > 0 && total > 0 && total+event.Size() > maxInflightBytes {
+				deferred := len(batch) - j
+				for _, rest := range batches[i+1:] {
+					deferred += len(rest)
+				}
+				log.Printf("Sync pass reached SYNC_MAX_INFLIGHT_BYTES (%d bytes), deferring %d events to the next pass", total, deferred)
+				metrics.SyncInflightBytes.Set(float64(total))
+				if j == 0 {
+					return batches[:i]
+				}
+				return append(batches[:i:i], batch[:j])
+			}
+			total += event.Size()
+		}
+	}
+	metrics.SyncInflightBytes.Set(float64(total))
+	return batches
+}
+
+// newRetryBudget returns the token bucket for SYNC_RETRY_RATE, or nil when
+// retries are unlimited. The burst defaults to one second's worth of tokens.
+func newRetryBudget(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(perSecond))
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// limitRetries takes a token from the retry budget for every event that has
+// failed before, and ends the pass at the first one that gets none. Like
+// limitInflight it cuts a prefix, so the deferred events, fresh ones behind
+// them included, are read again next pass in their original order. This
+// keeps a struggling broker from being hammered by redeliveries.
+func (ks *KafkaSync) limitRetries(batches [][]*buffer.Event) [][]*buffer.Event {
+	if ks.retryBudget == nil {
+		return batches
+	}
+	for i, batch := range batches {
+		for j, event := range batch {
+			if event.Retries == 0 || ks.retryBudget.Allow() {
+				continue
+			}
+			deferred := len(batch) - j
+			for _, rest := range batches[i+1:] {
+				deferred += len(rest)
+			}
+			log.Printf("Retry budget exhausted, deferring %d events to a later pass", deferred)
+			metrics.RetriesDeferred.Add(float64(deferred))
+			if j == 0 {
+				return batches[:i]
+			}
+			return append(batches[:i:i], batch[:j])
+		}
+	}
+	return batches
+}
+
+// regroupByKey redistributes events so all events with the same message key
+// land in the same batch, in buffered order. Batches are written in parallel,
+// so splitting a key across them could reorder its changes.
+func (ks *KafkaSync) regroupByKey(batches [][]*buffer.Event) [][]*buffer.Event {
+	regrouped := make([][]*buffer.Event, len(batches))
+	for _, batch := range batches {
+		for _, event := range batch {
+			h := fnv.New32a()
+			h.Write(ks.messageKey(event))
+			i := h.Sum32() % uint32(len(regrouped))
+			regrouped[i] = append(regrouped[i], event)
+		}
+	}
+	return regrouped
+}
+
+// syncingLog and syncedLog sample the lines logged for every batch.
+var (
+	syncingLog = logging.NewSampler("batches synced")
+	syncedLog  = logging.NewSampler("batches fully delivered")
+)
+
+// syncEvents writes events to Kafka and every additional sink that has not yet
+// acknowledged them, and removes each event from the buffer once all sinks
+// have. Events that only some sinks took are marked so the next sync sends
+// them to the rest only.
+func (ks *KafkaSync) syncEvents(ctx context.Context, events []*buffer.Event) error {
+	events = ks.applyFilter(events)
+	events = ks.dropUnmarshallable(ctx, ks.dropUnroutable(ctx, events))
 	if len(events) == 0 {
 		return nil
 	}
 
-	log.Printf("Syncing %d events to Kafka", len(events))
+	syncingLog.Printf("Syncing %d events", len(events))
+
+	// acked holds the sinks that took each event during this sync, and
+	// failed the events a sink refused while taking others, which are the
+	// failures counted as a retry.
+	acked := make(map[*buffer.Event][]string)
+	failed := make(map[*buffer.Event]bool)
+	var errs []error
+
+	var primaryErr error
+	mirrored := false
+	for _, cluster := range ks.clusters {
+		pending := undelivered(events, cluster.name)
+		if len(pending) == 0 {
+			continue
+		}
+		delivered, refused, err := writeIsolating(ctx, pending, func(part []*buffer.Event) error {
+			// Events coalesced away are acknowledged with the ones that
+			// replaced them
+			if ks.config.CoalesceBatch {
+				part = coalesce(part)
+			}
+			return ks.writeKafka(ctx, cluster, part)
+		})
+		for _, event := range refused {
+			failed[event] = true
+		}
+		if len(delivered) > 0 && cluster.name != kafkaSinkName {
+			mirrored = true
+		}
+		for _, event := range delivered {
+			acked[event] = append(acked[event], cluster.name)
+		}
+		if err == nil {
+			continue
+		}
+		if cluster.name == kafkaSinkName {
+			primaryErr = fmt.Errorf("failed to write messages to Kafka: %w", err)
+			continue
+		}
+		// Mirrors do not trip the circuit breaker, which guards the
+		// primary, so err is not wrapped
+		metrics.SinkFailures.WithLabelValues(cluster.name).Inc()
+		errs = append(errs, fmt.Errorf("%w: %s: %v", ErrSinkWriteFailed, cluster.name, err))
+	}
+	if primaryErr != nil {
+		if mirrored && ks.config.ReplicationPolicy == ReplicationAny {
+			// A mirror took the events, so the breaker should stay closed
+			primaryErr = fmt.Errorf("%w: %v", ErrSinkWriteFailed, primaryErr)
+		}
+		errs = append(errs, primaryErr)
+	}
+
+	for _, sink := range ks.sinks {
+		pending := undelivered(events, sink.Name())
+		if len(pending) == 0 {
+			continue
+		}
+		delivered, refused, err := writeIsolating(ctx, pending, func(part []*buffer.Event) error {
+			return sink.Write(ctx, part)
+		})
+		for _, event := range refused {
+			failed[event] = true
+		}
+		for _, event := range delivered {
+			acked[event] = append(acked[event], sink.Name())
+		}
+		if err != nil {
+			metrics.SinkFailures.WithLabelValues(sink.Name()).Inc()
+			errs = append(errs, fmt.Errorf("%w: %s: %w", ErrSinkWriteFailed, sink.Name(), err))
+		}
+	}
+
+	var synced []*buffer.Event
+	now := time.Now()
+	for _, event := range events {
+		remaining := ks.remainingSinks(event, acked[event])
+		if len(remaining) == 0 {
+			metrics.EventsSynced.WithLabelValues(event.Operation).Inc()
+			metrics.EventAge.Observe(now.Sub(event.Timestamp).Seconds())
+			synced = append(synced, event)
+			continue
+		}
+
+		if len(acked[event]) > 0 {
+			err := ks.buffer.MarkDelivered(event, acked[event])
+			if err != nil && !errors.Is(err, buffer.ErrEventNotFound) {
+				log.Printf("Failed to record delivery of event %s: %v", event.ID, err)
+			}
+		}
+		if failed[event] {
+			ks.retryLater(ctx, event, remaining)
+		}
+	}
+
+	if len(synced) > 0 {
+		if _, err := ks.buffer.DeleteBatch(synced); err != nil {
+			log.Printf("Failed to delete synced events from buffer: %v", err)
+		}
+		syncedLog.Printf("Successfully synced %d events", len(synced))
+		if ks.bus != nil {
+			ks.bus.Publish(sinkPayload(synced))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// dropUnroutable dead-letters the events whose collection does not make a
+// valid topic name and returns the rest. Events from the configured
+// collection always route, since its topic is validated at startup.
+func (ks *KafkaSync) dropUnroutable(ctx context.Context, events []*buffer.Event) []*buffer.Event {
+	if !ks.topics.perEvent() {
+		return events
+	}
+	routable := events[:0:0]
+	for _, event := range events {
+		if _, err := ks.topics.topicFor(event); err != nil {
+			ks.deadLetter(ctx, event, err.Error())
+			continue
+		}
+		routable = append(routable, event)
+	}
+	return routable
+}
+
+// dropUnmarshallable dead-letters the events that cannot be encoded as a
+// message value, such as a BSON-buffered NaN, and returns the rest. They are
+// dropped before anything is written so no sink takes them either.
+func (ks *KafkaSync) dropUnmarshallable(ctx context.Context, events []*buffer.Event) []*buffer.Event {
+	valid := events[:0:0]
+	for _, event := range events {
+		if _, err := json.Marshal(withoutBookkeeping(event)); err != nil {
+			ks.deadLetter(ctx, event, fmt.Sprintf("cannot be encoded as JSON: %v", err))
+			continue
+		}
+		valid = append(valid, event)
+	}
+	return valid
+}
+
+// undelivered returns the events sink has not acknowledged yet.
+func undelivered(events []*buffer.Event, sink string) []*buffer.Event {
+	var pending []*buffer.Event
+	for _, event := range events {
+		if !event.DeliveredTo(sink) {
+			pending = append(pending, event)
+		}
+	}
+	return pending
+}
+
+// writeIsolating writes events with write and returns the events delivered.
+// When the write fails for a reason worth retrying, isolateFailures tells
+// events the sink refuses from a sink that is down: failed holds the events
+// refused while the sink took others, and is empty in an outage, so an outage
+// does not count against the events it holds up. Once the sink has been seen
+// to take writes, err no longer wraps ErrSinkUnavailable, as there is no
+// outage for the circuit breaker to guard against.
+func writeIsolating(ctx context.Context, events []*buffer.Event, write func([]*buffer.Event) error) (delivered, failed []*buffer.Event, err error) {
+	err = write(events)
+	if err == nil {
+		return events, nil, nil
+	}
+	if ctx.Err() != nil || errors.Is(err, ErrMessageRejected) {
+		// Rejected events are already dead-lettered and the rest of the
+		// batch is not at fault
+		return nil, nil, err
+	}
+	delivered, failed, up := isolateFailures(ctx, events, write, false)
+	if !up {
+		return nil, nil, err
+	}
+	return delivered, failed, fmt.Errorf("%d of %d events failed: %v", len(failed), len(events), err)
+}
+
+// isolateFailures splits events that failed to write as a whole in halves and
+// writes each. up says whether the sink is known to take writes; if it is not
+// and both halves fail too, the sink is taken to be down and nothing is split
+// further. Otherwise failing halves are split down to the single events the
+// sink keeps refusing, which are returned as failed. A half Kafka rejects in
+// part has its rejected events dead-lettered and the rest left for the next
+// sync, in neither list.
+func isolateFailures(ctx context.Context, events []*buffer.Event, write func([]*buffer.Event) error, up bool) (delivered, failed []*buffer.Event, sinkUp bool) {
+	if len(events) < 2 || ctx.Err() != nil {
+		return nil, events, up
+	}
+	var retry [][]*buffer.Event
+	for _, half := range [][]*buffer.Event{events[:len(events)/2], events[len(events)/2:]} {
+		err := write(half)
+		switch {
+		case err == nil:
+			delivered = append(delivered, half...)
+			up = true
+		case errors.Is(err, ErrMessageRejected):
+			up = true
+		default:
+			retry = append(retry, half)
+		}
+	}
+	if !up {
+		return nil, events, false
+	}
+	for _, half := range retry {
+		d, f, _ := isolateFailures(ctx, half, write, true)
+		delivered = append(delivered, d...)
+		failed = append(failed, f...)
+	}
+	return delivered, failed, true
+}
+
+// remainingSinks returns the sinks that have acknowledged event neither in an
+// earlier sync nor in acked, with the Kafka clusters KAFKA_REPLICATION_POLICY
+// still waits for.
+func (ks *KafkaSync) remainingSinks(event *buffer.Event, acked []string) []string {
+	remaining := ks.pendingClusters(event, acked)
+	for _, sink := range ks.sinks {
+		if !event.DeliveredTo(sink.Name()) && !slices.Contains(acked, sink.Name()) {
+			remaining = append(remaining, sink.Name())
+		}
+	}
+	return remaining
+}
+
+// writeKafka writes events to cluster, returning once every message has been
+// acknowledged or the write has failed.
+func (ks *KafkaSync) writeKafka(ctx context.Context, cluster *kafkaCluster, events []*buffer.Event) error {
+	messages, sent, err := ks.buildMessages(ctx, events)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+
+	if err := ks.writeWithRetry(ctx, cluster, messages, sent); err != nil {
+		return err
+	}
+	// Only the primary's writer collects checkpoints
+	if cluster.name == kafkaSinkName {
+		ks.recordCheckpoints()
+	}
+	return nil
+}
 
+// buildMessages turns events into Kafka messages, returning with them the
+// event behind each. Events that cannot be marshalled are logged and left
+// out; the sync paths dead-letter them beforehand with dropUnmarshallable.
+// The messages of one call share a stickyBatch as their WriterData.
+func (ks *KafkaSync) buildMessages(ctx context.Context, events []*buffer.Event) ([]kafka.Message, []*buffer.Event, error) {
 	var messages []kafka.Message
+	// sent[i] is the event behind messages[i]
+	var sent []*buffer.Event
+	batch := stickyBatch(ks.batches.Add(1) - 1)
 	for _, event := range events {
-		value, err := json.Marshal(event)
+		value, err := json.Marshal(withoutBookkeeping(event))
 		if err != nil {
 			log.Printf("Failed to marshal event %s: %v", event.ID, err)
 			continue
 		}
 
-		messages = append(messages, kafka.Message{
-			Key:   []byte(event.ID),
+		msg := kafka.Message{
+			Key:   ks.messageKey(event),
 			Value: value,
+			Time:  ks.messageTime(event),
 			Headers: []kafka.Header{
+				{Key: "id", Value: []byte(event.ID)},
 				{Key: "operation", Value: []byte(event.Operation)},
 				{Key: "timestamp", Value: []byte(event.Timestamp.Format(time.RFC3339))},
 			},
-		})
+			WriterData: batch,
+		}
+		if ks.config.RetryHeader != "" {
+			msg.Headers = append(msg.Headers, kafka.Header{Key: ks.config.RetryHeader, Value: []byte(strconv.Itoa(event.Retries))})
+		}
+		if key, ok := ks.tombstoneKey(event); ok {
+			msg.Key, msg.Value = key, nil
+		} else if ks.claims != nil {
+			value, url, err := ks.claims.apply(ctx, event, msg.Value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if url != "" {
+				msg.Value = value
+				msg.Headers = append(msg.Headers, kafka.Header{Key: "claim-check", Value: []byte(url)})
+				metrics.ClaimChecks.Inc()
+			}
+		}
+		if ks.signer != nil {
+			ks.signer.sign(&msg)
+		}
+		if ks.topics.perEvent() {
+			// dropUnroutable has already removed events without a valid topic
+			msg.Topic, _ = ks.topics.topicFor(event)
+		}
+		messages = append(messages, msg)
+		sent = append(sent, event)
 	}
+	return messages, sent, nil
+}
 
-	if len(messages) == 0 {
-		return nil
+// retryLater counts a failed sync against event, dead-lettering it once it
+// reaches BUFFER_MAX_REDELIVERIES so an event a sink keeps refusing cannot
+// stay in the buffer forever. It is only called for failures pinned on the
+// event by writeIsolating, never for an outage. pending names the sinks still
+// missing it.
+func (ks *KafkaSync) retryLater(ctx context.Context, event *buffer.Event, pending []string) {
+	if max := ks.runtime.Load().MaxRedeliveries; max > 0 && event.Retries+1 >= max {
+		event.Retries++
+		reason := fmt.Sprintf("gave up after %d failed syncs to %s", event.Retries, strings.Join(pending, ", "))
+		ks.deadLetter(ctx, event, reason)
+		return
 	}
 
-	err = ks.writeWithRetry(ctx, messages, events)
-	if err != nil {
-		return fmt.Errorf("failed to write messages to Kafka: %w", err)
+	err := ks.buffer.UpdateRetries(event, event.Retries+1)
+	if err != nil && !errors.Is(err, buffer.ErrEventNotFound) {
+		log.Printf("Failed to update retry count for event %s: %v", event.ID, err)
 	}
+}
 
-	for _, event := range events {
-		if err := ks.buffer.Delete(event.ID, event.Timestamp); err != nil {
-			log.Printf("Failed to delete event %s from buffer: %v", event.ID, err)
+// createTopics creates the topics of messages that KAFKA_CREATE_TOPIC has not
+// created yet. A failure is only logged: the write then fails and is retried
+// like any other, and creation is attempted again with the next batch.
+func (ks *KafkaSync) createTopics(ctx context.Context, cluster *kafkaCluster, messages []kafka.Message) {
+	if cluster.creator == nil {
+		return
+	}
+	topics := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		topic := msg.Topic
+		if topic == "" {
+			topic = cluster.writer.Topic
 		}
+		topics = append(topics, topic)
+	}
+	if err := cluster.creator.ensure(ctx, topics); err != nil {
+		log.Printf("Failed to create Kafka topics: %v", err)
 	}
-
-	log.Printf("Successfully synced %d events to Kafka", len(events))
-	return nil
 }
 
-func (ks *KafkaSync) writeWithRetry(ctx context.Context, messages []kafka.Message, events []*buffer.Event) error {
+func (ks *KafkaSync) writeWithRetry(ctx context.Context, cluster *kafkaCluster, messages []kafka.Message, events []*buffer.Event) error {
+	ks.createTopics(ctx, cluster, messages)
 	backoff := time.Second
 
 	for attempt := 0; attempt < ks.config.Retries; attempt++ {
@@ -169,12 +1272,19 @@ func (ks *KafkaSync) writeWithRetry(ctx context.Context, messages []kafka.Messag
 			}
 		}
 
-		err := ks.writer.WriteMessages(ctx, messages...)
+		started := time.Now()
+		err := cluster.writer.WriteMessages(ctx, messages...)
+		ks.checkSlowWrite(time.Since(started), events, err)
 		if err == nil {
 			return nil
 		}
 
-		log.Printf("Kafka write attempt %d failed: %v", attempt+1, err)
+		if rejected := permanentFailures(err, messages); rejected != nil {
+			ks.deadLetterRejected(ctx, events, rejected)
+			return fmt.Errorf("%w: %w", ErrMessageRejected, err)
+		}
+
+		log.Printf("Kafka write attempt %d to %s failed: %v", attempt+1, cluster.name, err)
 
 		if !ks.connMonitor.IsOnline() {
 			log.Println("Connection lost during Kafka write, will retry when online")
@@ -182,16 +1292,205 @@ func (ks *KafkaSync) writeWithRetry(ctx context.Context, messages []kafka.Messag
 		}
 	}
 
-	for _, event := range events {
-		if err := ks.buffer.UpdateRetries(event.ID, event.Timestamp, event.Retries+1); err != nil {
-			log.Printf("Failed to update retry count for event %s: %v", event.ID, err)
+	return fmt.Errorf("%w: write failed after %d retries", ErrSinkUnavailable, ks.config.Retries)
+}
+
+// checkSlowWrite logs a write attempt that took longer than
+// SLOW_WRITE_THRESHOLD, naming its events so latency spikes can be tied to
+// specific documents.
+func (ks *KafkaSync) checkSlowWrite(took time.Duration, events []*buffer.Event, err error) {
+	threshold := ks.config.SlowWriteThreshold
+	if threshold <= 0 || took <= threshold {
+		return
+	}
+	metrics.KafkaSlowWrites.Inc()
+
+	ids := make([]string, 0, min(len(events), maxSlowWriteLogged))
+	for _, event := range events[:min(len(events), maxSlowWriteLogged)] {
+		ids = append(ids, event.ID)
+	}
+	more := ""
+	if len(events) > maxSlowWriteLogged {
+		more = fmt.Sprintf(" and %d more", len(events)-maxSlowWriteLogged)
+	}
+	outcome := "succeeded"
+	if err != nil {
+		outcome = "failed"
+	}
+	log.Printf("WARNING: Slow Kafka write: %d messages took %s (threshold %s) and %s; events %s%s",
+		len(events), took.Round(time.Millisecond), threshold, outcome, strings.Join(ids, ", "), more)
+}
+
+// permanentFailures returns, for each message, the error that retrying cannot
+// fix (such as an oversized message) or nil if it may still succeed. It returns
+// nil when every failure may be transient, so the whole batch should be retried.
+func permanentFailures(err error, messages []kafka.Message) []error {
+	failed := make([]error, len(messages))
+
+	var writeErrs kafka.WriteErrors
+	var tooLarge kafka.MessageTooLargeError
+	switch {
+	case errors.As(err, &writeErrs):
+		any := false
+		for i, msgErr := range writeErrs {
+			if i < len(failed) && msgErr != nil && isPermanent(msgErr) {
+				failed[i] = msgErr
+				any = true
+			}
 		}
+		if !any {
+			return nil
+		}
+	case errors.As(err, &tooLarge):
+		// The writer checks sizes before sending anything and only reports
+		// the offending message, so find it by event ID
+		id := headerValue(tooLarge.Message, "id")
+		for i := range messages {
+			if headerValue(messages[i], "id") == id {
+				failed[i] = tooLarge
+				return failed
+			}
+		}
+		return nil
+	case isPermanent(err):
+		for i := range failed {
+			failed[i] = err
+		}
+	default:
+		return nil
+	}
+
+	return failed
+}
+
+// isPermanent reports whether err is a Kafka protocol error that the broker
+// will return again on retry. Errors without a Kafka code, such as network
+// failures, are treated as transient.
+func isPermanent(err error) bool {
+	var kafkaErr kafka.Error
+	if errors.As(err, &kafkaErr) {
+		return !kafkaErr.Temporary()
 	}
+	return false
+}
 
-	return fmt.Errorf("failed to write to Kafka after %d retries", ks.config.Retries)
+// deadLetterRejected moves the events whose messages were permanently rejected
+// to the dead-letter bucket. The rest of the batch stays buffered for the next
+// sync without having its retry count bumped.
+func (ks *KafkaSync) deadLetterRejected(ctx context.Context, events []*buffer.Event, rejected []error) {
+	for i, event := range events {
+		if rejected[i] == nil {
+			continue
+		}
+		log.Printf("Event %s rejected by Kafka: %v", event.ID, rejected[i])
+		ks.deadLetter(ctx, event, rejected[i].Error())
+	}
+}
+
+// deadLetter takes event out of the delivery path. With KAFKA_DLQ_TOPIC set it
+// is published there and deleted from the buffer; if that publish fails, or
+// no topic is set, it moves to the local dead-letter bucket instead.
+func (ks *KafkaSync) deadLetter(ctx context.Context, event *buffer.Event, reason string) {
+	if ks.dlqWriter != nil {
+		err := ks.publishDeadLetter(ctx, event, reason)
+		if err == nil {
+			if err := ks.buffer.Delete(event); err != nil && !errors.Is(err, buffer.ErrEventNotFound) {
+				log.Printf("Failed to delete dead-lettered event %s from buffer: %v", event.ID, err)
+			}
+			log.Printf("Event %s published to dead-letter topic %s: %s", event.ID, ks.dlqWriter.Topic, reason)
+			return
+		}
+		log.Printf("Failed to publish event %s to dead-letter topic %s, keeping it locally: %v", event.ID, ks.dlqWriter.Topic, err)
+	}
+
+	if err := ks.buffer.MoveToDeadLetter(event, reason); err != nil {
+		log.Printf("Failed to dead-letter event %s: %v", event.ID, err)
+		return
+	}
+	log.Printf("Event %s moved to dead-letter: %s", event.ID, reason)
+}
+
+// publishDeadLetter writes event to the DLQ topic with the reason and retry
+// count as headers, alongside the usual id, operation and timestamp.
+func (ks *KafkaSync) publishDeadLetter(ctx context.Context, event *buffer.Event, reason string) error {
+	value, err := json.Marshal(withoutBookkeeping(event))
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	// Unroutable events have no source topic; the reason names the invalid one
+	sourceTopic, _ := ks.topics.topicFor(event)
+	if ks.creator != nil {
+		if err := ks.creator.ensure(ctx, []string{ks.dlqWriter.Topic}); err != nil {
+			log.Printf("Failed to create Kafka topics: %v", err)
+		}
+	}
+
+	msg := kafka.Message{
+		Key:   ks.messageKey(event),
+		Value: value,
+		Time:  ks.messageTime(event),
+		Headers: []kafka.Header{
+			{Key: "id", Value: []byte(event.ID)},
+			{Key: "operation", Value: []byte(event.Operation)},
+			{Key: "timestamp", Value: []byte(event.Timestamp.Format(time.RFC3339))},
+			{Key: "dlq-reason", Value: []byte(reason)},
+			{Key: "dlq-retries", Value: []byte(strconv.Itoa(event.Retries))},
+			{Key: "dlq-source-topic", Value: []byte(sourceTopic)},
+		},
+	}
+	if ks.signer != nil {
+		ks.signer.sign(&msg)
+	}
+	return ks.dlqWriter.WriteMessages(ctx, msg)
+}
+
+// ReportStats samples the writer's statistics into logs and metrics. The
+// writer resets its counters on every sample, so each call covers the period
+// since the previous one. It matches scheduler.Task so it can run on a schedule.
+func (ks *KafkaSync) ReportStats(ctx context.Context) error {
+	stats := ks.writer.Stats()
+
+	metrics.KafkaWrites.Add(float64(stats.Writes))
+	metrics.KafkaMessages.Add(float64(stats.Messages))
+	metrics.KafkaBytes.Add(float64(stats.Bytes))
+	metrics.KafkaErrors.Add(float64(stats.Errors))
+	metrics.KafkaRetries.Add(float64(stats.Retries))
+	metrics.KafkaBatchSeconds.Set(stats.BatchTime.Avg.Seconds())
+	metrics.KafkaWriteSeconds.Set(stats.WriteTime.Avg.Seconds())
+	metrics.KafkaBatchSize.Set(float64(stats.BatchSize.Avg))
+
+	if stats.Writes > 0 || stats.Errors > 0 {
+		log.Printf("Kafka writer statistics - Writes: %d, Messages: %d, Bytes: %d, Errors: %d, Retries: %d, Avg batch time: %v, Avg write time: %v",
+			stats.Writes, stats.Messages, stats.Bytes, stats.Errors, stats.Retries, stats.BatchTime.Avg, stats.WriteTime.Avg)
+	}
+	return nil
+}
+
+// EventBus returns the bus synced events are published on, or nil when
+// SINK_BUS_BUFFER is not set.
+func (ks *KafkaSync) EventBus() *EventBus {
+	return ks.bus
 }
 
 func (ks *KafkaSync) Close() error {
+	if ks.bus != nil {
+		ks.bus.Close()
+	}
+	for _, sink := range ks.sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Failed to close sink %s: %v", sink.Name(), err)
+		}
+	}
+	for _, cluster := range ks.clusters[min(1, len(ks.clusters)):] {
+		if err := cluster.writer.Close(); err != nil {
+			log.Printf("Failed to close writer of %s: %v", cluster.name, err)
+		}
+	}
+	if ks.dlqWriter != nil {
+		if err := ks.dlqWriter.Close(); err != nil {
+			log.Printf("Failed to close dead-letter writer: %v", err)
+		}
+	}
 	if ks.writer != nil {
 		return ks.writer.Close()
 	}
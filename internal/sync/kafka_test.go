@@ -0,0 +1,1828 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/clock"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/metrics"
+	"buffered-cdc/internal/monitor"
+	"buffered-cdc/internal/scheduler"
+	"buffered-cdc/internal/workers"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/createtopics"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bufferWithNaN returns a buffer holding a "good" event and a "nan" one that
+// BSON stores but JSON cannot encode, and the two as read back.
+func bufferWithNaN(t *testing.T) (*buffer.Buffer, []*buffer.Event) {
+	t.Helper()
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), &buffer.Options{Timeout: time.Second, Codec: buffer.CodecBSON})
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	t.Cleanup(func() { buf.Close() })
+
+	for _, event := range []*buffer.Event{
+		{ID: "good", Operation: "insert", Timestamp: time.Now(), Data: map[string]interface{}{"total": 1.5}},
+		{ID: "nan", Operation: "insert", Timestamp: time.Now(), Data: map[string]interface{}{"total": math.NaN()}},
+	} {
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store %s: %v", event.ID, err)
+		}
+	}
+	events, err := buf.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	return buf, events
+}
+
+func deadLetteredIDs(t *testing.T, buf *buffer.Buffer) []string {
+	t.Helper()
+	var ids []string
+	if err := buf.ForEach(true, func(event *buffer.Event) error {
+		ids = append(ids, event.ID)
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	return ids
+}
+
+func TestDropUnmarshallableDeadLetters(t *testing.T) {
+	buf, events := bufferWithNaN(t)
+
+	ks := &KafkaSync{buffer: buf}
+	valid := ks.dropUnmarshallable(context.Background(), events)
+	if len(valid) != 1 || valid[0].ID != "good" {
+		t.Fatalf("dropUnmarshallable kept %v, want only good", valid)
+	}
+
+	if deadLettered := deadLetteredIDs(t, buf); len(deadLettered) != 1 || deadLettered[0] != "nan" {
+		t.Fatalf("dead-lettered %v, want nan", deadLetteredIDs(t, buf))
+	}
+
+	// Read again, only the good event is left to sync
+	remaining, err := buf.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if len(remaining) != 1 || remaining[0].ID != "good" {
+		t.Fatalf("queued after dropping %v, want only good", remaining)
+	}
+}
+
+func TestSyncEventsDeadLettersUnmarshallable(t *testing.T) {
+	buf, events := bufferWithNaN(t)
+
+	// With no clusters or sinks left to wait for, the good event counts as
+	// delivered and is deleted
+	ks := &KafkaSync{buffer: buf, config: &config.KafkaConfig{}, topics: &topicRouter{}}
+	if err := ks.syncEvents(context.Background(), events); err != nil {
+		t.Fatalf("syncEvents: %v", err)
+	}
+
+	if count, err := buf.Count(); err != nil || count != 0 {
+		t.Fatalf("Count after sync = %d, %v; want 0", count, err)
+	}
+	if deadLettered := deadLetteredIDs(t, buf); len(deadLettered) != 1 || deadLettered[0] != "nan" {
+		t.Fatalf("dead-lettered %v, want nan", deadLettered)
+	}
+}
+
+// recordingSink records the events written to it. fail, when set, decides
+// whether a write fails; delay is slept per write, standing in for a network
+// round trip. name defaults to "recording".
+type recordingSink struct {
+	name  string
+	fail  func([]*buffer.Event) bool
+	delay time.Duration
+
+	mu      gosync.Mutex
+	written map[string]int
+}
+
+func (s *recordingSink) Name() string {
+	if s.name == "" {
+		return "recording"
+	}
+	return s.name
+}
+func (s *recordingSink) Close() error { return nil }
+
+func (s *recordingSink) Write(ctx context.Context, events []*buffer.Event) error {
+	time.Sleep(s.delay)
+	if s.fail != nil && s.fail(events) {
+		return errors.New("write failed")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.written == nil {
+		s.written = make(map[string]int)
+	}
+	for _, event := range events {
+		s.written[event.ID]++
+	}
+	return nil
+}
+
+// newConcurrentSync returns a sync with no Kafka clusters that writes up to
+// concurrency batches of batchSize events to sink at once.
+func newConcurrentSync(buf *buffer.Buffer, sink Sink, concurrency, batchSize int) *KafkaSync {
+	runtime := &atomic.Pointer[config.Runtime]{}
+	runtime.Store(&config.Runtime{SyncBatchesPerTick: 1})
+	return &KafkaSync{
+		buffer:        buf,
+		config:        &config.KafkaConfig{},
+		topics:        &topicRouter{},
+		sinks:         []Sink{sink},
+		pool:          workers.New(concurrency),
+		readBatchSize: batchSize,
+		concurrency:   concurrency,
+		runtime:       runtime,
+	}
+}
+
+// fakeBroker is an in-memory Kafka cluster for kafka-go clients. It answers
+// metadata, produce and create-topics requests, records the messages
+// produced, and serves them back to fetch and list-offsets requests. A
+// message's offset is its index among every message produced. Topics are
+// created on first use unless strict is set.
+type fakeBroker struct {
+	partitions int
+	strict     bool
+	// fail, when set, returns the error code a produce to topic fails with,
+	// or 0 to accept it. down fails every request as if unreachable.
+	fail func(topic string) kafka.Error
+	down atomic.Bool
+	// calls counts every request, including those refused while down.
+	calls atomic.Int32
+	// denied lists topics the client is not authorized for.
+	denied map[string]bool
+
+	mu       gosync.Mutex
+	topics   map[string]bool
+	created  []string
+	produced []producedMessage
+	requests int
+	// creates lists every topic asked to be created, whether or not it
+	// already existed.
+	creates []createtopics.RequestTopic
+}
+
+// producedMessage is one record a fakeBroker accepted.
+type producedMessage struct {
+	Topic     string
+	Partition int
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+	Time      time.Time
+	// Request numbers the produce request the record came in.
+	Request int
+	// appended is when the broker stored the message, which time lookups
+	// go by, as for a topic with log append time.
+	appended time.Time
+	// lost hides the message from fetches, as if the broker had dropped it
+	// after accepting it.
+	lost bool
+}
+
+func newFakeBroker(partitions int, topics ...string) *fakeBroker {
+	b := &fakeBroker{partitions: partitions, topics: make(map[string]bool)}
+	for _, topic := range topics {
+		b.topics[topic] = true
+	}
+	return b
+}
+
+func (b *fakeBroker) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	b.calls.Add(1)
+	if b.down.Load() {
+		return nil, errors.New("fake broker: connection refused")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch req := req.(type) {
+	case *metadata.Request:
+		res := &metadata.Response{Brokers: []metadata.ResponseBroker{{NodeID: 1, Host: "fake", Port: 9092}}, ControllerID: 1}
+		for _, name := range req.TopicNames {
+			topic := metadata.ResponseTopic{Name: name}
+			if b.denied[name] {
+				topic.ErrorCode = int16(kafka.TopicAuthorizationFailed)
+			} else if b.strict && !b.topics[name] {
+				topic.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+			} else {
+				for p := 0; p < b.partitions; p++ {
+					topic.Partitions = append(topic.Partitions, metadata.ResponsePartition{PartitionIndex: int32(p), LeaderID: 1})
+				}
+			}
+			res.Topics = append(res.Topics, topic)
+		}
+		return res, nil
+
+	case *createtopics.Request:
+		res := &createtopics.Response{}
+		for _, topic := range req.Topics {
+			b.creates = append(b.creates, topic)
+			code := int16(0)
+			if b.topics[topic.Name] {
+				code = int16(kafka.TopicAlreadyExists)
+			} else {
+				b.topics[topic.Name] = true
+				b.created = append(b.created, topic.Name)
+			}
+			res.Topics = append(res.Topics, createtopics.ResponseTopic{Name: topic.Name, ErrorCode: code})
+		}
+		return res, nil
+
+	case *produce.Request:
+		b.requests++
+		res := &produce.Response{}
+		for _, topic := range req.Topics {
+			rt := produce.ResponseTopic{Topic: topic.Topic}
+			for _, partition := range topic.Partitions {
+				rp := produce.ResponsePartition{Partition: partition.Partition, BaseOffset: int64(len(b.produced))}
+				if b.fail != nil {
+					rp.ErrorCode = int16(b.fail(topic.Topic))
+				}
+				if rp.ErrorCode == 0 {
+					if err := b.record(topic.Topic, int(partition.Partition), partition.RecordSet.Records); err != nil {
+						return nil, err
+					}
+				}
+				rt.Partitions = append(rt.Partitions, rp)
+			}
+			res.Topics = append(res.Topics, rt)
+		}
+		return res, nil
+
+	case *fetch.Request:
+		return b.fetch(req), nil
+
+	case *listoffsets.Request:
+		return b.listOffsets(req), nil
+	}
+	return nil, fmt.Errorf("fake broker: unsupported request %T", req)
+}
+
+// fetch returns the messages of each requested partition from the fetch
+// offset on.
+func (b *fakeBroker) fetch(req *fetch.Request) *fetch.Response {
+	res := &fetch.Response{}
+	for _, topic := range req.Topics {
+		rt := fetch.ResponseTopic{Topic: topic.Topic}
+		for _, partition := range topic.Partitions {
+			var records []protocol.Record
+			for offset := partition.FetchOffset; offset < int64(len(b.produced)); offset++ {
+				msg := b.produced[offset]
+				if msg.lost || msg.Topic != topic.Topic || msg.Partition != int(partition.Partition) {
+					continue
+				}
+				record := protocol.Record{Offset: offset, Time: msg.Time, Key: protocol.NewBytes(msg.Key), Value: protocol.NewBytes(msg.Value)}
+				for key, value := range msg.Headers {
+					record.Headers = append(record.Headers, protocol.Header{Key: key, Value: []byte(value)})
+				}
+				records = append(records, record)
+			}
+			rt.Partitions = append(rt.Partitions, fetch.ResponsePartition{
+				Partition:     partition.Partition,
+				HighWatermark: int64(len(b.produced)),
+				RecordSet:     protocol.RecordSet{Version: 2, Records: protocol.NewRecordReader(records...)},
+			})
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	return res
+}
+
+// listOffsets answers first and last offset lookups, and time lookups with
+// the first message of the partition at or after the time.
+func (b *fakeBroker) listOffsets(req *listoffsets.Request) *listoffsets.Response {
+	res := &listoffsets.Response{}
+	for _, topic := range req.Topics {
+		rt := listoffsets.ResponseTopic{Topic: topic.Topic}
+		for _, partition := range topic.Partitions {
+			rp := listoffsets.ResponsePartition{Partition: partition.Partition, Timestamp: partition.Timestamp, Offset: -1}
+			switch partition.Timestamp {
+			case kafka.FirstOffset:
+				rp.Offset = 0
+			case kafka.LastOffset:
+				rp.Offset = int64(len(b.produced))
+			default:
+				for offset, msg := range b.produced {
+					if msg.Topic == topic.Topic && msg.Partition == int(partition.Partition) && msg.appended.UnixMilli() >= partition.Timestamp {
+						rp.Offset = int64(offset)
+						break
+					}
+				}
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		res.Topics = append(res.Topics, rt)
+	}
+	return res
+}
+
+// lose hides the messages of events ids from later fetches.
+func (b *fakeBroker) lose(ids ...string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.produced {
+		if slices.Contains(ids, b.produced[i].Headers["id"]) {
+			b.produced[i].lost = true
+		}
+	}
+}
+
+// record stores the records of one produced partition.
+func (b *fakeBroker) record(topic string, partition int, records protocol.RecordReader) error {
+	for {
+		rec, err := records.ReadRecord()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		msg := producedMessage{Topic: topic, Partition: partition, Time: rec.Time, Headers: make(map[string]string), Request: b.requests, appended: time.Now()}
+		if msg.Key, err = protocol.ReadAll(rec.Key); err != nil {
+			return err
+		}
+		if msg.Value, err = protocol.ReadAll(rec.Value); err != nil {
+			return err
+		}
+		for _, header := range rec.Headers {
+			msg.Headers[header.Key] = string(header.Value)
+		}
+		b.produced = append(b.produced, msg)
+	}
+}
+
+// messages returns the messages produced so far.
+func (b *fakeBroker) messages() []producedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.produced)
+}
+
+// serve points the writer and topic creator of cluster at b. The writer
+// tries each write once, leaving retries to writeWithRetry.
+func (b *fakeBroker) serve(cluster *kafkaCluster) {
+	cluster.writer.Transport = b
+	cluster.writer.MaxAttempts = 1
+	if cluster.creator != nil {
+		cluster.creator.client.Transport = b
+	}
+}
+
+// newBrokerSync builds a KafkaSync with NewKafkaSync from the environment,
+// overridden by env entries of the form KEY=value, and serves every cluster
+// and the dead-letter writer from broker.
+func newBrokerSync(t *testing.T, buf *buffer.Buffer, broker *fakeBroker, env ...string) *KafkaSync {
+	t.Helper()
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("KAFKA_BROKERS", "fake:9092")
+	t.Setenv("KAFKA_RETRIES", "1")
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		t.Setenv(key, value)
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	connMonitor, err := monitor.NewConnectivityMonitor(cfg)
+	if err != nil {
+		t.Fatalf("NewConnectivityMonitor: %v", err)
+	}
+	ks, err := NewKafkaSync(cfg, buf, connMonitor, workers.New(4))
+	if err != nil {
+		t.Fatalf("NewKafkaSync: %v", err)
+	}
+	t.Cleanup(func() { ks.Close() })
+
+	for _, cluster := range ks.clusters {
+		broker.serve(cluster)
+	}
+	if ks.dlqWriter != nil {
+		ks.dlqWriter.Transport = broker
+		ks.dlqWriter.MaxAttempts = 1
+	}
+	return ks
+}
+
+// newTestBuffer opens a buffer in a temporary directory for the test.
+func newTestBuffer(t testing.TB) *buffer.Buffer {
+	t.Helper()
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), &buffer.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	t.Cleanup(func() { buf.Close() })
+	return buf
+}
+
+func storeEvents(t testing.TB, buf *buffer.Buffer, n int) {
+	t.Helper()
+	base := time.Now()
+	for i := 0; i < n; i++ {
+		event := &buffer.Event{ID: fmt.Sprintf("e%03d", i), Operation: "insert", Timestamp: base.Add(time.Duration(i) * time.Microsecond)}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+}
+
+func TestSyncConcurrentDeliversEachEventOnce(t *testing.T) {
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	defer buf.Close()
+	const n = 95
+	storeEvents(t, buf, n)
+
+	sink := &recordingSink{}
+	ks := newConcurrentSync(buf, sink, 4, 10)
+	for pass := 0; pass < 10; pass++ {
+		if err := ks.syncConcurrent(context.Background()); err != nil {
+			t.Fatalf("syncConcurrent: %v", err)
+		}
+		if count, _ := buf.Count(); count == 0 {
+			break
+		}
+	}
+
+	if count, err := buf.Count(); err != nil || count != 0 {
+		t.Fatalf("Count after syncing = %d, %v; want 0", count, err)
+	}
+	if len(sink.written) != n {
+		t.Fatalf("sink received %d distinct events, want %d", len(sink.written), n)
+	}
+	for id, times := range sink.written {
+		if times != 1 {
+			t.Errorf("event %s written %d times, want once", id, times)
+		}
+	}
+}
+
+// refuse returns a recordingSink fail func that fails every write holding
+// one of ids.
+func refuse(ids ...string) func([]*buffer.Event) bool {
+	return func(events []*buffer.Event) bool {
+		for _, event := range events {
+			if slices.Contains(ids, event.ID) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// buffered returns the events left in buf, or its dead-lettered events, by ID.
+func buffered(t *testing.T, buf *buffer.Buffer, deadLetter bool) map[string]*buffer.Event {
+	t.Helper()
+	events := make(map[string]*buffer.Event)
+	if err := buf.ForEach(deadLetter, func(event *buffer.Event) error {
+		events[event.ID] = event
+		return nil
+	}); err != nil {
+		t.Fatalf("ForEach: %v", err)
+	}
+	return events
+}
+
+func TestSyncConcurrentIsolatesRefusedEvent(t *testing.T) {
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	defer buf.Close()
+	storeEvents(t, buf, 40)
+
+	// One pass reads four batches of ten; the sink refuses e015 only
+	sink := &recordingSink{fail: refuse("e015")}
+	ks := newConcurrentSync(buf, sink, 4, 10)
+	if err := ks.syncConcurrent(context.Background()); !errors.Is(err, ErrSinkWriteFailed) {
+		t.Fatalf("syncConcurrent = %v, want ErrSinkWriteFailed", err)
+	}
+
+	left := buffered(t, buf, false)
+	if len(left) != 1 || left["e015"] == nil {
+		t.Fatalf("events left = %v, want only e015", left)
+	}
+	if retries := left["e015"].Retries; retries != 1 {
+		t.Errorf("e015 has %d retries, want 1", retries)
+	}
+	if len(sink.written) != 39 || sink.written["e015"] != 0 {
+		t.Fatalf("sink received %d events, want the 39 other than e015", len(sink.written))
+	}
+}
+
+func TestRedeliveryLimitDeadLetters(t *testing.T) {
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	defer buf.Close()
+	storeEvents(t, buf, 5)
+
+	sink := &recordingSink{fail: refuse("e002")}
+	ks := newConcurrentSync(buf, sink, 1, 10)
+	ks.runtime.Store(&config.Runtime{SyncBatchesPerTick: 1, MaxRedeliveries: 3})
+
+	for pass := 1; pass <= 3; pass++ {
+		if pass > 1 {
+			// A lone event's failure cannot be told from an outage, so
+			// keep other events flowing alongside it
+			fresh := &buffer.Event{ID: fmt.Sprintf("fresh%d", pass), Operation: "insert", Timestamp: time.Now()}
+			if err := buf.Store(fresh); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+		if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrSinkWriteFailed) {
+			t.Fatalf("pass %d: syncBatch = %v, want ErrSinkWriteFailed", pass, err)
+		}
+		if pass < 3 {
+			if left := buffered(t, buf, false); len(left) != 1 || left["e002"].Retries != pass {
+				t.Fatalf("after pass %d buffered = %v, want e002 with %d retries", pass, left, pass)
+			}
+		}
+	}
+
+	if left := buffered(t, buf, false); len(left) != 0 {
+		t.Fatalf("events left after reaching the limit: %v", left)
+	}
+	dead := buffered(t, buf, true)
+	if len(dead) != 1 || dead["e002"] == nil {
+		t.Fatalf("dead-lettered = %v, want only e002", dead)
+	}
+	if reason := dead["e002"].DeadLetterReason; !strings.Contains(reason, "gave up after 3 failed syncs to recording") {
+		t.Errorf("dead-letter reason = %q", reason)
+	}
+	if len(sink.written) != 6 {
+		t.Errorf("sink received %d events, want the 6 others", len(sink.written))
+	}
+}
+
+func TestOutageDeadLettersNothing(t *testing.T) {
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), nil)
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	defer buf.Close()
+	const n = 25
+	storeEvents(t, buf, n)
+
+	down := true
+	sink := &recordingSink{fail: func([]*buffer.Event) bool { return down }}
+	ks := newConcurrentSync(buf, sink, 2, 10)
+	ks.runtime.Store(&config.Runtime{SyncBatchesPerTick: 1, MaxRedeliveries: 2})
+
+	// Many more failed passes than the limit allows
+	for pass := 0; pass < 10; pass++ {
+		if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrSinkWriteFailed) {
+			t.Fatalf("pass %d: syncBatch = %v, want ErrSinkWriteFailed", pass, err)
+		}
+	}
+	left := buffered(t, buf, false)
+	if len(left) != n {
+		t.Fatalf("%d events buffered after the outage, want %d", len(left), n)
+	}
+	for id, event := range left {
+		if event.Retries != 0 {
+			t.Errorf("event %s has %d retries after an outage, want 0", id, event.Retries)
+		}
+	}
+	if dead := buffered(t, buf, true); len(dead) != 0 {
+		t.Fatalf("outage dead-lettered %d events", len(dead))
+	}
+
+	down = false
+	for pass := 0; pass < 5; pass++ {
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch after the outage: %v", err)
+		}
+	}
+	if len(sink.written) != n || len(buffered(t, buf, false)) != 0 {
+		t.Fatalf("sink received %d of %d events after the outage", len(sink.written), n)
+	}
+}
+
+// BenchmarkSyncConcurrent measures sync throughput by the number of batches
+// written at once, against a sink that takes a millisecond per write.
+func BenchmarkSyncConcurrent(b *testing.B) {
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("batches=%d", concurrency), func(b *testing.B) {
+			buf, err := buffer.New(filepath.Join(b.TempDir(), "buffer.db"), &buffer.Options{Timeout: time.Second, NoSync: true})
+			if err != nil {
+				b.Fatalf("buffer.New: %v", err)
+			}
+			defer buf.Close()
+			storeEvents(b, buf, b.N)
+			ks := newConcurrentSync(buf, &recordingSink{delay: time.Millisecond}, concurrency, 50)
+
+			b.ResetTimer()
+			for {
+				if err := ks.syncConcurrent(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+				if count, _ := buf.Count(); count == 0 {
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestHeadOfLinePoisonDoesNotBlock(t *testing.T) {
+	buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), &buffer.Options{Timeout: time.Second, SlowLaneRetries: 2})
+	if err != nil {
+		t.Fatalf("buffer.New: %v", err)
+	}
+	defer buf.Close()
+	// e000 is the oldest event, so it heads every batch until it moves to
+	// the slow lane
+	storeEvents(t, buf, 30)
+
+	sink := &recordingSink{fail: refuse("e000")}
+	ks := newConcurrentSync(buf, sink, 1, 10)
+	// Nine events go through behind the poison in each of the first two
+	// passes; then it is in the slow lane and the rest go ahead of it
+	for pass := 0; pass < 3; pass++ {
+		err := ks.syncBatch(context.Background())
+		if pass < 2 && !errors.Is(err, ErrSinkWriteFailed) {
+			t.Fatalf("pass %d: syncBatch = %v, want ErrSinkWriteFailed", pass, err)
+		}
+		if pass == 2 && err != nil {
+			t.Fatalf("pass %d: syncBatch = %v, want the poison left out", pass, err)
+		}
+	}
+	left := buffered(t, buf, false)
+	if len(left) != 2 || left["e000"] == nil || left["e029"] == nil {
+		t.Fatalf("events left = %v, want e000 and e029", left)
+	}
+	if retries := left["e000"].Retries; retries != 2 {
+		t.Fatalf("e000 has %d retries, want 2", retries)
+	}
+	if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrSinkWriteFailed) {
+		t.Fatalf("last pass: syncBatch = %v, want ErrSinkWriteFailed", err)
+	}
+	if len(sink.written) != 29 {
+		t.Fatalf("sink received %d events, want the 29 behind the poison", len(sink.written))
+	}
+
+	// Now in the slow lane, it is read after events captured since
+	fresh := &buffer.Event{ID: "fresh", Operation: "insert", Timestamp: time.Now()}
+	if err := buf.Store(fresh); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	events, err := buf.GetReadyEvents(10, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	if len(events) != 2 || events[0].ID != "fresh" || events[1].ID != "e000" {
+		t.Fatalf("ready events = %v, want fresh before e000", events)
+	}
+}
+
+func TestSyncErrorIdentities(t *testing.T) {
+	t.Run("unreachable", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		broker.down.Store(true)
+		ks := newBrokerSync(t, buf, broker)
+		storeEvents(t, buf, 3)
+
+		if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrSinkUnavailable) || errors.Is(err, ErrMessageRejected) {
+			t.Fatalf("syncBatch = %v, want ErrSinkUnavailable", err)
+		}
+		if count, _ := buf.Count(); count != 3 {
+			t.Fatalf("%d events buffered after an outage, want 3", count)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		broker.fail = func(string) kafka.Error { return kafka.TopicAuthorizationFailed }
+		ks := newBrokerSync(t, buf, broker)
+		storeEvents(t, buf, 3)
+
+		if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrMessageRejected) || errors.Is(err, ErrSinkUnavailable) {
+			t.Fatalf("syncBatch = %v, want ErrMessageRejected", err)
+		}
+		if deadLettered := deadLetteredIDs(t, buf); len(deadLettered) != 3 {
+			t.Fatalf("dead-lettered %v, want every rejected event", deadLettered)
+		}
+	})
+
+	t.Run("sink failed", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		ks := newConcurrentSync(buf, &recordingSink{fail: func([]*buffer.Event) bool { return true }}, 1, 10)
+		storeEvents(t, buf, 1)
+
+		if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrSinkWriteFailed) {
+			t.Fatalf("syncBatch = %v, want ErrSinkWriteFailed", err)
+		}
+	})
+}
+
+func TestWriterStatsTask(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	ks := newBrokerSync(t, buf, broker)
+
+	sched := scheduler.New(buf, clock.New())
+	if err := sched.AddTask("kafka_writer_stats", "@every 1h", ks.ReportStats); err != nil {
+		t.Fatalf("AddTask: %v", err)
+	}
+	sched.Start(context.Background())
+	defer sched.Stop()
+
+	messages := func() float64 { return testutil.ToFloat64(metrics.KafkaMessages) }
+	before := messages()
+	// The writer has not written anything yet
+	if err := sched.RunTaskNow(context.Background(), "kafka_writer_stats"); err != nil {
+		t.Fatalf("stats task on an idle writer: %v", err)
+	}
+	if got := messages() - before; got != 0 {
+		t.Fatalf("idle writer reported %v messages", got)
+	}
+
+	storeEvents(t, buf, 3)
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+	if err := sched.RunTaskNow(context.Background(), "kafka_writer_stats"); err != nil {
+		t.Fatalf("stats task: %v", err)
+	}
+	if got := messages() - before; got != 3 {
+		t.Fatalf("reported %v messages after writing 3", got)
+	}
+	// Each sample covers the time since the previous one
+	if err := sched.RunTaskNow(context.Background(), "kafka_writer_stats"); err != nil {
+		t.Fatalf("stats task: %v", err)
+	}
+	if got := messages() - before; got != 3 {
+		t.Fatalf("reported %v messages in all after an idle period, want still 3", got)
+	}
+}
+
+func TestReadSizeIsBufferBatchSize(t *testing.T) {
+	tests := []struct {
+		reads string
+		want  int
+	}{
+		{"1", 7},
+		{"3", 21},
+	}
+	for _, tt := range tests {
+		t.Run("BUFFER_CONCURRENT_READS="+tt.reads, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(1)
+			ks := newBrokerSync(t, buf, broker, "BUFFER_BATCH_SIZE=7", "KAFKA_BATCH_SIZE=2", "BUFFER_CONCURRENT_READS="+tt.reads)
+			storeEvents(t, buf, 30)
+
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+			messages := broker.messages()
+			if len(messages) != tt.want {
+				t.Fatalf("one pass produced %d messages, want %d read in batches of BUFFER_BATCH_SIZE", len(messages), tt.want)
+			}
+			if count, _ := buf.Count(); count != 30-tt.want {
+				t.Fatalf("%d events left buffered, want %d", count, 30-tt.want)
+			}
+
+			// The writer groups what was read by KAFKA_BATCH_SIZE
+			perRequest := make(map[int]int)
+			for _, msg := range messages {
+				perRequest[msg.Request]++
+			}
+			for request, n := range perRequest {
+				if n > 2 {
+					t.Fatalf("produce request %d carried %d messages, want at most KAFKA_BATCH_SIZE", request, n)
+				}
+			}
+		})
+	}
+}
+
+func TestReadStopsAtBufferMaxBatchBytes(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	ks := newBrokerSync(t, buf, broker, "BUFFER_BATCH_SIZE=100", "BUFFER_MAX_BATCH_BYTES=12000", "BUFFER_CONCURRENT_READS=1")
+	base := time.Now()
+	for i := 0; i < 10; i++ {
+		event := &buffer.Event{
+			ID:        fmt.Sprintf("e%03d", i),
+			Operation: "insert",
+			Timestamp: base.Add(time.Duration(i) * time.Microsecond),
+			Data:      map[string]interface{}{"fullDocument": map[string]interface{}{"body": strings.Repeat("x", 5000)}},
+		}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	// Two 5 KB documents fit in 12000 bytes, a third does not
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+	if n := len(broker.messages()); n != 2 {
+		t.Fatalf("one pass produced %d messages, want 2 within BUFFER_MAX_BATCH_BYTES", n)
+	}
+	if count, _ := buf.Count(); count != 8 {
+		t.Fatalf("%d events left buffered, want 8", count)
+	}
+}
+
+func TestPreserveOrderPerDocument(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(4)
+	ks := newBrokerSync(t, buf, broker, "KAFKA_PRESERVE_ORDER=true", "BUFFER_BATCH_SIZE=5", "BUFFER_CONCURRENT_READS=3")
+
+	// Updates to four documents interleaved in the buffer, so every read
+	// batch holds a mix of documents
+	docs := []string{"a", "b", "c", "d"}
+	const updates = 6
+	base := time.Now()
+	for i := 0; i < updates; i++ {
+		for j, doc := range docs {
+			event := &buffer.Event{
+				ID:        fmt.Sprintf("%s-%d", doc, i),
+				Operation: "update",
+				Timestamp: base.Add(time.Duration(i*len(docs)+j) * time.Microsecond),
+				Data: map[string]interface{}{
+					"documentKey": map[string]interface{}{"_id": doc},
+				},
+			}
+			if err := buf.Store(event); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+		}
+	}
+
+	for pass := 0; ; pass++ {
+		if count, _ := buf.Count(); count == 0 {
+			break
+		}
+		if pass == updates*len(docs) {
+			t.Fatal("buffer not drained")
+		}
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+	}
+
+	partitions := make(map[string]map[int]bool)
+	order := make(map[string][]string)
+	for _, msg := range broker.messages() {
+		doc := string(msg.Key)
+		if partitions[doc] == nil {
+			partitions[doc] = make(map[int]bool)
+		}
+		partitions[doc][msg.Partition] = true
+		order[doc] = append(order[doc], msg.Headers["id"])
+	}
+	for _, doc := range docs {
+		if len(partitions[doc]) != 1 {
+			t.Errorf("document %s written to partitions %v, want one", doc, partitions[doc])
+		}
+		var want []string
+		for i := 0; i < updates; i++ {
+			want = append(want, fmt.Sprintf("%s-%d", doc, i))
+		}
+		if !slices.Equal(order[doc], want) {
+			t.Errorf("document %s written in order %v, want %v", doc, order[doc], want)
+		}
+	}
+}
+
+func TestMessageTimeSources(t *testing.T) {
+	captured := time.Date(2024, 5, 1, 12, 0, 30, 0, time.UTC)
+	changed := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	seconds := float64(changed.Unix())
+
+	tests := []struct {
+		name        string
+		source      string
+		clusterTime interface{}
+		want        time.Time
+	}{
+		{"broker", MessageTimeBroker, map[string]interface{}{"T": seconds, "I": float64(1)}, time.Time{}},
+		{"buffer", MessageTimeBuffer, map[string]interface{}{"T": seconds, "I": float64(1)}, captured},
+		{"cluster from JSON", MessageTimeCluster, map[string]interface{}{"T": seconds, "I": float64(1)}, changed},
+		{"cluster from Extended JSON", MessageTimeCluster, map[string]interface{}{"$timestamp": map[string]interface{}{"t": seconds, "i": float64(1)}}, changed},
+		{"cluster from BSON", MessageTimeCluster, primitive.Timestamp{T: uint32(changed.Unix()), I: 1}, changed},
+		// Without a usable clusterTime the buffered time is used
+		{"cluster missing", MessageTimeCluster, nil, captured},
+		{"cluster zero", MessageTimeCluster, map[string]interface{}{"T": float64(0), "I": float64(0)}, captured},
+		{"cluster malformed", MessageTimeCluster, "yesterday", captured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(1)
+			ks := newBrokerSync(t, buf, broker, "KAFKA_MESSAGE_TIME="+tt.source)
+
+			event := &buffer.Event{ID: "e1", Operation: "insert", Timestamp: captured, Data: map[string]interface{}{}}
+			if tt.clusterTime != nil {
+				event.Data["clusterTime"] = tt.clusterTime
+			}
+			if got := ks.messageTime(event); !got.Equal(tt.want) {
+				t.Fatalf("messageTime = %v, want %v", got, tt.want)
+			}
+			if tt.want.IsZero() {
+				return
+			}
+
+			// The time survives buffering and reaches the broker
+			if err := buf.Store(event); err != nil {
+				t.Fatalf("Store: %v", err)
+			}
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+			messages := broker.messages()
+			if len(messages) != 1 || !messages[0].Time.Equal(tt.want) {
+				t.Fatalf("produced %+v, want one message at %v", messages, tt.want)
+			}
+		})
+	}
+}
+
+// reachable returns the address of a listener for the connectivity monitor
+// to probe, so a KafkaSync served by a fakeBroker can be brought online.
+func reachable(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln.Addr().String()
+}
+
+func TestPauseStopsWrites(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	ks := newBrokerSync(t, buf, broker, "MONITOR_PROBE_KAFKA=false", "MONITOR_PROBE_TARGETS="+reachable(t))
+	if !ks.connMonitor.Recheck() || !ks.connMonitor.IsOnline() {
+		t.Fatal("connectivity monitor not online")
+	}
+	paused := func() float64 { return testutil.ToFloat64(metrics.KafkaSyncPaused) }
+
+	ks.Pause()
+	if !ks.Paused() || paused() != 1 {
+		t.Fatalf("Paused() = %v with gauge %v after Pause", ks.Paused(), paused())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ks.Start(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Capture keeps filling the buffer while the loop ticks past it
+	storeEvents(t, buf, 3)
+	time.Sleep(1500 * time.Millisecond)
+	if err := ks.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain while paused: %v", err)
+	}
+	if calls := broker.calls.Load(); calls != 0 {
+		t.Fatalf("%d requests reached the broker while paused", calls)
+	}
+	if count, _ := buf.Count(); count != 3 {
+		t.Fatalf("%d events buffered while paused, want 3", count)
+	}
+
+	// Resuming drains at once rather than at the next tick
+	resumed := time.Now()
+	ks.Resume()
+	if ks.Paused() || paused() != 0 {
+		t.Fatalf("Paused() = %v with gauge %v after Resume", ks.Paused(), paused())
+	}
+	for {
+		count, _ := buf.Count()
+		if count == 0 {
+			break
+		}
+		if time.Since(resumed) > 5*time.Second {
+			t.Fatalf("%d events left buffered after Resume", count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(broker.messages()); got != 3 {
+		t.Fatalf("%d messages written after Resume, want 3", got)
+	}
+}
+
+func TestFanOutWaitsForEverySink(t *testing.T) {
+	buf := newTestBuffer(t)
+	var down atomic.Bool
+	down.Store(true)
+	good := &recordingSink{name: "good"}
+	flaky := &recordingSink{name: "flaky", fail: func([]*buffer.Event) bool { return down.Load() }}
+	ks := newConcurrentSync(buf, good, 1, 10)
+	ks.sinks = append(ks.sinks, flaky)
+	storeEvents(t, buf, 3)
+
+	err := ks.syncBatch(context.Background())
+	if !errors.Is(err, ErrSinkWriteFailed) || !strings.Contains(err.Error(), "flaky") {
+		t.Fatalf("syncBatch = %v, want the flaky sink's failure", err)
+	}
+	left := buffered(t, buf, false)
+	if len(left) != 3 {
+		t.Fatalf("%d events buffered after one sink failed, want all 3", len(left))
+	}
+	for id, event := range left {
+		if !event.DeliveredTo("good") || event.DeliveredTo("flaky") {
+			t.Fatalf("event %s delivered to %v, want only the good sink", id, event.Delivered)
+		}
+	}
+
+	down.Store(false)
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch after recovery: %v", err)
+	}
+	if count, _ := buf.Count(); count != 0 {
+		t.Fatalf("%d events buffered once both sinks took them", count)
+	}
+	// The good sink is not sent the events again
+	for _, sink := range []*recordingSink{good, flaky} {
+		if len(sink.written) != 3 {
+			t.Errorf("%s sink got %d events, want 3", sink.name, len(sink.written))
+		}
+		for id, n := range sink.written {
+			if n != 1 {
+				t.Errorf("%s sink got %s %d times, want once", sink.name, id, n)
+			}
+		}
+	}
+}
+
+func TestWriterClientIDAndLoggers(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("KAFKA_BROKERS", "primary:9092")
+	t.Setenv("KAFKA_CLIENT_ID", "orders-cdc")
+	t.Setenv("KAFKA_LOG_LEVEL", KafkaLogError)
+	t.Setenv("KAFKA_DLQ_TOPIC", "orders-dlq")
+	t.Setenv("KAFKA_CLUSTERS", "dr")
+	t.Setenv(config.ClusterBrokersEnv("dr"), "dr:9092")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	connMonitor, err := monitor.NewConnectivityMonitor(cfg)
+	if err != nil {
+		t.Fatalf("NewConnectivityMonitor: %v", err)
+	}
+	ks, err := NewKafkaSync(cfg, newTestBuffer(t), connMonitor, workers.New(1))
+	if err != nil {
+		t.Fatalf("NewKafkaSync: %v", err)
+	}
+	defer ks.Close()
+
+	writers := map[string]*kafka.Writer{"dead-letter": ks.dlqWriter}
+	for _, cluster := range ks.clusters {
+		writers[cluster.name] = cluster.writer
+	}
+	if len(writers) != 3 {
+		t.Fatalf("got writers %v, want the primary, the mirror and the dead-letter one", writers)
+	}
+	for name, writer := range writers {
+		transport, ok := writer.Transport.(*kafka.Transport)
+		if !ok || transport.ClientID != "orders-cdc" {
+			t.Errorf("%s writer transport %#v, want ClientID orders-cdc", name, writer.Transport)
+		}
+		if writer.Logger == nil || writer.ErrorLogger == nil {
+			t.Errorf("%s writer has no logger", name)
+		}
+	}
+
+	var logged strings.Builder
+	writer := log.Writer()
+	log.SetOutput(&logged)
+	defer log.SetOutput(writer)
+	tests := []struct {
+		level       string
+		info, error bool
+	}{
+		{KafkaLogNone, false, false},
+		{KafkaLogError, false, true},
+		{KafkaLogDebug, true, true},
+	}
+	for _, tt := range tests {
+		rt := *ks.runtime.Load()
+		rt.KafkaLogLevel = tt.level
+		ks.runtime.Store(&rt)
+		logged.Reset()
+
+		ks.writer.Logger.Printf("writing %d messages", 3)
+		ks.writer.ErrorLogger.Printf("broker %s unreachable", "primary:9092")
+		if got := strings.Contains(logged.String(), "kafka: writing 3 messages"); got != tt.info {
+			t.Errorf("KAFKA_LOG_LEVEL=%s logged writer activity: %v, want %v", tt.level, got, tt.info)
+		}
+		if got := strings.Contains(logged.String(), "kafka error: broker primary:9092 unreachable"); got != tt.error {
+			t.Errorf("KAFKA_LOG_LEVEL=%s logged writer errors: %v, want %v", tt.level, got, tt.error)
+		}
+	}
+}
+
+func TestDeadLetterTopic(t *testing.T) {
+	const dlq = "orders-dlq"
+	rejectSource := func(topic string) kafka.Error {
+		if topic == dlq {
+			return 0
+		}
+		return kafka.TopicAuthorizationFailed
+	}
+	rejectAll := func(string) kafka.Error { return kafka.TopicAuthorizationFailed }
+
+	t.Run("published", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		broker.fail = rejectSource
+		ks := newBrokerSync(t, buf, broker, "KAFKA_DLQ_TOPIC="+dlq)
+		storeEvents(t, buf, 2)
+
+		if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrMessageRejected) {
+			t.Fatalf("syncBatch = %v, want ErrMessageRejected", err)
+		}
+		messages := broker.messages()
+		if len(messages) != 2 {
+			t.Fatalf("produced %d messages, want both events on the dead-letter topic", len(messages))
+		}
+		for _, msg := range messages {
+			if msg.Topic != dlq {
+				t.Errorf("message %s went to %s, want %s", msg.Headers["id"], msg.Topic, dlq)
+			}
+			if msg.Headers["dlq-reason"] == "" || msg.Headers["dlq-retries"] != "0" || msg.Headers["dlq-source-topic"] != ks.topics.defaultTopic() {
+				t.Errorf("message %s headers %v, want the reason, retries and source topic", msg.Headers["id"], msg.Headers)
+			}
+		}
+		if count, _ := buf.Count(); count != 0 {
+			t.Errorf("%d events buffered after publishing them to the dead-letter topic", count)
+		}
+		if dead := deadLetteredIDs(t, buf); len(dead) != 0 {
+			t.Errorf("dead-lettered locally %v as well", dead)
+		}
+	})
+
+	t.Run("after max redeliveries", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		ks := newBrokerSync(t, buf, broker, "KAFKA_DLQ_TOPIC="+dlq, "BUFFER_MAX_REDELIVERIES=3")
+		storeEvents(t, buf, 1)
+		event := buffered(t, buf, false)["e000"]
+		event.Retries = 2
+
+		ks.retryLater(context.Background(), event, []string{kafkaSinkName})
+		messages := broker.messages()
+		if len(messages) != 1 || messages[0].Topic != dlq {
+			t.Fatalf("produced %+v, want the event on the dead-letter topic", messages)
+		}
+		if got := messages[0].Headers; got["dlq-retries"] != "3" || !strings.Contains(got["dlq-reason"], "gave up after 3 failed syncs to kafka") {
+			t.Errorf("headers %v, want the retry count and reason", got)
+		}
+		if count, _ := buf.Count(); count != 0 {
+			t.Errorf("%d events buffered after publishing to the dead-letter topic", count)
+		}
+	})
+
+	t.Run("publish fails", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		broker.fail = rejectAll
+		ks := newBrokerSync(t, buf, broker, "KAFKA_DLQ_TOPIC="+dlq)
+		storeEvents(t, buf, 2)
+
+		if err := ks.syncBatch(context.Background()); !errors.Is(err, ErrMessageRejected) {
+			t.Fatalf("syncBatch = %v, want ErrMessageRejected", err)
+		}
+		if got := len(broker.messages()); got != 0 {
+			t.Fatalf("produced %d messages", got)
+		}
+		// Kept in the local dead-letter bucket instead of being lost
+		if dead := deadLetteredIDs(t, buf); !slices.Equal(dead, []string{"e000", "e001"}) {
+			t.Fatalf("dead-lettered locally %v, want both events", dead)
+		}
+		if count, _ := buf.Count(); count != 0 {
+			t.Errorf("%d events still pending", count)
+		}
+	})
+}
+
+func TestStrictOrderUsesOnePartition(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("KAFKA_STRICT_ORDER=%v", strict), func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(4)
+			ks := newBrokerSync(t, buf, broker, "KAFKA_STRICT_ORDER="+strconv.FormatBool(strict),
+				"KAFKA_BALANCER=hash", "KAFKA_ACKS=1", "BUFFER_BATCH_SIZE=5", "BUFFER_CONCURRENT_READS=3")
+			storeEvents(t, buf, 15)
+
+			for pass := 0; pass < 10; pass++ {
+				if err := ks.syncBatch(context.Background()); err != nil {
+					t.Fatalf("syncBatch: %v", err)
+				}
+				if count, _ := buf.Count(); count == 0 {
+					break
+				}
+			}
+			messages := broker.messages()
+			if len(messages) != 15 {
+				t.Fatalf("produced %d messages, want 15", len(messages))
+			}
+			partitions := make(map[int]bool)
+			var order []string
+			for _, msg := range messages {
+				partitions[msg.Partition] = true
+				order = append(order, msg.Headers["id"])
+			}
+			if !strict {
+				// Without it the keys spread over the partitions
+				if len(partitions) < 2 {
+					t.Fatalf("hash balancer used partitions %v, want several", partitions)
+				}
+				return
+			}
+
+			if len(partitions) != 1 || !partitions[0] {
+				t.Fatalf("messages written to partitions %v, want only 0", partitions)
+			}
+			if !slices.IsSorted(order) {
+				t.Errorf("messages written in order %v, want buffered order", order)
+			}
+			if ks.concurrency != 1 {
+				t.Errorf("concurrency = %d, want 1", ks.concurrency)
+			}
+			if ks.writer.RequiredAcks != kafka.RequireAll {
+				t.Errorf("RequiredAcks = %v, want RequireAll over KAFKA_ACKS=1", ks.writer.RequiredAcks)
+			}
+		})
+	}
+
+	if got := (firstPartition{}).Balance(kafka.Message{}, 3, 1, 2); got != 1 {
+		t.Errorf("firstPartition chose %d of [3 1 2], want 1", got)
+	}
+}
+
+// peakSink records the most writes it has had in progress at once.
+type peakSink struct {
+	recordingSink
+	active, peak atomic.Int32
+}
+
+func (s *peakSink) Write(ctx context.Context, events []*buffer.Event) error {
+	active := s.active.Add(1)
+	defer s.active.Add(-1)
+	for peak := s.peak.Load(); active > peak && !s.peak.CompareAndSwap(peak, active); peak = s.peak.Load() {
+	}
+	return s.recordingSink.Write(ctx, events)
+}
+
+func TestInflightLimits(t *testing.T) {
+	buf := newTestBuffer(t)
+	const n = 40
+	storeEvents(t, buf, n)
+	ready, err := buf.GetReadyEvents(1, 0)
+	if err != nil || len(ready) != 1 {
+		t.Fatalf("GetReadyEvents = %d events, %v", len(ready), err)
+	}
+	size := ready[0].Size()
+
+	ks := newBrokerSync(t, buf, newFakeBroker(1), "BUFFER_BATCH_SIZE=5", "BUFFER_CONCURRENT_READS=4",
+		"SYNC_MAX_INFLIGHT_BATCHES=2", "SYNC_MAX_INFLIGHT_BYTES="+strconv.Itoa(7*size))
+	sink := &peakSink{recordingSink: recordingSink{delay: 20 * time.Millisecond}}
+	ks.sinks = []Sink{sink}
+	if ks.concurrency != 2 {
+		t.Fatalf("concurrency = %d, want SYNC_MAX_INFLIGHT_BATCHES=2 over BUFFER_CONCURRENT_READS=4", ks.concurrency)
+	}
+
+	written := 0
+	for pass := 0; pass < 20 && written < n; pass++ {
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		sink.mu.Lock()
+		total := len(sink.written)
+		sink.mu.Unlock()
+		// Two batches of five would be ten events; the byte cap cuts the
+		// pass at seven
+		if got := total - written; got != 7 && total != n {
+			t.Errorf("pass %d sent %d events, want 7 within SYNC_MAX_INFLIGHT_BYTES", pass, got)
+		}
+		written = total
+	}
+	if written != n {
+		t.Fatalf("sent %d of %d events", written, n)
+	}
+	if peak := sink.peak.Load(); peak > 2 {
+		t.Errorf("%d batches in flight at once, want at most 2", peak)
+	}
+	if got := testutil.ToFloat64(metrics.SyncInflightBytes); got != 0 {
+		t.Errorf("SyncInflightBytes = %v after the passes, want 0", got)
+	}
+}
+
+func TestRetryBudgetLimitsRedeliveryRate(t *testing.T) {
+	buf := newTestBuffer(t)
+	base := time.Now()
+	for i := 0; i < 100; i++ {
+		// Failed before, but with no attempt time so no backoff applies
+		event := &buffer.Event{ID: fmt.Sprintf("r%03d", i), Operation: "insert", Timestamp: base.Add(time.Duration(i) * time.Microsecond), Retries: 1}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+
+	ks := newBrokerSync(t, buf, newFakeBroker(1), "SYNC_RETRY_RATE=20", "SYNC_RETRY_BURST=2", "BUFFER_BATCH_SIZE=10")
+	sink := &recordingSink{}
+	ks.sinks = []Sink{sink}
+	deferredBefore := testutil.ToFloat64(metrics.RetriesDeferred)
+
+	start := time.Now()
+	const window = 500 * time.Millisecond
+	for time.Since(start) < window {
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+
+	sink.mu.Lock()
+	attempts := len(sink.written)
+	sink.mu.Unlock()
+	// The burst plus what the rate refills over the window
+	if limit := 2 + int(20*elapsed.Seconds()); attempts > limit {
+		t.Errorf("%d redeliveries in %v, want at most %d at SYNC_RETRY_RATE=20", attempts, elapsed, limit)
+	}
+	if attempts < 5 {
+		t.Errorf("%d redeliveries in %v, want the budget to keep letting some through", attempts, elapsed)
+	}
+	if testutil.ToFloat64(metrics.RetriesDeferred) == deferredBefore {
+		t.Error("RetriesDeferred did not grow while the budget was exhausted")
+	}
+}
+
+func TestDeleteTombstones(t *testing.T) {
+	change := func(id, op string, i int, full map[string]interface{}) *buffer.Event {
+		data := map[string]interface{}{"documentKey": map[string]interface{}{"_id": "d1"}}
+		if full != nil {
+			data["fullDocument"] = full
+		}
+		return &buffer.Event{ID: id, Operation: op, Timestamp: time.Now().Add(time.Duration(i) * time.Microsecond), Data: data}
+	}
+	tests := []struct {
+		name string
+		env  []string
+		// tombstone is whether the delete is sent with a nil value
+		tombstone bool
+	}{
+		{"tombstones", []string{"KAFKA_DELETE_TOMBSTONE=true"}, true},
+		{"normal deletes", []string{"KAFKA_DELETE_TOMBSTONE=false", "KAFKA_KEY_TEMPLATE={documentKey._id}"}, false},
+		// A key the delete cannot render would compact nothing
+		{"unrenderable key", []string{"KAFKA_DELETE_TOMBSTONE=true", "KAFKA_KEY_TEMPLATE={fullDocument.sku}"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(1)
+			ks := newBrokerSync(t, buf, broker, tt.env...)
+			for i, event := range []*buffer.Event{
+				change("ins", "insert", 0, map[string]interface{}{"_id": "d1", "sku": "d1"}),
+				change("upd", "update", 1, map[string]interface{}{"_id": "d1", "sku": "d1"}),
+				change("del", "delete", 2, nil),
+			} {
+				if err := buf.Store(event); err != nil {
+					t.Fatalf("Store %d: %v", i, err)
+				}
+			}
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+
+			messages := make(map[string]producedMessage)
+			for _, msg := range broker.messages() {
+				messages[msg.Headers["id"]] = msg
+			}
+			if len(messages) != 3 {
+				t.Fatalf("produced %d messages, want 3", len(messages))
+			}
+			for _, id := range []string{"ins", "upd"} {
+				if messages[id].Value == nil {
+					t.Errorf("%s sent with a nil value", id)
+				}
+			}
+			del := messages["del"]
+			if (del.Value == nil) != tt.tombstone {
+				t.Errorf("delete value %q, want tombstone %v", del.Value, tt.tombstone)
+			}
+			if del.Headers["operation"] != "delete" {
+				t.Errorf("delete sent with operation header %q", del.Headers["operation"])
+			}
+			if tt.tombstone && string(del.Key) != string(messages["ins"].Key) {
+				t.Errorf("tombstone keyed %q, want the insert's key %q", del.Key, messages["ins"].Key)
+			}
+		})
+	}
+}
+
+func TestRetryHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    []string
+		header string
+	}{
+		{"default", nil, "retry-count"},
+		{"renamed", []string{"KAFKA_RETRY_HEADER=x-attempts"}, "x-attempts"},
+		{"disabled", []string{"KAFKA_RETRY_HEADER="}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(1)
+			ks := newBrokerSync(t, buf, broker, tt.env...)
+			base := time.Now()
+			for i, retries := range []int{0, 1, 4} {
+				// No attempt time, so the retried events are ready at once
+				event := &buffer.Event{ID: fmt.Sprintf("r%d", retries), Operation: "insert", Timestamp: base.Add(time.Duration(i) * time.Microsecond), Retries: retries}
+				if err := buf.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+
+			messages := broker.messages()
+			if len(messages) != 3 {
+				t.Fatalf("produced %d messages, want 3", len(messages))
+			}
+			for _, msg := range messages {
+				id := msg.Headers["id"]
+				value, ok := msg.Headers[tt.header]
+				if tt.header == "" {
+					if _, ok := msg.Headers["retry-count"]; ok {
+						t.Errorf("%s has a retry-count header with KAFKA_RETRY_HEADER empty", id)
+					}
+					continue
+				}
+				if want := strings.TrimPrefix(id, "r"); !ok || value != want {
+					t.Errorf("%s has %s header %q, want %q", id, tt.header, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUnsafeAcksGuard(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		// refused names the setting the guard refuses, or "" to start
+		refused         string
+		acks, dlqAcks   kafka.RequiredAcks
+		warnsOfDataLoss bool
+	}{
+		{"acks=0 refused", []string{"KAFKA_ACKS=0"}, "KAFKA_ACKS=0", 0, 0, false},
+		{"acks=0 allowed", []string{"KAFKA_ACKS=0", "KAFKA_ALLOW_UNSAFE_ACKS=true"}, "", kafka.RequireNone, 0, true},
+		{"dead-letter acks=0 refused", []string{"KAFKA_DLQ_TOPIC=dlq", "KAFKA_DLQ_ACKS=0"}, "KAFKA_DLQ_ACKS=0", 0, 0, false},
+		// The dead-letter writer is not used without a topic
+		{"dead-letter acks=0 without a topic", []string{"KAFKA_DLQ_ACKS=0"}, "", kafka.RequireOne, 0, false},
+		{"per-destination acks", []string{"KAFKA_ACKS=-1", "KAFKA_DLQ_TOPIC=dlq", "KAFKA_DLQ_ACKS=1"}, "", kafka.RequireAll, kafka.RequireOne, false},
+		{"dead-letter acks default to KAFKA_ACKS", []string{"KAFKA_ACKS=-1", "KAFKA_DLQ_TOPIC=dlq"}, "", kafka.RequireAll, kafka.RequireAll, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			for _, kv := range tt.env {
+				key, value, _ := strings.Cut(kv, "=")
+				t.Setenv(key, value)
+			}
+			cfg, err := config.Load()
+			if err != nil {
+				t.Fatalf("config.Load: %v", err)
+			}
+
+			var out strings.Builder
+			writer := log.Writer()
+			log.SetOutput(&out)
+			ks, err := NewKafkaSync(cfg, newTestBuffer(t), nil, workers.New(1))
+			log.SetOutput(writer)
+
+			if tt.refused != "" {
+				if err == nil {
+					ks.Close()
+					t.Fatalf("NewKafkaSync started with %s", tt.refused)
+				}
+				if !strings.Contains(err.Error(), tt.refused) || !strings.Contains(err.Error(), "KAFKA_ALLOW_UNSAFE_ACKS") {
+					t.Fatalf("NewKafkaSync = %v, want it to name %s and KAFKA_ALLOW_UNSAFE_ACKS", err, tt.refused)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewKafkaSync: %v", err)
+			}
+			defer ks.Close()
+			if ks.writer.RequiredAcks != tt.acks {
+				t.Errorf("writer acks %v, want %v", ks.writer.RequiredAcks, tt.acks)
+			}
+			if ks.dlqWriter != nil && ks.dlqWriter.RequiredAcks != tt.dlqAcks {
+				t.Errorf("dead-letter writer acks %v, want %v", ks.dlqWriter.RequiredAcks, tt.dlqAcks)
+			}
+			if warned := strings.Contains(out.String(), "WARNING: KAFKA_ACKS=0"); warned != tt.warnsOfDataLoss {
+				t.Errorf("warned of data loss = %v, want %v; log %q", warned, tt.warnsOfDataLoss, out.String())
+			}
+		})
+	}
+}
+
+// eventAge returns the sample count and sum of the buffer_event_age_seconds
+// histogram, and the cumulative count of its bucket with upper bound le.
+func eventAge(t *testing.T, le float64) (count uint64, sum float64, under uint64) {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "buffered_cdc_buffer_event_age_seconds" {
+			continue
+		}
+		histogram := family.GetMetric()[0].GetHistogram()
+		for _, bucket := range histogram.GetBucket() {
+			if bucket.GetUpperBound() == le {
+				under = bucket.GetCumulativeCount()
+			}
+		}
+		return histogram.GetSampleCount(), histogram.GetSampleSum(), under
+	}
+	t.Fatal("buffer_event_age_seconds is not registered")
+	return 0, 0, 0
+}
+
+func TestEventAgeObserved(t *testing.T) {
+	buf := newTestBuffer(t)
+	now := time.Now()
+	ages := map[string]time.Duration{"fresh": 0, "minute": time.Minute, "hour": time.Hour}
+	for id, age := range ages {
+		if err := buf.Store(&buffer.Event{ID: id, Operation: "insert", Timestamp: now.Add(-age)}); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	// A failed event is not synced, so its age is not observed
+	if err := buf.Store(&buffer.Event{ID: "failed", Operation: "insert", Timestamp: now.Add(-24 * time.Hour)}); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	ks := newConcurrentSync(buf, &recordingSink{fail: refuse("failed")}, 1, 10)
+
+	// 0.01 * 4^4 = 2.56 seconds, 0.01 * 4^8 = 655.36 seconds
+	countBefore, sumBefore, shortBefore := eventAge(t, 2.56)
+	_, _, mediumBefore := eventAge(t, 655.36)
+	if err := ks.syncEvents(context.Background(), mustReady(t, buf)); err == nil {
+		t.Fatal("syncEvents succeeded with an event refused")
+	}
+	count, sum, short := eventAge(t, 2.56)
+	_, _, medium := eventAge(t, 655.36)
+
+	if got := count - countBefore; got != 3 {
+		t.Fatalf("observed %d ages, want one for each of the 3 synced events", got)
+	}
+	// The events were stored moments ago, so their ages have grown a little
+	want := (time.Minute + time.Hour).Seconds()
+	if got := sum - sumBefore; got < want || got > want+10 {
+		t.Errorf("observed ages summing to %.1fs, want about %.0fs", got, want)
+	}
+	if got := short - shortBefore; got != 1 {
+		t.Errorf("%d ages under 2.56s, want the fresh event's", got)
+	}
+	if got := medium - mediumBefore; got != 2 {
+		t.Errorf("%d ages under 655.36s, want the fresh and minute-old events'", got)
+	}
+}
+
+// mustReady returns every ready event in buf.
+func mustReady(t *testing.T, buf *buffer.Buffer) []*buffer.Event {
+	t.Helper()
+	events, err := buf.GetReadyEvents(100, 0)
+	if err != nil {
+		t.Fatalf("GetReadyEvents: %v", err)
+	}
+	return events
+}
+
+// slowTransport delays produce requests, as a congested broker would.
+type slowTransport struct {
+	kafka.RoundTripper
+	delay time.Duration
+}
+
+func (s *slowTransport) RoundTrip(ctx context.Context, addr net.Addr, req protocol.Message) (protocol.Message, error) {
+	if _, ok := req.(*produce.Request); ok {
+		time.Sleep(s.delay)
+	}
+	return s.RoundTripper.RoundTrip(ctx, addr, req)
+}
+
+func TestSlowWriteWarning(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		delay time.Duration
+		slow  bool
+	}{
+		{"fast write", 0, false},
+		{"slow write", 150 * time.Millisecond, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(1)
+			ks := newBrokerSync(t, buf, broker, "SLOW_WRITE_THRESHOLD=50ms", "BUFFER_BATCH_SIZE=25")
+			ks.clusters[0].writer.Transport = &slowTransport{RoundTripper: broker, delay: tt.delay}
+			storeEvents(t, buf, 25)
+			slowBefore := testutil.ToFloat64(metrics.KafkaSlowWrites)
+
+			var out strings.Builder
+			writer := log.Writer()
+			log.SetOutput(&out)
+			err := ks.syncBatch(context.Background())
+			log.SetOutput(writer)
+			if err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+
+			logged := out.String()
+			warned := strings.Contains(logged, "WARNING: Slow Kafka write: 25 messages took")
+			if warned != tt.slow {
+				t.Fatalf("slow write warning logged = %v, want %v:\n%s", warned, tt.slow, logged)
+			}
+			if got := testutil.ToFloat64(metrics.KafkaSlowWrites) - slowBefore; (got == 1) != tt.slow {
+				t.Errorf("KafkaSlowWrites grew by %v", got)
+			}
+			if !tt.slow {
+				return
+			}
+			// The warning names the events, up to a limit
+			if !strings.Contains(logged, "and succeeded; events e000, e001") || !strings.Contains(logged, "e019 and 5 more") {
+				t.Errorf("warning does not list the first %d event IDs:\n%s", maxSlowWriteLogged, logged)
+			}
+			if strings.Contains(logged, "e020") {
+				t.Errorf("warning lists more than %d event IDs:\n%s", maxSlowWriteLogged, logged)
+			}
+		})
+	}
+}
+
+func TestDelayedEventsNotSyncedEarly(t *testing.T) {
+	for _, scheduled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ScheduleDelayed=%v", scheduled), func(t *testing.T) {
+			start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			clk := clock.NewFake(start)
+			buf, err := buffer.New(filepath.Join(t.TempDir(), "buffer.db"), &buffer.Options{Timeout: time.Second, Clock: clk, ScheduleDelayed: scheduled})
+			if err != nil {
+				t.Fatalf("buffer.New: %v", err)
+			}
+			defer buf.Close()
+
+			// The delayed changes were captured before the immediate ones
+			ready := start.Add(time.Minute)
+			for i := 0; i < 5; i++ {
+				event := &buffer.Event{ID: fmt.Sprintf("delayed%d", i), Operation: "insert", Timestamp: start.Add(time.Duration(i) * time.Microsecond), DelayedUntil: &ready}
+				if err := buf.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			for i := 0; i < 5; i++ {
+				event := &buffer.Event{ID: fmt.Sprintf("immediate%d", i), Operation: "insert", Timestamp: start.Add(time.Millisecond + time.Duration(i)*time.Microsecond)}
+				if err := buf.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+
+			sink := &recordingSink{}
+			ks := newConcurrentSync(buf, sink, 1, 3)
+			// pass promotes what is ready, as the scheduler does, then syncs
+			pass := func() {
+				t.Helper()
+				if _, err := buf.PromoteScheduled(); err != nil {
+					t.Fatalf("PromoteScheduled: %v", err)
+				}
+				if err := ks.syncBatch(context.Background()); err != nil {
+					t.Fatalf("syncBatch: %v", err)
+				}
+			}
+
+			// Immediate events go out first although captured later
+			pass()
+			for i := 0; i < 3; i++ {
+				if sink.written[fmt.Sprintf("immediate%d", i)] != 1 {
+					t.Fatalf("first batch sent %v, want immediate0-2", sink.written)
+				}
+			}
+			pass()
+			pass()
+			if len(sink.written) != 5 {
+				t.Fatalf("sent %v before the ready time, want only the immediate events", sink.written)
+			}
+
+			clk.Set(ready.Add(-time.Second))
+			pass()
+			if len(sink.written) != 5 {
+				t.Fatalf("sent %d events just before the ready time, want 5", len(sink.written))
+			}
+
+			clk.Set(ready)
+			pass()
+			pass()
+			for i := 0; i < 5; i++ {
+				if sink.written[fmt.Sprintf("delayed%d", i)] != 1 {
+					t.Errorf("delayed%d sent %d times once ready, want once", i, sink.written[fmt.Sprintf("delayed%d", i)])
+				}
+			}
+			if count, _ := buf.Count(); count != 0 {
+				t.Errorf("%d events left buffered, want none", count)
+			}
+		})
+	}
+}
+
+func TestStickyBalancer(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(3)
+	ks := newBrokerSync(t, buf, broker, "KAFKA_BALANCER=sticky", "BUFFER_BATCH_SIZE=5", "BUFFER_CONCURRENT_READS=1")
+	storeEvents(t, buf, 20)
+
+	for pass := 0; pass < 4; pass++ {
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+	}
+	if count, _ := buf.Count(); count != 0 {
+		t.Fatalf("%d events left buffered, want all 20 synced", count)
+	}
+
+	// Each batch of 5 lands whole on one partition, the next batch on the
+	// next partition
+	partitions := make(map[int]map[int]bool)
+	for _, msg := range broker.messages() {
+		n, err := strconv.Atoi(strings.TrimPrefix(msg.Headers["id"], "e"))
+		if err != nil {
+			t.Fatalf("unexpected message %s", msg.Headers["id"])
+		}
+		if partitions[n/5] == nil {
+			partitions[n/5] = make(map[int]bool)
+		}
+		partitions[n/5][msg.Partition] = true
+	}
+	first := -1
+	for p := range partitions[0] {
+		first = p
+	}
+	for batch := 0; batch < 4; batch++ {
+		want := (first + batch) % 3
+		if !reflect.DeepEqual(partitions[batch], map[int]bool{want: true}) {
+			t.Errorf("batch %d written to partitions %v, want only %d", batch, partitions[batch], want)
+		}
+	}
+
+	// Without a batch, as for dead-letter messages, the first partition
+	if got := (stickyBalancer{}).Balance(kafka.Message{}, 4, 5, 6); got != 4 {
+		t.Errorf("Balance outside a batch = %d, want 4", got)
+	}
+}
@@ -0,0 +1,151 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+)
+
+// documentKeyTemplate keys messages by document so all changes to a document
+// land on one partition. It is the default when KAFKA_PRESERVE_ORDER is set.
+const documentKeyTemplate = "{documentKey._id}"
+
+// documentIDPath is the field deletes are keyed by when the key template
+// cannot be rendered for them.
+var documentIDPath = []string{"documentKey", "_id"}
+
+// keyTemplate renders Kafka message keys from KAFKA_KEY_TEMPLATE, e.g.
+// "{documentKey._id}" or "{fullDocument.tenantId}:{operation}". Placeholders
+// name an event field (id, operation, timestamp) or a dotted path into the
+// event's data; everything outside braces is copied as-is.
+type keyTemplate struct {
+	parts []keyPart
+}
+
+// keyPart is either literal text or, when path is set, a placeholder.
+type keyPart struct {
+	literal string
+	path    []string
+}
+
+// parseKeyTemplate validates a key template. An empty template returns nil,
+// meaning messages are keyed by event ID.
+func parseKeyTemplate(template string) (*keyTemplate, error) {
+	if template == "" {
+		return nil, nil
+	}
+
+	t := &keyTemplate{}
+	rest := template
+	for rest != "" {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			t.parts = append(t.parts, keyPart{literal: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, fmt.Errorf("invalid key template %q: unexpected '}'", template)
+		}
+		if open > 0 {
+			t.parts = append(t.parts, keyPart{literal: rest[:open]})
+		}
+
+		end := strings.IndexAny(rest[open+1:], "{}")
+		if end < 0 || rest[open+1+end] != '}' {
+			return nil, fmt.Errorf("invalid key template %q: unclosed '{'", template)
+		}
+		field := strings.TrimSpace(rest[open+1 : open+1+end])
+		if field == "" {
+			return nil, fmt.Errorf("invalid key template %q: empty placeholder", template)
+		}
+		path := strings.Split(field, ".")
+		for _, segment := range path {
+			if segment == "" {
+				return nil, fmt.Errorf("invalid key template %q: bad field %q", template, field)
+			}
+		}
+		t.parts = append(t.parts, keyPart{path: path})
+		rest = rest[open+1+end+1:]
+	}
+
+	return t, nil
+}
+
+// render builds the key for event. It returns false if any referenced field is
+// missing so the caller can fall back to the event ID.
+func (t *keyTemplate) render(event *buffer.Event) ([]byte, bool) {
+	var key strings.Builder
+	for _, part := range t.parts {
+		if part.path == nil {
+			key.WriteString(part.literal)
+			continue
+		}
+
+		value, ok := keyField(event, part.path)
+		if !ok {
+			return nil, false
+		}
+		key.WriteString(value)
+	}
+	return []byte(key.String()), true
+}
+
+func keyField(event *buffer.Event, path []string) (string, bool) {
+	if len(path) == 1 {
+		switch path[0] {
+		case "id":
+			return event.ID, true
+		case "operation":
+			return event.Operation, true
+		case "timestamp":
+			return event.Timestamp.Format(time.RFC3339Nano), true
+		}
+	}
+
+	var current interface{} = event.Data
+	for _, segment := range path {
+		doc, ok := current.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if current, ok = doc[segment]; !ok || current == nil {
+			return "", false
+		}
+	}
+
+	switch v := jsonValue(current).(type) {
+	case string:
+		return v, true
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(data), true
+	default:
+		return fmt.Sprintf("%v", v), true
+	}
+}
+
+// jsonValue returns the value v reads as after a JSON round trip. Events
+// buffered with BUFFER_CODEC=bson keep typed BSON values such as ObjectIDs
+// and int64s in their data; keys and filters see them as they would with
+// the JSON codec: ObjectIDs as hex strings and numbers as float64.
+func jsonValue(v interface{}) interface{} {
+	switch v.(type) {
+	case string, float64, bool, nil, map[string]interface{}, []interface{}:
+		return v
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return v
+	}
+	return decoded
+}
@@ -0,0 +1,173 @@
+package sync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseKeyTemplateRejectsMalformed(t *testing.T) {
+	for _, template := range []string{
+		"{fullDocument.tenantId",
+		"tenant}",
+		"{}",
+		"{ }",
+		"{fullDocument..tenantId}",
+		"{fullDocument.{tenantId}}",
+	} {
+		if _, err := parseKeyTemplate(template); err == nil {
+			t.Errorf("parseKeyTemplate(%q) succeeded, want an error", template)
+		}
+	}
+
+	if tmpl, err := parseKeyTemplate(""); tmpl != nil || err != nil {
+		t.Errorf("parseKeyTemplate(\"\") = %v, %v, want no template", tmpl, err)
+	}
+}
+
+func TestKeyTemplateRender(t *testing.T) {
+	oid := primitive.NewObjectID()
+	event := &buffer.Event{
+		ID:        "evt-1",
+		Operation: "update",
+		Timestamp: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Data: map[string]interface{}{
+			"documentKey": map[string]interface{}{"_id": oid},
+			"fullDocument": map[string]interface{}{
+				"tenantId": "acme",
+				"shard":    float64(7),
+				"owner":    map[string]interface{}{"name": "ops"},
+			},
+		},
+	}
+
+	tests := []struct {
+		template string
+		want     string
+		ok       bool
+	}{
+		{"{documentKey._id}", oid.Hex(), true},
+		{"{fullDocument.tenantId}:{operation}", "acme:update", true},
+		{"tenant/{fullDocument.tenantId}/{fullDocument.shard}", "tenant/acme/7", true},
+		{"{id}@{timestamp}", "evt-1@2024-05-01T12:00:00Z", true},
+		{"{fullDocument.owner}", `{"name":"ops"}`, true},
+		{"static", "static", true},
+		// Any missing field fails the whole key, not just its placeholder
+		{"{fullDocument.region}:{operation}", "", false},
+		{"{fullDocument.tenantId.name}", "", false},
+	}
+	for _, tt := range tests {
+		tmpl, err := parseKeyTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("parseKeyTemplate(%q): %v", tt.template, err)
+		}
+		key, ok := tmpl.render(event)
+		if ok != tt.ok || string(key) != tt.want {
+			t.Errorf("render(%q) = %q, %v, want %q, %v", tt.template, key, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestInvalidKeyTemplateFailsStartup(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("KAFKA_KEY_TEMPLATE", "{fullDocument.tenantId")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	if _, err := NewKafkaSync(cfg, newTestBuffer(t), nil, nil); err == nil {
+		t.Fatal("NewKafkaSync accepted an unclosed placeholder")
+	}
+}
+
+func TestKeyTemplateFallsBackToEventID(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	ks := newBrokerSync(t, buf, broker, "KAFKA_KEY_TEMPLATE={fullDocument.tenantId}:{operation}")
+
+	base := time.Now()
+	events := []*buffer.Event{
+		{ID: "with-tenant", Operation: "insert", Timestamp: base, Data: map[string]interface{}{
+			"fullDocument": map[string]interface{}{"tenantId": "acme"},
+		}},
+		{ID: "without-tenant", Operation: "insert", Timestamp: base.Add(time.Microsecond), Data: map[string]interface{}{
+			"fullDocument": map[string]interface{}{"name": "no tenant"},
+		}},
+	}
+	for _, event := range events {
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+
+	keys := make(map[string]bool)
+	for _, msg := range broker.messages() {
+		keys[string(msg.Key)] = true
+	}
+	if len(keys) != 2 || !keys["acme:insert"] || !keys["without-tenant"] {
+		t.Fatalf("produced keys %v, want acme:insert and the event ID without-tenant", keys)
+	}
+}
+
+func TestDocumentChangesShareKey(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+	}{
+		{"documentKey template", []string{"KAFKA_KEY_TEMPLATE={documentKey._id}"}},
+		{"preserve order default", []string{"KAFKA_PRESERVE_ORDER=true"}},
+		// The delete has no fullDocument and falls back to documentKey._id,
+		// which is the same value
+		{"fullDocument template", []string{"KAFKA_KEY_TEMPLATE={fullDocument._id}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(4)
+			ks := newBrokerSync(t, buf, broker, append(tt.env, "KAFKA_BALANCER=hash")...)
+			base := time.Now()
+			for i, event := range []*buffer.Event{
+				docEvent("i1", "insert", "order-1", true),
+				docEvent("u1", "update", "order-1", true),
+				docEvent("d1", "delete", "order-1", false),
+			} {
+				event.Timestamp = base.Add(time.Duration(i) * time.Microsecond)
+				if err := buf.Store(event); err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			}
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+
+			produced := broker.messages()
+			if len(produced) != 3 {
+				t.Fatalf("produced %d messages, want 3", len(produced))
+			}
+			for _, msg := range produced {
+				if string(msg.Key) != "order-1" {
+					t.Errorf("%s keyed %q, want order-1", msg.Headers["id"], msg.Key)
+				}
+				if msg.Partition != produced[0].Partition {
+					t.Errorf("%s on partition %d, want %d with the document's other changes", msg.Headers["id"], msg.Partition, produced[0].Partition)
+				}
+			}
+		})
+	}
+
+	// A template the delete cannot be rendered for still keys it by the
+	// document rather than by the event ID
+	buf := newTestBuffer(t)
+	ks := newBrokerSync(t, buf, newFakeBroker(1), "KAFKA_KEY_TEMPLATE={fullDocument.tenantId}")
+	if key := ks.messageKey(docEvent("d1", "delete", "order-1", false)); string(key) != "order-1" {
+		t.Errorf("delete keyed %q, want documentKey._id order-1", key)
+	}
+}
@@ -0,0 +1,211 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"log"
+	gosync "sync"
+	"time"
+
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Values for SYNC_LAG_SOURCE, which selects where consumer lag comes from.
+const (
+	LagSourceNone = ""
+	// LagSourceKafka sums the lag of the SYNC_LAG_GROUPS consumer groups
+	// from their committed offsets.
+	LagSourceKafka = "kafka"
+	// LagSourceAdmin uses the lag last reported to POST /sync/lag.
+	LagSourceAdmin = "admin"
+)
+
+// LagSource reports how many messages downstream consumers have yet to read.
+type LagSource interface {
+	Lag(ctx context.Context) (int64, error)
+}
+
+// lagThrottle polls a LagSource and lowers the batches sent per tick while
+// consumers are behind: to one batch above SYNC_LAG_THRESHOLD and to none at
+// or above SYNC_LAG_PAUSE. It fails open: while the lag is unknown the sync
+// worker runs at full speed.
+type lagThrottle struct {
+	source    LagSource
+	interval  time.Duration
+	threshold int64
+	pauseAt   int64
+
+	mu    gosync.Mutex
+	lag   int64
+	known bool
+}
+
+// newLagThrottle returns the throttle for SYNC_LAG_SOURCE, or nil when it is
+// not set. The thresholds are checked with the other runtime settings.
+func newLagThrottle(cfg *config.SyncConfig, client *kafka.Client) (*lagThrottle, error) {
+	var source LagSource
+	switch cfg.LagSource {
+	case LagSourceNone:
+		return nil, nil
+	case LagSourceKafka:
+		if len(cfg.LagGroups) == 0 {
+			return nil, fmt.Errorf("SYNC_LAG_SOURCE=kafka requires SYNC_LAG_GROUPS")
+		}
+		source = &groupLagSource{client: client, groups: cfg.LagGroups}
+	case LagSourceAdmin:
+		source = &reportedLag{maxAge: 3 * cfg.LagInterval}
+	default:
+		return nil, fmt.Errorf("invalid SYNC_LAG_SOURCE %q: must be kafka or admin", cfg.LagSource)
+	}
+	if cfg.LagInterval <= 0 {
+		return nil, fmt.Errorf("invalid SYNC_LAG_INTERVAL %v: must be positive", cfg.LagInterval)
+	}
+
+	return &lagThrottle{
+		source:    source,
+		interval:  cfg.LagInterval,
+		threshold: int64(cfg.LagThreshold),
+		pauseAt:   int64(cfg.LagPause),
+	}, nil
+}
+
+// run polls the lag source every SYNC_LAG_INTERVAL until ctx is done.
+func (lt *lagThrottle) run(ctx context.Context) {
+	ticker := time.NewTicker(lt.interval)
+	defer ticker.Stop()
+
+	for {
+		lt.poll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setLimits replaces SYNC_LAG_THRESHOLD and SYNC_LAG_PAUSE after a reload.
+func (lt *lagThrottle) setLimits(threshold, pauseAt int64) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.threshold, lt.pauseAt = threshold, pauseAt
+}
+
+func (lt *lagThrottle) poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, lt.interval)
+	defer cancel()
+
+	lag, err := lt.source.Lag(ctx)
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if err != nil {
+		if lt.known {
+			log.Printf("Failed to read consumer lag, no longer throttling: %v", err)
+		}
+		lt.known = false
+		metrics.ConsumerLag.Set(-1)
+		return
+	}
+	lt.lag, lt.known = lag, true
+	metrics.ConsumerLag.Set(float64(lag))
+}
+
+// batches returns how many of max batches to send this tick.
+func (lt *lagThrottle) batches(max int) int {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	switch {
+	case !lt.known || lt.lag <= lt.threshold:
+		return max
+	case lt.pauseAt > 0 && lt.lag >= lt.pauseAt:
+		return 0
+	default:
+		return min(max, 1)
+	}
+}
+
+// groupLagSource reads the committed offsets of consumer groups and reports
+// the highest total lag among them. Partitions a group has not committed
+// for are not counted.
+type groupLagSource struct {
+	client *kafka.Client
+	groups []string
+}
+
+func (g *groupLagSource) Lag(ctx context.Context) (int64, error) {
+	var highest int64
+	for _, group := range g.groups {
+		lag, err := g.groupLag(ctx, group)
+		if err != nil {
+			return 0, fmt.Errorf("group %s: %w", group, err)
+		}
+		highest = max(highest, lag)
+	}
+	return highest, nil
+}
+
+func (g *groupLagSource) groupLag(ctx context.Context, group string) (int64, error) {
+	// A nil topic map returns every topic the group has committed for
+	committed, err := g.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: group})
+	if err != nil {
+		return 0, err
+	}
+	if committed.Error != nil {
+		return 0, committed.Error
+	}
+
+	var lag int64
+	for topic, partitions := range committed.Topics {
+		var requests []kafka.OffsetRequest
+		for _, p := range partitions {
+			if p.Error == nil && p.CommittedOffset >= 0 {
+				requests = append(requests, kafka.LastOffsetOf(p.Partition))
+			}
+		}
+		if len(requests) == 0 {
+			continue
+		}
+		ends, err := listOffsets(ctx, g.client, topic, requests)
+		if err != nil {
+			return 0, fmt.Errorf("failed to list offsets of %s: %w", topic, err)
+		}
+		for _, p := range partitions {
+			if end, ok := ends[p.Partition]; ok && p.Error == nil && p.CommittedOffset >= 0 {
+				lag += max(0, end.LastOffset-p.CommittedOffset)
+			}
+		}
+	}
+	return lag, nil
+}
+
+// reportedLag is the lag last reported through the admin API. A report older
+// than maxAge counts as unknown, so a stopped reporter cannot hold the sync
+// worker back.
+type reportedLag struct {
+	maxAge time.Duration
+
+	mu         gosync.Mutex
+	lag        int64
+	reportedAt time.Time
+}
+
+func (r *reportedLag) report(lag int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lag, r.reportedAt = lag, time.Now()
+}
+
+func (r *reportedLag) Lag(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.reportedAt.IsZero() {
+		return 0, fmt.Errorf("no lag reported yet")
+	}
+	if age := time.Since(r.reportedAt); age > r.maxAge {
+		return 0, fmt.Errorf("last lag report is %s old", age.Round(time.Second))
+	}
+	return r.lag, nil
+}
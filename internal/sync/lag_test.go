@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// mockLag is a LagSource reporting whatever the test sets.
+type mockLag struct {
+	mu  gosync.Mutex
+	lag int64
+	err error
+}
+
+func (m *mockLag) set(lag int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lag, m.err = lag, err
+}
+
+func (m *mockLag) Lag(ctx context.Context) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lag, m.err
+}
+
+func TestLagThrottle(t *testing.T) {
+	ks := newBrokerSync(t, newTestBuffer(t), newFakeBroker(1), "SYNC_LAG_SOURCE=admin",
+		"SYNC_BATCHES_PER_TICK=4", "SYNC_LAG_THRESHOLD=100", "SYNC_LAG_PAUSE=1000")
+	source := &mockLag{}
+	ks.lag.source = source
+
+	tests := []struct {
+		name string
+		lag  int64
+		err  error
+		// want is the batches sent per tick
+		want int
+	}{
+		{"lag unknown", 0, errors.New("consumer group not found"), 4},
+		{"below threshold", 50, nil, 4},
+		{"at threshold", 100, nil, 4},
+		{"above threshold", 101, nil, 1},
+		{"at pause", 1000, nil, 0},
+		{"far behind", 50000, nil, 0},
+		{"caught up", 10, nil, 4},
+		// A failing source must not hold the sync worker back
+		{"source fails after lag", 0, errors.New("broker unreachable"), 4},
+	}
+	for _, tt := range tests {
+		source.set(tt.lag, tt.err)
+		ks.lag.poll(context.Background())
+		if got := ks.tickBatches(); got != tt.want {
+			t.Errorf("%s: %d batches per tick, want %d", tt.name, got, tt.want)
+		}
+		if got := testutil.ToFloat64(metrics.SyncBatchesPerTick); got != float64(tt.want) {
+			t.Errorf("%s: SyncBatchesPerTick = %v, want %d", tt.name, got, tt.want)
+		}
+		wantLag := float64(tt.lag)
+		if tt.err != nil {
+			wantLag = -1
+		}
+		if got := testutil.ToFloat64(metrics.ConsumerLag); got != wantLag {
+			t.Errorf("%s: ConsumerLag = %v, want %v", tt.name, got, wantLag)
+		}
+	}
+
+	// Without SYNC_LAG_PAUSE a lag above the threshold only slows sending
+	ks.lag.setLimits(100, 0)
+	source.set(50000, nil)
+	ks.lag.poll(context.Background())
+	if got := ks.tickBatches(); got != 1 {
+		t.Errorf("%d batches per tick without a pause threshold, want 1", got)
+	}
+}
+
+func TestLagThrottlePolls(t *testing.T) {
+	source := &mockLag{lag: 500}
+	lt := &lagThrottle{source: source, interval: 10 * time.Millisecond, threshold: 100}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		lt.run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for lt.batches(4) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first poll did not apply the lag")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	source.set(0, nil)
+	for lt.batches(4) != 4 {
+		if time.Now().After(deadline) {
+			t.Fatal("a later poll did not pick up the lag clearing")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("run did not stop when ctx was done")
+	}
+}
+
+func TestReportLag(t *testing.T) {
+	ks := newBrokerSync(t, newTestBuffer(t), newFakeBroker(1), "SYNC_LAG_SOURCE=admin",
+		"SYNC_BATCHES_PER_TICK=4", "SYNC_LAG_THRESHOLD=100", "SYNC_LAG_INTERVAL=100ms")
+	if got := ks.tickBatches(); got != 4 {
+		t.Errorf("%d batches per tick before any report, want 4", got)
+	}
+	if err := ks.ReportLag(-1); err == nil {
+		t.Error("ReportLag accepted a negative lag")
+	}
+
+	// A report applies at once, without waiting for the next poll
+	if err := ks.ReportLag(500); err != nil {
+		t.Fatalf("ReportLag: %v", err)
+	}
+	if got := ks.tickBatches(); got != 1 {
+		t.Errorf("%d batches per tick after reporting lag 500, want 1", got)
+	}
+
+	// A reporter that stops is not trusted for long
+	time.Sleep(350 * time.Millisecond)
+	ks.lag.poll(context.Background())
+	if got := ks.tickBatches(); got != 4 {
+		t.Errorf("%d batches per tick on a stale report, want 4", got)
+	}
+
+	other := newBrokerSync(t, newTestBuffer(t), newFakeBroker(1), "SYNC_LAG_SOURCE=kafka", "SYNC_LAG_GROUPS=consumers")
+	if err := other.ReportLag(10); err == nil {
+		t.Error("ReportLag accepted a report with SYNC_LAG_SOURCE=kafka")
+	}
+}
+
+func TestNewLagThrottleValidates(t *testing.T) {
+	for _, cfg := range []config.SyncConfig{
+		{LagSource: "prometheus", LagInterval: time.Second},
+		{LagSource: LagSourceKafka, LagInterval: time.Second},
+		{LagSource: LagSourceAdmin},
+	} {
+		if _, err := newLagThrottle(&cfg, nil); err == nil {
+			t.Errorf("newLagThrottle(%+v) succeeded, want an error", cfg)
+		}
+	}
+	if lt, err := newLagThrottle(&config.SyncConfig{}, nil); lt != nil || err != nil {
+		t.Errorf("newLagThrottle without a source = %v, %v; want no throttle", lt, err)
+	}
+}
@@ -0,0 +1,46 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Preflight checks that the brokers answer a metadata request and that the
+// default topic, and the DLQ topic when set, exist. Asking for a topic's
+// metadata creates it on brokers with auto.create.topics.enable, so a
+// missing topic is only reported when the broker would not create it. With
+// KAFKA_CREATE_TOPIC the topics are created first.
+func (ks *KafkaSync) Preflight(ctx context.Context) error {
+	topics := []string{ks.topics.defaultTopic()}
+	if ks.dlqWriter != nil {
+		topics = append(topics, ks.dlqWriter.Topic)
+	}
+
+	if ks.creator != nil {
+		if err := ks.creator.ensure(ctx, topics); err != nil {
+			return err
+		}
+	}
+
+	client := &kafka.Client{Addr: ks.writer.Addr, Transport: ks.writer.Transport}
+	resp, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: topics})
+	if err != nil {
+		return fmt.Errorf("cannot reach Kafka brokers %s: %w (check KAFKA_BROKERS and that the brokers are up)", ks.writer.Addr, err)
+	}
+
+	var errs []error
+	for _, topic := range resp.Topics {
+		switch {
+		case errors.Is(topic.Error, kafka.UnknownTopicOrPartition):
+			errs = append(errs, fmt.Errorf("Kafka topic %s does not exist and the brokers did not create it: create it or enable auto.create.topics.enable", topic.Name))
+		case errors.Is(topic.Error, kafka.TopicAuthorizationFailed):
+			errs = append(errs, fmt.Errorf("not authorized for Kafka topic %s: grant this client access to it", topic.Name))
+		case topic.Error != nil:
+			errs = append(errs, fmt.Errorf("Kafka topic %s: %w", topic.Name, topic.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
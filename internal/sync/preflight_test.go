@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	tests := []struct {
+		name   string
+		broker func() *fakeBroker
+		env    []string
+		// want is a fragment of the error, or "" when preflight passes
+		want string
+	}{
+		{
+			name:   "topic exists",
+			broker: func() *fakeBroker { b := newFakeBroker(1, "cdc-events"); b.strict = true; return b },
+		},
+		{
+			name:   "brokers unreachable",
+			broker: func() *fakeBroker { b := newFakeBroker(1, "cdc-events"); b.down.Store(true); return b },
+			want:   "check KAFKA_BROKERS",
+		},
+		{
+			name:   "topic missing",
+			broker: func() *fakeBroker { b := newFakeBroker(1); b.strict = true; return b },
+			want:   "Kafka topic cdc-events does not exist",
+		},
+		{
+			name:   "dead-letter topic missing",
+			broker: func() *fakeBroker { b := newFakeBroker(1, "cdc-events"); b.strict = true; return b },
+			env:    []string{"KAFKA_DLQ_TOPIC=cdc-dlq"},
+			want:   "Kafka topic cdc-dlq does not exist",
+		},
+		{
+			name: "topic not authorized",
+			broker: func() *fakeBroker {
+				b := newFakeBroker(1, "cdc-events")
+				b.denied = map[string]bool{"cdc-events": true}
+				return b
+			},
+			want: "not authorized for Kafka topic cdc-events",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := tt.broker()
+			ks := newBrokerSync(t, newTestBuffer(t), broker, append([]string{"KAFKA_TOPIC=cdc-events"}, tt.env...)...)
+
+			err := ks.Preflight(context.Background())
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("Preflight: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Preflight = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("creates missing topics", func(t *testing.T) {
+		broker := newFakeBroker(1)
+		broker.strict = true
+		ks := newBrokerSync(t, newTestBuffer(t), broker, "KAFKA_TOPIC=cdc-events", "KAFKA_CREATE_TOPIC=true", "KAFKA_DLQ_TOPIC=cdc-dlq")
+		if err := ks.Preflight(context.Background()); err != nil {
+			t.Fatalf("Preflight: %v", err)
+		}
+		broker.mu.Lock()
+		created := slices.Clone(broker.created)
+		broker.mu.Unlock()
+		slices.Sort(created)
+		if !slices.Equal(created, []string{"cdc-dlq", "cdc-events"}) {
+			t.Fatalf("created topics %v, want cdc-dlq and cdc-events", created)
+		}
+	})
+}
@@ -0,0 +1,227 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// maxMissingLogged caps how many missing event IDs one reconcile run logs.
+const maxMissingLogged = 20
+
+type topicPartition struct {
+	topic     string
+	partition int
+}
+
+// Reconcile checks that the events synced within the lookback, as recorded
+// in the checkpoints, can be read back from Kafka, and reports the ones that
+// cannot. Checkpoints with an offset are looked up by reading their partition
+// between the lowest and highest recorded offset. Writes with KAFKA_ACKS=0
+// return no position, so for those every partition of the topic is read from
+// the lookback before the oldest such checkpoint. Messages are fetched by
+// offset without a consumer group, so no group offsets are committed and
+// consumers are unaffected. It matches scheduler.Task.
+func (ks *KafkaSync) Reconcile(ctx context.Context) error {
+	checkpoints, err := ks.buffer.Checkpoints(ks.checkpointSize)
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoints: %w", err)
+	}
+
+	since := time.Now().Add(-ks.reconcileLookback)
+	positioned := make(map[topicPartition][]buffer.Checkpoint)
+	unpositioned := make(map[string][]buffer.Checkpoint)
+	for _, cp := range checkpoints {
+		if cp.SyncedAt.Before(since) || cp.EventID == "" {
+			continue
+		}
+		if cp.Offset < 0 {
+			unpositioned[cp.Topic] = append(unpositioned[cp.Topic], cp)
+			continue
+		}
+		tp := topicPartition{cp.Topic, cp.Partition}
+		positioned[tp] = append(positioned[tp], cp)
+	}
+
+	client := &kafka.Client{Addr: ks.writer.Addr, Transport: ks.writer.Transport}
+	checked := 0
+	var missing []string
+	for tp, cps := range positioned {
+		first, last := cps[0].Offset, cps[0].Offset
+		for _, cp := range cps {
+			first, last = min(first, cp.Offset), max(last, cp.Offset)
+		}
+		found := make(map[string]bool)
+		if err := scanPartition(ctx, client, tp, first, last+1, found); err != nil {
+			return fmt.Errorf("failed to read %s partition %d: %w", tp.topic, tp.partition, err)
+		}
+		checked += len(cps)
+		missing = appendMissing(missing, cps, found)
+	}
+	for topic, cps := range unpositioned {
+		oldest := cps[0].SyncedAt
+		for _, cp := range cps {
+			if cp.SyncedAt.Before(oldest) {
+				oldest = cp.SyncedAt
+			}
+		}
+		found, err := scanTopicSince(ctx, client, topic, oldest.Add(-ks.reconcileLookback))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", topic, err)
+		}
+		checked += len(cps)
+		missing = appendMissing(missing, cps, found)
+	}
+
+	metrics.ReconcileMissing.Set(float64(len(missing)))
+	if len(missing) == 0 {
+		log.Printf("Reconcile: all %d events synced in the last %s were found in Kafka", checked, ks.reconcileLookback)
+		return nil
+	}
+
+	sort.Strings(missing)
+	shown := missing
+	if len(shown) > maxMissingLogged {
+		shown = shown[:maxMissingLogged]
+	}
+	log.Printf("Reconcile: %d of %d events synced in the last %s are missing from Kafka: %s",
+		len(missing), checked, ks.reconcileLookback, strings.Join(shown, ", "))
+	return nil
+}
+
+func appendMissing(missing []string, checkpoints []buffer.Checkpoint, found map[string]bool) []string {
+	for _, cp := range checkpoints {
+		if !found[cp.EventID] {
+			missing = append(missing, cp.EventID)
+		}
+	}
+	return missing
+}
+
+// scanTopicSince reads every partition of topic from the first offset at or
+// after since up to its current end.
+func scanTopicSince(ctx context.Context, client *kafka.Client, topic string, since time.Time) (map[string]bool, error) {
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, err
+	}
+	if len(meta.Topics) == 0 || meta.Topics[0].Error != nil {
+		if len(meta.Topics) > 0 {
+			return nil, meta.Topics[0].Error
+		}
+		return nil, fmt.Errorf("no metadata for topic")
+	}
+
+	// Kafka rejects a partition listed twice in one request, so the start
+	// and end offsets are looked up separately.
+	var starts, ends []kafka.OffsetRequest
+	for _, p := range meta.Topics[0].Partitions {
+		starts = append(starts, kafka.TimeOffsetOf(p.ID, since))
+		ends = append(ends, kafka.LastOffsetOf(p.ID))
+	}
+	startOffsets, err := listOffsets(ctx, client, topic, starts)
+	if err != nil {
+		return nil, err
+	}
+	endOffsets, err := listOffsets(ctx, client, topic, ends)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	for _, p := range endOffsets {
+		// The time lookup finds no offset when nothing was written since
+		first := p.LastOffset
+		for offset := range startOffsets[p.Partition].Offsets {
+			if offset >= 0 && offset < first {
+				first = offset
+			}
+		}
+		if err := scanPartition(ctx, client, topicPartition{topic, p.Partition}, first, p.LastOffset, found); err != nil {
+			return nil, fmt.Errorf("partition %d: %w", p.Partition, err)
+		}
+	}
+	return found, nil
+}
+
+// listOffsets runs one ListOffsets request for topic and returns the result
+// by partition.
+func listOffsets(ctx context.Context, client *kafka.Client, topic string, requests []kafka.OffsetRequest) (map[int]kafka.PartitionOffsets, error) {
+	res, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: map[string][]kafka.OffsetRequest{topic: requests}})
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[int]kafka.PartitionOffsets)
+	for _, p := range res.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("partition %d: %w", p.Partition, p.Error)
+		}
+		offsets[p.Partition] = p
+	}
+	return offsets, nil
+}
+
+// scanPartition records the event ID header of every message in the offset
+// range [from, to) of a partition in found. It stops early at the end of the
+// partition.
+func scanPartition(ctx context.Context, client *kafka.Client, tp topicPartition, from, to int64, found map[string]bool) error {
+	offset := from
+	for offset < to {
+		res, err := client.Fetch(ctx, &kafka.FetchRequest{
+			Topic:     tp.topic,
+			Partition: tp.partition,
+			Offset:    offset,
+			MinBytes:  1,
+			MaxBytes:  1 << 20,
+			MaxWait:   500 * time.Millisecond,
+		})
+		if err != nil {
+			return err
+		}
+		if res.Error != nil {
+			return res.Error
+		}
+
+		next := offset
+		for res.Records != nil {
+			record, err := res.Records.ReadRecord()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			// Fetches may start at the batch containing offset
+			if record.Offset < offset || record.Offset >= to {
+				continue
+			}
+			for _, header := range record.Headers {
+				if header.Key == "id" {
+					found[string(header.Value)] = true
+				}
+			}
+			next = record.Offset + 1
+		}
+
+		if next == offset {
+			// Nothing more to read: the end of the partition, or offsets
+			// removed by compaction or transaction markers
+			if offset >= res.HighWatermark {
+				return nil
+			}
+			next = offset + 1
+		}
+		offset = next
+	}
+	return nil
+}
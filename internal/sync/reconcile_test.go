@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReconcile(t *testing.T) {
+	tests := []struct {
+		name string
+		env  []string
+		lost []string
+		// want is how many synced events Reconcile reports missing
+		want float64
+	}{
+		{"all present", nil, nil, 0},
+		{"lost after acks", nil, []string{"e003", "e011"}, 2},
+		// Without positions every partition is read from the lookback
+		{"acks=0 all present", []string{"KAFKA_ACKS=0", "KAFKA_ALLOW_UNSAFE_ACKS=true"}, nil, 0},
+		{"acks=0 lost", []string{"KAFKA_ACKS=0", "KAFKA_ALLOW_UNSAFE_ACKS=true"}, []string{"e005"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(3)
+			ks := newBrokerSync(t, buf, broker, append([]string{"KAFKA_BALANCER=hash", "BUFFER_CHECKPOINT_SIZE=100"}, tt.env...)...)
+			storeEvents(t, buf, 15)
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+			if checkpoints, _ := buf.Checkpoints(100); len(checkpoints) != 15 {
+				t.Fatalf("recorded %d checkpoints, want 15", len(checkpoints))
+			}
+			broker.lose(tt.lost...)
+
+			var out bytes.Buffer
+			writer := log.Writer()
+			log.SetOutput(&out)
+			err := ks.Reconcile(context.Background())
+			log.SetOutput(writer)
+			if err != nil {
+				t.Fatalf("Reconcile: %v", err)
+			}
+
+			if got := testutil.ToFloat64(metrics.ReconcileMissing); got != tt.want {
+				t.Errorf("ReconcileMissing = %v, want %v", got, tt.want)
+			}
+			for _, id := range tt.lost {
+				if !strings.Contains(out.String(), id) {
+					t.Errorf("lost event %s not reported in %q", id, out.String())
+				}
+			}
+		})
+	}
+
+	t.Run("outside the lookback", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		ks := newBrokerSync(t, buf, broker, "RECONCILE_LOOKBACK=1ms")
+		storeEvents(t, buf, 5)
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		broker.lose("e001")
+		time.Sleep(10 * time.Millisecond)
+
+		if err := ks.Reconcile(context.Background()); err != nil {
+			t.Fatalf("Reconcile: %v", err)
+		}
+		if got := testutil.ToFloat64(metrics.ReconcileMissing); got != 0 {
+			t.Errorf("ReconcileMissing = %v for a loss older than the lookback, want 0", got)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package sync
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"buffered-cdc/internal/config"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// verify checks a signature the way the README tells consumers to.
+func verify(key string, value []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(value)
+	want, err := hex.DecodeString(signature)
+	return err == nil && hmac.Equal(mac.Sum(nil), want)
+}
+
+func TestSignatureOfKnownInput(t *testing.T) {
+	// RFC 4231, test case 2
+	s := newSigner(&config.KafkaConfig{SigningKey: "Jefe"})
+	const want = "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got := s.signature([]byte("what do ya want for nothing?")); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+
+	msg := kafka.Message{Value: []byte("what do ya want for nothing?")}
+	s.sign(&msg)
+	if len(msg.Headers) != 1 || msg.Headers[0].Key != signatureHeader || string(msg.Headers[0].Value) != want {
+		t.Errorf("signed headers %v, want only the signature", msg.Headers)
+	}
+
+	if newSigner(&config.KafkaConfig{}) != nil {
+		t.Error("signer created without EVENT_SIGNING_KEY")
+	}
+}
+
+func TestSignedMessagesVerify(t *testing.T) {
+	buf := newTestBuffer(t)
+	broker := newFakeBroker(1)
+	ks := newBrokerSync(t, buf, broker, "EVENT_SIGNING_KEY=s3cret", "EVENT_SIGNING_KEY_ID=2024-05")
+	storeEvents(t, buf, 5)
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+
+	produced := broker.messages()
+	if len(produced) != 5 {
+		t.Fatalf("produced %d messages, want 5", len(produced))
+	}
+	for _, msg := range produced {
+		signature := msg.Headers[signatureHeader]
+		if !verify("s3cret", msg.Value, signature) {
+			t.Errorf("message %s: signature %q does not verify", msg.Headers["id"], signature)
+		}
+		if keyID := msg.Headers[signatureKeyIDHeader]; keyID != "2024-05" {
+			t.Errorf("message %s: key ID %q, want 2024-05", msg.Headers["id"], keyID)
+		}
+
+		// Any change to the value, or the wrong key, fails verification
+		tampered := append([]byte(nil), msg.Value...)
+		tampered[len(tampered)/2] ^= 1
+		if verify("s3cret", tampered, signature) {
+			t.Errorf("message %s: signature still verifies a tampered value", msg.Headers["id"])
+		}
+		if verify("s3cret", append(msg.Value, ' '), signature) {
+			t.Errorf("message %s: signature still verifies an extended value", msg.Headers["id"])
+		}
+		if verify("other", msg.Value, signature) {
+			t.Errorf("message %s: signature verifies under another key", msg.Headers["id"])
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+)
+
+// kafkaSinkName identifies Kafka in buffer.Event.Delivered.
+const kafkaSinkName = "kafka"
+
+// Sink is a destination that receives every synced event in addition to
+// Kafka. Write must either deliver all events or return an error; a failed
+// write is retried on a later sync with only the events the sink has not yet
+// acknowledged. Implementations must be safe for concurrent use.
+type Sink interface {
+	// Name identifies the sink in the buffer's delivery records, so it must
+	// stay the same across restarts.
+	Name() string
+	Write(ctx context.Context, events []*buffer.Event) error
+	Close() error
+}
+
+// newSinks builds the additional sinks configured alongside Kafka.
+func newSinks(cfg *config.SinkConfig) []Sink {
+	var sinks []Sink
+	for i, url := range cfg.WebhookURLs {
+		sinks = append(sinks, &webhookSink{
+			name:    fmt.Sprintf("webhook-%d", i+1),
+			url:     url,
+			retries: cfg.WebhookRetries,
+			client:  &http.Client{Timeout: cfg.WebhookTimeout},
+		})
+	}
+	return sinks
+}
+
+// webhookSink POSTs each batch as a JSON array of events. Any 2xx response
+// acknowledges the whole batch.
+type webhookSink struct {
+	name    string
+	url     string
+	retries int
+	client  *http.Client
+}
+
+func (w *webhookSink) Name() string {
+	return w.name
+}
+
+func (w *webhookSink) Write(ctx context.Context, events []*buffer.Event) error {
+	body, err := json.Marshal(sinkPayload(events))
+	if err != nil {
+		return fmt.Errorf("failed to marshal events: %w", err)
+	}
+
+	backoff := time.Second
+	attempts := w.retries
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+				backoff *= 2
+			}
+		}
+
+		if err = w.post(ctx, body); err == nil {
+			return nil
+		}
+		log.Printf("Webhook %s attempt %d failed: %v", w.name, attempt+1, err)
+	}
+	return err
+}
+
+func (w *webhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhookSink) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// sinkPayload strips buffer bookkeeping from events before they are sent.
+func sinkPayload(events []*buffer.Event) []*buffer.Event {
+	payload := make([]*buffer.Event, len(events))
+	for i, event := range events {
+		payload[i] = withoutBookkeeping(event)
+	}
+	return payload
+}
+
+// withoutBookkeeping returns event without the fields that only matter to the
+// buffer: its record key, delivery records and last failed attempt.
+func withoutBookkeeping(event *buffer.Event) *buffer.Event {
+	stripped := *event
+	stripped.Key = ""
+	stripped.Delivered = nil
+	stripped.LastAttempt = nil
+	return &stripped
+}
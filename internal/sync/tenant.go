@@ -0,0 +1,141 @@
+package sync
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/metrics"
+
+	"golang.org/x/time/rate"
+)
+
+// tenantIdleAfter is how long a tenant's token bucket may go unused before it
+// is dropped; a full bucket behaves like a new one, so nothing is lost.
+const tenantIdleAfter = 10 * time.Minute
+
+// tenantLimiter gives every tenant, named by a fullDocument field, its own
+// token bucket so one busy tenant cannot take all of the Kafka throughput.
+type tenantLimiter struct {
+	path      []string
+	rate      float64
+	burst     int
+	overrides map[string]float64
+
+	mu       gosync.Mutex
+	limiters map[string]*tenantBucket
+}
+
+type tenantBucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// newTenantLimiter returns the limiter for SYNC_TENANT_FIELD, or nil when no
+// field is set. SYNC_TENANT_RATES entries are tenant=rate pairs overriding
+// SYNC_TENANT_RATE for single tenants.
+func newTenantLimiter(cfg *config.SyncConfig) (*tenantLimiter, error) {
+	if cfg.TenantField == "" {
+		return nil, nil
+	}
+
+	path := append([]string{"fullDocument"}, strings.Split(cfg.TenantField, ".")...)
+	for _, segment := range path {
+		if segment == "" {
+			return nil, fmt.Errorf("invalid SYNC_TENANT_FIELD %q", cfg.TenantField)
+		}
+	}
+	if cfg.TenantRate <= 0 {
+		return nil, fmt.Errorf("invalid SYNC_TENANT_RATE %v: must be positive", cfg.TenantRate)
+	}
+
+	overrides := make(map[string]float64, len(cfg.TenantRates))
+	for _, entry := range cfg.TenantRates {
+		tenant, value, ok := strings.Cut(entry, "=")
+		perSecond, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || strings.TrimSpace(tenant) == "" || err != nil || perSecond <= 0 {
+			return nil, fmt.Errorf("invalid SYNC_TENANT_RATES entry %q: want tenant=rate with a positive rate", entry)
+		}
+		overrides[strings.TrimSpace(tenant)] = perSecond
+	}
+
+	return &tenantLimiter{
+		path:      path,
+		rate:      cfg.TenantRate,
+		burst:     cfg.TenantBurst,
+		overrides: overrides,
+		limiters:  make(map[string]*tenantBucket),
+	}, nil
+}
+
+// tenant returns the tenant an event belongs to, or "" when its document has
+// no tenant field. Deletes, and updates without a full document, have none.
+func (tl *tenantLimiter) tenant(event *buffer.Event) string {
+	value, _ := keyField(event, tl.path)
+	return value
+}
+
+// admitter returns the admit function for one buffer read. It takes a token
+// from the event's tenant bucket and, once a tenant is out of tokens, rejects
+// the rest of that tenant's events in the read, so a tenant's events are
+// still sent in buffered order. Events without a tenant are not limited.
+func (tl *tenantLimiter) admitter() func(*buffer.Event) bool {
+	now := time.Now()
+	tl.prune(now)
+
+	exhausted := make(map[string]bool)
+	return func(event *buffer.Event) bool {
+		tenant := tl.tenant(event)
+		if tenant == "" {
+			return true
+		}
+		if exhausted[tenant] {
+			metrics.TenantEventsDeferred.Inc()
+			return false
+		}
+		if tl.bucket(tenant, now).Allow() {
+			return true
+		}
+		exhausted[tenant] = true
+		metrics.TenantEventsDeferred.Inc()
+		return false
+	}
+}
+
+func (tl *tenantLimiter) bucket(tenant string, now time.Time) *rate.Limiter {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	b, ok := tl.limiters[tenant]
+	if !ok {
+		perSecond := tl.rate
+		if override, ok := tl.overrides[tenant]; ok {
+			perSecond = override
+		}
+		burst := tl.burst
+		if burst <= 0 {
+			burst = int(math.Ceil(perSecond))
+		}
+		b = &tenantBucket{limiter: rate.NewLimiter(rate.Limit(perSecond), burst)}
+		tl.limiters[tenant] = b
+	}
+	b.lastUsed = now
+	return b.limiter
+}
+
+// prune drops the buckets of tenants not seen for tenantIdleAfter, so the
+// map does not grow with every tenant ever synced.
+func (tl *tenantLimiter) prune(now time.Time) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	for tenant, b := range tl.limiters {
+		if now.Sub(b.lastUsed) > tenantIdleAfter {
+			delete(tl.limiters, tenant)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package sync
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+	"buffered-cdc/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// storeTenantEvents buffers n inserts for tenant, after any already stored.
+func storeTenantEvents(t *testing.T, buf *buffer.Buffer, tenant string, n int, base time.Time) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		event := &buffer.Event{
+			ID:        fmt.Sprintf("%s-%03d", tenant, i),
+			Operation: "insert",
+			Timestamp: base.Add(time.Duration(i) * time.Microsecond),
+			Data: map[string]interface{}{
+				"fullDocument": map[string]interface{}{"tenant": map[string]interface{}{"id": tenant}},
+			},
+		}
+		if tenant == "" {
+			event.ID = fmt.Sprintf("none-%03d", i)
+			event.Data = map[string]interface{}{}
+		}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+}
+
+func TestTenantFairness(t *testing.T) {
+	buf := newTestBuffer(t)
+	base := time.Now()
+	// The noisy tenant's backlog is buffered ahead of everyone else
+	storeTenantEvents(t, buf, "noisy", 200, base)
+	storeTenantEvents(t, buf, "quiet", 10, base.Add(time.Millisecond))
+	storeTenantEvents(t, buf, "vip", 50, base.Add(2*time.Millisecond))
+	storeTenantEvents(t, buf, "", 5, base.Add(3*time.Millisecond))
+
+	ks := newBrokerSync(t, buf, newFakeBroker(1), "SYNC_TENANT_FIELD=tenant.id", "SYNC_TENANT_RATE=20",
+		"SYNC_TENANT_RATES=vip=40", "BUFFER_BATCH_SIZE=500")
+	sink := &recordingSink{}
+	ks.sinks = []Sink{sink}
+	deferredBefore := testutil.ToFloat64(metrics.TenantEventsDeferred)
+
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+	sent := make(map[string]int)
+	for id := range sink.written {
+		tenant, _, _ := strings.Cut(id, "-")
+		sent[tenant]++
+	}
+	// Each tenant gets its burst, the rest of the noisy backlog waits, and
+	// events without a tenant are not limited
+	want := map[string]int{"noisy": 20, "quiet": 10, "vip": 40, "none": 5}
+	for tenant, n := range want {
+		if sent[tenant] != n {
+			t.Errorf("first pass sent %d %s events, want %d", sent[tenant], tenant, n)
+		}
+	}
+	if count, _ := buf.Count(); count != 190 {
+		t.Errorf("%d events left buffered, want the 180 noisy and 10 vip events deferred", count)
+	}
+	if got := testutil.ToFloat64(metrics.TenantEventsDeferred) - deferredBefore; got != 190 {
+		t.Errorf("TenantEventsDeferred grew by %v, want 190", got)
+	}
+
+	// Deferred events go out in buffered order as the bucket refills
+	time.Sleep(100 * time.Millisecond)
+	if err := ks.syncBatch(context.Background()); err != nil {
+		t.Fatalf("syncBatch: %v", err)
+	}
+	noisy := 0
+	for i := 0; i < 200; i++ {
+		if sink.written[fmt.Sprintf("noisy-%03d", i)] == 0 {
+			break
+		}
+		noisy++
+	}
+	if noisy <= 20 {
+		t.Error("no more noisy events sent after the bucket refilled")
+	}
+	for id := range sink.written {
+		if tenant, _, _ := strings.Cut(id, "-"); tenant == "noisy" && id >= fmt.Sprintf("noisy-%03d", noisy) {
+			t.Errorf("sent %s before noisy-%03d", id, noisy)
+		}
+	}
+}
+
+func TestNewTenantLimiterRejectsMalformed(t *testing.T) {
+	for _, cfg := range []config.SyncConfig{
+		{TenantField: "tenant..id", TenantRate: 10},
+		{TenantField: "tenant", TenantRate: 0},
+		{TenantField: "tenant", TenantRate: 10, TenantRates: []string{"acme"}},
+		{TenantField: "tenant", TenantRate: 10, TenantRates: []string{"acme=-1"}},
+		{TenantField: "tenant", TenantRate: 10, TenantRates: []string{"=5"}},
+	} {
+		if _, err := newTenantLimiter(&cfg); err == nil {
+			t.Errorf("newTenantLimiter(%+v) succeeded, want an error", cfg)
+		}
+	}
+	if tl, err := newTenantLimiter(&config.SyncConfig{}); tl != nil || err != nil {
+		t.Errorf("newTenantLimiter without a field = %v, %v; want no limiter", tl, err)
+	}
+}
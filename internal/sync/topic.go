@@ -0,0 +1,175 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	gosync "sync"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// maxTopicLength is the longest topic name Kafka accepts.
+const maxTopicLength = 249
+
+// topicRouter picks the topic each event is published to: KAFKA_TOPIC, or
+// with KAFKA_TOPIC_FROM_COLLECTION the collection the event came from, joined
+// to KAFKA_TOPIC_PREFIX with a dot when a prefix is set.
+type topicRouter struct {
+	prefix         string
+	topic          string
+	fromCollection bool
+	// collection is used for events buffered without a namespace.
+	collection string
+}
+
+func newTopicRouter(cfg *config.Config) (*topicRouter, error) {
+	r := &topicRouter{
+		prefix:         cfg.Kafka.TopicPrefix,
+		topic:          cfg.Kafka.Topic,
+		fromCollection: cfg.Kafka.TopicFromCollection,
+		collection:     cfg.MongoDB.Collection,
+	}
+	if err := validateTopic(r.defaultTopic()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// defaultTopic is the topic of events from the configured collection.
+func (r *topicRouter) defaultTopic() string {
+	if r.fromCollection {
+		return r.withPrefix(r.collection)
+	}
+	return r.withPrefix(r.topic)
+}
+
+// perEvent reports whether events may go to different topics, so the topic
+// is set on each message rather than on the writer.
+func (r *topicRouter) perEvent() bool {
+	return r.fromCollection
+}
+
+// topicFor returns the topic of event. With MONGODB_WATCH_SCOPE wider than a
+// collection the name comes from the event, so it is validated here.
+func (r *topicRouter) topicFor(event *buffer.Event) (string, error) {
+	if !r.fromCollection {
+		return r.defaultTopic(), nil
+	}
+	coll := event.Collection()
+	if coll == "" {
+		return r.defaultTopic(), nil
+	}
+	topic := r.withPrefix(coll)
+	if err := validateTopic(topic); err != nil {
+		return "", err
+	}
+	return topic, nil
+}
+
+func (r *topicRouter) withPrefix(topic string) string {
+	if r.prefix == "" {
+		return topic
+	}
+	return r.prefix + "." + topic
+}
+
+// validateTopic applies the broker's rules for topic names: 1 to 249 ASCII
+// letters, digits, '.', '_' or '-', and not "." or "..".
+func validateTopic(topic string) error {
+	switch {
+	case topic == "":
+		return fmt.Errorf("kafka topic is empty")
+	case topic == "." || topic == "..":
+		return fmt.Errorf("invalid kafka topic %q: cannot be \".\" or \"..\"", topic)
+	case len(topic) > maxTopicLength:
+		return fmt.Errorf("invalid kafka topic %q: longer than %d characters", topic, maxTopicLength)
+	}
+	for _, r := range topic {
+		valid := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			r == '.' || r == '_' || r == '-'
+		if !valid {
+			return fmt.Errorf("invalid kafka topic %q: %q is not allowed (use letters, digits, '.', '_' or '-')", topic, r)
+		}
+	}
+	return nil
+}
+
+// topicCreator creates topics with KAFKA_CREATE_TOPIC before they are first
+// written to, for brokers that do not auto-create them. Each topic is created
+// at most once per process; one that already exists counts as created.
+type topicCreator struct {
+	client            *kafka.Client
+	partitions        int
+	replicationFactor int
+
+	mu    gosync.Mutex
+	known map[string]bool
+}
+
+// newTopicCreator returns nil unless KAFKA_CREATE_TOPIC is set. Partition and
+// replication counts of 0 leave the choice to the broker defaults.
+func newTopicCreator(cfg *config.KafkaConfig, client *kafka.Client) *topicCreator {
+	if !cfg.CreateTopic {
+		return nil
+	}
+	tc := &topicCreator{
+		client:            client,
+		partitions:        cfg.TopicPartitions,
+		replicationFactor: cfg.TopicReplication,
+		known:             make(map[string]bool),
+	}
+	if tc.partitions <= 0 {
+		tc.partitions = -1
+	}
+	if tc.replicationFactor <= 0 {
+		tc.replicationFactor = -1
+	}
+	return tc
+}
+
+// ensure creates whichever of topics have not been created yet.
+func (tc *topicCreator) ensure(ctx context.Context, topics []string) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	var missing []kafka.TopicConfig
+	seen := make(map[string]bool)
+	for _, topic := range topics {
+		if tc.known[topic] || seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		missing = append(missing, kafka.TopicConfig{
+			Topic:             topic,
+			NumPartitions:     tc.partitions,
+			ReplicationFactor: tc.replicationFactor,
+		})
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	resp, err := tc.client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: missing})
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka topics: %w", err)
+	}
+
+	var errs []error
+	for _, t := range missing {
+		switch err := resp.Errors[t.Topic]; {
+		case err == nil:
+			log.Printf("Created Kafka topic %s", t.Topic)
+			tc.known[t.Topic] = true
+		case errors.Is(err, kafka.TopicAlreadyExists):
+			tc.known[t.Topic] = true
+		default:
+			errs = append(errs, fmt.Errorf("failed to create Kafka topic %s: %w", t.Topic, err))
+		}
+	}
+	return errors.Join(errs...)
+}
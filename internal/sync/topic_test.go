@@ -0,0 +1,212 @@
+package sync
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"buffered-cdc/internal/buffer"
+	"buffered-cdc/internal/config"
+
+	"github.com/segmentio/kafka-go/protocol/createtopics"
+)
+
+// storeFrom stores an event from-<collection> per collection, in order, with
+// the namespace the monitor records; an empty collection stores one without a
+// namespace, as no-namespace.
+func storeFrom(t *testing.T, buf *buffer.Buffer, collections ...string) {
+	t.Helper()
+	base := time.Now()
+	for i, coll := range collections {
+		event := &buffer.Event{ID: "no-namespace", Operation: "insert", Timestamp: base.Add(time.Duration(i) * time.Microsecond), Data: map[string]interface{}{}}
+		if coll != "" {
+			event.ID = "from-" + coll
+			event.Data["ns"] = map[string]interface{}{"db": "shop", "coll": coll}
+		}
+		if err := buf.Store(event); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+	}
+}
+
+func TestTopicPrefix(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         []string
+		collections []string
+		want        map[string]string
+	}{
+		{
+			name:        "static topic",
+			env:         []string{"KAFKA_TOPIC=order-events"},
+			collections: []string{"orders", "users"},
+			want:        map[string]string{"from-orders": "tenant1.order-events", "from-users": "tenant1.order-events"},
+		},
+		{
+			name:        "collection topic",
+			env:         []string{"KAFKA_TOPIC_FROM_COLLECTION=true", "MONGODB_COLLECTION=orders"},
+			collections: []string{"orders", "users", ""},
+			want:        map[string]string{"from-orders": "tenant1.orders", "from-users": "tenant1.users", "no-namespace": "tenant1.orders"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := newTestBuffer(t)
+			broker := newFakeBroker(1)
+			ks := newBrokerSync(t, buf, broker, append(tt.env, "KAFKA_TOPIC_PREFIX=tenant1")...)
+			storeFrom(t, buf, tt.collections...)
+
+			if err := ks.syncBatch(context.Background()); err != nil {
+				t.Fatalf("syncBatch: %v", err)
+			}
+			got := make(map[string]string)
+			for _, msg := range broker.messages() {
+				got[msg.Headers["id"]] = msg.Topic
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("published %v, want %v", got, tt.want)
+			}
+			for id, topic := range tt.want {
+				if got[id] != topic {
+					t.Errorf("%s published to %q, want %q", id, got[id], topic)
+				}
+			}
+		})
+	}
+}
+
+func TestPrefixedTopicValidated(t *testing.T) {
+	t.Run("at startup", func(t *testing.T) {
+		for _, prefix := range []string{"tenant 1", "tenant/1", strings.Repeat("t", maxTopicLength)} {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("KAFKA_TOPIC_PREFIX", prefix)
+			cfg, err := config.Load()
+			if err != nil {
+				t.Fatalf("config.Load: %v", err)
+			}
+			if _, err := NewKafkaSync(cfg, newTestBuffer(t), nil, nil); err == nil {
+				t.Errorf("NewKafkaSync accepted prefix %q", prefix)
+			}
+		}
+	})
+
+	t.Run("per event", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		ks := newBrokerSync(t, buf, broker, "KAFKA_TOPIC_PREFIX=tenant1", "KAFKA_TOPIC_FROM_COLLECTION=true", "MONGODB_COLLECTION=orders")
+		storeFrom(t, buf, "orders", "bad$name")
+
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		if messages := broker.messages(); len(messages) != 1 || messages[0].Topic != "tenant1.orders" {
+			t.Fatalf("published %+v, want only the routable event", messages)
+		}
+		dead := buffered(t, buf, true)
+		if event := dead["from-bad$name"]; event == nil || !strings.Contains(event.DeadLetterReason, `"tenant1.bad$name"`) {
+			t.Fatalf("dead-lettered %v, want the unroutable event with the topic named", dead)
+		}
+	})
+}
+
+func TestValidateTopic(t *testing.T) {
+	valid := []string{"orders", "tenant1.orders", "a_b-c.D9", strings.Repeat("t", maxTopicLength)}
+	for _, topic := range valid {
+		if err := validateTopic(topic); err != nil {
+			t.Errorf("validateTopic(%q) = %v", topic, err)
+		}
+	}
+	invalid := []string{"", ".", "..", "has space", "slash/topic", "ünïcode", strings.Repeat("t", maxTopicLength+1)}
+	for _, topic := range invalid {
+		if err := validateTopic(topic); err == nil {
+			t.Errorf("validateTopic(%q) succeeded, want an error", topic)
+		}
+	}
+}
+
+func TestCreateMissingTopic(t *testing.T) {
+	// createRequests returns the topics asked to be created so far.
+	createRequests := func(broker *fakeBroker) []createtopics.RequestTopic {
+		broker.mu.Lock()
+		defer broker.mu.Unlock()
+		return slices.Clone(broker.creates)
+	}
+
+	t.Run("not created without KAFKA_CREATE_TOPIC", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		broker.strict = true
+		ks := newBrokerSync(t, buf, broker, "KAFKA_TOPIC=orders")
+		storeEvents(t, buf, 3)
+
+		if err := ks.syncBatch(context.Background()); err == nil {
+			t.Fatal("syncBatch succeeded with the topic missing")
+		}
+		if n := len(createRequests(broker)); n != 0 {
+			t.Fatalf("asked to create %d topics", n)
+		}
+		if count, _ := buf.Count(); count != 3 {
+			t.Fatalf("%d events left buffered, want all 3", count)
+		}
+	})
+
+	t.Run("missing then present", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		broker := newFakeBroker(1)
+		broker.strict = true
+		ks := newBrokerSync(t, buf, broker, "KAFKA_TOPIC=orders", "KAFKA_CREATE_TOPIC=true",
+			"KAFKA_TOPIC_PARTITIONS=6", "KAFKA_TOPIC_REPLICATION=3")
+		storeEvents(t, buf, 3)
+
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		creates := createRequests(broker)
+		if len(creates) != 1 || creates[0].Name != "orders" {
+			t.Fatalf("create requests %+v, want one for orders", creates)
+		}
+		if creates[0].NumPartitions != 6 || creates[0].ReplicationFactor != 3 {
+			t.Errorf("created orders with %d partitions and replication %d, want 6 and 3",
+				creates[0].NumPartitions, creates[0].ReplicationFactor)
+		}
+		if n := len(broker.messages()); n != 3 {
+			t.Fatalf("produced %d messages, want 3", n)
+		}
+
+		// Once created, later batches write without asking again
+		storeEvents(t, buf, 2)
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		if n := len(createRequests(broker)); n != 1 {
+			t.Errorf("asked to create topics %d times, want once", n)
+		}
+	})
+
+	t.Run("already exists", func(t *testing.T) {
+		buf := newTestBuffer(t)
+		// Created by another instance, or by hand
+		broker := newFakeBroker(1, "orders")
+		broker.strict = true
+		ks := newBrokerSync(t, buf, broker, "KAFKA_TOPIC=orders", "KAFKA_CREATE_TOPIC=true")
+		storeEvents(t, buf, 3)
+
+		if err := ks.syncBatch(context.Background()); err != nil {
+			t.Fatalf("syncBatch: %v", err)
+		}
+		if err := ks.creator.ensure(context.Background(), []string{"orders"}); err != nil {
+			t.Fatalf("ensure of an existing topic: %v", err)
+		}
+		broker.mu.Lock()
+		created := len(broker.created)
+		broker.mu.Unlock()
+		if created != 0 || len(createRequests(broker)) != 1 {
+			t.Errorf("created %d topics in %d requests, want one request and nothing new", created, len(createRequests(broker)))
+		}
+		if n := len(broker.messages()); n != 3 {
+			t.Fatalf("produced %d messages, want 3", n)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	gosync "sync"
+
+	"buffered-cdc/internal/metrics"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Pool bounds how many units of work run at once across the service. Work is
+// submitted by short-lived tasks such as a batch write or a snapshot document;
+// long-running loops must not hold a slot, or they would starve everything
+// else.
+type Pool struct {
+	sem *semaphore.Weighted
+}
+
+// New returns a pool running at most size tasks at once. A size of zero or
+// less means no limit.
+func New(size int) *Pool {
+	p := &Pool{}
+	if size > 0 {
+		p.sem = semaphore.NewWeighted(int64(size))
+	}
+	return p
+}
+
+func (p *Pool) acquire(ctx context.Context) error {
+	if p.sem != nil {
+		if err := p.sem.Acquire(ctx, 1); err != nil {
+			return err
+		}
+	}
+	metrics.WorkersActive.Inc()
+	return nil
+}
+
+func (p *Pool) release() {
+	metrics.WorkersActive.Dec()
+	if p.sem != nil {
+		p.sem.Release(1)
+	}
+}
+
+// Do runs fn in the calling goroutine once a slot is free.
+func (p *Pool) Do(ctx context.Context, fn func() error) error {
+	if err := p.acquire(ctx); err != nil {
+		return err
+	}
+	defer p.release()
+	return fn()
+}
+
+// Group returns a group whose tasks run on the pool.
+func (p *Pool) Group(ctx context.Context) *Group {
+	return &Group{pool: p, ctx: ctx}
+}
+
+// Group runs related tasks on a pool and collects their errors. Unlike
+// errgroup it does not cancel the others when one fails, since callers such
+// as the sync worker want every independent batch to finish.
+type Group struct {
+	pool *Pool
+	ctx  context.Context
+	wg   gosync.WaitGroup
+
+	mu   gosync.Mutex
+	errs []error
+}
+
+// Go blocks until a slot is free and then runs fn in a new goroutine, so a
+// caller submitting work in a loop never has more goroutines than slots.
+func (g *Group) Go(fn func() error) {
+	if err := g.pool.acquire(g.ctx); err != nil {
+		g.fail(err)
+		return
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer g.pool.release()
+		if err := fn(); err != nil {
+			g.fail(err)
+		}
+	}()
+}
+
+func (g *Group) fail(err error) {
+	g.mu.Lock()
+	g.errs = append(g.errs, err)
+	g.mu.Unlock()
+}
+
+// Wait waits for every task and returns their errors joined.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	return errors.Join(g.errs...)
+}
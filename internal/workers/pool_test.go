@@ -0,0 +1,152 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tracker records the most tasks seen running at once.
+type tracker struct {
+	running atomic.Int64
+	peak    atomic.Int64
+}
+
+func (tr *tracker) task() error {
+	n := tr.running.Add(1)
+	defer tr.running.Add(-1)
+	for {
+		peak := tr.peak.Load()
+		if n <= peak || tr.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	// Long enough for the other submitters to pile up behind the limit
+	time.Sleep(2 * time.Millisecond)
+	return nil
+}
+
+func TestPoolNeverExceedsSize(t *testing.T) {
+	const size, tasks = 3, 60
+
+	t.Run("Do", func(t *testing.T) {
+		pool := New(size)
+		var tr tracker
+		var wg gosync.WaitGroup
+		for i := 0; i < tasks; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := pool.Do(context.Background(), tr.task); err != nil {
+					t.Errorf("Do: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+		if peak := tr.peak.Load(); peak > size || peak == 0 {
+			t.Fatalf("%d tasks ran at once, want at most %d", peak, size)
+		}
+	})
+
+	t.Run("Group", func(t *testing.T) {
+		pool := New(size)
+		var tr tracker
+		// Two groups and direct calls share the pool's limit
+		groups := []*Group{pool.Group(context.Background()), pool.Group(context.Background())}
+		var wg gosync.WaitGroup
+		for _, g := range groups {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < tasks; i++ {
+					g.Go(tr.task)
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < tasks; i++ {
+				pool.Do(context.Background(), tr.task)
+			}
+		}()
+		wg.Wait()
+		for _, g := range groups {
+			if err := g.Wait(); err != nil {
+				t.Errorf("Wait: %v", err)
+			}
+		}
+		if peak := tr.peak.Load(); peak > size || peak == 0 {
+			t.Fatalf("%d tasks ran at once, want at most %d", peak, size)
+		}
+	})
+}
+
+func TestPoolUnlimited(t *testing.T) {
+	pool := New(0)
+	const tasks = 20
+	// Every task waits for all the others, so this only finishes if they
+	// all run at once
+	var started gosync.WaitGroup
+	started.Add(tasks)
+	g := pool.Group(context.Background())
+	for i := 0; i < tasks; i++ {
+		g.Go(func() error {
+			started.Done()
+			started.Wait()
+			return nil
+		})
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- g.Wait() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Wait: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tasks did not all run at once with no limit")
+	}
+}
+
+func TestGroupCollectsErrors(t *testing.T) {
+	pool := New(2)
+	first, second := errors.New("first"), errors.New("second")
+	g := pool.Group(context.Background())
+	g.Go(func() error { return first })
+	g.Go(func() error { return nil })
+	g.Go(func() error { return second })
+
+	err := g.Wait()
+	if !errors.Is(err, first) || !errors.Is(err, second) {
+		t.Fatalf("Wait = %v, want both errors", err)
+	}
+}
+
+func TestDoWaitsForSlotUntilCancelled(t *testing.T) {
+	pool := New(1)
+	release := make(chan struct{})
+	held := make(chan struct{})
+	go pool.Do(context.Background(), func() error {
+		close(held)
+		<-release
+		return nil
+	})
+	<-held
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := pool.Do(ctx, func() error {
+		ran = true
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || ran {
+		t.Fatalf("Do with the only slot held = %v (ran %v), want DeadlineExceeded without running", err, ran)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -12,19 +14,23 @@ import (
 )
 
 func main() {
+	validate := flag.Bool("validate", false, "Check the configuration, print it with credentials masked and exit without connecting to anything")
+	flag.Parse()
+
 	cfg, err := config.Load()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
-	svc, err := service.New(cfg)
-	if err != nil {
-		log.Fatalf("Failed to create service: %v", err)
+	if *validate {
+		os.Exit(validateConfig(cfg))
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Set up before connecting, so a shutdown signal also stops the
+	// connection retries
 	go func() {
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -33,9 +39,40 @@ func main() {
 		cancel()
 	}()
 
+	svc, err := service.New(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Failed to create service: %v", err)
+	}
+
+	go func() {
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		for range hupChan {
+			log.Println("SIGHUP received, reloading configuration")
+			if err := svc.Reload(); err != nil {
+				log.Printf("Keeping the current configuration: %v", err)
+			}
+		}
+	}()
+
 	if err := svc.Start(ctx); err != nil {
 		log.Fatalf("Service failed: %v", err)
 	}
 
 	log.Println("Service stopped gracefully")
-}
\ No newline at end of file
+}
+
+// validateConfig prints the effective configuration and any problems with
+// it, returning the exit status for -validate.
+func validateConfig(cfg *config.Config) int {
+	if err := cfg.Redacted().Print(os.Stdout); err != nil {
+		log.Printf("Failed to print configuration: %v", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nConfiguration is invalid:\n%v\n", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "\nConfiguration is valid")
+	return 0
+}
@@ -11,6 +11,9 @@ DELAYED_PERCENT=30
 MAX_DELAY_HOURS=24
 DATABASE="testdb"
 COLLECTION="events"
+VERIFY=false
+KAFKA_BROKERS="kafka:29092"
+KAFKA_TOPIC="cdc-events"
 
 # Parse command line arguments
 while [[ $# -gt 0 ]]; do
@@ -43,6 +46,18 @@ while [[ $# -gt 0 ]]; do
       COLLECTION="$2"
       shift 2
       ;;
+    --verify)
+      VERIFY=true
+      shift
+      ;;
+    --kafka-brokers)
+      KAFKA_BROKERS="$2"
+      shift 2
+      ;;
+    --kafka-topic)
+      KAFKA_TOPIC="$2"
+      shift 2
+      ;;
     -h|--help)
       echo "Usage: $0 [OPTIONS]"
       echo ""
@@ -56,6 +71,9 @@ while [[ $# -gt 0 ]]; do
       echo "      --max-delay-hours HOURS        Maximum delay in hours (default: 24)"
       echo "      --database DATABASE            Database name (default: testdb)"
       echo "      --collection COLLECTION        Collection name (default: events)"
+      echo "      --verify                       Verify inserted messages arrive on Kafka"
+      echo "      --kafka-brokers BROKERS        Kafka brokers used by --verify (default: kafka:29092)"
+      echo "      --kafka-topic TOPIC            Kafka topic used by --verify (default: cdc-events)"
       echo "  -h, --help                         Show this help message"
       echo ""
       echo "Examples:"
@@ -92,7 +110,10 @@ docker compose --profile loadtest run --rm loadtest \
     --delayed-percent="$DELAYED_PERCENT" \
     --max-delay-hours="$MAX_DELAY_HOURS" \
     --database="$DATABASE" \
-    --collection="$COLLECTION"
+    --collection="$COLLECTION" \
+    --verify="$VERIFY" \
+    --kafka-brokers="$KAFKA_BROKERS" \
+    --kafka-topic="$KAFKA_TOPIC"
 
 echo ""
 echo "Load test completed!"